@@ -0,0 +1,111 @@
+package caddytlss3
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// accessDeniedThreshold AccessDenied errors within accessDeniedWindow
+	// trigger a permission probe. Probes run at most once per window.
+	accessDeniedThreshold = 3
+	accessDeniedWindow    = 5 * time.Minute
+)
+
+// credentialErrorCodes are the error codes S3 returns when the request
+// credentials themselves are no longer valid.
+var credentialErrorCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+	"SignatureDoesNotMatch": true,
+	"TokenRefreshRequired":  true,
+	"InvalidClientTokenId":  true,
+}
+
+// accessMonitors tracks AccessDenied errors per bucket across instances.
+var (
+	accessMonitorsMu sync.Mutex
+	accessMonitors   = make(map[string]*accessMonitor)
+)
+
+type accessMonitor struct {
+	mu        sync.Mutex
+	denials   []time.Time
+	lastProbe time.Time
+}
+
+func monitorFor(bucket string) *accessMonitor {
+	accessMonitorsMu.Lock()
+	defer accessMonitorsMu.Unlock()
+	m, ok := accessMonitors[bucket]
+	if !ok {
+		m = &accessMonitor{}
+		accessMonitors[bucket] = m
+	}
+	return m
+}
+
+// denied records an AccessDenied error and returns true if a probe
+// should be run to find out why access is being denied.
+func (m *accessMonitor) denied(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	denials := m.denials[:0]
+	for _, t := range m.denials {
+		if now.Sub(t) < accessDeniedWindow {
+			denials = append(denials, t)
+		}
+	}
+	m.denials = append(denials, now)
+	if len(m.denials) < accessDeniedThreshold || now.Sub(m.lastProbe) < accessDeniedWindow {
+		return false
+	}
+	m.lastProbe = now
+	return true
+}
+
+// accessHandler is installed on S3 clients to watch for requests that are
+// rejected for permission reasons.
+func (s *S3Storage) accessHandler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "caddytlss3.AccessMonitor",
+		Fn: func(r *request.Request) {
+			e, ok := r.Error.(awserr.Error)
+			if !ok {
+				return
+			}
+			op := r.Operation.Name
+			switch {
+			case credentialErrorCodes[e.Code()]:
+				s.log().Errorf("%s on bucket %s rejected with %s: credentials have expired or been rotated", op, s.bucket, e.Code())
+			case e.Code() == "AccessDenied":
+				if monitorFor(s.bucket).denied(s.now()) {
+					go s.probeAccess(op)
+				}
+			}
+		},
+	}
+}
+
+// probeAccess determines whether repeated AccessDenied errors are caused by
+// invalid credentials or by a change to the IAM or bucket policy, and logs
+// the outcome.
+func (s *S3Storage) probeAccess(op string) {
+	id, err := sts.New(s.session).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && credentialErrorCodes[e.Code()] {
+			s.log().Errorf("repeated AccessDenied on bucket %s: credentials have expired or been rotated (%s)", s.bucket, e.Code())
+			return
+		}
+		s.log().Errorf("repeated AccessDenied on bucket %s: unable to verify credentials: %s", s.bucket, err)
+		return
+	}
+	s.log().Errorf("repeated AccessDenied on bucket %s: credentials for %s are valid, so the IAM or bucket policy has likely changed (last denied operation %s)",
+		s.bucket, aws.StringValue(id.Arn), op)
+}
@@ -0,0 +1,210 @@
+package caddytlss3
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// With shared accounts, accounts are stored outside of the CA namespaces,
+// so they survive changes of the CA directory URL:
+//
+//	accounts/key/<thumbprint>                 the account
+//	accounts/user/<email>[/<key type>]        an accountRef to it
+//
+// where thumbprint is the RFC 7638 JWK thumbprint of the account key. Site
+// data remains in the CA namespaces.
+
+// accountRef is the object stored for an email in the shared account
+// namespace.
+type accountRef struct {
+	schemaHeader
+	Thumbprint string `json:"thumbprint"`
+}
+
+// userPrefix returns the prefix of the keys of accounts.
+func (s *S3Storage) userPrefix() string {
+	if s.sharedAccounts {
+		return s.basePrefix + "accounts/user/"
+	}
+	return s.prefix + "user/"
+}
+
+// accountKey returns the key of the shared account whose key has the given
+// thumbprint.
+func (s *S3Storage) accountKey(thumbprint string) *string {
+	return aws.String(s.basePrefix + "accounts/key/" + thumbprint)
+}
+
+// userKeysUnder returns the keys of userKeys under another user prefix.
+func (s *S3Storage) userKeysUnder(prefix, email string) []*string {
+	keys := s.userKeys(email)
+	for i, key := range keys {
+		keys[i] = aws.String(prefix + strings.TrimPrefix(*key, s.userPrefix()))
+	}
+	return keys
+}
+
+// sharedAccountRef returns the key of the shared account that the object
+// at key with contents b refers to, or nil if it's an account itself.
+func (s *S3Storage) sharedAccountRef(key string, b []byte) (*string, error) {
+	if !s.sharedAccounts || !strings.HasPrefix(key, s.userPrefix()) {
+		return nil, nil
+	}
+	if err := checkSchema(s.bucket, key, b); err != nil {
+		if _, ok := err.(ErrSchemaVersion); ok {
+			return nil, err
+		}
+		return nil, ErrCorruptData{Bucket: s.bucket, Key: key, Err: err}
+	}
+	var ref accountRef
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return nil, ErrCorruptData{Bucket: s.bucket, Key: key, Err: err}
+	}
+	if ref.Thumbprint == "" {
+		return nil, ErrCorruptData{Bucket: s.bucket, Key: key, Err: errors.New("no account thumbprint")}
+	}
+	return s.accountKey(ref.Thumbprint), nil
+}
+
+// marshalAccountRef encodes a reference to the shared account whose key
+// has the given thumbprint.
+func marshalAccountRef(thumbprint string) ([]byte, error) {
+	return json.Marshal(accountRef{schemaHeader{schemaVersion}, thumbprint})
+}
+
+// deleteSharedAccount deletes the shared account that the object at key
+// refers to, if any.
+func (s *S3Storage) deleteSharedAccount(key *string) error {
+	if !s.sharedAccounts {
+		return nil
+	}
+	b, err := s.fetchObject(s.s3, s.bucket, *key)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	account, err := s.sharedAccountRef(*key, b)
+	if err != nil || account == nil {
+		return err
+	}
+	err = s.deleteObject(s.s3, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    account,
+	})
+	s.invalidate(s.bucket, *account)
+	if err != nil {
+		return err
+	}
+	if s.keys != nil {
+		return s.deleteKey(s.bucket, *account)
+	}
+	return nil
+}
+
+// migrateScopedUser imports the account for email from the CA namespace
+// into the shared account namespace after it wasn't found there, like
+// migrateSite. The account is left in place for hosts that don't share
+// accounts.
+func (s *S3Storage) migrateScopedUser(email string) (*caddytls.UserData, bool) {
+	if !s.sharedAccounts {
+		return nil, false
+	}
+	for _, key := range s.userKeysUnder(s.prefix+"user/", email) {
+		data, err := s.loadUser(key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			s.log().Errorf("reading account %s from CA namespace %s: %s", email, s.ca, err)
+			return nil, false
+		}
+		if s.readOnly {
+			return data, true
+		}
+		if err := s.StoreUser(email, data); err != nil {
+			s.log().Errorf("sharing account %s of CA namespace %s: %s", email, s.ca, err)
+		} else {
+			s.log().Infof("shared account %s of CA namespace %s", email, s.ca)
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// accountThumbprint returns the RFC 7638 JWK thumbprint of the public key
+// of the PEM encoded private key, base64url encoded.
+func accountThumbprint(key []byte) (string, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return "", errors.New("account key is not PEM encoded")
+	}
+	var priv crypto.PrivateKey
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return "", fmt.Errorf("parsing account key: %s", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("unsupported account key type %T", priv)
+	}
+	return jwkThumbprint(signer.Public())
+}
+
+// jwkThumbprint returns the RFC 7638 JWK thumbprint of an RSA or ECDSA
+// public key, base64url encoded.
+func jwkThumbprint(pub crypto.PublicKey) (string, error) {
+	// The members are in lexicographic order without whitespace.
+	var jwk string
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		e := big.NewInt(int64(k.E)).Bytes()
+		jwk = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, b64url(e), b64url(k.N.Bytes()))
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		x := padded(k.X.Bytes(), size)
+		y := padded(k.Y.Bytes(), size)
+		jwk = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Curve.Params().Name, b64url(x), b64url(y))
+	default:
+		return "", fmt.Errorf("unsupported account key type %T", pub)
+	}
+	sum := sha256.Sum256([]byte(jwk))
+	return b64url(sum[:]), nil
+}
+
+// padded returns b left padded with zeros to size bytes.
+func padded(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	p := make([]byte, size)
+	copy(p[size-len(b):], b)
+	return p
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
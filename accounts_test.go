@@ -0,0 +1,108 @@
+package caddytlss3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	// The example of RFC 7638, section 3.1.
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := jwkThumbprint(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("Expected thumbprint %s, got %s", want, got)
+	}
+	if _, err := accountThumbprint([]byte("key")); err == nil {
+		t.Error("Expected an error for a key that isn't PEM encoded")
+	}
+}
+
+func testAccountKey(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func TestSharedAccounts(t *testing.T) {
+	client := fakes.NewS3()
+	newStorage := func(ca string, shared bool) *S3Storage {
+		opts := []Option{WithCA(ca)}
+		if shared {
+			opts = append(opts, WithSharedAccounts())
+		}
+		return newFakeStorage(t, client, "bucket", opts...)
+	}
+	v01 := newStorage("acme-v01.api.letsencrypt.org", false)
+	key := testAccountKey(t)
+	if err := v01.StoreUser("me@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Accounts of the CA namespace are shared when they're first loaded.
+	shared := newStorage("acme-v01.api.letsencrypt.org", true)
+	if data, err := shared.LoadUser("me@example.com"); err != nil || string(data.Key) != string(key) {
+		t.Fatalf("LoadUser: %v %v", data, err)
+	}
+	thumbprint, err := accountThumbprint(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "accounts/key/"+thumbprint); !ok {
+		t.Errorf("Expected the account stored by thumbprint, got %v", client.Keys("bucket"))
+	}
+	if _, ok := client.Object("bucket", "acme/acme-v01.api.letsencrypt.org/user/me@example.com/ecdsa"); !ok {
+		t.Error("Expected the account kept in the CA namespace")
+	}
+
+	// Hosts using another directory find the account.
+	v02 := newStorage("acme-v02.api.letsencrypt.org", true)
+	if email := v02.MostRecentUserEmail(); email != "me@example.com" {
+		t.Fatalf("Expected the shared account to be the most recent user, got %q", email)
+	}
+	data, err := v02.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data.Key) != string(key) || string(data.Reg) != "reg" {
+		t.Errorf("Unexpected account %+v", data)
+	}
+	if users, err := v02.ListUsers(); err != nil || len(users) != 1 || users[0] != "me@example.com" {
+		t.Errorf("ListUsers: %v %v", users, err)
+	}
+
+	if err := v02.DeleteUser("me@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range client.Keys("bucket") {
+		if strings.HasPrefix(k, "accounts/") {
+			t.Errorf("Expected the shared account deleted, found %s", k)
+		}
+	}
+
+	if err := v02.StoreUser("other@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err == nil {
+		t.Error("Expected an error sharing an account with an invalid key")
+	}
+}
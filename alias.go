@@ -0,0 +1,130 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// siteAliasMeta is the object metadata of site aliases naming the domain
+// they refer to, so StatSite can follow them with HeadObject requests.
+const siteAliasMeta = "Site-Alias"
+
+// siteAlias is stored instead of site data for a domain that's served by
+// the site of another domain, e.g. a wildcard certificate, or by a blob of
+// the shared layout. It's written with aliasSchemaVersion so previous
+// versions fail to read it instead of reading empty site data.
+type siteAlias struct {
+	schemaHeader
+	Alias string `json:"alias,omitempty"`
+	// Blob is the SHA-256 of the site data in the shared layout, see
+	// blobKey.
+	Blob string `json:"blob,omitempty"`
+}
+
+// errSiteAlias is returned by unmarshalSite for a site alias.
+type errSiteAlias struct {
+	domain string
+	blob   string
+}
+
+func (e errSiteAlias) Error() string {
+	if e.blob != "" {
+		return "S3Storage: site is stored in blob " + e.blob
+	}
+	return "S3Storage: site is an alias of " + e.domain
+}
+
+// parseSiteAlias returns the alias encoded in b, if b is one.
+func parseSiteAlias(b []byte) (errSiteAlias, bool) {
+	var a siteAlias
+	if err := json.Unmarshal(b, &a); err != nil || a.SchemaVersion != aliasSchemaVersion || a.Alias == "" && a.Blob == "" {
+		return errSiteAlias{}, false
+	}
+	return errSiteAlias{domain: a.Alias, blob: a.Blob}, true
+}
+
+// loadAlias returns the site data of target for domain, whose site is an
+// alias of it. Aliases of aliases aren't followed.
+func (s *S3Storage) loadAlias(domain, target string) (*caddytls.SiteData, error) {
+	data, err := s.loadSiteData(target)
+	if _, ok := err.(errSiteAlias); ok {
+		loc := s.routes.site(domain)
+		return nil, ErrCorruptData{Bucket: loc.bucket, Key: loc.key, Err: errors.New("alias of an alias")}
+	}
+	return data, err
+}
+
+// storeAlias stores an alias of target as the site of domain. It's only
+// written if domain has no site data, so it can't replace a certificate
+// stored concurrently.
+func (s *S3Storage) storeAlias(domain, target string) error {
+	b, err := json.Marshal(siteAlias{schemaHeader: schemaHeader{aliasSchemaVersion}, Alias: strings.ToLower(target)})
+	if err != nil {
+		return err
+	}
+	loc := s.routes.site(domain)
+	in := loc.encrypt(&s3.PutObjectInput{
+		Bucket:        &loc.bucket,
+		Key:           &loc.key,
+		Body:          bytes.NewReader(b),
+		ContentLength: aws.Int64(int64(len(b))),
+		ContentType:   aws.String(contentTypeJSON),
+		Metadata:      map[string]*string{siteAliasMeta: aws.String(strings.ToLower(target))},
+		IfNoneMatch:   aws.String("*"),
+	})
+	err = s.putObject(loc.s3, in)
+	s.invalidate(loc.bucket, loc.key)
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// wildcardDomain returns the wildcard domain whose certificate covers
+// domain, e.g. *.example.com for www.example.com, or "" if there is none.
+func wildcardDomain(domain string) string {
+	if strings.HasPrefix(domain, "*.") {
+		return ""
+	}
+	i := strings.IndexByte(domain, '.')
+	// A wildcard doesn't cover a TLD.
+	if i <= 0 || !strings.Contains(domain[i+1:], ".") {
+		return ""
+	}
+	return "*" + domain[i:]
+}
+
+// wildcardSite returns the site data of the wildcard domain covering domain
+// after domain wasn't found, if there is a wildcard certificate valid for
+// domain, and stores an alias of it for domain so the next load doesn't
+// miss again.
+func (s *S3Storage) wildcardSite(domain string) (*caddytls.SiteData, bool) {
+	wildcard := wildcardDomain(strings.ToLower(domain))
+	if wildcard == "" {
+		return nil, false
+	}
+	data, err := s.loadSiteData(wildcard)
+	if err != nil {
+		if _, ok := err.(caddytls.ErrNotExist); !ok {
+			s.log().Warnf("loading %s for %s: %s", wildcard, domain, err)
+		}
+		return nil, false
+	}
+	cert, err := LeafCertificate(data.Cert)
+	if err != nil || cert.VerifyHostname(domain) != nil {
+		s.log().Debugf("certificate of %s doesn't cover %s", wildcard, domain)
+		return nil, false
+	}
+	if !s.readOnly {
+		if err := s.storeAlias(domain, wildcard); err != nil {
+			s.log().Warnf("storing %s as an alias of %s: %s", domain, wildcard, err)
+		}
+	}
+	return data, true
+}
@@ -0,0 +1,123 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestWildcardDomain(t *testing.T) {
+	for domain, want := range map[string]string{
+		"www.example.com":   "*.example.com",
+		"a.b.example.com":   "*.b.example.com",
+		"example.com":       "",
+		"*.example.com":     "",
+		"localhost":         "",
+		".example.com":      "",
+		"www.example.co.uk": "*.example.co.uk",
+	} {
+		if got := wildcardDomain(domain); got != want {
+			t.Errorf("wildcardDomain(%q) = %q, expected %q", domain, got, want)
+		}
+	}
+}
+
+func TestWildcardFallback(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "wildcard-bucket", WithClock(clock), WithWildcardFallback())
+	certPEM, keyPEM := testCertificate(t, []string{"*.example.com"}, clock.Now().Add(30*24*time.Hour))
+	if err := storage.StoreSite("*.example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := storage.LoadSite("WWW.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data.Cert, certPEM) {
+		t.Fatal("Expected the wildcard certificate")
+	}
+	loc := storage.routes.site("www.example.com")
+	if v := metadataValue(client.Metadata("wildcard-bucket", loc.key), siteAliasMeta); v != "*.example.com" {
+		t.Fatalf("Expected an alias of *.example.com to be stored, got %q", v)
+	}
+	// The alias is followed without falling back.
+	storage.wildcard = false
+	if data, err = storage.LoadSite("www.example.com"); err != nil || !bytes.Equal(data.Cert, certPEM) {
+		t.Fatalf("Expected the alias to be followed, got %v", err)
+	}
+	info, err := storage.StatSite("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Domain != "www.example.com" || info.CertNotAfter.IsZero() {
+		t.Errorf("Expected the information of the wildcard site, got %+v", info)
+	}
+
+	// A site stored for the domain replaces the alias.
+	ownCert, ownKey := testCertificate(t, []string{"www.example.com"}, clock.Now().Add(60*24*time.Hour))
+	if err := storage.StoreSite("www.example.com", &caddytls.SiteData{Cert: ownCert, Key: ownKey}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = storage.LoadSite("www.example.com"); err != nil || !bytes.Equal(data.Cert, ownCert) {
+		t.Fatalf("Expected the stored certificate, got %v", err)
+	}
+
+	// An alias whose target was deleted is missing.
+	storage.wildcard = true
+	if _, err := storage.LoadSite("api.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteSite("*.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadSite("api.example.com"); err == nil {
+		t.Fatal("Expected an error for a dangling alias")
+	} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+		t.Fatalf("Expected ErrNotExist for a dangling alias, got %T %v", err, err)
+	}
+}
+
+func TestWildcardFallbackMismatch(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "wildcard-mismatch-bucket", WithClock(clock), WithWildcardFallback())
+	// Stored under the wildcard name, but not valid for subdomains.
+	certPEM, keyPEM := testCertificate(t, []string{"example.com"}, clock.Now().Add(30*24*time.Hour))
+	if err := storage.StoreSite("*.example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadSite("www.example.com"); err == nil {
+		t.Fatal("Expected a certificate not covering the domain not to be used")
+	}
+	// Two levels below the wildcard aren't covered either.
+	if _, err := storage.LoadSite("a.b.example.com"); err == nil {
+		t.Fatal("Expected no fallback for a.b.example.com")
+	}
+	loc := storage.routes.site("www.example.com")
+	if _, ok := client.Object("wildcard-mismatch-bucket", loc.key); ok {
+		t.Error("Expected no alias to be stored")
+	}
+}
+
+func TestWildcardFallbackReadOnly(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "wildcard-ro-bucket", WithClock(clock), WithWildcardFallback())
+	certPEM, keyPEM := testCertificate(t, []string{"*.example.com"}, clock.Now().Add(30*24*time.Hour))
+	if err := storage.StoreSite("*.example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+	storage.readOnly = true
+	if _, err := storage.LoadSite("www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	loc := storage.routes.site("www.example.com")
+	if _, ok := client.Object("wildcard-ro-bucket", loc.key); ok {
+		t.Error("Expected no alias to be stored by read-only storage")
+	}
+}
@@ -0,0 +1,71 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// AuditLockTakeover is the action of audit records of locks taken over
+// from another host after they expired. Other records have the actions of
+// events.
+const AuditLockTakeover = "lock_takeover"
+
+// AuditRecord is an entry of the audit trail of changes to certificates,
+// accounts, and locks. Each record is stored as a JSON object under
+// "audit/" in the bucket that's never overwritten, so with S3 Object Lock
+// on the prefix the trail is append-only.
+type AuditRecord struct {
+	Event
+	// Lock and PreviousOwner are set for lock takeovers.
+	Lock          string `json:"lock,omitempty"`
+	PreviousOwner string `json:"previous_owner,omitempty"`
+	// Actor identifies the process that made the change by host, pid, and
+	// a random suffix, as in lock objects.
+	Actor string `json:"actor"`
+}
+
+// auditPrefix returns the prefix of audit records.
+func (s *S3Storage) auditPrefix() string {
+	return s.prefix + "audit/"
+}
+
+// audit stores r if the audit log is enabled. The change it records has
+// already been made, so failures are only logged.
+func (s *S3Storage) audit(r *AuditRecord) {
+	if !s.auditLog {
+		return
+	}
+	r.Actor = lockOwner
+	if r.CA == "" {
+		r.CA = s.ca
+	}
+	if r.Time.IsZero() {
+		r.Time = s.now().UTC()
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		s.log().Errorf("encoding %s audit record: %s", r.Action, err)
+		return
+	}
+	// Keys sort by time, and the random suffix keeps records of the same
+	// instant apart.
+	var b [8]byte
+	rand.Read(b[:])
+	key := s.auditPrefix() + r.Time.Format("2006/01/02/150405.000000000") + "-" + r.Action + "-" + hex.EncodeToString(b[:]) + ".json"
+	in := s.encrypt(&s3.PutObjectInput{
+		Bucket:        &s.bucket,
+		Key:           &key,
+		Body:          bytes.NewReader(body),
+		ContentLength: aws.Int64(int64(len(body))),
+		ContentType:   aws.String(contentTypeJSON),
+		IfNoneMatch:   aws.String("*"),
+	})
+	if err := s.putPlainObject(s.s3, in); err != nil {
+		s.log().Errorf("writing %s audit record for s3://%s/%s: %s", r.Action, r.Bucket, r.Key, err)
+	}
+}
@@ -0,0 +1,97 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func auditRecords(t *testing.T, client *fakes.S3, bucket, prefix string) []*AuditRecord {
+	t.Helper()
+	var keys []string
+	for _, key := range client.Keys(bucket) {
+		if strings.HasPrefix(key, prefix+"audit/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var records []*AuditRecord
+	for _, key := range keys {
+		b, _ := client.Object(bucket, key)
+		var r AuditRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatalf("Invalid audit record %s: %s", key, err)
+		}
+		records = append(records, &r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	storage := newFakeStorage(t, client, "audit-bucket", WithClock(clock), WithAuditLog())
+
+	if err := storage.StoreSite("Example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := storage.DeleteSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := storage.StoreUser("admin@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	other, _ := json.Marshal(&lockInfo{Owner: "other", Created: clock.Now().Add(-2 * time.Minute), Expires: clock.Now().Add(-time.Minute)})
+	client.SetObject("audit-bucket", "acme/ca/locks/example.com", other, nil)
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("Expected to take over the expired lock, got %v, %v", w, err)
+	}
+	defer storage.Unlock("example.com")
+
+	records := auditRecords(t, client, "audit-bucket", "acme/ca/")
+	var actions []string
+	for _, r := range records {
+		actions = append(actions, r.Action)
+		if r.Actor != lockOwner || r.CA != "ca" || r.Bucket != "audit-bucket" || r.Time.IsZero() {
+			t.Errorf("Unexpected audit record %+v", r)
+		}
+	}
+	want := []string{EventSiteStored, EventSiteDeleted, EventUserStored, AuditLockTakeover}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected audit records %v, got %v", want, actions)
+	}
+	if records[0].Domain != "example.com" || records[2].Email != "admin@example.com" {
+		t.Errorf("Unexpected records %+v, %+v", records[0], records[2])
+	}
+	if r := records[3]; r.Lock != "example.com" || r.PreviousOwner != "other" || r.Key != "acme/ca/locks/example.com" {
+		t.Errorf("Unexpected lock takeover record %+v", r)
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "no-audit-bucket")
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if records := auditRecords(t, client, "no-audit-bucket", "acme/ca/"); len(records) != 0 {
+		t.Errorf("Expected no audit records, got %d", len(records))
+	}
+}
+
+func TestAuditLogDryRun(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "dry-audit-bucket", WithAuditLog(), WithDryRun(true))
+	storage.audit(&AuditRecord{Event: Event{Action: EventSiteStored, Domain: "example.com"}})
+	if records := auditRecords(t, client, "dry-audit-bucket", "acme/ca/"); len(records) != 0 {
+		t.Errorf("Expected no audit records in dry run, got %d", len(records))
+	}
+}
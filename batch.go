@@ -0,0 +1,116 @@
+package caddytlss3
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// maxDeleteObjects is the most keys a DeleteObjects request can delete.
+const maxDeleteObjects = 1000
+
+// deleteBatch groups deletes of objects in a bucket into DeleteObjects
+// requests of up to maxDeleteObjects keys. Like deleteObject, it only logs
+// the deletes in a dry run.
+type deleteBatch struct {
+	s      *S3Storage
+	client s3iface.S3API
+	bucket string
+	keys   []string
+	// done is called with the result of the delete of each key of a
+	// request that succeeded, nil if the object was deleted. Keys of
+	// requests that failed as a whole aren't passed to it.
+	done func(key string, err error)
+}
+
+func (s *S3Storage) newDeleteBatch(client s3iface.S3API, bucket string, done func(key string, err error)) *deleteBatch {
+	return &deleteBatch{s: s, client: client, bucket: bucket, done: done}
+}
+
+// add queues the delete of key, and sends the batch once it's full.
+func (b *deleteBatch) add(key string) error {
+	b.keys = append(b.keys, key)
+	if len(b.keys) < maxDeleteObjects {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush sends the queued deletes, and returns the error of the request if
+// it failed as a whole.
+func (b *deleteBatch) flush() error {
+	if len(b.keys) == 0 {
+		return nil
+	}
+	keys := b.keys
+	b.keys = nil
+	if b.s.skipDeletes() {
+		for _, key := range keys {
+			b.s.log().Infof("dry run: DeleteObject s3://%s/%s", b.bucket, key)
+			b.done(key, nil)
+		}
+		return nil
+	}
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+	ctx, cancel := b.s.opContext()
+	defer cancel()
+	res, err := b.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: &b.bucket,
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	for _, key := range keys {
+		b.s.invalidate(b.bucket, key)
+	}
+	if err != nil {
+		return b.s.storageError("DeleteObjects", b.bucket, "", err)
+	}
+	failed := make(map[string]error, len(res.Errors))
+	for _, e := range res.Errors {
+		failed[aws.StringValue(e.Key)] = awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil)
+	}
+	for _, key := range keys {
+		b.done(key, failed[key])
+	}
+	return nil
+}
+
+// deleteErrors collects the keys a deleteBatch failed to delete.
+type deleteErrors map[string]error
+
+func (e deleteErrors) add(key string, err error) {
+	if err != nil {
+		e[key] = err
+	}
+}
+
+// err returns the collected failures as an ErrDeleteObjects, or nil if
+// there were none.
+func (e deleteErrors) err(bucket string) error {
+	if len(e) == 0 {
+		return nil
+	}
+	return ErrDeleteObjects{Bucket: bucket, Failed: e}
+}
+
+// deleteKeys deletes the objects with the given keys in bucket with as few
+// DeleteObjects requests as possible.
+func (s *S3Storage) deleteKeys(client s3iface.S3API, bucket string, keys []string) error {
+	errs := make(deleteErrors)
+	b := s.newDeleteBatch(client, bucket, errs.add)
+	for _, key := range keys {
+		if err := b.add(key); err != nil {
+			return err
+		}
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return errs.err(bucket)
+}
@@ -0,0 +1,112 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// batchS3 counts DeleteObjects requests and fails the deletes of denied
+// keys like S3 does, in the Errors of the response.
+type batchS3 struct {
+	*fakes.S3
+	requests int
+	denied   map[string]bool
+}
+
+func (f *batchS3) DeleteObjectsWithContext(ctx aws.Context, in *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	f.requests++
+	if len(in.Delete.Objects) > maxDeleteObjects {
+		return nil, fmt.Errorf("%d keys in one request", len(in.Delete.Objects))
+	}
+	var allowed []*s3.ObjectIdentifier
+	var errs []*s3.Error
+	for _, o := range in.Delete.Objects {
+		if f.denied[aws.StringValue(o.Key)] {
+			errs = append(errs, &s3.Error{Key: o.Key, Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")})
+			continue
+		}
+		allowed = append(allowed, o)
+	}
+	out, err := f.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{Bucket: in.Bucket, Delete: &s3.Delete{Objects: allowed}})
+	if err != nil {
+		return nil, err
+	}
+	out.Errors = errs
+	return out, nil
+}
+
+func TestDeleteKeys(t *testing.T) {
+	client := &batchS3{S3: fakes.NewS3(), denied: map[string]bool{"keys/0042": true}}
+	storage := newFakeStorage(t, client, "batch-bucket")
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("keys/%04d", i)
+		client.SetObject("batch-bucket", key, []byte("data"), nil)
+		keys = append(keys, key)
+	}
+
+	err := storage.deleteKeys(client, "batch-bucket", keys)
+	e, ok := err.(ErrDeleteObjects)
+	if !ok {
+		t.Fatalf("Expected ErrDeleteObjects, got %T %v", err, err)
+	}
+	if len(e.Failed) != 1 || e.Failed["keys/0042"] == nil || !strings.Contains(e.Error(), "AccessDenied") {
+		t.Errorf("Expected keys/0042 to be reported, got %v", e)
+	}
+	if client.requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", client.requests)
+	}
+	if remaining := client.Keys("batch-bucket"); len(remaining) != 1 || remaining[0] != "keys/0042" {
+		t.Errorf("Expected only the denied key to remain, got %d keys", len(remaining))
+	}
+
+	client.requests = 0
+	storage.dryRunDeletes = true
+	if err := storage.deleteKeys(client, "batch-bucket", []string{"keys/0042"}); err != nil {
+		t.Fatal(err)
+	}
+	if client.requests != 0 {
+		t.Errorf("Expected no requests in a dry run, got %d", client.requests)
+	}
+}
+
+func TestDeletePrefixPartialFailure(t *testing.T) {
+	client := &batchS3{S3: fakes.NewS3(), denied: map[string]bool{"env/b": true}}
+	storage := newFakeStorage(t, client, "batch-prefix-bucket", WithPrefix("env"))
+	for _, key := range []string{"env/a", "env/b", "env/c"} {
+		client.SetObject("batch-prefix-bucket", key, []byte("data"), nil)
+	}
+	err := storage.Purge()
+	if e, ok := err.(ErrDeleteObjects); !ok || len(e.Failed) != 1 || e.Failed["env/b"] == nil {
+		t.Fatalf("Expected env/b to be reported, got %v", err)
+	}
+	if keys := client.Keys("batch-prefix-bucket"); len(keys) != 1 {
+		t.Errorf("Expected the other objects to be deleted, got %v", keys)
+	}
+}
+
+func TestCleanUpBatchFailure(t *testing.T) {
+	client := &batchS3{S3: fakes.NewS3(), denied: map[string]bool{"probe/probe-2": true}}
+	clock := &testClock{t: time.Now().Add(2 * time.Hour)}
+	storage := newFakeStorage(t, client, "batch-cleanup-bucket", WithClock(clock))
+	for _, key := range []string{"probe/probe-1", "probe/probe-2", "probe/probe-3"} {
+		client.SetObject("batch-cleanup-bucket", key, []byte("probe"), nil)
+	}
+	report, err := storage.CleanUp(0)
+	if err == nil {
+		t.Fatal("Expected the failed delete to be reported")
+	}
+	if got := strings.Join(report.TempObjects, ","); got != "probe/probe-1,probe/probe-3" {
+		t.Errorf("Expected only the deleted probes to be reported, got %s", got)
+	}
+	if client.requests != 1 {
+		t.Errorf("Expected one request, got %d", client.requests)
+	}
+}
@@ -0,0 +1,158 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// trashRetentionDays and backupRetentionDays are how long objects under
+	// the trash/ and backups/ prefixes are kept by buckets created here.
+	trashRetentionDays  = 30
+	backupRetentionDays = 90
+	// probeRetentionDays is how long probe objects left behind by Validate
+	// are kept by buckets created here, in case CleanUp isn't run.
+	probeRetentionDays = 1
+	// noncurrentRetentionDays is how long previous versions are kept.
+	noncurrentRetentionDays = 90
+)
+
+// bootstrapped records buckets that have already been checked so the
+// bootstrap only runs once per bucket per process.
+var (
+	bootstrappedMu sync.Mutex
+	bootstrapped   = make(map[string]bool)
+)
+
+// bootstrapBucket creates the bucket if it doesn't exist yet, with
+// versioning enabled, default encryption, all public access blocked, and
+// lifecycle rules that expire trash, backups, probes, and old versions.
+// The rules are scoped to the base prefix, so they cover every CA
+// namespace sharing the bucket. Existing buckets are left untouched.
+func (s *S3Storage) bootstrapBucket(region string) error {
+	bootstrappedMu.Lock()
+	defer bootstrappedMu.Unlock()
+	if bootstrapped[s.bucket] {
+		return nil
+	}
+
+	ctx, cancel := s.opContext()
+	_, err := s.s3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: &s.bucket})
+	cancel()
+	if err == nil {
+		bootstrapped[s.bucket] = true
+		return nil
+	}
+	if !isNotFound(err) {
+		return fmt.Errorf("S3Storage: checking bucket %s: %s", s.bucket, err)
+	}
+	if s.dryRun {
+		s.log().Infof("dry run: CreateBucket %s in %s", s.bucket, region)
+		return nil
+	}
+
+	s.log().Infof("creating bucket %s in %s", s.bucket, region)
+	in := &s3.CreateBucketInput{Bucket: &s.bucket}
+	// us-east-1 is the default location and must not be given explicitly.
+	if region != "us-east-1" {
+		in.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+	ctx, cancel = s.opContext()
+	_, err = s.s3.CreateBucketWithContext(ctx, in)
+	cancel()
+	if err != nil {
+		if e, ok := err.(awserr.Error); !ok || e.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+			return fmt.Errorf("S3Storage: creating bucket %s: %s", s.bucket, err)
+		}
+	}
+	ctx, cancel = s.opContext()
+	err = s.s3.WaitUntilBucketExistsWithContext(ctx, &s3.HeadBucketInput{Bucket: &s.bucket})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("S3Storage: waiting for bucket %s: %s", s.bucket, err)
+	}
+
+	ctx, cancel = s.opContext()
+	_, err = s.s3.PutPublicAccessBlockWithContext(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: &s.bucket,
+		PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("S3Storage: blocking public access to bucket %s: %s", s.bucket, err)
+	}
+	ctx, cancel = s.opContext()
+	_, err = s.s3.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{
+		Bucket: &s.bucket,
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("S3Storage: enabling versioning on bucket %s: %s", s.bucket, err)
+	}
+	ctx, cancel = s.opContext()
+	_, err = s.s3.PutBucketEncryptionWithContext(ctx, &s3.PutBucketEncryptionInput{
+		Bucket: &s.bucket,
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{{
+				ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+					SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+				},
+			}},
+		},
+	})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("S3Storage: enabling default encryption on bucket %s: %s", s.bucket, err)
+	}
+	ctx, cancel = s.opContext()
+	_, err = s.s3.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: &s.bucket,
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: []*s3.LifecycleRule{
+				expireRule("expire-trash", s.basePrefix+"trash/", trashRetentionDays),
+				expireRule("expire-backups", s.basePrefix+"backups/", backupRetentionDays),
+				expireRule("expire-probes", s.basePrefix+"probe/", probeRetentionDays),
+				{
+					ID:     aws.String("expire-noncurrent-versions"),
+					Status: aws.String(s3.ExpirationStatusEnabled),
+					Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(s.basePrefix)},
+					NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+						NoncurrentDays: aws.Int64(noncurrentRetentionDays),
+					},
+					AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+						DaysAfterInitiation: aws.Int64(1),
+					},
+				},
+			},
+		},
+	})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("S3Storage: configuring lifecycle rules on bucket %s: %s", s.bucket, err)
+	}
+	bootstrapped[s.bucket] = true
+	return nil
+}
+
+func expireRule(id, prefix string, days int64) *s3.LifecycleRule {
+	return &s3.LifecycleRule{
+		ID:         aws.String(id),
+		Status:     aws.String(s3.ExpirationStatusEnabled),
+		Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+		Expiration: &s3.LifecycleExpiration{Days: aws.Int64(days)},
+	}
+}
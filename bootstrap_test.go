@@ -0,0 +1,71 @@
+package caddytlss3
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// bootstrapS3 is a missing bucket which records the lifecycle rules it's
+// created with.
+type bootstrapS3 struct {
+	*fakes.S3
+	rules *[]*s3.LifecycleRule
+}
+
+func (c bootstrapS3) HeadBucketWithContext(aws.Context, *s3.HeadBucketInput, ...request.Option) (*s3.HeadBucketOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+}
+
+func (c bootstrapS3) CreateBucketWithContext(aws.Context, *s3.CreateBucketInput, ...request.Option) (*s3.CreateBucketOutput, error) {
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (c bootstrapS3) WaitUntilBucketExistsWithContext(aws.Context, *s3.HeadBucketInput, ...request.WaiterOption) error {
+	return nil
+}
+
+func (c bootstrapS3) PutPublicAccessBlockWithContext(aws.Context, *s3.PutPublicAccessBlockInput, ...request.Option) (*s3.PutPublicAccessBlockOutput, error) {
+	return &s3.PutPublicAccessBlockOutput{}, nil
+}
+
+func (c bootstrapS3) PutBucketVersioningWithContext(aws.Context, *s3.PutBucketVersioningInput, ...request.Option) (*s3.PutBucketVersioningOutput, error) {
+	return &s3.PutBucketVersioningOutput{}, nil
+}
+
+func (c bootstrapS3) PutBucketEncryptionWithContext(aws.Context, *s3.PutBucketEncryptionInput, ...request.Option) (*s3.PutBucketEncryptionOutput, error) {
+	return &s3.PutBucketEncryptionOutput{}, nil
+}
+
+func (c bootstrapS3) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, in *s3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	*c.rules = in.LifecycleConfiguration.Rules
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func TestBootstrapLifecycleRules(t *testing.T) {
+	var rules []*s3.LifecycleRule
+	storage := newFakeStorage(t, bootstrapS3{fakes.NewS3(), &rules}, "bootstrap-bucket", WithPrefix("caddy"))
+	if err := storage.bootstrapBucket("us-east-1"); err != nil {
+		t.Fatal(err)
+	}
+	// The rules cover every CA namespace under the base prefix.
+	want := map[string]string{
+		"expire-trash":               "caddy/trash/",
+		"expire-backups":             "caddy/backups/",
+		"expire-probes":              "caddy/probe/",
+		"expire-noncurrent-versions": "caddy/",
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("Expected %d lifecycle rules, got %d", len(want), len(rules))
+	}
+	for _, r := range rules {
+		if prefix, ok := want[aws.StringValue(r.ID)]; !ok || aws.StringValue(r.Filter.Prefix) != prefix {
+			t.Errorf("Expected rule %s to have prefix %q, got %q", aws.StringValue(r.ID), prefix, aws.StringValue(r.Filter.Prefix))
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package caddytlss3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// maxCacheEntries bounds the in-memory cache. Expired entries are pruned
+// when it's exceeded.
+const maxCacheEntries = 10000
+
+// objectCache caches object contents by bucket and key. It's shared by all
+// storage instances since Caddy constructs them on demand.
+var objectCache = struct {
+	sync.Mutex
+	entries map[string]*cacheEntry
+}{entries: make(map[string]*cacheEntry)}
+
+// missingSites is the negative cache of site data that doesn't exist. It
+// maps cache keys to the expiry of the entry.
+var missingSites = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+type cacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+func cacheKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// cachePath returns the path of the on-disk cache file for a key.
+func (s *S3Storage) cachePath(ck string) string {
+	return hashedPath(s.cacheDir, ck)
+}
+
+// hashedPath returns the path of the file for a cache key in dir. Names
+// are hashed so keys (domains and emails) don't need escaping.
+func hashedPath(dir, ck string) string {
+	h := sha256.Sum256([]byte(ck))
+	return filepath.Join(dir, hex.EncodeToString(h[:]))
+}
+
+// getObject returns the contents of an object, using the read-through
+// cache when a cache TTL is configured. Objects are cached in memory and,
+// if a cache directory is configured, on disk so that the cache survives
+// restarts. Writes from other hosts are only seen once cached entries
+// expire.
+func (s *S3Storage) getObject(client s3iface.S3API, bucket, key string) ([]byte, error) {
+	if s.cacheTTL <= 0 {
+		return s.fetchObject(client, bucket, key)
+	}
+	ck := cacheKey(bucket, key)
+	now := s.now()
+	objectCache.Lock()
+	e, ok := objectCache.entries[ck]
+	objectCache.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.data, nil
+	}
+	if s.cacheDir != "" {
+		path := s.cachePath(ck)
+		if fi, err := os.Stat(path); err == nil && now.Before(fi.ModTime().Add(s.cacheTTL)) {
+			if data, err := ioutil.ReadFile(path); err == nil {
+				s.cacheStore(ck, data, fi.ModTime().Add(s.cacheTTL), false)
+				return data, nil
+			}
+		}
+	}
+	data, err := s.fetchObject(client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheStore(ck, data, now.Add(s.cacheTTL), true)
+	return data, nil
+}
+
+func (s *S3Storage) cacheStore(ck string, data []byte, expires time.Time, toDisk bool) {
+	objectCache.Lock()
+	objectCache.entries[ck] = &cacheEntry{data: data, expires: expires}
+	if len(objectCache.entries) > maxCacheEntries {
+		now := s.now()
+		for k, e := range objectCache.entries {
+			if !now.Before(e.expires) {
+				delete(objectCache.entries, k)
+			}
+		}
+	}
+	objectCache.Unlock()
+	if toDisk && s.cacheDir != "" {
+		// The cache holds private keys so it must only be readable by
+		// this user.
+		if err := os.MkdirAll(s.cacheDir, 0700); err != nil {
+			s.log().Errorf("creating cache directory: %s", err)
+			return
+		}
+		if err := ioutil.WriteFile(s.cachePath(ck), data, 0600); err != nil {
+			s.log().Errorf("writing cache file: %s", err)
+		}
+	}
+}
+
+// knownMissing returns true if the negative cache records that the object
+// doesn't exist.
+func (s *S3Storage) knownMissing(bucket, key string) bool {
+	if s.negativeTTL <= 0 {
+		return false
+	}
+	missingSites.Lock()
+	defer missingSites.Unlock()
+	expires, ok := missingSites.expires[cacheKey(bucket, key)]
+	return ok && s.now().Before(expires)
+}
+
+// cacheMissing records in the negative cache that the object doesn't
+// exist, so that names that are looked up repeatedly without being stored,
+// e.g. by SNI scanners, don't each cost a request.
+func (s *S3Storage) cacheMissing(bucket, key string) {
+	if s.negativeTTL <= 0 {
+		return
+	}
+	now := s.now()
+	missingSites.Lock()
+	defer missingSites.Unlock()
+	if len(missingSites.expires) >= maxCacheEntries {
+		for k, expires := range missingSites.expires {
+			if !now.Before(expires) {
+				delete(missingSites.expires, k)
+			}
+		}
+		if len(missingSites.expires) >= maxCacheEntries {
+			// Under a flood of distinct names, start over rather than
+			// growing without bound.
+			missingSites.expires = make(map[string]time.Time)
+		}
+	}
+	missingSites.expires[cacheKey(bucket, key)] = now.Add(s.negativeTTL)
+}
+
+// invalidate removes an object from the cache after it's been written or
+// deleted.
+func (s *S3Storage) invalidate(bucket, key string) {
+	ck := cacheKey(bucket, key)
+	objectCache.Lock()
+	delete(objectCache.entries, ck)
+	objectCache.Unlock()
+	missingSites.Lock()
+	delete(missingSites.expires, ck)
+	missingSites.Unlock()
+	if s.cacheDir != "" {
+		if err := os.Remove(s.cachePath(ck)); err != nil && !os.IsNotExist(err) {
+			s.log().Errorf("removing cache file: %s", err)
+		}
+	}
+}
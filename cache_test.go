@@ -0,0 +1,105 @@
+package caddytlss3
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestReadThroughCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytlss3-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "cache-bucket", WithCache(time.Minute, dir), WithClock(clock))
+	key := siteKey("acme/ca/", "example.com")
+
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Meta: []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Meta) != "v1" {
+		t.Fatalf("Expected v1, got %q", data.Meta)
+	}
+
+	// Changes made by other hosts are only seen once the entry expires.
+	client.SetObject("cache-bucket", key, []byte(`{"Meta":"djI="}`), nil)
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Meta) != "v1" {
+		t.Errorf("Expected cached v1, got %q", data.Meta)
+	}
+
+	// The disk cache is used when the in-memory entry is gone.
+	objectCache.Lock()
+	delete(objectCache.entries, cacheKey("cache-bucket", key))
+	objectCache.Unlock()
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Meta) != "v1" {
+		t.Errorf("Expected v1 from disk, got %q", data.Meta)
+	}
+
+	clock.Add(2 * time.Minute)
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Meta) != "v2" {
+		t.Errorf("Expected v2 after expiry, got %q", data.Meta)
+	}
+
+	// Writes and deletes invalidate the cache.
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Meta: []byte("v3")}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Meta) != "v3" {
+		t.Errorf("Expected v3 after store, got %q", data.Meta)
+	}
+	if err := storage.DeleteSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadSite("example.com"); err == nil {
+		t.Error("Expected error after delete")
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	client := &gatedS3{S3: fakes.NewS3(), gate: make(chan struct{})}
+	close(client.gate)
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "negative-bucket", WithClock(clock), WithNegativeCache(time.Minute))
+
+	for i := 0; i < 3; i++ {
+		if _, err := storage.LoadSite("missing.example.com"); err == nil {
+			t.Fatal("Expected the site to be missing")
+		} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+			t.Fatalf("Expected ErrNotExist, got %T", err)
+		}
+	}
+	if client.reads != 1 {
+		t.Errorf("Expected 1 read of a missing site, got %d", client.reads)
+	}
+	clock.Add(2 * time.Minute)
+	storage.LoadSite("missing.example.com")
+	if client.reads != 2 {
+		t.Errorf("Expected another read once the entry expired, got %d", client.reads)
+	}
+
+	// Storing the site is seen immediately.
+	if err := storage.StoreSite("missing.example.com", &caddytls.SiteData{Meta: []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadSite("missing.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
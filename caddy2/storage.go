@@ -0,0 +1,163 @@
+// Package caddy2 is the Caddy 2 storage module of caddytlss3, storing the
+// data of certmagic in the same bucket as the Caddy 1 plugin.
+package caddy2
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/sprucehealth/caddytlss3"
+)
+
+func init() {
+	caddy.RegisterModule(Storage{})
+}
+
+// Storage is the Caddy 2 storage module (caddy.storage.s3). It provides a
+// caddytlss3.CertmagicStorage to certmagic.
+//
+// JSON config:
+//
+//	"storage": {"module": "s3", "bucket": "my-bucket", "prefix": "caddy"}
+//
+// Caddyfile:
+//
+//	storage s3 {
+//		bucket my-bucket
+//		prefix caddy
+//		region us-east-1
+//		endpoint http://minio:9000
+//		force_path_style
+//		sse aws:kms
+//		kms_key_id alias/caddy
+//		storage_class STANDARD_IA
+//		lock_table caddy-locks
+//	}
+type Storage struct {
+	Bucket         string `json:"bucket,omitempty"`
+	Prefix         string `json:"prefix,omitempty"`
+	Region         string `json:"region,omitempty"`
+	Endpoint       string `json:"endpoint,omitempty"`
+	ForcePathStyle bool   `json:"force_path_style,omitempty"`
+	Accelerate     bool   `json:"accelerate,omitempty"`
+	DualStack      bool   `json:"dual_stack,omitempty"`
+	Partition      string `json:"partition,omitempty"`
+	FIPS           bool   `json:"fips,omitempty"`
+	SSE            string `json:"sse,omitempty"`
+	KMSKeyID       string `json:"kms_key_id,omitempty"`
+	StorageClass   string `json:"storage_class,omitempty"`
+	LockTable      string `json:"lock_table,omitempty"`
+
+	s *caddytlss3.CertmagicStorage
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*Storage)(nil)
+	_ caddy.StorageConverter = (*Storage)(nil)
+	_ caddy.CleanerUpper     = (*Storage)(nil)
+	_ caddyfile.Unmarshaler  = (*Storage)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (Storage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.s3",
+		New: func() caddy.Module { return new(Storage) },
+	}
+}
+
+// config returns the storage configuration of the module.
+func (cs *Storage) config() caddytlss3.Config {
+	return caddytlss3.Config{
+		Bucket:         cs.Bucket,
+		Prefix:         cs.Prefix,
+		Region:         cs.Region,
+		Endpoint:       cs.Endpoint,
+		ForcePathStyle: cs.ForcePathStyle,
+		Accelerate:     cs.Accelerate,
+		DualStack:      cs.DualStack,
+		Partition:      cs.Partition,
+		FIPS:           cs.FIPS,
+		SSE:            cs.SSE,
+		KMSKeyID:       cs.KMSKeyID,
+		StorageClass:   cs.StorageClass,
+		LockTable:      cs.LockTable,
+	}
+}
+
+// Provision creates the underlying storage.
+func (cs *Storage) Provision(ctx caddy.Context) error {
+	s, err := caddytlss3.NewCertmagicStorage(cs.config())
+	if err != nil {
+		return err
+	}
+	cs.s = s
+	return nil
+}
+
+// Cleanup closes the underlying storage.
+func (cs *Storage) Cleanup() error {
+	if cs.s == nil {
+		return nil
+	}
+	return cs.s.Close()
+}
+
+// CertMagicStorage returns the storage for use by certmagic.
+func (cs *Storage) CertMagicStorage() (certmagic.Storage, error) {
+	return cs.s, nil
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens.
+func (cs *Storage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var field *string
+			switch d.Val() {
+			case "bucket":
+				field = &cs.Bucket
+			case "prefix":
+				field = &cs.Prefix
+			case "region":
+				field = &cs.Region
+			case "endpoint":
+				field = &cs.Endpoint
+			case "sse":
+				field = &cs.SSE
+			case "kms_key_id":
+				field = &cs.KMSKeyID
+			case "storage_class":
+				field = &cs.StorageClass
+			case "lock_table":
+				field = &cs.LockTable
+			case "partition":
+				field = &cs.Partition
+			case "force_path_style", "accelerate", "dual_stack", "fips":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case "force_path_style":
+					cs.ForcePathStyle = true
+				case "accelerate":
+					cs.Accelerate = true
+				case "dual_stack":
+					cs.DualStack = true
+				case "fips":
+					cs.FIPS = true
+				}
+				continue
+			default:
+				return d.Errf("unrecognized s3 storage option %q", d.Val())
+			}
+			if !d.Args(field) {
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package caddy2
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sprucehealth/caddytlss3"
+)
+
+func TestStorageConfig(t *testing.T) {
+	if id := (Storage{}).CaddyModule().ID; id != "caddy.storage.s3" {
+		t.Errorf("Unexpected module ID %q", id)
+	}
+	cs := &Storage{Bucket: "bucket", Prefix: "caddy", Region: "us-west-2", FIPS: true, SSE: "aws:kms", KMSKeyID: "alias/caddy", LockTable: "caddy-locks"}
+	want := caddytlss3.Config{Bucket: "bucket", Prefix: "caddy", Region: "us-west-2", FIPS: true, SSE: "aws:kms", KMSKeyID: "alias/caddy", LockTable: "caddy-locks"}
+	if got := cs.config(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
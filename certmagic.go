@@ -0,0 +1,185 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/caddyserver/certmagic"
+)
+
+// CertmagicStorage implements certmagic.Storage on top of the same bucket,
+// credentials, and locking as S3Storage, so a deployment can move to Caddy
+// 2 without switching storage backends. Certmagic keys are stored as is
+// under the prefix, next to the acme/ namespaces used by Caddy 1. The
+// Caddy 2 storage module is in the caddy2 package.
+type CertmagicStorage struct {
+	s *S3Storage
+}
+
+var _ certmagic.Storage = (*CertmagicStorage)(nil)
+
+// NewCertmagicStorage returns a certmagic storage for cfg modified by
+// opts. Certmagic keys aren't namespaced by CA, so locks are kept directly
+// under the prefix too.
+func NewCertmagicStorage(cfg Config, opts ...Option) (*CertmagicStorage, error) {
+	cfg.flat = true
+	s, err := NewS3StorageWithConfig(cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &CertmagicStorage{s: s}, nil
+}
+
+// Close closes the underlying storage.
+func (cs *CertmagicStorage) Close() error {
+	return cs.s.Close()
+}
+
+func (cs *CertmagicStorage) key(key string) *string {
+	return aws.String(cs.s.basePrefix + strings.TrimPrefix(key, "/"))
+}
+
+// Lock obtains the lock for name, waiting until it's released by other
+// processes or hosts, or until ctx is done.
+func (cs *CertmagicStorage) Lock(ctx context.Context, name string) error {
+	for {
+		w, err := cs.s.TryLock(name)
+		if err != nil || w == nil {
+			return err
+		}
+		lw, ok := w.(*LockWaiter)
+		if !ok {
+			w.Wait()
+			continue
+		}
+		// Keep waiting past Config.LockWait, until ctx is done.
+		if err := lw.WaitContext(ctx); err != nil {
+			if _, ok := err.(ErrLockTimeout); !ok {
+				return err
+			}
+		}
+	}
+}
+
+// Unlock releases the lock for name.
+func (cs *CertmagicStorage) Unlock(ctx context.Context, name string) error {
+	return cs.s.Unlock(name)
+}
+
+// Store writes value at key.
+func (cs *CertmagicStorage) Store(ctx context.Context, key string, value []byte) error {
+	if cs.s.readOnly {
+		return ErrReadOnly{Op: "Store", Name: key}
+	}
+	return cs.s.putObject(cs.s.s3, cs.s.encrypt(&s3.PutObjectInput{
+		Bucket:        &cs.s.bucket,
+		Key:           cs.key(key),
+		Body:          bytes.NewReader(value),
+		ContentLength: aws.Int64(int64(len(value))),
+	}))
+}
+
+// Load returns the value at key, or fs.ErrNotExist.
+func (cs *CertmagicStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	res, err := cs.s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &cs.s.bucket,
+		Key:    cs.key(key),
+	})
+	if isNotFound(err) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readObject(res, cs.s.bucket, *cs.key(key))
+}
+
+// Delete deletes key, and everything under it if key is a directory.
+// Deleting a key that doesn't exist isn't an error.
+func (cs *CertmagicStorage) Delete(ctx context.Context, key string) error {
+	if cs.s.readOnly {
+		return ErrReadOnly{Op: "Delete", Name: key}
+	}
+	if err := cs.s.deleteObject(cs.s.s3, &s3.DeleteObjectInput{
+		Bucket: &cs.s.bucket,
+		Key:    cs.key(key),
+	}); err != nil {
+		return err
+	}
+	return cs.s.deletePrefix(cs.s.s3, cs.s.bucket, *cs.key(key)+"/")
+}
+
+// Exists returns true if key is an object or a directory.
+func (cs *CertmagicStorage) Exists(ctx context.Context, key string) bool {
+	_, err := cs.Stat(ctx, key)
+	return err == nil
+}
+
+// Stat returns information about key. Keys that are a prefix of other keys
+// are reported as directories (not terminal).
+func (cs *CertmagicStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	head, err := cs.s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &cs.s.bucket,
+		Key:    cs.key(key),
+	})
+	if err == nil {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   aws.TimeValue(head.LastModified),
+			Size:       aws.Int64Value(head.ContentLength),
+			IsTerminal: true,
+		}, nil
+	}
+	if !isNotFound(err) {
+		return certmagic.KeyInfo{}, err
+	}
+	res, err := cs.s.s3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  &cs.s.bucket,
+		Prefix:  aws.String(*cs.key(key) + "/"),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	if len(res.Contents) == 0 {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	return certmagic.KeyInfo{Key: key}, nil
+}
+
+// List returns the keys under path. Unless recursive, only the direct
+// children of path are returned, including directories.
+func (cs *CertmagicStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	prefix := *cs.key(path)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	in := &s3.ListObjectsV2Input{
+		Bucket: &cs.s.bucket,
+		Prefix: &prefix,
+	}
+	if !recursive {
+		in.Delimiter = aws.String("/")
+	}
+	var keys []string
+	err := cs.s.s3.ListObjectsV2PagesWithContext(ctx, in, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			keys = append(keys, strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), cs.s.basePrefix), "/"))
+		}
+		for _, o := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(o.Key), cs.s.basePrefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return keys, nil
+}
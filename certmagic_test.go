@@ -0,0 +1,101 @@
+package caddytlss3
+
+import (
+	"context"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestS3CertmagicStorage(t *testing.T) {
+	client := fakes.NewS3()
+	cs, err := NewCertmagicStorage(Config{Bucket: "bucket", Prefix: "caddy", CA: "ca", client: client}, WithClock(&testClock{t: time.Now()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	ctx := context.Background()
+
+	key := "certificates/acme-v02/example.com/example.com.crt"
+	if _, err := cs.Load(ctx, key); err != fs.ErrNotExist {
+		t.Fatalf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if err := cs.Store(ctx, key, []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "caddy/"+key); !ok {
+		t.Fatal("Expected the key to be stored under the prefix")
+	}
+	if b, err := cs.Load(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "cert" {
+		t.Errorf("Expected cert, got %q", b)
+	}
+
+	if info, err := cs.Stat(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if !info.IsTerminal || info.Size != 4 {
+		t.Errorf("Unexpected key info %+v", info)
+	}
+	if info, err := cs.Stat(ctx, "certificates/acme-v02"); err != nil {
+		t.Fatal(err)
+	} else if info.IsTerminal {
+		t.Error("Expected a directory to not be terminal")
+	}
+
+	if keys, err := cs.List(ctx, "certificates", false); err != nil {
+		t.Fatal(err)
+	} else if want := []string{"certificates/acme-v02"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Expected %v, got %v", want, keys)
+	}
+	if keys, err := cs.List(ctx, "certificates", true); err != nil {
+		t.Fatal(err)
+	} else if want := []string{key}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Expected %v, got %v", want, keys)
+	}
+
+	if err := cs.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "caddy/locks/issue_cert_example.com"); !ok {
+		t.Error("Expected a lock object under the prefix")
+	}
+	if err := cs.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.Delete(ctx, "certificates"); err != nil {
+		t.Fatal(err)
+	}
+	if cs.Exists(ctx, key) {
+		t.Error("Expected keys under a deleted directory to be deleted")
+	}
+}
+
+func TestCertmagicLockCanceled(t *testing.T) {
+	cs, err := NewCertmagicStorage(Config{Bucket: "bucket", Prefix: "caddy", client: fakes.NewS3()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	name := "issue_cert_canceled.example.com"
+	if err := cs.Lock(context.Background(), name); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Unlock(context.Background(), name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cs.Lock(ctx, name); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the wait to end with the context, got %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); lockWaitGoroutines() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected no goroutine left waiting for the lock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
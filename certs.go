@@ -0,0 +1,246 @@
+package caddytlss3
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// Object metadata set on site objects describing the leaf certificate so
+// that expiry can be checked with a HeadObject request alone.
+const (
+	certFingerprintMeta = "Cert-Sha256"
+	certNotAfterMeta    = "Cert-Not-After"
+)
+
+// Object tags set on site objects so that lifecycle rules and audit tools
+// can select certificates by domain, issuer, or expiry.
+const (
+	domainTag       = "caddy-domain"
+	certIssuerTag   = "caddy-cert-issuer"
+	certNotAfterTag = "caddy-cert-not-after"
+
+	maxTagValueLen = 256
+)
+
+// SiteInfo describes stored site data.
+type SiteInfo struct {
+	Domain       string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	// CertSHA256 and CertNotAfter describe the leaf certificate. They're
+	// empty for sites stored before certificate metadata was recorded.
+	CertSHA256   string
+	CertNotAfter time.Time
+}
+
+// StatSite returns information about the stored site for domain without
+// downloading the certificate and private key. If the site does not exist
+// an error of type ErrNotExist is returned. For a site alias, the
+// information is about the site it refers to.
+func (s *S3Storage) StatSite(domain string) (*SiteInfo, error) {
+	res, err := s.headSite(domain)
+	if err != nil {
+		return nil, err
+	}
+	if target := metadataValue(res.Metadata, siteAliasMeta); target != "" {
+		if res, err = s.headSite(target); err != nil {
+			return nil, err
+		}
+	}
+	info := &SiteInfo{
+		Domain:       domain,
+		Size:         aws.Int64Value(res.ContentLength),
+		LastModified: aws.TimeValue(res.LastModified),
+		ETag:         aws.StringValue(res.ETag),
+		CertSHA256:   metadataValue(res.Metadata, certFingerprintMeta),
+	}
+	if v := metadataValue(res.Metadata, certNotAfterMeta); v != "" {
+		// Invalid values are left zero like missing ones.
+		info.CertNotAfter, _ = time.Parse(time.RFC3339, v)
+	}
+	return info, nil
+}
+
+// headSite returns the metadata of the site object of domain.
+func (s *S3Storage) headSite(domain string) (*s3.HeadObjectOutput, error) {
+	var res *s3.HeadObjectOutput
+	var err error
+	var loc *location
+	for _, loc = range s.siteLocations(domain) {
+		ctx, cancel := s.opContext()
+		res, err = loc.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &loc.bucket,
+			Key:    &loc.key,
+		})
+		cancel()
+		if !isNotFound(err) {
+			break
+		}
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return nil, caddytls.ErrNotExist(err)
+		}
+		return nil, s.storageError("HeadObject", loc.bucket, loc.key, err)
+	}
+	return res, nil
+}
+
+// siteNotAfter returns the expiry of the stored certificate of domain,
+// from its metadata or, for sites stored before it was recorded, by
+// parsing the certificate.
+func (s *S3Storage) siteNotAfter(domain string) (time.Time, error) {
+	info, err := s.StatSite(domain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !info.CertNotAfter.IsZero() {
+		return info.CertNotAfter, nil
+	}
+	data, err := s.LoadSite(domain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert, err := LeafCertificate(data.Cert)
+	if err != nil {
+		loc := s.routes.site(domain)
+		return time.Time{}, ErrCorruptData{Bucket: loc.bucket, Key: loc.key, Err: err}
+	}
+	return cert.NotAfter, nil
+}
+
+// ExpiringSite is a site whose certificate expires soon.
+type ExpiringSite struct {
+	Domain   string
+	NotAfter time.Time
+}
+
+// ExpiringSites returns the sites of the CA namespace whose certificates
+// expire within the given duration, including expired ones, ordered by
+// expiry. Renewals happen well ahead of expiry, so a site that's returned
+// for a window shorter than the renewal window isn't being renewed.
+// Expiry is read from the metadata of the sites, or by parsing the
+// certificates of sites stored before it was recorded. Sites whose
+// certificates can't be parsed are logged and skipped.
+func (s *S3Storage) ExpiringSites(within time.Duration) ([]ExpiringSite, error) {
+	deadline := s.now().Add(within)
+	var sites []ExpiringSite
+	it := s.IterSites("")
+	for it.Next() {
+		domain := it.Name()
+		notAfter, err := s.siteNotAfter(domain)
+		switch err.(type) {
+		case nil:
+		case caddytls.ErrNotExist:
+			// Deleted since it was listed.
+			continue
+		case ErrCorruptData:
+			s.log().Warnf("checking the expiry of %s: %s", domain, err)
+			continue
+		default:
+			return nil, err
+		}
+		if notAfter.Before(deadline) {
+			sites = append(sites, ExpiringSite{Domain: domain, NotAfter: notAfter})
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(sites, func(i, j int) bool {
+		return sites[i].NotAfter.Before(sites[j].NotAfter)
+	})
+	return sites, nil
+}
+
+// metadataValue returns the value of an object metadata key. Keys are
+// matched case insensitively since S3 compatible stores differ in how they
+// return them.
+func metadataValue(meta map[string]*string, key string) string {
+	if v, ok := meta[key]; ok {
+		return aws.StringValue(v)
+	}
+	key = http.CanonicalHeaderKey(key)
+	for k, v := range meta {
+		if http.CanonicalHeaderKey(k) == key {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// LeafCertificate parses the first certificate of a PEM encoded chain,
+// e.g. of SiteData.Cert.
+func LeafCertificate(pemData []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			return nil, errors.New("no certificate found in PEM data")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// certTagging returns the object tags of a site as the URL encoded
+// Tagging parameter of PutObject. The certificate tags are omitted if the
+// leaf certificate can't be parsed.
+func certTagging(domain string, pemData []byte) string {
+	tags := url.Values{domainTag: {tagValue(strings.ToLower(domain))}}
+	if cert, err := LeafCertificate(pemData); err == nil {
+		tags.Set(certNotAfterTag, cert.NotAfter.UTC().Format("2006-01-02"))
+		issuer := cert.Issuer.CommonName
+		if issuer == "" && len(cert.Issuer.Organization) != 0 {
+			issuer = cert.Issuer.Organization[0]
+		}
+		if issuer != "" {
+			tags.Set(certIssuerTag, tagValue(issuer))
+		}
+	}
+	return tags.Encode()
+}
+
+// tagValue replaces the characters S3 doesn't allow in tag values and
+// truncates the value to the maximum length.
+func tagValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune("_.:/=+-@", r) {
+			return r
+		}
+		return '_'
+	}, v)
+	if r := []rune(v); len(r) > maxTagValueLen {
+		v = string(r[:maxTagValueLen])
+	}
+	return v
+}
+
+// certMetadata returns the object metadata for the leaf certificate of a
+// PEM encoded chain, or nil if the certificate can't be parsed.
+func certMetadata(pemData []byte) map[string]*string {
+	cert, err := LeafCertificate(pemData)
+	if err != nil {
+		return nil
+	}
+	fp := sha256.Sum256(cert.Raw)
+	return map[string]*string{
+		certFingerprintMeta: aws.String(hex.EncodeToString(fp[:])),
+		certNotAfterMeta:    aws.String(cert.NotAfter.UTC().Format(time.RFC3339)),
+	}
+}
@@ -0,0 +1,65 @@
+package caddytlss3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// checksumMeta is the object metadata holding the SHA-256 of the object
+// contents, set on every write.
+const checksumMeta = "Payload-Sha256"
+
+// setChecksum adds the checksum of the body of in to its metadata. The
+// metadata map is copied since callers reuse it across writes.
+func setChecksum(in *s3.PutObjectInput) error {
+	if in.Body == nil {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, in.Body); err != nil {
+		return err
+	}
+	if _, err := in.Body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	meta := make(map[string]*string, len(in.Metadata)+1)
+	for k, v := range in.Metadata {
+		meta[k] = v
+	}
+	meta[checksumMeta] = aws.String(hex.EncodeToString(h.Sum(nil)))
+	in.Metadata = meta
+	return nil
+}
+
+// readObject reads and closes the body of a GetObject response, checks it
+// against the stored checksum, and decompresses it.
+func readObject(res *s3.GetObjectOutput, bucket, key string) ([]byte, error) {
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(bucket, key, res.Metadata, data); err != nil {
+		return nil, err
+	}
+	return decompress(bucket, key, res.Metadata, data)
+}
+
+// verifyChecksum checks data against the checksum in the object metadata.
+// Objects written before checksums were recorded aren't checked.
+func verifyChecksum(bucket, key string, meta map[string]*string, data []byte) error {
+	want := metadataValue(meta, checksumMeta)
+	if want == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != want {
+		return ErrCorruptData{Bucket: bucket, Key: key}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package caddytlss3
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestChecksum(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+	if err := storage.StoreUser("user@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	key := *storage.userKey("user@example.com")
+	if metadataValue(client.Metadata("bucket", key), checksumMeta) == "" {
+		t.Fatal("Expected a checksum in the object metadata")
+	}
+	if _, err := storage.LoadUser("user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partial body doesn't match the checksum.
+	b, _ := client.Object("bucket", key)
+	b = b[:len(b)-1]
+	client.SetObject("bucket", key, b, client.Metadata("bucket", key))
+	_, err := storage.LoadUser("user@example.com")
+	if e, ok := err.(ErrCorruptData); !ok || e.Key != key {
+		t.Fatalf("Expected ErrCorruptData for %s, got %v", key, err)
+	}
+
+	// Objects without a checksum aren't verified.
+	client.SetObject("bucket", key, b, nil)
+	if _, err := storage.LoadUser("user@example.com"); err == nil {
+		t.Fatal("Expected a decode error")
+	} else if e, ok := err.(ErrCorruptData); !ok || e.Err == nil {
+		t.Fatalf("Expected a decode error rather than a checksum mismatch, got %v", err)
+	}
+}
+
+// lostWriteS3 acknowledges writes without storing them.
+type lostWriteS3 struct {
+	*fakes.S3
+}
+
+func (lostWriteS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestVerifyWrites(t *testing.T) {
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket", WithWriteVerification())
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}
+	if err := storage.StoreSite("example.com", site); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.s3 = lostWriteS3{fakes.NewS3()}
+	if err := storage.StoreSite("example.com", site); err == nil {
+		t.Fatal("Expected an error for a write that can't be read back")
+	}
+}
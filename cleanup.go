@@ -0,0 +1,263 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// staleTempAge is how old a probe object written by Validate has to be to
+// be considered left behind. Validate deletes its probes right away.
+const staleTempAge = time.Hour
+
+// CleanUpReport lists the objects removed by CleanUp, or that would have
+// been removed in a dry run.
+type CleanUpReport struct {
+	// Sites are the domains whose certificates had expired.
+	Sites []string
+	// Locks are the names of lock objects whose lease had expired.
+	Locks []string
+	// TempObjects are the keys of probe objects left behind by Validate.
+	TempObjects []string
+	// Blobs are the keys of blobs of the shared layout that no site refers
+	// to anymore.
+	Blobs []string
+}
+
+// CleanUp deletes the sites of the CA namespace whose certificates expired
+// more than grace ago, lock objects whose lease expired more than a lease
+// ago, probe objects left behind by Validate, and blobs of the shared
+// layout that no site refers to. Sites are deleted with
+// DeleteSite while holding their lock, so a site that's being renewed is
+// skipped, and sites whose certificates can't be parsed are kept. CleanUp
+// continues after errors and returns the first one.
+func (s *S3Storage) CleanUp(grace time.Duration) (*CleanUpReport, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly{Op: "CleanUp", Name: s.bucket}
+	}
+	c := &cleanup{s: s, report: &CleanUpReport{}}
+	c.sites(s.now().Add(-grace))
+	if l, ok := s.locker.(*s3Locker); ok {
+		c.locks(l)
+	}
+	c.tempObjects()
+	c.blobs()
+	if c.errs != 0 {
+		return c.report, fmt.Errorf("S3Storage: cleanup failed for %d objects, first error: %s", c.errs, c.err)
+	}
+	return c.report, nil
+}
+
+// cleanup is the state of a CleanUp run.
+type cleanup struct {
+	s      *S3Storage
+	report *CleanUpReport
+	errs   int
+	err    error
+}
+
+func (c *cleanup) fail(what string, err error) {
+	c.s.log().Errorf("cleaning up %s: %s", what, err)
+	if c.errs == 0 {
+		c.err = err
+	}
+	c.errs++
+}
+
+// sites deletes the sites whose certificates expired before cutoff.
+func (c *cleanup) sites(cutoff time.Time) {
+	it := c.s.IterSites("")
+	for it.Next() {
+		domain := it.Name()
+		ok, err := c.expiredSite(domain, cutoff)
+		if err != nil {
+			c.fail(domain, err)
+			continue
+		}
+		if ok {
+			c.s.log().Infof("deleting %s, its certificate expired before %s", domain, cutoff.Format(time.RFC3339))
+			c.report.Sites = append(c.report.Sites, domain)
+		}
+	}
+	if err := it.Err(); err != nil {
+		c.fail("sites", err)
+	}
+}
+
+// expiredSite deletes the site of domain if its certificate expired before
+// cutoff, and returns whether it did.
+func (c *cleanup) expiredSite(domain string, cutoff time.Time) (bool, error) {
+	notAfter, err := c.s.siteNotAfter(domain)
+	if err != nil {
+		// Sites that can't be read or parsed aren't known to be garbage.
+		if _, ok := err.(caddytls.ErrNotExist); !ok {
+			c.s.log().Warnf("not cleaning up %s: %s", domain, err)
+		}
+		return false, nil
+	}
+	if !notAfter.Before(cutoff) {
+		return false, nil
+	}
+	w, err := c.s.TryLock(domain)
+	if err != nil {
+		return false, err
+	}
+	if w != nil {
+		c.s.log().Infof("not deleting %s, it's locked for renewal", domain)
+		return false, nil
+	}
+	defer c.s.Unlock(domain)
+	// It may have been renewed before the lock was obtained.
+	if notAfter, err = c.s.siteNotAfter(domain); err != nil || !notAfter.Before(cutoff) {
+		return false, nil
+	}
+	if err := c.s.DeleteSite(domain); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// locks deletes the lock objects whose lease expired more than a lease
+// ago, and released ones. Each is deleted with s3Locker.deleteStale, so a
+// lock taken over since it was read is kept. A holder that's merely slow
+// finds the lock gone when renewing it, and doesn't store its site like
+// after a takeover.
+func (c *cleanup) locks(l *s3Locker) {
+	prefix := c.s.prefix + "locks/"
+	keys, err := c.s.listKeys(c.s.s3, c.s.bucket, prefix)
+	if err != nil {
+		c.fail("locks", err)
+		return
+	}
+	cutoff := c.s.now().Add(-l.lease())
+	for _, o := range keys {
+		name := strings.TrimPrefix(aws.StringValue(o.Key), prefix)
+		info, etag, err := l.read(name)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			c.fail("lock "+name, err)
+			continue
+		}
+		if !info.Expires.Before(cutoff) {
+			continue
+		}
+		if c.s.skipDeletes() {
+			// Taking the lock over without deleting it would block
+			// other hosts for a lease.
+			c.s.log().Infof("dry run: DeleteObject %s", objectURL(c.s.bucket, aws.StringValue(o.Key)))
+			c.report.Locks = append(c.report.Locks, name)
+			continue
+		}
+		c.s.log().Infof("deleting lock for %s held by %s, which expired at %s", name, info.Owner, info.Expires)
+		deleted, err := l.deleteStale(name, info, etag)
+		if err != nil {
+			c.fail("lock "+name, err)
+			continue
+		}
+		if deleted {
+			c.report.Locks = append(c.report.Locks, name)
+		}
+	}
+}
+
+// tempObjects deletes probe objects left behind by Validate, e.g. after it
+// was interrupted or denied s3:DeleteObject.
+func (c *cleanup) tempObjects() {
+	cutoff := c.s.now().Add(-staleTempAge)
+	for _, loc := range c.s.routes.roots() {
+		keys, err := c.s.listKeys(loc.s3, loc.bucket, loc.prefix+"probe/")
+		if err != nil {
+			c.fail("probes in "+objectURL(loc.bucket, loc.prefix), err)
+			continue
+		}
+		c.deleteOld(loc, keys, cutoff, &c.report.TempObjects)
+	}
+}
+
+// blobs deletes the blobs of the shared layout that no site refers to.
+// Blobs younger than staleTempAge are kept since they may have been
+// written by a StoreSite that hasn't written the pointer yet.
+func (c *cleanup) blobs() {
+	used := make(map[string]bool)
+	it := c.s.IterSites("")
+	for it.Next() {
+		loc := c.s.routes.site(it.Name())
+		b, err := c.s.fetchObject(loc.s3, loc.bucket, loc.key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			// A blob in use could be deleted without knowing all pointers.
+			c.fail("blobs", err)
+			return
+		}
+		if alias, ok := parseSiteAlias(b); ok && alias.blob != "" {
+			used[loc.bucket+"/"+blobKey(loc, alias.blob)] = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		c.fail("blobs", err)
+		return
+	}
+	cutoff := c.s.now().Add(-staleTempAge)
+	for _, root := range c.s.routes.roots() {
+		prefix := caPrefix(root.prefix, c.s.ca) + "blob/"
+		keys, err := c.s.listKeys(root.s3, root.bucket, prefix)
+		if err != nil {
+			c.fail("blobs in "+objectURL(root.bucket, prefix), err)
+			continue
+		}
+		var unused []*s3.Object
+		for _, o := range keys {
+			if !used[root.bucket+"/"+aws.StringValue(o.Key)] {
+				unused = append(unused, o)
+			}
+		}
+		c.deleteOld(root, unused, cutoff, &c.report.Blobs)
+	}
+}
+
+// deleteOld deletes the objects in the bucket of loc that were last
+// modified before cutoff, and adds the keys of the deleted ones to report.
+func (c *cleanup) deleteOld(loc *location, objects []*s3.Object, cutoff time.Time, report *[]string) {
+	b := c.s.newDeleteBatch(loc.s3, loc.bucket, func(key string, err error) {
+		if err != nil {
+			c.fail(objectURL(loc.bucket, key), err)
+			return
+		}
+		*report = append(*report, key)
+	})
+	for _, o := range objects {
+		if !aws.TimeValue(o.LastModified).Before(cutoff) {
+			continue
+		}
+		if err := b.add(aws.StringValue(o.Key)); err != nil {
+			c.fail(objectURL(loc.bucket, ""), err)
+		}
+	}
+	if err := b.flush(); err != nil {
+		c.fail(objectURL(loc.bucket, ""), err)
+	}
+}
+
+// listKeys returns the objects under prefix.
+func (s *S3Storage) listKeys(client s3iface.S3API, bucket, prefix string) ([]*s3.Object, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	var objects []*s3.Object
+	err := client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	return objects, err
+}
@@ -0,0 +1,118 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestCleanUp(t *testing.T) {
+	client := fakes.NewS3()
+	// Objects written by the fake are modified now, so they're old enough
+	// for cleanup in two hours.
+	clock := &testClock{t: time.Now().Add(2 * time.Hour)}
+	storage := newFakeStorage(t, client, "cleanup-bucket", WithClock(clock))
+
+	for domain, notAfter := range map[string]time.Time{
+		"old.example.com":    clock.Now().Add(-60 * 24 * time.Hour),
+		"recent.example.com": clock.Now().Add(-24 * time.Hour),
+		"valid.example.com":  clock.Now().Add(30 * 24 * time.Hour),
+	} {
+		certPEM, keyPEM := testCertificate(t, []string{domain}, notAfter)
+		if err := storage.StoreSite(domain, &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.StoreSite("invalid.example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := json.Marshal(&lockInfo{Owner: "other", Expires: clock.Now().Add(-time.Hour)})
+	client.SetObject("cleanup-bucket", "acme/ca/locks/stale.example.com", stale, nil)
+	held, _ := json.Marshal(&lockInfo{Owner: "other", Expires: clock.Now().Add(time.Minute)})
+	client.SetObject("cleanup-bucket", "acme/ca/locks/held.example.com", held, nil)
+	client.SetObject("cleanup-bucket", "probe/probe-0123", []byte("probe"), nil)
+
+	report, err := storage.CleanUp(7 * 24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &CleanUpReport{
+		Sites:       []string{"old.example.com"},
+		Locks:       []string{"old.example.com", "stale.example.com"},
+		TempObjects: []string{"probe/probe-0123"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("Expected %+v, got %+v", want, report)
+	}
+	sites, err := storage.ListSites()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"invalid.example.com", "recent.example.com", "valid.example.com"}; !reflect.DeepEqual(sites, want) {
+		t.Errorf("Expected sites %v to remain, got %v", want, sites)
+	}
+	if _, ok := client.Object("cleanup-bucket", "acme/ca/locks/held.example.com"); !ok {
+		t.Error("Expected the held lock to remain")
+	}
+	if _, ok := client.Object("cleanup-bucket", "acme/ca/locks/old.example.com"); ok {
+		t.Error("Expected the lock taken for the deletion to be released")
+	}
+}
+
+func TestCleanUpLocked(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "cleanup-locked-bucket", WithClock(clock))
+	certPEM, keyPEM := testCertificate(t, []string{"renewing.example.com"}, clock.Now().Add(-60*24*time.Hour))
+	if err := storage.StoreSite("renewing.example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+	// Another host is renewing it.
+	held, _ := json.Marshal(&lockInfo{Owner: "other", Expires: clock.Now().Add(time.Minute)})
+	client.SetObject("cleanup-locked-bucket", "acme/ca/locks/renewing.example.com", held, nil)
+
+	report, err := storage.CleanUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sites) != 0 {
+		t.Errorf("Expected the locked site to be kept, got %v", report.Sites)
+	}
+
+	storage.readOnly = true
+	if _, err := storage.CleanUp(0); err == nil {
+		t.Error("Expected read-only storage to refuse cleaning up")
+	}
+}
+
+func TestCleanUpLockTakenOver(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "cleanup-lock-bucket", WithClock(clock))
+	l := &s3Locker{s: storage, ttl: time.Minute}
+	storage.locker = l
+
+	stale, _ := json.Marshal(&lockInfo{Owner: "other", Created: clock.Now().Add(-time.Hour), Expires: clock.Now().Add(-time.Hour), Fence: 1})
+	client.SetObject("cleanup-lock-bucket", "acme/ca/locks/example.com", stale, nil)
+	info, etag, err := l.read("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another host takes the lock over after it was read.
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("Expected to take the stale lock over, got %v, %v", w, err)
+	}
+	if deleted, err := l.deleteStale("example.com", info, etag); err != nil || deleted {
+		t.Fatalf("Expected the lock taken over to be kept, got %v, %v", deleted, err)
+	}
+	if lockReleased(t, client, "cleanup-lock-bucket", "acme/ca/locks/example.com") {
+		t.Error("Expected the lock to still be held")
+	}
+	if err := storage.Unlock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
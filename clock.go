@@ -0,0 +1,80 @@
+package caddytlss3
+
+import "time"
+
+// Clock provides the current time, and the timers and tickers of lock
+// heartbeats and waits. Decisions based on the time (lock and cache
+// expiry, domain rate limits, timestamps) and the lock timers go through
+// it so they can be controlled in tests. Other waiting happens in real
+// time, so the timers and sleeps of retries, request rate limiting, and
+// watching for changes, and the durations measured around requests, use
+// the time package.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a Timer which fires once d has passed.
+	NewTimer(d time.Duration) Timer
+	// NewTicker returns a Ticker which fires every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer of a Clock, like a time.Timer.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+	// Stop stops the timer, and returns false if it already fired or was
+	// stopped.
+	Stop() bool
+}
+
+// Ticker is a ticker of a Clock, like a time.Ticker.
+type Ticker interface {
+	// C returns the channel the time is sent on at every tick.
+	C() <-chan time.Time
+	// Stop stops the ticker.
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+func (s *S3Storage) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+func (s *S3Storage) newTimer(d time.Duration) Timer {
+	if s.clock == nil {
+		return systemClock{}.NewTimer(d)
+	}
+	return s.clock.NewTimer(d)
+}
+
+func (s *S3Storage) newTicker(d time.Duration) Ticker {
+	if s.clock == nil {
+		return systemClock{}.NewTicker(d)
+	}
+	return s.clock.NewTicker(d)
+}
@@ -0,0 +1,431 @@
+// Command caddytls-s3ctl inspects and manages the certificates and accounts
+// that Caddy stores in S3, using the same configuration as Caddy: the
+// CADDY_S3_* environment variables, with the bucket, prefix, and CA
+// optionally given as flags.
+//
+// Usage:
+//
+//	caddytls-s3ctl [flags] ls [-users]
+//	caddytls-s3ctl [flags] show [-pem] <domain>
+//	caddytls-s3ctl [flags] export [-json] [-o file]
+//	caddytls-s3ctl [flags] import [file]
+//	caddytls-s3ctl [flags] import -cert file -key file <domain>
+//	caddytls-s3ctl [flags] rm <domain>...
+//	caddytls-s3ctl [flags] cleanup [-grace duration]
+//	caddytls-s3ctl [flags] purge -yes
+//	caddytls-s3ctl [flags] doctor
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3"
+)
+
+const defaultCA = "https://acme-v02.api.letsencrypt.org/directory"
+
+// stdout is where commands write their output.
+var stdout io.Writer = os.Stdout
+
+// expiryWarning is how far ahead doctor warns about expiring certificates.
+const expiryWarning = 14 * 24 * time.Hour
+
+type command struct {
+	run   func(s *caddytlss3.S3Storage, args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"ls":      {list, "ls [-users]: list stored sites with their expiry, or accounts"},
+	"show":    {show, "show [-pem] <domain>: describe the certificate of a site"},
+	"export":  {export, "export [-json] [-o file]: write all sites as a tar.gz, or sites and accounts as JSON"},
+	"import":  {importData, "import [file] | -cert file -key file <domain>: store an export, or a certificate and key"},
+	"rm":      {remove, "rm <domain>...: delete sites"},
+	"cleanup": {cleanUp, "cleanup [-grace duration]: delete expired sites, stale locks, and leftover probe objects"},
+	"purge":   {purge, "purge -yes: delete every object under the prefix, in all CA namespaces"},
+	"doctor":  {doctor, "doctor: check access to the bucket and the stored certificates"},
+}
+
+func main() {
+	flag.Usage = usage
+	bucket := flag.String("bucket", "", "bucket, instead of CADDY_S3_BUCKET")
+	prefix := flag.String("prefix", "", "key prefix, instead of CADDY_S3_PREFIX")
+	ca := flag.String("ca", defaultCA, "ACME directory URL of the CA")
+	flag.Parse()
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	cfg, err := config(*ca, *bucket, *prefix)
+	if err != nil {
+		fatal(err)
+	}
+	s, err := caddytlss3.NewS3StorageWithConfig(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	err = cmd.run(s, flag.Args()[1:])
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: caddytls-s3ctl [flags] <command> [args]\n\ncommands:\n")
+	for _, name := range []string{"ls", "show", "export", "import", "rm", "cleanup", "purge", "doctor"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "caddytls-s3ctl: %s\n", err)
+	os.Exit(1)
+}
+
+// config returns the configuration Caddy uses for the CA, with the bucket
+// and prefix of the flags if set.
+func config(ca, bucket, prefix string) (caddytlss3.Config, error) {
+	u, err := url.Parse(ca)
+	if err != nil || u.Host == "" {
+		return caddytlss3.Config{}, fmt.Errorf("invalid CA URL %q", ca)
+	}
+	cfg, err := caddytlss3.ConfigFromEnv(u)
+	if err != nil {
+		return caddytlss3.Config{}, err
+	}
+	if bucket != "" {
+		cfg.Bucket = bucket
+	}
+	if prefix != "" {
+		cfg.Prefix = prefix
+	}
+	if cfg.Bucket == "" {
+		return caddytlss3.Config{}, errors.New("no bucket, set -bucket or CADDY_S3_BUCKET")
+	}
+	// Validation writes a probe object, which only doctor should do.
+	cfg.SkipValidate = true
+	return cfg, nil
+}
+
+func list(s *caddytlss3.S3Storage, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	users := fs.Bool("users", false, "list accounts instead of sites")
+	fs.Parse(args)
+	if *users {
+		emails, err := s.ListUsers()
+		if err != nil {
+			return err
+		}
+		recent := s.MostRecentUserEmail()
+		for _, email := range emails {
+			if strings.EqualFold(email, recent) {
+				email += " (most recent)"
+			}
+			fmt.Fprintln(stdout, email)
+		}
+		return nil
+	}
+	domains, err := s.ListSites()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tEXPIRES\tMODIFIED")
+	for _, domain := range domains {
+		info, err := s.StatSite(domain)
+		if err != nil {
+			return err
+		}
+		expires := "-"
+		if !info.CertNotAfter.IsZero() {
+			expires = info.CertNotAfter.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", domain, expires, info.LastModified.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func show(s *caddytlss3.S3Storage, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	printPEM := fs.Bool("pem", false, "print the certificate chain")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("show takes a domain")
+	}
+	domain := fs.Arg(0)
+	info, err := s.StatSite(domain)
+	if err != nil {
+		return err
+	}
+	data, err := s.LoadSite(domain)
+	if err != nil {
+		return err
+	}
+	if *printPEM {
+		_, err := stdout.Write(data.Cert)
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Domain:\t%s\n", domain)
+	fmt.Fprintf(w, "Modified:\t%s\n", info.LastModified.Format(time.RFC3339))
+	fmt.Fprintf(w, "Size:\t%d\n", info.Size)
+	cert, err := caddytlss3.LeafCertificate(data.Cert)
+	if err != nil {
+		fmt.Fprintf(w, "Certificate:\t%s\n", err)
+		return w.Flush()
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fmt.Fprintf(w, "Subject:\t%s\n", cert.Subject)
+	fmt.Fprintf(w, "Names:\t%s\n", strings.Join(cert.DNSNames, ", "))
+	fmt.Fprintf(w, "Issuer:\t%s\n", cert.Issuer)
+	fmt.Fprintf(w, "Not before:\t%s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "Not after:\t%s\n", cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(w, "SHA-256:\t%s\n", hex.EncodeToString(sum[:]))
+	fmt.Fprintf(w, "Key:\t%s\n", keyDescription(data.Key))
+	return w.Flush()
+}
+
+// dump is the format of export and import.
+type dump struct {
+	Sites map[string]*caddytls.SiteData `json:"sites"`
+	Users map[string]*caddytls.UserData `json:"users"`
+}
+
+func export(s *caddytlss3.S3Storage, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "output file instead of stdout")
+	asJSON := fs.Bool("json", false, "write sites and accounts as JSON for import")
+	fs.Parse(args)
+	var w io.Writer = stdout
+	if *out != "" {
+		// The export contains private keys.
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if !*asJSON {
+		return s.Export(w)
+	}
+	d := dump{
+		Sites: make(map[string]*caddytls.SiteData),
+		Users: make(map[string]*caddytls.UserData),
+	}
+	domains, err := s.ListSites()
+	if err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		if d.Sites[domain], err = s.LoadSite(domain); err != nil {
+			return fmt.Errorf("%s: %s", domain, err)
+		}
+	}
+	emails, err := s.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, email := range emails {
+		if d.Users[email], err = s.LoadUser(email); err != nil {
+			return fmt.Errorf("%s: %s", email, err)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d sites and %d accounts\n", len(d.Sites), len(d.Users))
+	return nil
+}
+
+func importData(s *caddytlss3.S3Storage, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	certFile := fs.String("cert", "", "PEM certificate chain to import for the domain")
+	keyFile := fs.String("key", "", "PEM private key of the certificate")
+	fs.Parse(args)
+	if *certFile != "" || *keyFile != "" {
+		if *certFile == "" || *keyFile == "" || fs.NArg() != 1 {
+			return errors.New("import -cert and -key take a domain")
+		}
+		certPEM, err := ioutil.ReadFile(*certFile)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		return s.ImportSite(fs.Arg(0), certPEM, keyPEM)
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	if fs.NArg() > 1 {
+		return errors.New("import takes at most one file")
+	} else if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = bufio.NewReader(f)
+	}
+	// Archives written by export start with the gzip magic number, JSON
+	// exports with a brace.
+	if magic, _ := r.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return s.Import(r)
+	}
+	var d dump
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return fmt.Errorf("reading export: %s", err)
+	}
+	for domain, data := range d.Sites {
+		if err := s.StoreSite(domain, data); err != nil {
+			return fmt.Errorf("%s: %s", domain, err)
+		}
+	}
+	for email, data := range d.Users {
+		if err := s.StoreUser(email, data); err != nil {
+			return fmt.Errorf("%s: %s", email, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "imported %d sites and %d accounts\n", len(d.Sites), len(d.Users))
+	return nil
+}
+
+func remove(s *caddytlss3.S3Storage, args []string) error {
+	if len(args) == 0 {
+		return errors.New("rm takes one or more domains")
+	}
+	for _, domain := range args {
+		if err := s.DeleteSite(domain); err != nil {
+			return fmt.Errorf("%s: %s", domain, err)
+		}
+	}
+	return nil
+}
+
+func cleanUp(s *caddytlss3.S3Storage, args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	grace := fs.Duration("grace", 30*24*time.Hour, "how long after expiry sites are deleted")
+	fs.Parse(args)
+	report, err := s.CleanUp(*grace)
+	if report != nil {
+		for _, domain := range report.Sites {
+			fmt.Fprintf(stdout, "deleted site %s\n", domain)
+		}
+		for _, name := range report.Locks {
+			fmt.Fprintf(stdout, "deleted lock %s\n", name)
+		}
+		for _, key := range report.TempObjects {
+			fmt.Fprintf(stdout, "deleted %s\n", key)
+		}
+		for _, key := range report.Blobs {
+			fmt.Fprintf(stdout, "deleted unused blob %s\n", key)
+		}
+	}
+	return err
+}
+
+func purge(s *caddytlss3.S3Storage, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "confirm deleting all certificates and accounts")
+	fs.Parse(args)
+	if !*yes {
+		return errors.New("purge deletes all certificates and accounts under the prefix, pass -yes to confirm")
+	}
+	return s.Purge()
+}
+
+func doctor(s *caddytlss3.S3Storage, args []string) error {
+	ok := true
+	check := func(name string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Fprintf(stdout, "FAIL %s: %s\n", name, err)
+		} else {
+			fmt.Fprintf(stdout, "ok   %s\n", name)
+		}
+	}
+	check("bucket access", s.Validate())
+	namespaces, err := s.CANamespaces()
+	check("list CA namespaces", err)
+	if err == nil {
+		fmt.Fprintf(stdout, "     CA namespaces: %s\n", strings.Join(namespaces, ", "))
+	}
+	domains, err := s.ListSites()
+	check("list sites", err)
+	now := time.Now()
+	for _, domain := range domains {
+		info, err := s.StatSite(domain)
+		if err != nil {
+			check(domain, err)
+			continue
+		}
+		notAfter := info.CertNotAfter
+		if notAfter.IsZero() {
+			// The site was stored before certificate metadata was
+			// recorded.
+			data, err := s.LoadSite(domain)
+			var cert *x509.Certificate
+			if err == nil {
+				cert, err = caddytlss3.LeafCertificate(data.Cert)
+			}
+			if err != nil {
+				check(domain, err)
+				continue
+			}
+			notAfter = cert.NotAfter
+		}
+		switch {
+		case notAfter.Before(now):
+			check(domain, fmt.Errorf("certificate expired %s", notAfter.Format(time.RFC3339)))
+		case notAfter.Before(now.Add(expiryWarning)):
+			check(domain, fmt.Errorf("certificate expires %s", notAfter.Format(time.RFC3339)))
+		default:
+			check(domain, nil)
+		}
+	}
+	if !ok {
+		return errors.New("problems found")
+	}
+	return nil
+}
+
+// keyDescription describes the type of a PEM encoded private key.
+func keyDescription(keyPEM []byte) string {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return "invalid"
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return "RSA"
+	case "EC PRIVATE KEY":
+		return "ECDSA"
+	}
+	return strings.ToLower(block.Type)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// testStorage returns a storage on a fake bucket with a site stored for
+// example.com, and captures the output of commands until the test ends.
+func testStorage(t *testing.T) (*caddytlss3.S3Storage, *bytes.Buffer, time.Time) {
+	t.Helper()
+	s, err := caddytlss3.NewS3StorageWithClient(fakes.NewS3(), "bucket", "caddy", caddytlss3.WithCA("ca"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second).UTC()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "www.example.com"},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreSite("example.com", &caddytls.SiteData{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	stdout = &out
+	t.Cleanup(func() { stdout = os.Stdout })
+	return s, &out, notAfter
+}
+
+func TestList(t *testing.T) {
+	s, out, notAfter := testStorage(t)
+	if err := list(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "DOMAIN") {
+		t.Fatalf("Expected a header and one site, got %q", out.String())
+	}
+	if f := strings.Fields(lines[1]); len(f) != 3 || f[0] != "example.com" || f[1] != notAfter.Format(time.RFC3339) {
+		t.Errorf("Unexpected site line %q", lines[1])
+	}
+}
+
+func TestShow(t *testing.T) {
+	s, out, notAfter := testStorage(t)
+	if err := show(s, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			fields[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	for name, want := range map[string]string{
+		"Domain":    "example.com",
+		"Names":     "example.com, www.example.com",
+		"Not after": notAfter.Format(time.RFC3339),
+		"Key":       "ECDSA",
+	} {
+		if fields[name] != want {
+			t.Errorf("Expected %s %q, got %q", name, want, fields[name])
+		}
+	}
+
+	out.Reset()
+	if err := show(s, []string{"-pem", "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "-----BEGIN CERTIFICATE-----") {
+		t.Errorf("Expected the certificate chain, got %q", out.String())
+	}
+
+	if err := show(s, []string{"missing.example.com"}); err == nil {
+		t.Error("Expected an error for a missing site")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer os.Setenv("CADDY_S3_BUCKET", os.Getenv("CADDY_S3_BUCKET"))
+	os.Setenv("CADDY_S3_BUCKET", "")
+
+	if _, err := config(defaultCA, "", ""); err == nil {
+		t.Error("Expected an error without a bucket")
+	}
+	cfg, err := config(defaultCA, "flag-bucket", "flag/prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Bucket != "flag-bucket" || cfg.Prefix != "flag/prefix" || !cfg.SkipValidate {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+	if _, err := config("not a URL", "bucket", ""); err == nil {
+		t.Error("Expected an error for an invalid CA URL")
+	}
+}
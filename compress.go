@@ -0,0 +1,83 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Compression formats of stored objects.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+)
+
+// compressionMeta is the object metadata key recording the compression of
+// the object contents. It's kept out of the Content-Encoding header, which
+// HTTP clients may decode on their own.
+const compressionMeta = "Payload-Encoding"
+
+// compressMinSize is the size below which objects aren't compressed since
+// they'd hardly get smaller.
+const compressMinSize = 512
+
+// compress compresses the body of in with the configured compression and
+// records it in the object metadata. The metadata map is copied since
+// callers reuse it across writes.
+func (s *S3Storage) compress(in *s3.PutObjectInput) error {
+	if s.compression == CompressionNone || in.Body == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return err
+	}
+	if len(data) < compressMinSize {
+		_, err := in.Body.Seek(0, io.SeekStart)
+		return err
+	}
+	if in.ContentType == nil {
+		in.ContentType = aws.String(contentType(data))
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	in.Body = bytes.NewReader(buf.Bytes())
+	in.ContentLength = aws.Int64(int64(buf.Len()))
+	meta := make(map[string]*string, len(in.Metadata)+1)
+	for k, v := range in.Metadata {
+		meta[k] = v
+	}
+	meta[compressionMeta] = aws.String(s.compression)
+	in.Metadata = meta
+	return nil
+}
+
+// decompress returns the contents of an object given its metadata.
+// Objects written without compression are returned as is.
+func decompress(bucket, key string, meta map[string]*string, data []byte) ([]byte, error) {
+	switch enc := metadataValue(meta, compressionMeta); enc {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, ErrCorruptData{Bucket: bucket, Key: key, Err: err}
+		}
+		out, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, ErrCorruptData{Bucket: bucket, Key: key, Err: err}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("S3Storage: s3://%s/%s has unsupported compression %q", bucket, key, enc)
+	}
+}
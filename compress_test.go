@@ -0,0 +1,57 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestCompression(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+
+	// Sites stored before compression was enabled remain readable.
+	chain := bytes.Repeat([]byte("-----BEGIN CERTIFICATE-----\n"), 100)
+	if err := storage.StoreSite("legacy.example.com", &caddytls.SiteData{Cert: chain, Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.compression = CompressionGzip
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: chain, Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	key := "acme/ca/domain/example.com"
+	if enc := metadataValue(client.Metadata("bucket", key), compressionMeta); enc != CompressionGzip {
+		t.Fatalf("Expected gzip compression to be recorded, got %q", enc)
+	}
+	stored, _ := client.Object("bucket", key)
+	if len(stored) >= len(chain) {
+		t.Errorf("Expected the stored object to be compressed, got %d bytes", len(stored))
+	}
+	for _, domain := range []string{"example.com", "legacy.example.com"} {
+		data, err := storage.LoadSite(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data.Cert, chain) {
+			t.Errorf("%s: expected the stored certificate", domain)
+		}
+	}
+
+	// Small objects aren't compressed.
+	if err := storage.StoreUser("user@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if enc := metadataValue(client.Metadata("bucket", *storage.userKey("user@example.com")), compressionMeta); enc != "" {
+		t.Errorf("Expected a small object not to be compressed, got %q", enc)
+	}
+
+	// Truncated compressed data is corrupt.
+	if _, err := decompress("bucket", key, client.Metadata("bucket", key), stored[:len(stored)/2]); err == nil {
+		t.Error("Expected an error for truncated data")
+	} else if _, ok := err.(ErrCorruptData); !ok {
+		t.Errorf("Expected ErrCorruptData, got %v", err)
+	}
+}
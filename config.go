@@ -0,0 +1,1128 @@
+package caddytlss3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server side encryption modes.
+const (
+	SSEAES256   = "AES256"  // S3 managed keys (the default)
+	SSEKMS      = "aws:kms" // KMS, using KMSKeyID or the AWS managed key
+	SSECustomer = "sse-c"   // customer provided key, using SSECustomerKey
+	SSENone     = "none"    // for S3 compatible stores without encryption support
+)
+
+// objectACLs are the canned ACLs objects can be written with. None of
+// them grant access beyond the writer and the bucket owner.
+var objectACLs = map[string]bool{
+	s3.ObjectCannedACLPrivate:                true,
+	s3.ObjectCannedACLBucketOwnerRead:        true,
+	s3.ObjectCannedACLBucketOwnerFullControl: true,
+}
+
+// storageClasses are the storage classes objects can be stored with. All of
+// them can be read immediately.
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+}
+
+// Config is the configuration of a storage instance. Only Bucket is
+// required. Caddy builds the configuration from the storage URL and the
+// CADDY_S3_* environment variables, while programs embedding the storage
+// use NewS3StorageWithConfig.
+type Config struct {
+	Bucket string
+	// Prefix is prepended to all keys.
+	Prefix string
+	// CA is the namespace for the data of an ACME CA, usually derived from
+	// its directory URL by CANamespace.
+	CA string
+	// LegacyCA is the namespace the data of the CA was stored in by
+	// previous versions, if it differs from CA. Sites and accounts missing
+	// from CA are read from there and imported.
+	LegacyCA string
+
+	// Region of the bucket. When empty the region from the AWS environment
+	// is used, or the region of the bucket is detected.
+	Region string
+	// Endpoint is the URL of an S3 compatible object store to use instead
+	// of AWS, e.g. MinIO or DigitalOcean Spaces.
+	Endpoint       string
+	ForcePathStyle bool
+	// Accelerate uses S3 Transfer Acceleration endpoints, which must be
+	// enabled on the bucket, for hosts far from the bucket's region.
+	Accelerate bool
+	// DualStack uses S3 endpoints reachable over IPv6 as well as IPv4.
+	DualStack bool
+	// Partition is the AWS partition of the bucket (aws, aws-cn, or
+	// aws-us-gov), used to detect its region when none is set. It's
+	// derived from the region otherwise.
+	Partition string
+	// FIPS uses FIPS 140-2 validated endpoints for all AWS requests.
+	FIPS bool
+
+	// SSE is the server side encryption mode: SSEAES256 (the default),
+	// SSEKMS, SSECustomer, or SSENone.
+	SSE      string
+	KMSKeyID string
+	// SSECustomerKey is the 256-bit key of SSECustomer, sent with every
+	// request that reads or writes an object so S3 never stores it. All
+	// objects must be written with the same key, including those written
+	// before switching to SSECustomer, which are otherwise unreadable.
+	SSECustomerKey []byte
+	// StorageClass is the storage class of site, user, and certmagic
+	// objects: STANDARD (the default), STANDARD_IA, ONEZONE_IA, or
+	// INTELLIGENT_TIERING. Short lived lock objects are always STANDARD.
+	StorageClass string
+	// Compression compresses stored objects: CompressionNone (the default)
+	// or CompressionGzip. Site data with full chains shrinks to about half.
+	// It's recorded in the object metadata, so objects are read whatever
+	// the compression they were written with, but hosts that predate it
+	// can't read compressed objects. Readable copies aren't compressed.
+	Compression string
+	// DisableTagging disables the domain and certificate tags of site
+	// objects, for S3 compatible stores without tagging support. Tagging
+	// requires the s3:PutObjectTagging permission.
+	DisableTagging bool
+	// ACL is the canned ACL of written objects: private,
+	// bucket-owner-read, or bucket-owner-full-control, which gives the
+	// owner of a bucket in another account access to the objects. It
+	// requires the s3:PutObjectAcl permission. When empty no ACL is sent,
+	// which is required for buckets with ACLs disabled; their objects are
+	// owned by the bucket owner anyway.
+	ACL string
+	// RequesterPays accepts the charges of requests to buckets with
+	// requester pays enabled, e.g. a bucket shared by another account.
+	RequesterPays bool
+	// AssumeExistsOnDenied makes SiteExists report a site whose existence
+	// check was denied as existing, with a warning, instead of failing.
+	// Without s3:ListBucket S3 denies requests for missing objects rather
+	// than reporting them missing, so this only helps when the bucket
+	// policy grants s3:GetObject but not s3:ListBucket.
+	AssumeExistsOnDenied bool
+	// SharedAccounts stores ACME accounts outside of the CA namespaces, by
+	// the thumbprint of their key, so they're kept when the CA directory
+	// URL changes, e.g. from Let's Encrypt's v01 to its v02 API. Site data
+	// remains in the CA namespace. Accounts of the CA namespace are shared
+	// when they're first loaded, and remain in place for hosts that don't
+	// share accounts.
+	SharedAccounts bool
+	// SiteLayout is how site data is stored: SiteLayoutJSON (the default),
+	// SiteLayoutSplit, or SiteLayoutShared. All hosts sharing a bucket must
+	// use the same layout. Sites stored in the JSON layout remain readable
+	// after switching to another layout. Recovery of corrupted site data from
+	// previous versions only applies to the JSON layout.
+	SiteLayout string
+	// VerifyWrites reads site data back after StoreSite writes it and
+	// fails the store unless the stored object matches, retrying a few
+	// times.
+	VerifyWrites bool
+	// KeySecretPrefix stores the private keys of sites and accounts in AWS
+	// Secrets Manager, in secrets named with this prefix followed by the
+	// bucket and object key, while certificates and metadata stay in S3.
+	// This requires the secretsmanager:CreateSecret, PutSecretValue,
+	// GetSecretValue, DeleteSecret, and RestoreSecret permissions on the
+	// secrets. Keys stored before are read from S3 until they're stored
+	// again. Deleted keys can be restored during the recovery window of
+	// Secrets Manager.
+	KeySecretPrefix string
+	// KeySecretKMSKeyID is the KMS key new secrets are encrypted with, by
+	// default the AWS managed key of Secrets Manager.
+	KeySecretKMSKeyID string
+
+	// EventTopicARN is an SNS topic and EventBus an EventBridge event bus
+	// (name or ARN) that an Event is published to whenever StoreSite,
+	// DeleteSite, or StoreUser succeeds. Failing to publish an event only
+	// logs an error. SNS messages have an "action" attribute for
+	// subscription filters; EventBridge events have the source
+	// "caddytlss3" and the action as their detail type.
+	EventTopicARN string
+	EventBus      string
+	// InvalidationQueueURL is an SQS queue of this host, subscribed to the
+	// event topic or bus of all hosts, that is consumed in the background
+	// to evict cached site and user data as soon as another host changes
+	// it instead of after the cache TTL. OnInvalidate, if set, is called
+	// with the domain of every changed site, e.g. to reload the
+	// certificate.
+	InvalidationQueueURL string
+	OnInvalidate         func(domain string)
+	// WatchInterval polls the listing of the sites of the CA namespace at
+	// this interval instead, to evict the sites changed by other hosts or
+	// operators. It costs a list request per thousand sites per poll, and
+	// doesn't need SNS or SQS. OnWatchChange, if set, is called with the
+	// domain of every changed site it finds.
+	WatchInterval time.Duration
+	OnWatchChange func(domain string)
+
+	// Credentials override the default AWS credential chain.
+	Credentials *credentials.Credentials
+	// RoleChain is a list of IAM role ARNs assumed in order.
+	RoleChain []string
+	// ExternalID is passed when assuming the last role of the chain, which
+	// is usually the role in the account that owns the bucket.
+	ExternalID string
+	// RoleSessionName identifies the role sessions in CloudTrail,
+	// "caddy-s3-storage" by default.
+	RoleSessionName string
+	// RequireIMDSv2 disables the fallback to IMDSv1 when reading EC2
+	// instance role credentials, for instances with HttpTokens=required,
+	// and fails construction if no credentials can be resolved. IMDSv2
+	// token responses are limited by the hop limit of the instance
+	// (HttpPutResponseHopLimit), which must be at least 2 for Caddy in a
+	// container.
+	RequireIMDSv2 bool
+	// HTTPClient is used for all AWS requests when set.
+	HTTPClient *http.Client
+	// HTTP configures the default HTTP client instead.
+	HTTP HTTPSettings
+	// Retry configures retries of transient AWS errors (throttling, 5xx,
+	// and connection failures) with exponential backoff and jitter.
+	Retry RetryPolicy
+	// Retryer replaces the retry policy for AWS requests when set.
+	Retryer request.Retryer
+
+	DryRun bool
+	// DryRunDeletes only logs the deletes of DeleteSite, DeleteUser, and
+	// cleanups, like DryRun, but performs writes.
+	DryRunDeletes bool
+	// ReadOnly serves certificates and accounts from the bucket without
+	// ever writing to it: stores and deletes return ErrReadOnly and locks
+	// are skipped, so edge hosts can serve what a control node issues.
+	ReadOnly      bool
+	Readable      bool
+	CreateBucket  bool
+	VerifyPrivate bool
+	// SkipValidate disables the access check of Validate at construction.
+	SkipValidate bool
+
+	// CacheTTL enables the read-through cache of site and user data for
+	// LoadSite and LoadUser. Data written by other hosts is seen after at
+	// most CacheTTL.
+	CacheTTL time.Duration
+	// NegativeCacheTTL enables caching that a site doesn't exist for
+	// LoadSite, to save requests when clients ask for names without
+	// certificates, e.g. with on-demand TLS. StoreSite on this host is seen
+	// immediately, while sites stored by other hosts are seen after at
+	// most NegativeCacheTTL.
+	NegativeCacheTTL time.Duration
+	// WildcardFallback serves a domain without a site from the wildcard
+	// certificate of its parent domain, e.g. www.example.com from
+	// *.example.com, if the certificate is valid for it. An alias of the
+	// wildcard site is stored for the domain so later loads don't miss.
+	WildcardFallback bool
+	// CacheDir additionally caches data on disk so it survives restarts.
+	// The files contain private keys and are only readable by the user.
+	CacheDir string
+
+	// MirrorDir keeps a copy of site data on disk that LoadSite falls back
+	// to when S3 is unavailable. The files contain private keys and are
+	// only readable by the user.
+	MirrorDir string
+	// MirrorMaxAge is the maximum age of mirrored data that is used, zero
+	// for no limit.
+	MirrorMaxAge time.Duration
+	// Prefetch loads all stored sites into the cache and the disk mirror
+	// in the background after construction, this many at a time, so the
+	// first handshakes after a deploy don't wait for S3. Zero disables
+	// it. It requires CacheTTL or MirrorDir.
+	Prefetch int
+
+	// ReplicaBucket is a replica of Bucket, usually in another region and
+	// kept up to date by S3 cross-region replication, that site and user
+	// data is read from when reading from Bucket fails or takes longer
+	// than ReplicaTimeout. Writes always go to Bucket. Buckets of routes
+	// have no replica.
+	ReplicaBucket string
+	// ReplicaRegion is the region of ReplicaBucket, by default the region
+	// of Bucket.
+	ReplicaRegion  string
+	ReplicaTimeout time.Duration
+
+	// MigrateDir is the root of Caddy's file storage ($CADDYPATH/acme).
+	// When set, sites and accounts that aren't in S3 are read from there
+	// and imported. See Migrate.
+	MigrateDir string
+
+	Routes []*RouteRule
+	// Limits caps the S3 requests of the process.
+	Limits RequestLimits
+	// DomainRateLimit is the number of writes allowed per domain every
+	// DomainRateInterval. Zero disables the limit.
+	DomainRateLimit    int
+	DomainRateInterval time.Duration
+	// AccountKeyTypes is the order in which accounts are looked up by key
+	// type, "ecdsa" and "rsa" by default.
+	AccountKeyTypes []string
+
+	// Lock is the distributed lock mode: "s3" (the default), "dynamodb",
+	// or "local".
+	Lock      string
+	LockTable string
+	LockTTL   time.Duration
+	// LockWait is how long a Waiter returned by TryLock waits for a lock
+	// held by another goroutine or host before giving up, so a stuck
+	// issuance doesn't block everyone else. Zero waits until the lock is
+	// released or, for distributed locks, its lease expires.
+	LockWait time.Duration
+	// LeaderElection elects one of the hosts sharing the CA namespace as
+	// leader, using a lease in the distributed lock backend. Only the
+	// leader renews stored certificates; the other hosts load them once
+	// renewed, which avoids duplicate ACME orders in large fleets. Names
+	// without stored site data are issued by any host.
+	LeaderElection bool
+
+	// Context is the parent context of all AWS operations. Canceling it
+	// aborts operations in flight, e.g. on shutdown.
+	Context context.Context
+	// Timeout bounds each AWS operation including retries, 30s by default.
+	Timeout time.Duration
+
+	// Logger receives log messages, which are discarded by default. See
+	// StdLogger to write them to the standard logger.
+	Logger Logger
+	// TracerProvider provides the tracer of the spans of S3 requests, by
+	// default the global provider of otel.
+	TracerProvider trace.TracerProvider
+	// XRay instruments the S3 client with the X-Ray SDK, so S3 requests
+	// are subsegments of the X-Ray segment of the operation's context.
+	// Requests without a segment, e.g. of background renewals, are
+	// handled by the SDK's context missing strategy.
+	XRay bool
+	// AuditLog records site and account changes and lock takeovers as
+	// objects under "audit/" in the bucket, see AuditRecord.
+	AuditLog bool
+
+	Clock Clock
+
+	// client is used for S3 requests instead of a client built from the
+	// AWS session, see NewS3StorageWithClient.
+	client s3iface.S3API
+	// flat keeps the data of the storage, including locks, directly under
+	// Prefix instead of in the CA namespace, see NewCertmagicStorage.
+	flat bool
+}
+
+// roleSessionNameRE matches the role session names accepted by STS.
+var roleSessionNameRE = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// secretPrefixRE matches the characters allowed in secret names.
+var secretPrefixRE = regexp.MustCompile(`^[\w/+=.@-]*$`)
+
+// Option modifies a Config.
+type Option func(*Config)
+
+// WithPrefix sets the key prefix.
+func WithPrefix(prefix string) Option {
+	return func(c *Config) { c.Prefix = prefix }
+}
+
+// WithCA sets the CA namespace.
+func WithCA(ca string) Option {
+	return func(c *Config) { c.CA = ca }
+}
+
+// WithLegacyCA sets the CA namespace used by previous versions.
+func WithLegacyCA(ca string) Option {
+	return func(c *Config) { c.LegacyCA = ca }
+}
+
+// WithRegion sets the region of the bucket.
+func WithRegion(region string) Option {
+	return func(c *Config) { c.Region = region }
+}
+
+// WithEndpoint uses an S3 compatible object store instead of AWS.
+func WithEndpoint(endpoint string, forcePathStyle bool) Option {
+	return func(c *Config) {
+		c.Endpoint = endpoint
+		c.ForcePathStyle = forcePathStyle
+	}
+}
+
+// WithSSE sets the server side encryption mode and, for SSEKMS, the key.
+func WithSSE(mode, kmsKeyID string) Option {
+	return func(c *Config) {
+		c.SSE = mode
+		c.KMSKeyID = kmsKeyID
+	}
+}
+
+// WithSSECustomerKey encrypts objects with the customer provided 256-bit
+// key.
+func WithSSECustomerKey(key []byte) Option {
+	return func(c *Config) {
+		c.SSE = SSECustomer
+		c.SSECustomerKey = key
+	}
+}
+
+// WithCompression sets the compression of stored objects.
+func WithCompression(compression string) Option {
+	return func(c *Config) { c.Compression = compression }
+}
+
+// WithStorageClass sets the storage class of stored objects.
+func WithStorageClass(class string) Option {
+	return func(c *Config) { c.StorageClass = class }
+}
+
+// WithCredentials overrides the default AWS credential chain.
+func WithCredentials(creds *credentials.Credentials) Option {
+	return func(c *Config) { c.Credentials = creds }
+}
+
+// WithRole assumes the IAM role arn, after any roles already in the chain,
+// passing externalID if it's not empty.
+func WithRole(arn, externalID string) Option {
+	return func(c *Config) {
+		c.RoleChain = append(c.RoleChain, arn)
+		c.ExternalID = externalID
+	}
+}
+
+// WithRequireIMDSv2 reads EC2 instance role credentials with IMDSv2 only.
+func WithRequireIMDSv2() Option {
+	return func(c *Config) { c.RequireIMDSv2 = true }
+}
+
+// WithHTTPClient sets the HTTP client used for AWS requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Config) { c.HTTPClient = hc }
+}
+
+// WithHTTPSettings tunes the HTTP client used for AWS requests.
+func WithHTTPSettings(h HTTPSettings) Option {
+	return func(c *Config) { c.HTTP = h }
+}
+
+// WithAcceleration uses S3 Transfer Acceleration and/or dual-stack (IPv6)
+// endpoints.
+func WithAcceleration(accelerate, dualStack bool) Option {
+	return func(c *Config) {
+		c.Accelerate = accelerate
+		c.DualStack = dualStack
+	}
+}
+
+// WithPartition sets the AWS partition of the bucket, e.g. aws-us-gov,
+// for detecting its region.
+func WithPartition(partition string) Option {
+	return func(c *Config) { c.Partition = partition }
+}
+
+// WithFIPS uses FIPS endpoints for all AWS requests.
+func WithFIPS() Option {
+	return func(c *Config) { c.FIPS = true }
+}
+
+// WithRetryer sets the retry policy for AWS requests.
+func WithRetryer(r request.Retryer) Option {
+	return func(c *Config) { c.Retryer = r }
+}
+
+// WithMaxRetries retries transient errors of AWS requests at most n
+// times.
+func WithMaxRetries(n int) Option {
+	return func(c *Config) { c.Retry.MaxAttempts = n + 1 }
+}
+
+// WithRoutes routes the site data of matching domains to other buckets or
+// prefixes, see RouteRule.
+func WithRoutes(rules ...*RouteRule) Option {
+	return func(c *Config) { c.Routes = append(c.Routes, rules...) }
+}
+
+// WithRequestLimits caps the S3 requests of the process.
+func WithRequestLimits(l RequestLimits) Option {
+	return func(c *Config) { c.Limits = l }
+}
+
+// WithRetryPolicy sets the retry policy for transient errors of AWS
+// requests.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Config) { c.Retry = p }
+}
+
+// WithCache enables the read-through cache with the given TTL, also on
+// disk in dir if it's not empty.
+func WithCache(ttl time.Duration, dir string) Option {
+	return func(c *Config) {
+		c.CacheTTL = ttl
+		c.CacheDir = dir
+	}
+}
+
+// WithNegativeCache remembers that a site doesn't exist for ttl.
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(c *Config) { c.NegativeCacheTTL = ttl }
+}
+
+// WithMirror keeps a copy of site data in dir that is used when S3 is
+// unavailable, as long as it's not older than maxAge (if not zero).
+func WithMirror(dir string, maxAge time.Duration) Option {
+	return func(c *Config) {
+		c.MirrorDir = dir
+		c.MirrorMaxAge = maxAge
+	}
+}
+
+// WithPrefetch loads all stored sites into the cache and the disk mirror
+// after construction, concurrency at a time.
+func WithPrefetch(concurrency int) Option {
+	return func(c *Config) { c.Prefetch = concurrency }
+}
+
+// WithReplica reads from the replica bucket in region when reading from
+// the bucket fails or takes longer than timeout, if it's not zero.
+func WithReplica(bucket, region string, timeout time.Duration) Option {
+	return func(c *Config) {
+		c.ReplicaBucket = bucket
+		c.ReplicaRegion = region
+		c.ReplicaTimeout = timeout
+	}
+}
+
+// WithMigration imports sites and accounts missing from S3 from Caddy's
+// file storage in dir, $CADDYPATH/acme if dir is empty, when they're
+// loaded.
+func WithMigration(dir string) Option {
+	return func(c *Config) {
+		if dir == "" {
+			dir = defaultFileStorageDir()
+		}
+		c.MigrateDir = dir
+	}
+}
+
+// WithACL writes objects with the canned ACL acl, e.g.
+// bucket-owner-full-control.
+func WithACL(acl string) Option {
+	return func(c *Config) { c.ACL = acl }
+}
+
+// WithRequesterPays accepts the charges of requests to requester pays
+// buckets.
+func WithRequesterPays() Option {
+	return func(c *Config) { c.RequesterPays = true }
+}
+
+// WithSharedAccounts stores accounts outside of the CA namespaces.
+func WithSharedAccounts() Option {
+	return func(c *Config) { c.SharedAccounts = true }
+}
+
+// WithAssumeExistsOnDenied reports sites whose existence check was denied
+// as existing.
+func WithAssumeExistsOnDenied() Option {
+	return func(c *Config) { c.AssumeExistsOnDenied = true }
+}
+
+// WithSiteLayout sets how site data is stored, SiteLayoutJSON,
+// SiteLayoutSplit, or SiteLayoutShared.
+func WithSiteLayout(layout string) Option {
+	return func(c *Config) { c.SiteLayout = layout }
+}
+
+// WithWriteVerification confirms every StoreSite by reading the site back.
+func WithWriteVerification() Option {
+	return func(c *Config) { c.VerifyWrites = true }
+}
+
+// WithKeySecrets stores private keys in Secrets Manager secrets named
+// with prefix, encrypted with the KMS key kmsKeyID if it's not empty.
+func WithKeySecrets(prefix, kmsKeyID string) Option {
+	return func(c *Config) {
+		c.KeySecretPrefix = prefix
+		c.KeySecretKMSKeyID = kmsKeyID
+	}
+}
+
+// WithEvents publishes events of changes to the SNS topic and/or the
+// EventBridge bus that aren't empty.
+func WithEvents(topicARN, bus string) Option {
+	return func(c *Config) {
+		c.EventTopicARN = topicARN
+		c.EventBus = bus
+	}
+}
+
+// WithInvalidationQueue consumes the SQS queue at queueURL to evict cached
+// data changed by other hosts, calling onInvalidate, if it's not nil, for
+// every changed site.
+func WithInvalidationQueue(queueURL string, onInvalidate func(domain string)) Option {
+	return func(c *Config) {
+		c.InvalidationQueueURL = queueURL
+		c.OnInvalidate = onInvalidate
+	}
+}
+
+// WithWatch polls the sites every interval to evict sites changed by other
+// hosts or operators from the cache, calling onChange, if it's not nil,
+// for every changed site.
+func WithWatch(interval time.Duration, onChange func(domain string)) Option {
+	return func(c *Config) {
+		c.WatchInterval = interval
+		c.OnWatchChange = onChange
+	}
+}
+
+// WithDryRun logs writes and deletes instead of performing them.
+func WithDryRun(dryRun bool) Option {
+	return func(c *Config) { c.DryRun = dryRun }
+}
+
+// WithReadOnly makes the storage read-only, see Config.ReadOnly.
+func WithReadOnly() Option {
+	return func(c *Config) { c.ReadOnly = true }
+}
+
+// WithWildcardFallback serves domains from the wildcard certificate of
+// their parent domain, see Config.WildcardFallback.
+func WithWildcardFallback() Option {
+	return func(c *Config) { c.WildcardFallback = true }
+}
+
+// WithDryRunDeletes logs deletes instead of performing them.
+func WithDryRunDeletes() Option {
+	return func(c *Config) { c.DryRunDeletes = true }
+}
+
+// WithLock sets the distributed lock mode and, for "dynamodb", the table.
+func WithLock(mode, table string) Option {
+	return func(c *Config) {
+		c.Lock = mode
+		c.LockTable = table
+	}
+}
+
+// WithLockWait gives up waiting for a lock held elsewhere after d.
+func WithLockWait(d time.Duration) Option {
+	return func(c *Config) { c.LockWait = d }
+}
+
+// WithLeaderElection leaves renewals to the elected leader of the hosts
+// sharing the CA namespace.
+func WithLeaderElection() Option {
+	return func(c *Config) { c.LeaderElection = true }
+}
+
+// WithContext sets the parent context of all AWS operations.
+func WithContext(ctx context.Context) Option {
+	return func(c *Config) { c.Context = ctx }
+}
+
+// WithTimeout sets the timeout of each AWS operation.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Config) { c.Timeout = d }
+}
+
+// WithLogger sets the logger.
+func WithLogger(l Logger) Option {
+	return func(c *Config) { c.Logger = l }
+}
+
+// WithTracerProvider sets the provider of the tracer of S3 requests.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *Config) { c.TracerProvider = tp }
+}
+
+// WithXRay instruments the S3 client with the X-Ray SDK.
+func WithXRay() Option {
+	return func(c *Config) { c.XRay = true }
+}
+
+// WithAuditLog records site and account changes and lock takeovers in
+// the bucket.
+func WithAuditLog() Option {
+	return func(c *Config) { c.AuditLog = true }
+}
+
+// WithClock sets the clock used for timestamps, rate limits, lock expiry,
+// and the timers of lock heartbeats and waits.
+func WithClock(clock Clock) Option {
+	return func(c *Config) { c.Clock = clock }
+}
+
+// validate checks the configuration and fills in defaults.
+func (c *Config) validate() error {
+	if c.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	prefix, err := normalizePrefix(c.Prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix: %s", err)
+	}
+	c.Prefix = prefix
+	switch c.SSE {
+	case "":
+		c.SSE = SSEAES256
+	case SSEAES256, SSENone:
+		if c.KMSKeyID != "" {
+			return errors.New("a KMS key requires SSE mode aws:kms")
+		}
+	case SSEKMS:
+	case SSECustomer:
+		if len(c.SSECustomerKey) != sseCustomerKeySize {
+			return fmt.Errorf("SSE mode sse-c requires a %d byte customer key", sseCustomerKeySize)
+		}
+		if c.KMSKeyID != "" {
+			return errors.New("a KMS key requires SSE mode aws:kms")
+		}
+		// Objects can't be read with the customer key if a route wrote
+		// them with KMS.
+		for _, r := range c.Routes {
+			if r.KMSKeyID != "" {
+				return errors.New("route KMS keys are not supported with SSE mode sse-c")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown SSE mode %q", c.SSE)
+	}
+	if c.SSE != SSECustomer && len(c.SSECustomerKey) != 0 {
+		return errors.New("a customer key requires SSE mode sse-c")
+	}
+	switch c.Compression {
+	case CompressionNone, CompressionGzip:
+	default:
+		return fmt.Errorf("unknown compression %q", c.Compression)
+	}
+	if c.StorageClass != "" && !storageClasses[c.StorageClass] {
+		return fmt.Errorf("unknown storage class %q", c.StorageClass)
+	}
+	if c.ACL != "" && !objectACLs[c.ACL] {
+		return fmt.Errorf("unsupported object ACL %q", c.ACL)
+	}
+	if (c.Accelerate || c.DualStack) && c.Endpoint != "" {
+		return errors.New("acceleration and dual-stack endpoints are only supported by AWS")
+	}
+	if c.Accelerate && (c.ForcePathStyle || strings.Contains(c.Bucket, ".")) {
+		return errors.New("transfer acceleration requires virtual hosted-style addressing and a bucket name without dots")
+	}
+	if c.FIPS && (c.Endpoint != "" || c.Accelerate) {
+		return errors.New("FIPS endpoints are only supported by AWS and not with transfer acceleration")
+	}
+	if c.Partition != "" {
+		if _, ok := partitionRegions[c.Partition]; !ok {
+			return fmt.Errorf("unknown AWS partition %q", c.Partition)
+		}
+		if c.Region != "" && regionPartition(c.Region) != c.Partition {
+			return fmt.Errorf("region %s is not in partition %s", c.Region, c.Partition)
+		}
+	}
+	switch c.SiteLayout {
+	case "":
+		c.SiteLayout = SiteLayoutJSON
+	case SiteLayoutJSON, SiteLayoutSplit, SiteLayoutShared:
+	default:
+		return fmt.Errorf("unknown site layout %q", c.SiteLayout)
+	}
+	if c.SiteLayout == SiteLayoutShared && c.KeySecretPrefix != "" {
+		// The blob would refer to the secret of a single domain.
+		return errors.New("the shared site layout can't be used with private keys in Secrets Manager")
+	}
+	if c.KeySecretPrefix == "" && c.KeySecretKMSKeyID != "" {
+		return errors.New("a secret KMS key requires a secret prefix")
+	}
+	if !secretPrefixRE.MatchString(c.KeySecretPrefix) {
+		return fmt.Errorf("invalid secret prefix %q", c.KeySecretPrefix)
+	}
+	if c.WatchInterval < 0 {
+		return errors.New("the watch interval must not be negative")
+	}
+	if c.OnInvalidate != nil && c.InvalidationQueueURL == "" {
+		return errors.New("an invalidation callback requires an invalidation queue")
+	}
+	if c.OnWatchChange != nil && c.WatchInterval == 0 {
+		return errors.New("a watch callback requires a watch interval")
+	}
+	if c.EventTopicARN != "" && (!strings.HasPrefix(c.EventTopicARN, "arn:") || !strings.Contains(c.EventTopicARN, ":sns:")) {
+		return fmt.Errorf("%q is not an SNS topic ARN", c.EventTopicARN)
+	}
+	for _, r := range c.Routes {
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("invalid route: %s", err)
+		}
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if c.DomainRateLimit < 0 || (c.DomainRateLimit > 0 && c.DomainRateInterval <= 0) {
+		return errors.New("domain rate limit requires a positive count and interval")
+	}
+	if len(c.AccountKeyTypes) == 0 {
+		c.AccountKeyTypes = defaultAccountKeyTypes
+	}
+	for _, kt := range c.AccountKeyTypes {
+		if kt != keyTypeECDSA && kt != keyTypeRSA {
+			return fmt.Errorf("unknown account key type %q", kt)
+		}
+	}
+	if c.ReplicaBucket == "" && (c.ReplicaRegion != "" || c.ReplicaTimeout != 0) {
+		return errors.New("a replica region or timeout requires a replica bucket")
+	}
+	if c.ReplicaTimeout < 0 {
+		return errors.New("the replica timeout must not be negative")
+	}
+	if c.LockWait < 0 {
+		return errors.New("the lock wait must not be negative")
+	}
+	if c.NegativeCacheTTL < 0 {
+		return errors.New("the negative cache TTL must not be negative")
+	}
+	if c.CacheDir != "" && c.CacheTTL <= 0 {
+		return errors.New("a cache directory requires a cache TTL")
+	}
+	if c.Prefetch < 0 {
+		return errors.New("the prefetch concurrency must not be negative")
+	}
+	if c.Prefetch > 0 && c.CacheTTL <= 0 && c.MirrorDir == "" {
+		return errors.New("prefetch requires a cache TTL or a mirror directory")
+	}
+	if c.ExternalID != "" && len(c.RoleChain) == 0 {
+		return errors.New("an external ID requires a role to assume")
+	}
+	if c.RoleSessionName == "" {
+		c.RoleSessionName = defaultRoleSessionName
+	} else if !roleSessionNameRE.MatchString(c.RoleSessionName) {
+		return fmt.Errorf("invalid role session name %q", c.RoleSessionName)
+	}
+	if err := c.HTTP.validate(); err != nil {
+		return err
+	}
+	c.Retry = c.Retry.withDefaults()
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+	if c.Lock == "" && c.LockTable != "" {
+		c.Lock = "dynamodb"
+	}
+	// Without an AWS session there are no clients for other services or
+	// regions.
+	if c.client != nil {
+		if c.Lock == "dynamodb" || c.ReplicaRegion != "" || c.KeySecretPrefix != "" || c.EventTopicARN != "" || c.EventBus != "" || c.InvalidationQueueURL != "" {
+			return errors.New("DynamoDB locks, replica regions, Secrets Manager keys, events, and invalidation queues are not supported with an injected S3 client")
+		}
+		if c.RequesterPays {
+			return errors.New("requester pays is not supported with an injected S3 client, set the X-Amz-Request-Payer header on the client instead")
+		}
+		if c.SSE == SSECustomer {
+			return errors.New("SSE mode sse-c is not supported with an injected S3 client")
+		}
+		if c.XRay {
+			return errors.New("X-Ray is not supported with an injected S3 client, instrument the client with xray.AWS instead")
+		}
+		for _, r := range c.Routes {
+			if r.Region != "" {
+				return errors.New("routes to other regions are not supported with an injected S3 client")
+			}
+		}
+	}
+	if c.ReadOnly && (c.CreateBucket || c.LeaderElection) {
+		return errors.New("bucket creation and leader election are not supported by read-only storage")
+	}
+	if c.LeaderElection && c.Lock == "local" {
+		return errors.New("leader election requires distributed locks")
+	}
+	if c.LockTTL <= 0 {
+		c.LockTTL = defaultLockTTL
+	}
+	if c.Context == nil {
+		c.Context = context.Background()
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.Logger == nil {
+		c.Logger = NopLogger{}
+	}
+	if c.TracerProvider == nil {
+		c.TracerProvider = otel.GetTracerProvider()
+	}
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
+	return nil
+}
+
+// ConfigFromEnv builds the configuration Caddy uses from a storage or CA
+// URL and the CADDY_S3_* environment variables, e.g. for tools working on
+// the data Caddy stores.
+//
+// When given a storage URL of the form s3://bucket/prefix the bucket and
+// key prefix are taken from the URL, along with the region, endpoint,
+// path_style, storage_class, lock, lock_table, and read_only query
+// parameters, and credentials (see urlCredentials). Otherwise (e.g. for
+// an ACME CA URL) they're read from the environment, and the bucket is
+// left empty if CADDY_S3_BUCKET isn't set.
+func ConfigFromEnv(caURL *url.URL) (Config, error) {
+	bucket, prefix, err := bucketAndPrefix(caURL)
+	if err != nil && err != errNoBucket {
+		return Config{}, err
+	}
+	query := storageQuery(caURL)
+	cfg := Config{
+		Bucket:   bucket,
+		Prefix:   prefix,
+		CA:       CANamespace(caURL),
+		Region:   configuredRegion(query),
+		SSE:      os.Getenv("CADDY_S3_SSE"),
+		KMSKeyID: os.Getenv("CADDY_S3_KMS_KEY_ID"),
+	}
+	if cfg.CA != caURL.Host {
+		cfg.LegacyCA = caURL.Host
+	}
+	if cfg.StorageClass = query.Get("storage_class"); cfg.StorageClass == "" {
+		cfg.StorageClass = os.Getenv("CADDY_S3_STORAGE_CLASS")
+	}
+	cfg.Compression = os.Getenv("CADDY_S3_COMPRESSION")
+	// A KMS key implies KMS encryption.
+	if cfg.SSE == "" && cfg.KMSKeyID != "" {
+		cfg.SSE = SSEKMS
+	}
+	if cfg.SSECustomerKey, err = configuredCustomerKey(); err != nil {
+		return Config{}, err
+	}
+	// So does a customer key.
+	if cfg.SSE == "" && cfg.SSECustomerKey != nil {
+		cfg.SSE = SSECustomer
+	}
+	if cfg.Credentials, err = urlCredentials(caURL); err != nil {
+		return Config{}, err
+	}
+	if cfg.Endpoint, cfg.ForcePathStyle, err = configuredEndpoint(query); err != nil {
+		return Config{}, err
+	}
+	var debug, migrate bool
+	for name, v := range map[string]*bool{
+		"CADDY_S3_DEBUG":           &debug,
+		"CADDY_S3_MIGRATE":         &migrate,
+		"CADDY_S3_DRY_RUN":         &cfg.DryRun,
+		"CADDY_S3_DRY_RUN_DELETES": &cfg.DryRunDeletes,
+		"CADDY_S3_READ_ONLY":       &cfg.ReadOnly,
+		"CADDY_S3_WILDCARD":        &cfg.WildcardFallback,
+		"CADDY_S3_READABLE":        &cfg.Readable,
+		"CADDY_S3_CREATE_BUCKET":   &cfg.CreateBucket,
+		"CADDY_S3_VERIFY_PRIVATE":  &cfg.VerifyPrivate,
+		"CADDY_S3_SKIP_VALIDATE":   &cfg.SkipValidate,
+		"CADDY_S3_DISABLE_TAGGING": &cfg.DisableTagging,
+		"CADDY_S3_VERIFY_WRITES":   &cfg.VerifyWrites,
+		"CADDY_S3_ACCELERATE":      &cfg.Accelerate,
+		"CADDY_S3_DUAL_STACK":      &cfg.DualStack,
+		"CADDY_S3_FIPS":            &cfg.FIPS,
+		"CADDY_S3_LEADER_ELECTION": &cfg.LeaderElection,
+		"CADDY_S3_REQUIRE_IMDSV2":  &cfg.RequireIMDSv2,
+		"CADDY_S3_REQUESTER_PAYS":  &cfg.RequesterPays,
+		"CADDY_S3_ASSUME_EXISTS":   &cfg.AssumeExistsOnDenied,
+		"CADDY_S3_SHARED_ACCOUNTS": &cfg.SharedAccounts,
+		"CADDY_S3_XRAY":            &cfg.XRay,
+		"CADDY_S3_AUDIT_LOG":       &cfg.AuditLog,
+	} {
+		if *v, err = parseBoolEnv(name); err != nil {
+			return Config{}, err
+		}
+	}
+	if v := query.Get("read_only"); v != "" {
+		if cfg.ReadOnly, err = strconv.ParseBool(v); err != nil {
+			return Config{}, fmt.Errorf("invalid read_only value %q: %s", v, err)
+		}
+	}
+	// Caddy writes the standard logger to its log.
+	cfg.Logger = StdLogger(nil, debug)
+	// CADDY_S3_MIGRATE_DIR enables migration from a file storage in a
+	// different directory.
+	if cfg.MigrateDir = os.Getenv("CADDY_S3_MIGRATE_DIR"); cfg.MigrateDir == "" && migrate {
+		cfg.MigrateDir = defaultFileStorageDir()
+	}
+	if v := os.Getenv("CADDY_S3_CACHE_TTL"); v != "" {
+		cfg.CacheTTL, err = time.ParseDuration(v)
+		if err != nil || cfg.CacheTTL < 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_CACHE_TTL value %q", v)
+		}
+	}
+	cfg.CacheDir = os.Getenv("CADDY_S3_CACHE_DIR")
+	if v := os.Getenv("CADDY_S3_NEGATIVE_CACHE_TTL"); v != "" {
+		cfg.NegativeCacheTTL, err = time.ParseDuration(v)
+		if err != nil || cfg.NegativeCacheTTL < 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_NEGATIVE_CACHE_TTL value %q", v)
+		}
+	}
+	cfg.ReplicaBucket = os.Getenv("CADDY_S3_REPLICA_BUCKET")
+	cfg.ReplicaRegion = os.Getenv("CADDY_S3_REPLICA_REGION")
+	if v := os.Getenv("CADDY_S3_REPLICA_TIMEOUT"); v != "" {
+		cfg.ReplicaTimeout, err = time.ParseDuration(v)
+		if err != nil || cfg.ReplicaTimeout < 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_REPLICA_TIMEOUT value %q", v)
+		}
+	}
+	cfg.MirrorDir = os.Getenv("CADDY_S3_MIRROR_DIR")
+	if v := os.Getenv("CADDY_S3_MIRROR_MAX_AGE"); v != "" {
+		cfg.MirrorMaxAge, err = time.ParseDuration(v)
+		if err != nil || cfg.MirrorMaxAge < 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_MIRROR_MAX_AGE value %q", v)
+		}
+	}
+	if v := os.Getenv("CADDY_S3_WATCH_INTERVAL"); v != "" {
+		cfg.WatchInterval, err = time.ParseDuration(v)
+		if err != nil || cfg.WatchInterval < 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_WATCH_INTERVAL value %q", v)
+		}
+	}
+	if cfg.Routes, err = parseRouteRules(os.Getenv("CADDY_S3_ROUTES")); err != nil {
+		return Config{}, fmt.Errorf("invalid CADDY_S3_ROUTES: %s", err)
+	}
+	rate, err := parseRateLimit(os.Getenv("CADDY_S3_DOMAIN_RATE_LIMIT"))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid CADDY_S3_DOMAIN_RATE_LIMIT: %s", err)
+	}
+	if rate != nil {
+		cfg.DomainRateLimit = rate.n
+		cfg.DomainRateInterval = rate.interval
+	}
+	if cfg.AccountKeyTypes, err = parseAccountKeyTypes(os.Getenv("CADDY_S3_ACCOUNT_KEY_TYPE")); err != nil {
+		return Config{}, fmt.Errorf("invalid CADDY_S3_ACCOUNT_KEY_TYPE: %s", err)
+	}
+	if cfg.RoleChain, err = parseRoleChain(os.Getenv("CADDY_S3_ROLE_CHAIN")); err != nil {
+		return Config{}, fmt.Errorf("invalid CADDY_S3_ROLE_CHAIN: %s", err)
+	}
+	// CADDY_S3_ROLE_ARN is the role in the account that owns the bucket, so
+	// it's assumed last.
+	if arn := os.Getenv("CADDY_S3_ROLE_ARN"); arn != "" {
+		arns, err := parseRoleChain(arn)
+		if err != nil || len(arns) != 1 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_ROLE_ARN value %q", arn)
+		}
+		cfg.RoleChain = append(cfg.RoleChain, arns[0])
+	}
+	cfg.ExternalID = os.Getenv("CADDY_S3_EXTERNAL_ID")
+	cfg.RoleSessionName = os.Getenv("CADDY_S3_ROLE_SESSION_NAME")
+	if cfg.Lock = query.Get("lock"); cfg.Lock == "" {
+		cfg.Lock = os.Getenv("CADDY_S3_LOCK")
+	}
+	if cfg.LockTable = query.Get("lock_table"); cfg.LockTable == "" {
+		cfg.LockTable = os.Getenv("CADDY_S3_LOCK_TABLE")
+	}
+	if v := os.Getenv("CADDY_S3_LOCK_TTL"); v != "" {
+		cfg.LockTTL, err = time.ParseDuration(v)
+		if err != nil || cfg.LockTTL <= 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_LOCK_TTL value %q", v)
+		}
+	}
+	if v := os.Getenv("CADDY_S3_LOCK_WAIT"); v != "" {
+		cfg.LockWait, err = time.ParseDuration(v)
+		if err != nil || cfg.LockWait < 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_LOCK_WAIT value %q", v)
+		}
+	}
+	if v := os.Getenv("CADDY_S3_TIMEOUT"); v != "" {
+		cfg.Timeout, err = time.ParseDuration(v)
+		if err != nil || cfg.Timeout <= 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_TIMEOUT value %q", v)
+		}
+	}
+	cfg.Partition = os.Getenv("CADDY_S3_PARTITION")
+	cfg.SiteLayout = os.Getenv("CADDY_S3_SITE_LAYOUT")
+	cfg.ACL = os.Getenv("CADDY_S3_ACL")
+	cfg.KeySecretPrefix = os.Getenv("CADDY_S3_KEY_SECRET_PREFIX")
+	cfg.KeySecretKMSKeyID = os.Getenv("CADDY_S3_KEY_SECRET_KMS_KEY_ID")
+	cfg.EventTopicARN = os.Getenv("CADDY_S3_EVENT_TOPIC_ARN")
+	cfg.EventBus = os.Getenv("CADDY_S3_EVENT_BUS")
+	cfg.InvalidationQueueURL = os.Getenv("CADDY_S3_INVALIDATION_QUEUE_URL")
+	cfg.HTTP.ProxyURL = os.Getenv("CADDY_S3_PROXY")
+	cfg.HTTP.CAFile = os.Getenv("CADDY_S3_CA_FILE")
+	if v := os.Getenv("CADDY_S3_MAX_IDLE_CONNS"); v != "" {
+		cfg.HTTP.MaxIdleConns, err = strconv.Atoi(v)
+		if err != nil || cfg.HTTP.MaxIdleConns < 0 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_MAX_IDLE_CONNS value %q", v)
+		}
+	}
+	for _, n := range []struct {
+		env string
+		v   *int
+	}{
+		{"CADDY_S3_MAX_READS", &cfg.Limits.MaxReads},
+		{"CADDY_S3_MAX_WRITES", &cfg.Limits.MaxWrites},
+		{"CADDY_S3_PREFETCH", &cfg.Prefetch},
+	} {
+		if v := os.Getenv(n.env); v != "" {
+			*n.v, err = strconv.Atoi(v)
+			if err != nil || *n.v < 0 {
+				return Config{}, fmt.Errorf("invalid %s value %q", n.env, v)
+			}
+		}
+	}
+	for _, r := range []struct {
+		env string
+		v   *float64
+	}{
+		{"CADDY_S3_READ_RATE", &cfg.Limits.ReadRate},
+		{"CADDY_S3_WRITE_RATE", &cfg.Limits.WriteRate},
+	} {
+		if v := os.Getenv(r.env); v != "" {
+			*r.v, err = strconv.ParseFloat(v, 64)
+			if err != nil || *r.v < 0 {
+				return Config{}, fmt.Errorf("invalid %s value %q", r.env, v)
+			}
+		}
+	}
+	if v := os.Getenv("CADDY_S3_MAX_ATTEMPTS"); v != "" {
+		cfg.Retry.MaxAttempts, err = strconv.Atoi(v)
+		if err != nil || cfg.Retry.MaxAttempts < 1 {
+			return Config{}, fmt.Errorf("invalid CADDY_S3_MAX_ATTEMPTS value %q", v)
+		}
+	}
+	for _, d := range []struct {
+		env string
+		v   *time.Duration
+	}{
+		{"CADDY_S3_RETRY_BASE_DELAY", &cfg.Retry.BaseDelay},
+		{"CADDY_S3_RETRY_MAX_DELAY", &cfg.Retry.MaxDelay},
+		{"CADDY_S3_DIAL_TIMEOUT", &cfg.HTTP.DialTimeout},
+		{"CADDY_S3_TLS_HANDSHAKE_TIMEOUT", &cfg.HTTP.TLSHandshakeTimeout},
+	} {
+		if v := os.Getenv(d.env); v != "" {
+			*d.v, err = time.ParseDuration(v)
+			if err != nil || *d.v <= 0 {
+				return Config{}, fmt.Errorf("invalid %s value %q", d.env, v)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// configuredEndpoint returns the endpoint from the endpoint URL parameter
+// or CADDY_S3_ENDPOINT, and whether path-style addressing is enabled by
+// the path_style URL parameter or CADDY_S3_FORCE_PATH_STYLE.
+func configuredEndpoint(query url.Values) (string, bool, error) {
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = os.Getenv("CADDY_S3_ENDPOINT")
+	}
+	if v := query.Get("path_style"); v != "" {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid path_style value %q: %s", v, err)
+		}
+		return endpoint, pathStyle, nil
+	}
+	pathStyle, err := parseBoolEnv("CADDY_S3_FORCE_PATH_STYLE")
+	return endpoint, pathStyle, err
+}
@@ -0,0 +1,24 @@
+package caddytlss3
+
+import (
+	"context"
+	"time"
+)
+
+// defaultTimeout bounds each S3 and DynamoDB operation, including retries,
+// so that a hung connection can't block certificate loading indefinitely.
+const defaultTimeout = 30 * time.Second
+
+// opContext returns the context for a single AWS operation: the storage
+// context bounded by the per-operation timeout. The cancel function must be
+// called once the response has been read.
+func (s *S3Storage) opContext() (context.Context, context.CancelFunc) {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
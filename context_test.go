@@ -0,0 +1,41 @@
+package caddytlss3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// hungS3 never responds, like a stalled connection.
+type hungS3 struct {
+	s3iface.S3API
+}
+
+func (hungS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestOperationTimeout(t *testing.T) {
+	storage := newFakeStorage(t, hungS3{}, "bucket", WithTimeout(10*time.Millisecond))
+	start := time.Now()
+	if _, err := storage.LoadSite("example.com"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("LoadSite took %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	storage.ctx = ctx
+	storage.timeout = time.Hour
+	if _, err := storage.LoadSite("example.com"); err != context.Canceled {
+		t.Fatalf("Expected canceled, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// reported holds the diagnostics that have already been logged. Caddy
+// constructs storage instances on demand so each distinct configuration
+// is only reported the first time it's seen.
+var (
+	reportedMu sync.Mutex
+	reported   = make(map[string]bool)
+)
+
+// diagnostics describes the effective configuration of a storage instance.
+type diagnostics struct {
+	AuditLog         bool
+	Bucket           string
+	Cache            string
+	Compression      string
+	Credentials      string
+	DiskMirror       string
+	DomainRateLimit  string
+	DryRun           bool
+	DryRunDeletes    bool
+	Encryption       string
+	Endpoint         string
+	Events           string
+	Invalidation     string
+	Locking          string
+	NegativeCache    string
+	Partition        string
+	Prefix           string
+	PrivateKeys      string
+	ReadOnly         bool
+	ReadableMirror   bool
+	Region           string
+	Replica          string
+	RequestLimits    string
+	Routes           int
+	SharedAccounts   bool
+	SiteLayout       string
+	WildcardFallback bool
+	XRay             bool
+}
+
+// String formats the diagnostics as key=value pairs sorted by key.
+func (d *diagnostics) String() string {
+	pairs := []struct {
+		key   string
+		value interface{}
+	}{
+		{"audit_log", d.AuditLog},
+		{"bucket", d.Bucket},
+		{"cache", d.Cache},
+		{"compression", d.Compression},
+		{"credentials", d.Credentials},
+		{"disk_mirror", d.DiskMirror},
+		{"domain_rate_limit", d.DomainRateLimit},
+		{"dry_run", d.DryRun},
+		{"dry_run_deletes", d.DryRunDeletes},
+		{"encryption", d.Encryption},
+		{"endpoint", d.Endpoint},
+		{"events", d.Events},
+		{"invalidation", d.Invalidation},
+		{"locking", d.Locking},
+		{"negative_cache", d.NegativeCache},
+		{"partition", d.Partition},
+		{"prefix", d.Prefix},
+		{"private_keys", d.PrivateKeys},
+		{"read_only", d.ReadOnly},
+		{"readable_mirror", d.ReadableMirror},
+		{"region", d.Region},
+		{"replica", d.Replica},
+		{"request_limits", d.RequestLimits},
+		{"routes", d.Routes},
+		{"shared_accounts", d.SharedAccounts},
+		{"site_layout", d.SiteLayout},
+		{"wildcard_fallback", d.WildcardFallback},
+		{"xray", d.XRay},
+	}
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = fmt.Sprintf("%s=%q", p.key, fmt.Sprint(p.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *S3Storage) diagnostics(region string) *diagnostics {
+	// Credentials are only reported once they've been retrieved, since
+	// resolving them here could mean STS or instance metadata requests.
+	credSource := "not resolved yet"
+	if s.session == nil {
+		credSource = "injected client"
+	} else if creds := s.session.Config.Credentials; creds == nil {
+		credSource = "none"
+	} else if !creds.IsExpired() {
+		if v, err := creds.Get(); err == nil {
+			credSource = v.ProviderName
+		}
+	}
+	if e := containerCredentialsEndpoint(); e != "" && credSource == endpointcreds.ProviderName {
+		credSource += " " + e
+	}
+	if credSource == ec2rolecreds.ProviderName {
+		if fallback := s.session.Config.EC2MetadataEnableFallback; fallback != nil && !*fallback {
+			credSource += " (IMDSv2 only)"
+		}
+	}
+	encryption := s.sse
+	if s.kmsKeyID != "" {
+		encryption += ":" + s.kmsKeyID
+	}
+	for _, r := range s.routes.rules {
+		if r.KMSKeyID != "" {
+			encryption += "+kms-routes"
+			break
+		}
+	}
+	locking := "in-process"
+	if s.locker != nil {
+		locking = s.locker.mode()
+	}
+	endpoint := "aws"
+	if s.session == nil {
+		endpoint = "injected client"
+	} else if s.s3Config != nil && s.s3Config.Endpoint != nil {
+		endpoint = *s.s3Config.Endpoint
+		if aws.BoolValue(s.s3Config.S3ForcePathStyle) {
+			endpoint += " (path-style)"
+		}
+	}
+	if s.s3Config != nil && aws.BoolValue(s.s3Config.S3UseAccelerate) {
+		endpoint += " (accelerate)"
+	}
+	if s.s3Config != nil && s.s3Config.UseDualStackEndpoint == endpoints.DualStackEndpointStateEnabled {
+		endpoint += " (dual-stack)"
+	}
+	if s.session != nil && s.session.Config.UseFIPSEndpoint == endpoints.FIPSEndpointStateEnabled {
+		endpoint += " (fips)"
+	}
+	cache := "off"
+	if s.cacheTTL > 0 {
+		cache = s.cacheTTL.String()
+		if s.cacheDir != "" {
+			cache += " " + s.cacheDir
+		}
+	}
+	negative := "off"
+	if s.negativeTTL > 0 {
+		negative = s.negativeTTL.String()
+	}
+	mirror := "off"
+	if s.mirrorDir != "" {
+		mirror = s.mirrorDir
+		if s.mirrorMaxAge > 0 {
+			mirror += " max_age=" + s.mirrorMaxAge.String()
+		}
+	}
+	replica := "off"
+	if s.replica != nil {
+		replica = s.replica.bucket
+		if s.replica.timeout > 0 {
+			replica += " timeout=" + s.replica.timeout.String()
+		}
+	}
+	bucket := s.bucket
+	if s.requesterPays {
+		bucket += " (requester pays)"
+	}
+	if s.acl != "" {
+		bucket += " (acl " + s.acl + ")"
+	}
+	layout := SiteLayoutJSON
+	switch {
+	case s.split:
+		layout = SiteLayoutSplit
+	case s.shared:
+		layout = SiteLayoutShared
+	}
+	keys := "s3"
+	if s.keys != nil {
+		keys = "secretsmanager " + s.keys.prefix
+	}
+	var events []string
+	if s.notifier != nil {
+		for _, dest := range []string{s.notifier.topic, s.notifier.bus} {
+			if dest != "" {
+				events = append(events, dest)
+			}
+		}
+	}
+	if len(events) == 0 {
+		events = []string{"off"}
+	}
+	if s.elector != nil {
+		locking += " (leader election)"
+	}
+	if s.lockWait > 0 {
+		locking += fmt.Sprintf(" (wait %s)", s.lockWait)
+	}
+	invalidation := "off"
+	if s.invalidationQueue != "" {
+		invalidation = s.invalidationQueue
+	}
+	rate := "off"
+	if s.domainRate != nil {
+		rate = fmt.Sprintf("%d/%s", s.domainRate.n, s.domainRate.interval)
+	}
+	limits := "off"
+	if s.limits != nil {
+		limits = fmt.Sprintf("reads %s, writes %s", s.limits.reads, s.limits.writes)
+	}
+	compression := "off"
+	if s.compression != CompressionNone {
+		compression = s.compression
+	}
+	return &diagnostics{
+		Credentials:      credSource,
+		Region:           region,
+		SiteLayout:       layout,
+		PrivateKeys:      keys,
+		Events:           strings.Join(events, " "),
+		Invalidation:     invalidation,
+		Partition:        regionPartition(region),
+		Endpoint:         endpoint,
+		Bucket:           bucket,
+		Prefix:           s.prefix,
+		Encryption:       encryption,
+		Compression:      compression,
+		RequestLimits:    limits,
+		SharedAccounts:   s.sharedAccounts,
+		XRay:             s.xray,
+		AuditLog:         s.auditLog,
+		Locking:          locking,
+		Routes:           len(s.routes.rules),
+		DryRun:           s.dryRun,
+		DryRunDeletes:    s.dryRunDeletes,
+		ReadOnly:         s.readOnly,
+		ReadableMirror:   s.readable,
+		Cache:            cache,
+		NegativeCache:    negative,
+		WildcardFallback: s.wildcard,
+		DiskMirror:       mirror,
+		Replica:          replica,
+		DomainRateLimit:  rate,
+	}
+}
+
+// reportDiagnostics logs the effective configuration once per distinct
+// configuration so operators can confirm it without reading code.
+func (s *S3Storage) reportDiagnostics(region string) {
+	d := s.diagnostics(region).String()
+	reportedMu.Lock()
+	defer reportedMu.Unlock()
+	if reported[d] {
+		return
+	}
+	reported[d] = true
+	s.log().Infof("configuration %s", d)
+}
@@ -0,0 +1,43 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// endpointConfig returns the S3 client configuration needed to use an S3
+// compatible object store such as MinIO, Ceph RGW, DigitalOcean Spaces, or
+// Wasabi instead of AWS. Most self-hosted stores also require path-style
+// addressing. The returned config is empty when neither is set.
+func endpointConfig(endpoint string, pathStyle bool) (*aws.Config, error) {
+	cfg := aws.NewConfig()
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %s", endpoint, err)
+		}
+		if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid endpoint %q: scheme must be http or https", endpoint)
+		}
+		cfg.WithEndpoint(endpoint)
+	}
+	if pathStyle {
+		cfg.WithS3ForcePathStyle(true)
+	}
+	return cfg, nil
+}
+
+// withAWSEndpoints selects S3 Transfer Acceleration and/or dual-stack
+// endpoints in cfg. Both only exist on AWS.
+func withAWSEndpoints(cfg *aws.Config, accelerate, dualStack bool) *aws.Config {
+	if accelerate {
+		cfg.WithS3UseAccelerate(true)
+	}
+	if dualStack {
+		cfg.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	return cfg
+}
@@ -0,0 +1,207 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ErrAccessDenied is returned when a request was denied by the IAM or
+// bucket policy. Key is empty for requests on the bucket itself.
+type ErrAccessDenied struct {
+	Op        string
+	Bucket    string
+	Key       string
+	RequestID string
+	// Err is the error returned by S3.
+	Err error
+	// hint names the permissions the request requires.
+	hint string
+}
+
+func (e ErrAccessDenied) Error() string {
+	msg := fmt.Sprintf("S3Storage: %s %s denied", e.Op, objectURL(e.Bucket, e.Key))
+	if e.hint != "" {
+		msg += ": " + e.hint
+	}
+	return msg + requestIDSuffix(e.RequestID)
+}
+
+// Unwrap returns the error returned by S3.
+func (e ErrAccessDenied) Unwrap() error {
+	return e.Err
+}
+
+// ErrBucketNotFound is returned when the bucket doesn't exist.
+type ErrBucketNotFound struct {
+	Bucket    string
+	RequestID string
+	// Err is the error returned by S3.
+	Err error
+}
+
+func (e ErrBucketNotFound) Error() string {
+	return fmt.Sprintf("S3Storage: bucket %s does not exist, create it or set CADDY_S3_CREATE_BUCKET%s", e.Bucket, requestIDSuffix(e.RequestID))
+}
+
+// Unwrap returns the error returned by S3.
+func (e ErrBucketNotFound) Unwrap() error {
+	return e.Err
+}
+
+// ErrReadOnly is returned by writes to a read-only storage, see
+// Config.ReadOnly.
+type ErrReadOnly struct {
+	Op   string
+	Name string
+}
+
+func (e ErrReadOnly) Error() string {
+	return fmt.Sprintf("S3Storage: %s %s refused: the storage is read-only, certificates are issued and stored by the control node", e.Op, e.Name)
+}
+
+// ErrCorruptData is returned when the contents of an object don't match
+// the checksum stored with it, e.g. after silent data corruption or when a
+// proxy returned a partial body, or when they can't be decoded.
+type ErrCorruptData struct {
+	Bucket string
+	Key    string
+	// Err is the decoding error, nil for a checksum mismatch.
+	Err error
+}
+
+func (e ErrCorruptData) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("S3Storage: s3://%s/%s is corrupted: %s", e.Bucket, e.Key, e.Err)
+	}
+	return fmt.Sprintf("S3Storage: s3://%s/%s does not match its checksum", e.Bucket, e.Key)
+}
+
+// Unwrap returns the decoding error.
+func (e ErrCorruptData) Unwrap() error {
+	return e.Err
+}
+
+// ErrCorrupt is the previous name of ErrCorruptData.
+//
+// Deprecated: use ErrCorruptData.
+type ErrCorrupt = ErrCorruptData
+
+// ErrSchemaVersion is returned when stored data was written in a newer
+// format than this version supports, by a host running a newer version.
+type ErrSchemaVersion struct {
+	Bucket  string
+	Key     string
+	Version int
+}
+
+func (e ErrSchemaVersion) Error() string {
+	return fmt.Sprintf("S3Storage: s3://%s/%s has schema version %d but at most %d is supported, upgrade to read it",
+		e.Bucket, e.Key, e.Version, schemaVersion)
+}
+
+// ErrDeleteObjects is returned when deleting objects in bulk failed for
+// some of them. The other objects were deleted.
+type ErrDeleteObjects struct {
+	Bucket string
+	// Failed maps the keys of the objects that weren't deleted to the
+	// error S3 returned for them.
+	Failed map[string]error
+}
+
+func (e ErrDeleteObjects) Error() string {
+	keys := make([]string, 0, len(e.Failed))
+	for key := range e.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("S3Storage: failed to delete %d objects in bucket %s, first s3://%s/%s: %s",
+		len(keys), e.Bucket, e.Bucket, keys[0], e.Failed[keys[0]])
+}
+
+// ErrLockTimeout is returned when a lock couldn't be obtained, because
+// another host held it for too long or because of too much contention.
+type ErrLockTimeout struct {
+	Name string
+	// Holder identifies the process last seen holding the lock, if known.
+	Holder string
+}
+
+func (e ErrLockTimeout) Error() string {
+	if e.Holder != "" {
+		return fmt.Sprintf("S3Storage: gave up obtaining lock for %s held by %s", e.Name, e.Holder)
+	}
+	return fmt.Sprintf("S3Storage: gave up obtaining lock for %s", e.Name)
+}
+
+// storageError returns err as an ErrAccessDenied or ErrBucketNotFound if
+// that's why the request op on the object at bucket/key failed, and
+// otherwise returns err unchanged.
+func (s *S3Storage) storageError(op, bucket, key string, err error) error {
+	switch err.(type) {
+	case nil, ErrAccessDenied, ErrBucketNotFound, ErrCorruptData:
+		return err
+	}
+	if isCode(err, s3.ErrCodeNoSuchBucket) {
+		return ErrBucketNotFound{Bucket: bucket, RequestID: requestID(err), Err: err}
+	}
+	if isAccessDenied(err) {
+		return ErrAccessDenied{
+			Op:        op,
+			Bucket:    bucket,
+			Key:       key,
+			RequestID: requestID(err),
+			Err:       err,
+			hint:      s.permissionHint(op, bucket, key),
+		}
+	}
+	return err
+}
+
+// permissionHint names the permissions required by the request op on the
+// object at bucket/key.
+func (s *S3Storage) permissionHint(op, bucket, key string) string {
+	resource := s.arn(bucket + "/" + key)
+	switch op {
+	case "HeadBucket":
+		return "grant s3:ListBucket on " + s.arn(bucket)
+	case "GetObject", "HeadObject":
+		// S3 also denies requests for missing objects when the caller
+		// lacks s3:ListBucket.
+		return "grant s3:GetObject on " + resource + " and s3:ListBucket on " + s.arn(bucket)
+	case "PutObject":
+		return "grant s3:PutObject on " + resource
+	case "DeleteObject":
+		return "grant s3:DeleteObject on " + resource
+	case "DeleteObjects":
+		return "grant s3:DeleteObject on " + s.arn(bucket+"/*")
+	case "CopyObject":
+		return "grant s3:GetObject and s3:PutObject on " + resource
+	}
+	return ""
+}
+
+// requestID returns the S3 request ID of a failed request, which AWS
+// support needs to investigate it.
+func requestID(err error) string {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		return e.RequestID()
+	}
+	return ""
+}
+
+func requestIDSuffix(id string) string {
+	if id == "" {
+		return ""
+	}
+	return " (request ID " + id + ")"
+}
+
+func objectURL(bucket, key string) string {
+	if key == "" {
+		return "bucket " + bucket
+	}
+	return "s3://" + bucket + "/" + key
+}
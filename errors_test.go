@@ -0,0 +1,44 @@
+package caddytlss3
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestStorageError(t *testing.T) {
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket")
+
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "req-1")
+	err := storage.storageError("PutObject", "bucket", "acme/ca/domain/example.com", denied)
+	e, ok := err.(ErrAccessDenied)
+	if !ok || e.Op != "PutObject" || e.Key != "acme/ca/domain/example.com" || e.RequestID != "req-1" || e.Err != denied {
+		t.Fatalf("Expected ErrAccessDenied, got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "grant s3:PutObject on arn:aws:s3:::bucket/acme/ca/domain/example.com") {
+		t.Errorf("Expected the missing permission in %q", err)
+	}
+	if again := storage.storageError("GetObject", "bucket", "other", err); again != err {
+		t.Errorf("Expected a typed error to be returned unchanged, got %v", again)
+	}
+
+	missing := awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchBucket, "not found", nil), http.StatusNotFound, "req-2")
+	if e, ok := storage.storageError("GetObject", "bucket", "key", missing).(ErrBucketNotFound); !ok || e.Bucket != "bucket" || e.RequestID != "req-2" {
+		t.Errorf("Expected ErrBucketNotFound, got %#v", e)
+	}
+
+	for _, err := range []error{
+		nil,
+		errors.New("other"),
+		awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "not found", nil), http.StatusNotFound, ""),
+	} {
+		if got := storage.storageError("GetObject", "bucket", "key", err); got != err {
+			t.Errorf("Expected %v to be returned unchanged, got %v", err, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// Actions of events.
+const (
+	EventSiteStored  = "site_stored"
+	EventSiteDeleted = "site_deleted"
+	EventUserStored  = "user_stored"
+)
+
+// eventSource is the source of EventBridge events.
+const eventSource = "caddytlss3"
+
+// Event describes a change of the stored data. It's published as JSON to
+// the configured SNS topic and EventBridge bus after the change succeeded,
+// so systems like CDNs and load balancers can pick up renewals without
+// polling the bucket.
+type Event struct {
+	Action string `json:"action"`
+	// Domain is set for site events and Email for user events.
+	Domain string `json:"domain,omitempty"`
+	Email  string `json:"email,omitempty"`
+	// NotAfter is the expiry of the stored certificate, if it can be parsed.
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	CA       string     `json:"ca,omitempty"`
+	Bucket   string     `json:"bucket"`
+	Key      string     `json:"key"`
+	Time     time.Time  `json:"time"`
+}
+
+// notifier publishes events to an SNS topic and/or an EventBridge bus.
+type notifier struct {
+	sns   snsiface.SNSAPI
+	topic string
+
+	events eventbridgeiface.EventBridgeAPI
+	bus    string
+}
+
+// newNotifier returns a notifier for the topic and bus that aren't empty.
+func (s *S3Storage) newNotifier(topicARN, bus string) *notifier {
+	n := &notifier{topic: topicARN, bus: bus}
+	if topicARN != "" {
+		c := sns.New(s.session)
+		s.addDebugHandlers(&c.Handlers)
+		n.sns = c
+	}
+	if bus != "" {
+		c := eventbridge.New(s.session)
+		s.addDebugHandlers(&c.Handlers)
+		n.events = c
+	}
+	return n
+}
+
+// siteEvent returns the event for a change of the site of domain stored at
+// loc, with the expiry of cert if it's not nil.
+func (s *S3Storage) siteEvent(action, domain string, loc *location, cert []byte) *Event {
+	e := &Event{
+		Action: action,
+		Domain: strings.ToLower(domain),
+		CA:     s.ca,
+		Bucket: loc.bucket,
+		Key:    loc.key,
+		Time:   s.now().UTC(),
+	}
+	if c, err := LeafCertificate(cert); err == nil {
+		notAfter := c.NotAfter.UTC()
+		e.NotAfter = &notAfter
+	}
+	return e
+}
+
+// publish sends e to the configured destinations and records it in the
+// audit log. The change it describes has already been made, so failures
+// are only logged.
+func (s *S3Storage) publish(e *Event) {
+	if s.dryRunDeletes && e.Action == EventSiteDeleted {
+		// The site wasn't actually deleted.
+		s.log().Infof("dry run: publish %s event for s3://%s/%s", e.Action, e.Bucket, e.Key)
+		return
+	}
+	s.audit(&AuditRecord{Event: *e})
+	if s.notifier == nil {
+		return
+	}
+	if s.dryRun {
+		s.log().Infof("dry run: publish %s event for s3://%s/%s", e.Action, e.Bucket, e.Key)
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		s.log().Errorf("encoding %s event: %s", e.Action, err)
+		return
+	}
+	n := s.notifier
+	if n.sns != nil {
+		if err := s.publishSNS(e, body); err != nil {
+			s.log().Errorf("publishing %s event for s3://%s/%s to %s: %s", e.Action, e.Bucket, e.Key, n.topic, err)
+		}
+	}
+	if n.events != nil {
+		if err := s.publishEventBridge(e, body); err != nil {
+			s.log().Errorf("publishing %s event for s3://%s/%s to event bus %s: %s", e.Action, e.Bucket, e.Key, n.bus, err)
+		}
+	}
+}
+
+// publishSNS publishes an event with its action as a message attribute so
+// subscriptions can filter on it.
+func (s *S3Storage) publishSNS(e *Event, body []byte) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, err := s.notifier.sns.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: &s.notifier.topic,
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"action": {DataType: aws.String("String"), StringValue: aws.String(e.Action)},
+		},
+	})
+	return err
+}
+
+// publishEventBridge puts an event with the action as its detail type and
+// the object as its resource.
+func (s *S3Storage) publishEventBridge(e *Event, body []byte) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := s.notifier.events.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{
+			EventBusName: &s.notifier.bus,
+			Source:       aws.String(eventSource),
+			DetailType:   aws.String(e.Action),
+			Detail:       aws.String(string(body)),
+			Resources:    []*string{aws.String(s.arn(e.Bucket + "/" + e.Key))},
+			Time:         aws.Time(e.Time),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(res.FailedEntryCount) != 0 && len(res.Entries) != 0 {
+		r := res.Entries[0]
+		return fmt.Errorf("%s: %s", aws.StringValue(r.ErrorCode), aws.StringValue(r.ErrorMessage))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// recordingSNS records published messages.
+type recordingSNS struct {
+	snsiface.SNSAPI
+	mu       sync.Mutex
+	messages []*sns.PublishInput
+}
+
+func (r *recordingSNS) PublishWithContext(ctx aws.Context, in *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, in)
+	return &sns.PublishOutput{MessageId: aws.String("id")}, nil
+}
+
+// recordingEventBridge records put events.
+type recordingEventBridge struct {
+	eventbridgeiface.EventBridgeAPI
+	mu      sync.Mutex
+	entries []*eventbridge.PutEventsRequestEntry
+}
+
+func (r *recordingEventBridge) PutEventsWithContext(ctx aws.Context, in *eventbridge.PutEventsInput, opts ...request.Option) (*eventbridge.PutEventsOutput, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, in.Entries...)
+	return &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil
+}
+
+func TestEvents(t *testing.T) {
+	topic := &recordingSNS{}
+	bus := &recordingEventBridge{}
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket")
+	storage.notifier = &notifier{sns: topic, topic: "arn:aws:sns:us-east-1:123456789012:certs", events: bus, bus: "default"}
+
+	notAfter := time.Now().Add(90 * 24 * time.Hour).UTC().Truncate(time.Second)
+	cert, key := testCertificate(t, []string{"example.com"}, notAfter)
+	if err := storage.StoreSite("Example.com", &caddytls.SiteData{Cert: cert, Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.StoreUser("user@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(topic.messages) != 3 || len(bus.entries) != 3 {
+		t.Fatalf("Expected 3 events, got %d messages and %d entries", len(topic.messages), len(bus.entries))
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(*topic.messages[0].Message), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Action != EventSiteStored || e.Domain != "example.com" || e.Key != "acme/ca/domain/example.com" {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	if e.NotAfter == nil || !e.NotAfter.Equal(notAfter) {
+		t.Errorf("Expected the certificate expiry %s, got %v", notAfter, e.NotAfter)
+	}
+	if a := topic.messages[0].MessageAttributes["action"]; a == nil || *a.StringValue != EventSiteStored {
+		t.Errorf("Expected an action attribute, got %v", a)
+	}
+	for i, action := range []string{EventSiteStored, EventSiteDeleted, EventUserStored} {
+		if dt := aws.StringValue(bus.entries[i].DetailType); dt != action {
+			t.Errorf("Expected event %d to be %s, got %s", i, action, dt)
+		}
+	}
+	if r := aws.StringValue(bus.entries[0].Resources[0]); r != "arn:aws:s3:::bucket/acme/ca/domain/example.com" {
+		t.Errorf("Unexpected resource %s", r)
+	}
+}
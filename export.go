@@ -0,0 +1,76 @@
+package caddytlss3
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// Export writes the site data of all domains in the CA namespace to w as a
+// gzipped tar archive with the files
+//
+//	<domain>/cert.pem
+//	<domain>/key.pem
+//	<domain>/meta.json
+//
+// per domain, e.g. for backups or to move certificates to other storage.
+// meta.json is omitted for sites without metadata. The archive contains
+// private keys, so it must be kept as safe as the bucket.
+func (s *S3Storage) Export(w io.Writer) error {
+	domains, err := s.ListSites()
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	modTime := s.now()
+	for _, domain := range domains {
+		data, err := s.LoadSite(domain)
+		if err != nil {
+			return fmt.Errorf("S3Storage: exporting %s: %s", domain, err)
+		}
+		if err := writeSiteFiles(tw, domain, data, modTime); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	s.log().Infof("exported %d sites", len(domains))
+	return nil
+}
+
+func writeSiteFiles(tw *tar.Writer, domain string, data *caddytls.SiteData, modTime time.Time) error {
+	for _, f := range []struct {
+		name string
+		mode int64
+		body []byte
+	}{
+		{"cert.pem", 0644, data.Cert},
+		{"key.pem", 0600, data.Key},
+		{"meta.json", 0644, data.Meta},
+	} {
+		if f.name == "meta.json" && len(f.body) == 0 {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    domain + "/" + f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.body)),
+			ModTime: modTime,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package caddytlss3
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestExport(t *testing.T) {
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket")
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert1"), Key: []byte("key1"), Meta: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.StoreSite("*.example.org", &caddytls.SiteData{Cert: []byte("cert2"), Key: []byte("key2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := storage.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+		if hdr.Name == "example.com/key.pem" && hdr.Mode != 0600 {
+			t.Errorf("Expected key mode 0600, got %o", hdr.Mode)
+		}
+	}
+	exp := map[string]string{
+		"*.example.org/cert.pem": "cert2",
+		"*.example.org/key.pem":  "key2",
+		"example.com/cert.pem":   "cert1",
+		"example.com/key.pem":    "key1",
+		"example.com/meta.json":  "{}",
+	}
+	if !reflect.DeepEqual(files, exp) {
+		t.Errorf("Expected %v, got %v", exp, files)
+	}
+}
@@ -0,0 +1,359 @@
+// Package fakes provides in-memory fakes of the AWS APIs used by the
+// storage, for tests of the storage and of programs that embed it.
+package fakes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// defaultMaxKeys is the page size of listings when MaxKeys isn't set, as
+// in S3.
+const defaultMaxKeys = 1000
+
+// S3 is an in-memory S3. It implements the object operations used by the
+// storage (get, head, put with If-Match and If-None-Match, copy, delete,
+// and list) with the status codes, error codes, and ETags of S3. Every
+// bucket exists and is empty until written to. Other operations panic.
+//
+// Last modified times come from a logical clock that advances one second
+// per write so the order of writes is deterministic.
+type S3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+	writes  int64
+}
+
+type object struct {
+	data     []byte
+	metadata map[string]*string
+	modified time.Time
+}
+
+// NewS3 returns an empty in-memory S3.
+func NewS3() *S3 {
+	return &S3{buckets: make(map[string]map[string]*object)}
+}
+
+// ETag returns the ETag S3 assigns to an object with the content b.
+func ETag(b []byte) string {
+	h := md5.Sum(b)
+	return `"` + hex.EncodeToString(h[:]) + `"`
+}
+
+// Object returns the content of an object and whether it exists.
+func (f *S3) Object(bucket, key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Metadata returns the user metadata of an object, or nil if it doesn't
+// exist.
+func (f *S3) Metadata(bucket, key string) map[string]*string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if o, ok := f.buckets[bucket][key]; ok {
+		return o.metadata
+	}
+	return nil
+}
+
+// SetObject writes an object unconditionally, e.g. to set up or corrupt
+// state in tests.
+func (f *S3) SetObject(bucket, key string, data []byte, metadata map[string]*string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.put(bucket, key, data, metadata)
+}
+
+// Keys returns the sorted keys of all objects in bucket.
+func (f *S3) Keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keys(bucket)
+}
+
+func (f *S3) keys(bucket string) []string {
+	keys := make([]string, 0, len(f.buckets[bucket]))
+	for k := range f.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *S3) put(bucket, key string, data []byte, metadata map[string]*string) *object {
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		objects = make(map[string]*object)
+		f.buckets[bucket] = objects
+	}
+	f.writes++
+	o := &object{data: data, metadata: metadata, modified: time.Unix(f.writes, 0)}
+	objects[key] = o
+	return o
+}
+
+func (f *S3) get(bucket, key, code string) (*object, error) {
+	o, ok := f.buckets[bucket][key]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(code, "The specified key does not exist.", nil), http.StatusNotFound, "")
+	}
+	return o, nil
+}
+
+func preconditionFailed() error {
+	return awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), http.StatusPreconditionFailed, "")
+}
+
+func (f *S3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return f.PutObjectWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *S3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	var b []byte
+	if in.Body != nil {
+		var err error
+		if b, err = ioutil.ReadAll(in.Body); err != nil {
+			return nil, err
+		}
+	}
+	if in.ContentMD5 != nil {
+		sum := md5.Sum(b)
+		if *in.ContentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return nil, awserr.NewRequestFailure(awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil), http.StatusBadRequest, "")
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, ok := f.buckets[*in.Bucket][*in.Key]
+	if in.IfNoneMatch != nil && ok {
+		return nil, preconditionFailed()
+	}
+	if in.IfMatch != nil && (!ok || ETag(cur.data) != *in.IfMatch) {
+		return nil, preconditionFailed()
+	}
+	f.put(*in.Bucket, *in.Key, b, in.Metadata)
+	return &s3.PutObjectOutput{ETag: aws.String(ETag(b))}, nil
+}
+
+func (f *S3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return f.GetObjectWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *S3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, err := f.get(*in.Bucket, *in.Key, s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return nil, err
+	}
+	if in.IfMatch != nil && ETag(o.data) != *in.IfMatch {
+		return nil, preconditionFailed()
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(o.data)),
+		ContentLength: aws.Int64(int64(len(o.data))),
+		ETag:          aws.String(ETag(o.data)),
+		LastModified:  aws.Time(o.modified),
+		Metadata:      o.metadata,
+	}, nil
+}
+
+func (f *S3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return f.HeadObjectWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *S3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// HEAD responses have no body, so S3 can't return NoSuchKey.
+	o, err := f.get(*in.Bucket, *in.Key, "NotFound")
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(o.data))),
+		ETag:          aws.String(ETag(o.data)),
+		LastModified:  aws.Time(o.modified),
+		Metadata:      o.metadata,
+	}, nil
+}
+
+func (f *S3) HeadBucket(in *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *S3) HeadBucketWithContext(ctx aws.Context, in *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *S3) CopyObject(in *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	return f.CopyObjectWithContext(aws.BackgroundContext(), in)
+}
+
+// CopyObjectWithContext copies an object within or between buckets. The
+// metadata is copied unless the directive is REPLACE.
+func (f *S3) CopyObjectWithContext(ctx aws.Context, in *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	source, err := url.PathUnescape(strings.TrimPrefix(aws.StringValue(in.CopySource), "/"))
+	if err != nil {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidArgument", "Invalid copy source encoding", err), http.StatusBadRequest, "")
+	}
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidArgument", "Invalid copy source", nil), http.StatusBadRequest, "")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	src, err := f.get(parts[0], parts[1], s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return nil, err
+	}
+	if in.CopySourceIfMatch != nil && ETag(src.data) != *in.CopySourceIfMatch {
+		return nil, preconditionFailed()
+	}
+	metadata := src.metadata
+	if aws.StringValue(in.MetadataDirective) == "REPLACE" {
+		metadata = in.Metadata
+	}
+	o := f.put(*in.Bucket, *in.Key, src.data, metadata)
+	return &s3.CopyObjectOutput{CopyObjectResult: &s3.CopyObjectResult{
+		ETag:         aws.String(ETag(o.data)),
+		LastModified: aws.Time(o.modified),
+	}}, nil
+}
+
+func (f *S3) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return f.DeleteObjectWithContext(aws.BackgroundContext(), in)
+}
+
+// DeleteObjectWithContext deletes an object. Like S3 it succeeds if the
+// object doesn't exist.
+func (f *S3) DeleteObjectWithContext(ctx aws.Context, in *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.buckets[*in.Bucket], *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *S3) DeleteObjects(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	return f.DeleteObjectsWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *S3) DeleteObjectsWithContext(ctx aws.Context, in *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.DeleteObjectsOutput{}
+	for _, o := range in.Delete.Objects {
+		delete(f.buckets[*in.Bucket], *o.Key)
+		out.Deleted = append(out.Deleted, &s3.DeletedObject{Key: o.Key})
+	}
+	return out, nil
+}
+
+func (f *S3) ListObjectsV2(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return f.ListObjectsV2WithContext(aws.BackgroundContext(), in)
+}
+
+// ListObjectsV2WithContext lists objects in key order, grouping keys by
+// delimiter into common prefixes. Pages hold up to MaxKeys keys and common
+// prefixes, continuing after the last one.
+func (f *S3) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prefix := aws.StringValue(in.Prefix)
+	delim := aws.StringValue(in.Delimiter)
+	after := aws.StringValue(in.StartAfter)
+	if in.ContinuationToken != nil {
+		after = *in.ContinuationToken
+	}
+	max := int(aws.Int64Value(in.MaxKeys))
+	if in.MaxKeys == nil {
+		max = defaultMaxKeys
+	}
+	out := &s3.ListObjectsV2Output{
+		Prefix:            in.Prefix,
+		ContinuationToken: in.ContinuationToken,
+		IsTruncated:       aws.Bool(false),
+	}
+	var n int
+	var last string
+	for _, k := range f.keys(*in.Bucket) {
+		if !strings.HasPrefix(k, prefix) || k <= after {
+			continue
+		}
+		entry := k
+		if delim != "" {
+			if i := strings.Index(k[len(prefix):], delim); i >= 0 {
+				entry = k[:len(prefix)+i+len(delim)]
+				// Skip the rest of a prefix listed on a previous page.
+				if entry <= after || entry == last {
+					continue
+				}
+			}
+		}
+		if n == max {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(last)
+			break
+		}
+		if entry != k {
+			out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+			// Continue after all keys with the prefix.
+			last = entry
+		} else {
+			o := f.buckets[*in.Bucket][k]
+			out.Contents = append(out.Contents, &s3.Object{
+				Key:          aws.String(k),
+				ETag:         aws.String(ETag(o.data)),
+				Size:         aws.Int64(int64(len(o.data))),
+				LastModified: aws.Time(o.modified),
+			})
+			last = k
+		}
+		n++
+	}
+	out.KeyCount = aws.Int64(int64(n))
+	return out, nil
+}
+
+func (f *S3) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	return f.ListObjectsV2PagesWithContext(aws.BackgroundContext(), in, fn)
+}
+
+func (f *S3) ListObjectsV2PagesWithContext(ctx aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	page := *in
+	for {
+		out, err := f.ListObjectsV2WithContext(ctx, &page, opts...)
+		if err != nil {
+			return err
+		}
+		lastPage := !aws.BoolValue(out.IsTruncated)
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		page.ContinuationToken = out.NextContinuationToken
+	}
+}
@@ -0,0 +1,103 @@
+package fakes
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func statusCode(err error) int {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		return e.StatusCode()
+	}
+	return 0
+}
+
+func TestS3Objects(t *testing.T) {
+	f := NewS3()
+	key := aws.String("a/b")
+	if _, err := f.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: key}); statusCode(err) != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %v", err)
+	}
+	if _, err := f.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: key}); statusCode(err) != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %v", err)
+	}
+
+	out, err := f.PutObject(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: key, Body: strings.NewReader("data"), IfNoneMatch: aws.String("*")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *out.ETag != ETag([]byte("data")) {
+		t.Errorf("Unexpected ETag %s", *out.ETag)
+	}
+	if _, err := f.PutObject(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: key, Body: strings.NewReader("new"), IfNoneMatch: aws.String("*")}); statusCode(err) != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for an existing object, got %v", err)
+	}
+	if _, err := f.PutObject(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: key, Body: strings.NewReader("new"), IfMatch: aws.String(`"stale"`)}); statusCode(err) != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for a stale ETag, got %v", err)
+	}
+	if _, err := f.PutObject(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: key, Body: strings.NewReader("new"), IfMatch: out.ETag}); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := f.Object("bucket", "a/b"); !ok || string(b) != "new" {
+		t.Errorf("Expected the new content, got %q", b)
+	}
+	if _, ok := f.Object("other", "a/b"); ok {
+		t.Error("Expected buckets to be separate")
+	}
+
+	if _, err := f.CopyObject(&s3.CopyObjectInput{Bucket: aws.String("other"), Key: aws.String("copy"), CopySource: aws.String("bucket/a%2Fb")}); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := f.Object("other", "copy"); !ok || string(b) != "new" {
+		t.Errorf("Expected the copied content, got %q", b)
+	}
+
+	if _, err := f.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: key}); err != nil {
+		t.Fatalf("Expected deleting a missing object to succeed, got %v", err)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	f := NewS3()
+	for _, k := range []string{"p/a", "p/b/1", "p/b/2", "p/c", "p/d/1", "q"} {
+		f.SetObject("bucket", k, []byte(k), nil)
+	}
+	var keys, prefixes []string
+	pages := 0
+	err := f.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String("bucket"),
+		Prefix:    aws.String("p/"),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(2),
+	}, func(out *s3.ListObjectsV2Output, last bool) bool {
+		pages++
+		for _, o := range out.Contents {
+			keys = append(keys, *o.Key)
+		}
+		for _, p := range out.CommonPrefixes {
+			prefixes = append(prefixes, *p.Prefix)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 2 {
+		t.Errorf("Expected 2 pages, got %d", pages)
+	}
+	if exp := []string{"p/a", "p/c"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("Expected keys %v, got %v", exp, keys)
+	}
+	if exp := []string{"p/b/", "p/d/"}; !reflect.DeepEqual(prefixes, exp) {
+		t.Errorf("Expected prefixes %v, got %v", exp, prefixes)
+	}
+}
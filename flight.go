@@ -0,0 +1,46 @@
+package caddytlss3
+
+import (
+	"errors"
+	"sync"
+)
+
+// flightGroup collapses concurrent calls for the same key into one, whose
+// result all callers receive. The zero value is ready to use.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// do calls fn unless a call for key is already in flight, in which case it
+// waits for that call and returns its result.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.val, c.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	// The error is replaced by the result of fn unless it panics.
+	c := &flightCall{done: make(chan struct{}), err: errors.New("S3Storage: concurrent call panicked")}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -0,0 +1,66 @@
+package caddytlss3
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// gatedS3 counts reads and holds them until the gate is closed.
+type gatedS3 struct {
+	*fakes.S3
+	gate  chan struct{}
+	reads int32
+}
+
+func (g *gatedS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	atomic.AddInt32(&g.reads, 1)
+	<-g.gate
+	return g.S3.GetObjectWithContext(ctx, in, opts...)
+}
+
+func TestLoadSiteSingleflight(t *testing.T) {
+	client := &gatedS3{S3: fakes.NewS3(), gate: make(chan struct{})}
+	storage := newFakeStorage(t, client.S3, "bucket")
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	storage.s3 = client
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make([]*caddytls.SiteData, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := storage.LoadSite("Example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = data
+		}(i)
+	}
+	// Give all loads time to join the one in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(client.gate)
+	wg.Wait()
+	if reads := atomic.LoadInt32(&client.reads); reads != 1 {
+		t.Errorf("Expected 1 read, got %d", reads)
+	}
+	for i, data := range results {
+		if data == nil || string(data.Cert) != "cert" {
+			t.Fatalf("Unexpected result %d: %+v", i, data)
+		}
+		if i > 0 && data == results[0] {
+			t.Error("Expected every caller to get its own copy")
+		}
+	}
+}
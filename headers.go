@@ -0,0 +1,65 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Content types of stored objects.
+const (
+	contentTypeJSON   = "application/json"
+	contentTypePEM    = "application/x-pem-file"
+	contentTypeText   = "text/plain; charset=utf-8"
+	contentTypeBinary = "application/octet-stream"
+)
+
+// objectCacheControl is the Cache-Control header of stored objects. They
+// hold private keys and change on every renewal, so neither CloudFront nor
+// browsers browsing the bucket should keep copies.
+const objectCacheControl = "private, no-store"
+
+// contentType returns the content type of object contents.
+func contentType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN ")):
+		return contentTypePEM
+	case json.Valid(data):
+		return contentTypeJSON
+	case bytes.IndexByte(data, 0) < 0:
+		return contentTypeText
+	}
+	return contentTypeBinary
+}
+
+// setHeaders sets the content type, unless already set, the cache headers
+// and the Content-MD5 of the body of in, which S3 checks so that bodies
+// corrupted on the way are rejected. The content type is that of the
+// decoded contents, set by compress for compressed objects.
+func setHeaders(in *s3.PutObjectInput) error {
+	if in.CacheControl == nil {
+		in.CacheControl = aws.String(objectCacheControl)
+	}
+	if in.Body == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return err
+	}
+	if _, err := in.Body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if in.ContentType == nil {
+		in.ContentType = aws.String(contentType(data))
+	}
+	sum := md5.Sum(data)
+	in.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	return nil
+}
@@ -0,0 +1,104 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// headerS3 records the headers of every write.
+type headerS3 struct {
+	*fakes.S3
+	puts map[string]*s3.PutObjectInput
+}
+
+func (c headerS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	c.puts[*in.Key] = in
+	return c.S3.PutObjectWithContext(ctx, in, opts...)
+}
+
+func TestObjectHeaders(t *testing.T) {
+	for _, compression := range []string{CompressionNone, CompressionGzip} {
+		client := headerS3{fakes.NewS3(), make(map[string]*s3.PutObjectInput)}
+		storage := newFakeStorage(t, client, "bucket", WithCompression(compression))
+		site := &caddytls.SiteData{Cert: bytes.Repeat([]byte("cert"), compressMinSize)}
+		if err := storage.StoreSite("example.com", site); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.StoreUser("me@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+			t.Fatal(err)
+		}
+		if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+			t.Fatalf("TryLock: %v %v", w, err)
+		}
+		storage.Unlock("example.com")
+
+		for key, want := range map[string]string{
+			"acme/ca/domain/example.com":    contentTypeJSON,
+			"acme/ca/user/me@example.com":   contentTypeJSON,
+			"acme/ca/meta/most-recent-user": contentTypeText,
+			"acme/ca/locks/example.com":     contentTypeJSON,
+		} {
+			in := client.puts[key]
+			if in == nil {
+				t.Errorf("%s: %s not written", compression, key)
+				continue
+			}
+			if got := aws.StringValue(in.ContentType); got != want {
+				t.Errorf("%s: expected %s to have content type %s, got %s", compression, key, want, got)
+			}
+			if got := aws.StringValue(in.CacheControl); got != objectCacheControl {
+				t.Errorf("%s: expected %s to have Cache-Control %s, got %s", compression, key, objectCacheControl, got)
+			}
+			if in.ContentMD5 == nil {
+				t.Errorf("%s: expected %s to have a Content-MD5", compression, key)
+			}
+		}
+		got, err := storage.LoadSite("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Cert, site.Cert) {
+			t.Errorf("%s: site data changed", compression)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	for data, want := range map[string]string{
+		"-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n": contentTypePEM,
+		`{"Reg":"cmVn"}`:   contentTypeJSON,
+		"me@example.com":   contentTypeText,
+		"\x1f\x8b\x08\x00": contentTypeBinary,
+	} {
+		if got := contentType([]byte(data)); got != want {
+			t.Errorf("contentType(%q) = %s, want %s", data, got, want)
+		}
+	}
+}
+
+func TestBadDigest(t *testing.T) {
+	client := fakes.NewS3()
+	in := &s3.PutObjectInput{
+		Bucket:     aws.String("bucket"),
+		Key:        aws.String("key"),
+		Body:       strings.NewReader("data"),
+		ContentMD5: aws.String("1B2M2Y8AsgTpgAmY7PhCfg=="),
+	}
+	if _, err := client.PutObject(in); !isCode(err, "BadDigest") {
+		t.Fatalf("Expected BadDigest, got %v", err)
+	}
+	in.Body = strings.NewReader("data")
+	if err := setHeaders(in); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PutObject(in); err != nil {
+		t.Fatal(err)
+	}
+}
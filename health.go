@@ -0,0 +1,82 @@
+package caddytlss3
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// healthTTL is how long the result of a health check is cached, so that
+// frequent polling by load balancers doesn't turn into as many requests.
+const healthTTL = 10 * time.Second
+
+// healthCache caches the result of Healthy.
+type healthCache struct {
+	mu      sync.Mutex
+	checked bool
+	err     error
+	expires time.Time
+	// checks collapses concurrent checks.
+	checks flightGroup
+}
+
+// get returns whether a result is cached as of now, and the result.
+func (c *healthCache) get(now time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checked && now.Before(c.expires), c.err
+}
+
+// set caches the result of a check as of now and returns the previous one.
+func (c *healthCache) set(err error, now time.Time) (checked bool, prev error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	checked, prev = c.checked, c.err
+	c.checked, c.err, c.expires = true, err, now.Add(healthTTL)
+	return checked, prev
+}
+
+// Healthy returns nil if the buckets of the storage are reachable with
+// the configured credentials, and otherwise why not, e.g. an
+// ErrAccessDenied or ErrBucketNotFound. It's meant for health endpoints
+// and monitoring, so S3 problems are noticed before certificates fail to
+// load. The result is cached for a few seconds.
+func (s *S3Storage) Healthy(ctx context.Context) error {
+	if ok, err := s.health.get(s.now()); ok {
+		return err
+	}
+	_, err := s.health.checks.do("", func() (interface{}, error) {
+		err := s.checkHealth(ctx)
+		checked, prev := s.health.set(err, s.now())
+		switch {
+		case err != nil && (prev == nil || !checked):
+			s.log().Warnf("health check failed: %s", err)
+		case err == nil && prev != nil:
+			s.log().Infof("health check passed again")
+		}
+		return nil, err
+	})
+	return err
+}
+
+// checkHealth checks that the bucket of every root location can be
+// reached with a HeadBucket request.
+func (s *S3Storage) checkHealth(ctx context.Context) error {
+	for _, loc := range s.routes.roots() {
+		opCtx, cancel := ctx, context.CancelFunc(func() {})
+		if s.timeout > 0 {
+			opCtx, cancel = context.WithTimeout(ctx, s.timeout)
+		}
+		_, err := loc.s3.HeadBucketWithContext(opCtx, &s3.HeadBucketInput{Bucket: &loc.bucket})
+		cancel()
+		if isNotFound(err) {
+			return ErrBucketNotFound{Bucket: loc.bucket, RequestID: requestID(err), Err: err}
+		}
+		if err != nil {
+			return s.storageError("HeadBucket", loc.bucket, "", err)
+		}
+	}
+	return nil
+}
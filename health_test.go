@@ -0,0 +1,68 @@
+package caddytlss3
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// headBucketS3 counts HeadBucket requests and fails them with err.
+type headBucketS3 struct {
+	*fakes.S3
+	calls *int
+	err   *error
+}
+
+func (c headBucketS3) HeadBucketWithContext(ctx aws.Context, in *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	*c.calls++
+	if *c.err != nil {
+		return nil, *c.err
+	}
+	return c.S3.HeadBucketWithContext(ctx, in, opts...)
+}
+
+func TestHealthy(t *testing.T) {
+	var calls int
+	var headErr error
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, headBucketS3{fakes.NewS3(), &calls, &headErr}, "bucket", WithClock(clock))
+
+	if err := storage.Healthy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The result is cached.
+	headErr = awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "req-1")
+	if err := storage.Healthy(context.Background()); err != nil || calls != 1 {
+		t.Fatalf("Expected the cached result after %d calls, got %v", calls, err)
+	}
+
+	clock.Add(healthTTL)
+	err := storage.Healthy(context.Background())
+	if _, ok := err.(ErrAccessDenied); !ok {
+		t.Fatalf("Expected ErrAccessDenied, got %T %v", err, err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", calls)
+	}
+
+	clock.Add(healthTTL)
+	headErr = awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	if err := storage.Healthy(context.Background()); err == nil {
+		t.Fatal("Expected an error for a missing bucket")
+	} else if _, ok := err.(ErrBucketNotFound); !ok {
+		t.Fatalf("Expected ErrBucketNotFound, got %T %v", err, err)
+	}
+
+	clock.Add(healthTTL)
+	headErr = nil
+	if err := storage.Healthy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
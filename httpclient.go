@@ -0,0 +1,88 @@
+package caddytlss3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPSettings tune the HTTP client used for AWS requests, e.g. for
+// corporate networks with a proxy. They're ignored if Config.HTTPClient is
+// set. Zero values keep the defaults of net/http.
+type HTTPSettings struct {
+	// ProxyURL is the proxy for all requests. By default HTTPS_PROXY,
+	// HTTP_PROXY, and NO_PROXY are used.
+	ProxyURL string
+	// CAFile is a PEM bundle of certificate authorities that are trusted
+	// in addition to the system ones, e.g. of a TLS intercepting proxy.
+	CAFile              string
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// MaxIdleConns is the number of idle connections kept per host.
+	MaxIdleConns int
+}
+
+func (h HTTPSettings) validate() error {
+	if h.ProxyURL != "" {
+		u, err := url.Parse(h.ProxyURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q", h.ProxyURL)
+		}
+	}
+	if h.DialTimeout < 0 || h.TLSHandshakeTimeout < 0 || h.MaxIdleConns < 0 {
+		return errors.New("HTTP timeouts and connection limits must not be negative")
+	}
+	return nil
+}
+
+// client returns an HTTP client with the settings applied, or nil if
+// there are none.
+func (h HTTPSettings) client() (*http.Client, error) {
+	if h == (HTTPSettings{}) {
+		return nil, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if h.ProxyURL != "" {
+		u, err := url.Parse(h.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if h.CAFile != "" {
+		pem, err := ioutil.ReadFile(h.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", h.CAFile)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if h.DialTimeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   h.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if h.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = h.TLSHandshakeTimeout
+	}
+	if h.MaxIdleConns > 0 {
+		t.MaxIdleConnsPerHost = h.MaxIdleConns
+		if t.MaxIdleConns < h.MaxIdleConns {
+			t.MaxIdleConns = h.MaxIdleConns
+		}
+	}
+	return &http.Client{Transport: t}, nil
+}
@@ -0,0 +1,48 @@
+package caddytlss3
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPSettings(t *testing.T) {
+	if c, err := (HTTPSettings{}).client(); err != nil || c != nil {
+		t.Fatalf("Expected no client without settings, got %v, %v", c, err)
+	}
+
+	certPEM, _ := testCertificate(t, []string{"proxy.internal"}, time.Now().Add(time.Hour))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := HTTPSettings{
+		ProxyURL:            "http://proxy.internal:3128",
+		CAFile:              caFile,
+		TLSHandshakeTimeout: 3 * time.Second,
+		MaxIdleConns:        50,
+	}.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := c.Transport.(*http.Transport)
+	req, _ := http.NewRequest("GET", "https://bucket.s3.amazonaws.com/", nil)
+	if u, err := tr.Proxy(req); err != nil || u.Host != "proxy.internal:3128" {
+		t.Errorf("Unexpected proxy %v, %v", u, err)
+	}
+	if tr.TLSClientConfig == nil || tr.TLSClientConfig.RootCAs == nil {
+		t.Error("Expected the CA file to be trusted")
+	}
+	if tr.TLSHandshakeTimeout != 3*time.Second || tr.MaxIdleConnsPerHost != 50 {
+		t.Errorf("Unexpected transport settings %v, %d", tr.TLSHandshakeTimeout, tr.MaxIdleConnsPerHost)
+	}
+
+	if _, err := (HTTPSettings{CAFile: filepath.Join(t.TempDir(), "missing.pem")}).client(); err == nil {
+		t.Error("Expected an error for a missing CA file")
+	}
+	if err := (HTTPSettings{ProxyURL: "proxy"}).validate(); err == nil {
+		t.Error("Expected an error for a proxy URL without host")
+	}
+}
@@ -0,0 +1,114 @@
+package caddytlss3
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// ImportSite stores a PEM encoded certificate chain and private key that
+// were obtained elsewhere, e.g. by certbot or another Caddy instance, as
+// the site data for domain. The key must match the certificate and the
+// certificate must be valid for domain. It replaces the stored
+// certificate, even one that expires later.
+func (s *S3Storage) ImportSite(domain string, certPEM, keyPEM []byte) error {
+	if err := checkKeyPair(domain, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("S3Storage: importing %s: %s", domain, err)
+	}
+	return s.StoreSite(domain, &caddytls.SiteData{Cert: certPEM, Key: keyPEM})
+}
+
+// checkKeyPair checks that keyPEM is the key of the leaf certificate in
+// certPEM and that the certificate is valid for domain.
+func checkKeyPair(domain string, certPEM, keyPEM []byte) error {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return err
+	}
+	cert, err := LeafCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, domain) {
+			return nil
+		}
+	}
+	return cert.VerifyHostname(domain)
+}
+
+// Import stores the sites in a gzipped tar archive as written by Export,
+// with cert.pem, key.pem, and optionally meta.json in a directory per
+// domain. The fullchain.pem and privkey.pem files of a certbot live
+// directory are accepted too. Sites are imported like with ImportSite; the
+// first site that fails aborts the import.
+func (s *S3Storage) Import(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("S3Storage: reading import archive: %s", err)
+	}
+	defer gz.Close()
+	sites := make(map[string]*caddytls.SiteData)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("S3Storage: reading import archive: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		dir, file := path.Split(strings.TrimPrefix(path.Clean(hdr.Name), "./"))
+		domain := path.Base(dir)
+		if dir == "" || domain == "." || domain == "/" {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("S3Storage: reading import archive: %s", err)
+		}
+		data := sites[domain]
+		if data == nil {
+			data = new(caddytls.SiteData)
+			sites[domain] = data
+		}
+		switch file {
+		case "cert.pem", "fullchain.pem":
+			data.Cert = b
+		case "key.pem", "privkey.pem":
+			data.Key = b
+		case "meta.json":
+			data.Meta = b
+		}
+	}
+
+	domains := make([]string, 0, len(sites))
+	for domain, data := range sites {
+		// Directories with other files, e.g. certbot's archive directory.
+		if data.Cert != nil || data.Key != nil {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		data := sites[domain]
+		if err := checkKeyPair(domain, data.Cert, data.Key); err != nil {
+			return fmt.Errorf("S3Storage: importing %s: %s", domain, err)
+		}
+		if err := s.StoreSite(domain, data); err != nil {
+			return err
+		}
+	}
+	s.log().Infof("imported %d sites", len(domains))
+	return nil
+}
@@ -0,0 +1,92 @@
+package caddytlss3
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestImportSite(t *testing.T) {
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket")
+	notAfter := time.Now().Add(time.Hour)
+	certPEM, keyPEM := testCertificate(t, []string{"example.com", "*.example.com"}, notAfter)
+	_, otherKey := testCertificate(t, []string{"example.com"}, notAfter)
+
+	if err := storage.ImportSite("example.com", certPEM, otherKey); err == nil {
+		t.Error("Expected an error for a key that doesn't match")
+	}
+	if err := storage.ImportSite("example.org", certPEM, keyPEM); err == nil {
+		t.Error("Expected an error for a certificate of another domain")
+	}
+	for _, domain := range []string{"example.com", "*.example.com", "www.example.com"} {
+		if err := storage.ImportSite(domain, certPEM, keyPEM); err != nil {
+			t.Fatalf("Importing %s: %s", domain, err)
+		}
+		data, err := storage.LoadSite(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data.Cert, certPEM) || !bytes.Equal(data.Key, keyPEM) {
+			t.Errorf("Expected the imported certificate for %s", domain)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	src := newFakeStorage(t, fakes.NewS3(), "bucket")
+	notAfter := time.Now().Add(time.Hour)
+	certPEM, keyPEM := testCertificate(t, []string{"example.com"}, notAfter)
+	if err := src.StoreSite("example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM, Meta: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newFakeStorage(t, fakes.NewS3(), "bucket", WithCA("other"))
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data, err := dst.LoadSite("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data.Cert, certPEM) || !bytes.Equal(data.Key, keyPEM) || string(data.Meta) != "{}" {
+		t.Errorf("Expected the exported site, got %+v", data)
+	}
+
+	// A certbot live directory.
+	certPEM, keyPEM = testCertificate(t, []string{"example.org"}, notAfter)
+	buf.Reset()
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range map[string][]byte{
+		"live/example.org/fullchain.pem": certPEM,
+		"live/example.org/privkey.pem":   keyPEM,
+		"live/example.org/README":        []byte("readme"),
+		"live/README":                    []byte("readme"),
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gz.Close()
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := dst.LoadSite("example.org"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data.Cert, certPEM) {
+		t.Error("Expected the certbot certificate")
+	}
+}
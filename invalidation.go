@@ -0,0 +1,174 @@
+package caddytlss3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	// invalidationWaitSeconds is the long polling wait of each receive.
+	invalidationWaitSeconds = 20
+	// invalidationRetryDelay is the pause after a failed receive.
+	invalidationRetryDelay = 5 * time.Second
+)
+
+// invalidationConsumers are the running consumers by queue URL. The caches
+// are shared by all storage instances, so each queue is consumed once per
+// process no matter how many instances Caddy constructs.
+var (
+	invalidationConsumersMu sync.Mutex
+	invalidationConsumers   = make(map[string]*invalidationConsumer)
+)
+
+// invalidationConsumer evicts cached data changed by other hosts. Each
+// host has its own SQS queue subscribed to the event topic or bus (see
+// Config.EventTopicARN), which the events of every host are delivered to.
+type invalidationConsumer struct {
+	s            *S3Storage
+	sqs          sqsiface.SQSAPI
+	queueURL     string
+	onInvalidate func(domain string)
+
+	// refs counts the open instances using the consumer.
+	refs int
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startInvalidation consumes the queue at queueURL until the storage is
+// closed, starting a consumer unless another instance already did.
+func (s *S3Storage) startInvalidation(client sqsiface.SQSAPI, queueURL string, onInvalidate func(domain string)) {
+	s.invalidationQueue = queueURL
+	invalidationConsumersMu.Lock()
+	c, ok := invalidationConsumers[queueURL]
+	if !ok {
+		c = &invalidationConsumer{
+			s:            s,
+			sqs:          client,
+			queueURL:     queueURL,
+			onInvalidate: onInvalidate,
+			stop:         make(chan struct{}),
+			done:         make(chan struct{}),
+		}
+		invalidationConsumers[queueURL] = c
+		go c.run()
+	}
+	c.refs++
+	invalidationConsumersMu.Unlock()
+	s.onClose(c.release)
+}
+
+// release stops the consumer once no open instance uses it.
+func (c *invalidationConsumer) release() error {
+	invalidationConsumersMu.Lock()
+	c.refs--
+	if c.refs > 0 {
+		invalidationConsumersMu.Unlock()
+		return nil
+	}
+	delete(invalidationConsumers, c.queueURL)
+	invalidationConsumersMu.Unlock()
+	close(c.stop)
+	<-c.done
+	return nil
+}
+
+func (c *invalidationConsumer) run() {
+	defer close(c.done)
+	ctx, cancel := context.WithCancel(c.s.ctx)
+	defer cancel()
+	go func() {
+		<-c.stop
+		cancel()
+	}()
+	for ctx.Err() == nil {
+		res, err := c.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            &c.queueURL,
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(invalidationWaitSeconds),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.s.log().Errorf("receiving invalidations from %s: %s", c.queueURL, err)
+			select {
+			case <-time.After(invalidationRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for _, m := range res.Messages {
+			e, err := parseInvalidation(aws.StringValue(m.Body))
+			if err != nil {
+				// Messages that can't be parsed never will be, so they're
+				// deleted rather than received again.
+				c.s.log().Errorf("ignoring invalidation message %s: %s", aws.StringValue(m.MessageId), err)
+			} else {
+				c.invalidate(e)
+			}
+			dctx, dcancel := c.s.opContext()
+			_, err = c.sqs.DeleteMessageWithContext(dctx, &sqs.DeleteMessageInput{
+				QueueUrl:      &c.queueURL,
+				ReceiptHandle: m.ReceiptHandle,
+			})
+			dcancel()
+			if err != nil {
+				c.s.log().Errorf("deleting invalidation message %s: %s", aws.StringValue(m.MessageId), err)
+			}
+		}
+	}
+}
+
+// invalidate evicts the cached data the event is about, including the
+// parts of sites in the split layout, and reports changed sites to the
+// callback.
+func (c *invalidationConsumer) invalidate(e *Event) {
+	c.s.invalidate(e.Bucket, e.Key)
+	if e.Domain == "" {
+		return
+	}
+	for _, part := range []string{splitCert, splitKey, splitMeta} {
+		c.s.invalidate(e.Bucket, e.Key+"/"+part)
+	}
+	c.s.log().Debugf("invalidated %s after %s", e.Domain, e.Action)
+	if c.onInvalidate != nil {
+		c.onInvalidate(e.Domain)
+	}
+}
+
+// parseInvalidation returns the event in a message body, which is either
+// an SNS notification, an EventBridge event, or the event itself (e.g. for
+// SNS subscriptions with raw message delivery).
+func parseInvalidation(body string) (*Event, error) {
+	var envelope struct {
+		Type    string
+		Message string
+		Detail  json.RawMessage `json:"detail"`
+	}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+		return nil, err
+	}
+	raw := []byte(body)
+	switch {
+	case envelope.Type == "Notification":
+		raw = []byte(envelope.Message)
+	case len(envelope.Detail) != 0:
+		raw = envelope.Detail
+	}
+	e := new(Event)
+	if err := json.Unmarshal(raw, e); err != nil {
+		return nil, err
+	}
+	if e.Action == "" || e.Bucket == "" || e.Key == "" {
+		return nil, errors.New("not a storage event")
+	}
+	return e, nil
+}
@@ -0,0 +1,110 @@
+package caddytlss3
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// chanSQS delivers the messages sent on a channel and records deletes.
+type chanSQS struct {
+	sqsiface.SQSAPI
+	messages chan string
+	mu       sync.Mutex
+	deleted  []string
+}
+
+func (q *chanSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	select {
+	case body := <-q.messages:
+		return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{{Body: &body, ReceiptHandle: aws.String(body)}}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *chanSQS) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleted = append(q.deleted, *in.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestParseInvalidation(t *testing.T) {
+	event := `{"action":"site_stored","domain":"example.com","bucket":"bucket","key":"acme/ca/domain/example.com"}`
+	notification, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": event})
+	for name, body := range map[string]string{
+		"raw":         event,
+		"sns":         string(notification),
+		"eventbridge": `{"source":"caddytlss3","detail-type":"site_stored","detail":` + event + `}`,
+	} {
+		e, err := parseInvalidation(body)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if e.Domain != "example.com" || e.Key != "acme/ca/domain/example.com" {
+			t.Errorf("%s: unexpected event %+v", name, e)
+		}
+	}
+	if _, err := parseInvalidation(`{"hello":"world"}`); err == nil {
+		t.Error("Expected an error for a message that isn't an event")
+	}
+}
+
+func TestInvalidationQueue(t *testing.T) {
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket", WithCache(time.Hour, ""), WithContext(context.Background()))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	ck := cacheKey("bucket", "acme/ca/domain/example.com")
+	objectCache.Lock()
+	_, cached := objectCache.entries[ck]
+	objectCache.Unlock()
+	if !cached {
+		t.Fatal("Expected the site to be cached")
+	}
+
+	queue := &chanSQS{messages: make(chan string)}
+	invalidated := make(chan string, 1)
+	storage.startInvalidation(queue, "https://sqs.us-east-1.amazonaws.com/123456789012/host-1", func(domain string) {
+		invalidated <- domain
+	})
+	defer storage.Close()
+	queue.messages <- "not json"
+	queue.messages <- `{"action":"site_stored","domain":"example.com","bucket":"bucket","key":"acme/ca/domain/example.com"}`
+	select {
+	case domain := <-invalidated:
+		if domain != "example.com" {
+			t.Errorf("Expected example.com to be invalidated, got %s", domain)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the site to be invalidated")
+	}
+	objectCache.Lock()
+	_, cached = objectCache.entries[ck]
+	objectCache.Unlock()
+	if cached {
+		t.Error("Expected the cache entry to be evicted")
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.deleted) != 2 {
+		t.Errorf("Expected both messages to be deleted, got %v", queue.deleted)
+	}
+}
@@ -0,0 +1,89 @@
+package caddytlss3
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// escapeName returns the key component for a domain or email. Names are
+// lowercased and every byte other than a-z, 0-9, '.', '-', '_', and '@' is
+// percent-encoded, so "*.example.com" is stored as "%2A.example.com" and a
+// name can't add path segments to a key or collide with another name.
+func escapeName(name string) string {
+	name = strings.ToLower(name)
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_' || c == '@' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
+
+// unescapeName reverses escapeName. Components of keys written before names
+// were escaped are returned unchanged unless they happen to contain a valid
+// escape sequence.
+func unescapeName(s string) string {
+	name, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return name
+}
+
+// legacyName returns the key component used for name before names were
+// escaped, and whether it differs from the escaped one. Reads fall back to
+// it so data stored by earlier versions remains available.
+func legacyName(name string) (string, bool) {
+	name = strings.ToLower(name)
+	return name, name != escapeName(name)
+}
+
+// legacySite returns the location of the site data for domain stored before
+// names were escaped, or nil if the key of domain is unchanged. l must be
+// the location of the site data for domain.
+func (l *location) legacySite(domain string) *location {
+	name, ok := legacyName(domain)
+	if !ok {
+		return nil
+	}
+	return l.withKey(l.prefix + "domain/" + name)
+}
+
+// siteLocations returns the locations of the objects whose metadata
+// describes the site data for domain, in lookup order: the certificate in
+// the split layout, the JSON object, and the JSON object stored before
+// names were escaped.
+func (s *S3Storage) siteLocations(domain string) []*location {
+	loc := s.routes.site(domain)
+	var locs []*location
+	if s.split {
+		locs = append(locs, loc.splitPart(splitCert))
+	}
+	locs = append(locs, loc)
+	if legacy := loc.legacySite(domain); legacy != nil {
+		locs = append(locs, legacy)
+	}
+	return locs
+}
+
+// deleteLegacySite deletes site data stored at a legacy location.
+func (s *S3Storage) deleteLegacySite(legacy *location) error {
+	err := s.deleteObject(legacy.s3, &s3.DeleteObjectInput{
+		Bucket: &legacy.bucket,
+		Key:    &legacy.key,
+	})
+	s.invalidate(legacy.bucket, legacy.key)
+	if err == nil && !s.dryRun {
+		s.deleteMirror(legacy.bucket, legacy.key)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestEscapeName(t *testing.T) {
+	for name, exp := range map[string]string{
+		"Example.COM":            "example.com",
+		"*.example.com":          "%2A.example.com",
+		"user+tag@example.com":   "user%2Btag@example.com",
+		"a/b@example.com":        "a%2Fb@example.com",
+		"100%@example.com":       "100%25@example.com",
+		"ü@example.com":          "%C3%BC@example.com",
+		"under_score-dash.local": "under_score-dash.local",
+	} {
+		if got := escapeName(name); got != exp {
+			t.Errorf("escapeName(%q) = %q, expected %q", name, got, exp)
+		}
+		if got := unescapeName(exp); got != strings.ToLower(name) {
+			t.Errorf("unescapeName(%q) = %q, expected %q", exp, got, strings.ToLower(name))
+		}
+	}
+}
+
+func TestEscapedKeys(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}
+	if err := storage.StoreSite("*.example.com", site); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/domain/%2A.example.com"); !ok {
+		t.Fatal("Expected the site to be stored under the escaped key")
+	}
+	if data, err := storage.LoadSite("*.example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Cert) != "cert" {
+		t.Errorf("Expected the stored site, got %q", data.Cert)
+	}
+	if err := storage.StoreUser("user+tag@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := storage.ListSites(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"*.example.com"}) {
+		t.Errorf("Expected the unescaped domain from ListSites, got %v", names)
+	}
+	if names, err := storage.ListUsers(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"user+tag@example.com"}) {
+		t.Errorf("Expected the unescaped email from ListUsers, got %v", names)
+	}
+}
+
+func TestLegacyKeys(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+
+	// Data stored before names were escaped.
+	site, _ := json.Marshal(&caddytls.SiteData{Cert: []byte("old"), Key: []byte("key")})
+	client.SetObject("bucket", "acme/ca/domain/*.example.com", site, nil)
+	user, _ := json.Marshal(&caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")})
+	client.SetObject("bucket", "acme/ca/user/user+tag@example.com", user, nil)
+
+	if ok, err := storage.SiteExists("*.example.com"); err != nil || !ok {
+		t.Fatalf("Expected the legacy site to exist, got %t, %v", ok, err)
+	}
+	if _, err := storage.StatSite("*.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.LoadSite("*.example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Cert) != "old" {
+		t.Errorf("Expected the legacy site, got %q", data.Cert)
+	}
+	if _, err := storage.LoadUser("user+tag@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing moves the site to the escaped key.
+	if err := storage.StoreSite("*.example.com", &caddytls.SiteData{Cert: []byte("new"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/domain/*.example.com"); ok {
+		t.Error("Expected the legacy site to be deleted")
+	}
+	if data, err := storage.LoadSite("*.example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Cert) != "new" {
+		t.Errorf("Expected the new site, got %q", data.Cert)
+	}
+
+	if err := storage.DeleteUser("user+tag@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/user/user+tag@example.com"); ok {
+		t.Error("Expected the legacy account to be deleted")
+	}
+}
@@ -0,0 +1,153 @@
+package caddytlss3
+
+import (
+	"sync"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// leaderLockName is the distributed lock held by the leader. It's not a
+// valid domain name so it can't clash with the lock of a site.
+const leaderLockName = ".leader"
+
+// electors are the running elections by bucket and CA namespace. Like
+// locks they're shared by all storage instances, so a process stays
+// leader across Caddy reloads.
+var (
+	electorsMu sync.Mutex
+	electors   = make(map[string]*elector)
+)
+
+// elector campaigns for the leadership of the hosts sharing a CA namespace
+// by holding the leader lock, renewing it like a site lock. Only the
+// leader renews certificates that are already stored; followers wait for
+// the leader to store them. Issuing certificates for new names isn't
+// affected, so followers can still serve on-demand names.
+type elector struct {
+	s   *S3Storage
+	key string
+
+	mu sync.Mutex
+	// fence is the fencing token of the leader lock while leader.
+	fence uint64
+
+	// refs counts the open instances using the elector.
+	refs int
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startElection joins the leader election of the CA namespace until the
+// storage is closed.
+func (s *S3Storage) startElection() {
+	key := s.bucket + "/" + s.prefix
+	electorsMu.Lock()
+	e, ok := electors[key]
+	if !ok {
+		e = &elector{s: s, key: key, stop: make(chan struct{}), done: make(chan struct{})}
+		electors[key] = e
+		e.campaign()
+		go e.run()
+	}
+	e.refs++
+	electorsMu.Unlock()
+	s.elector = e
+	s.onClose(e.release)
+}
+
+// IsLeader returns true unless leader election is enabled and another
+// host is the leader.
+func (s *S3Storage) IsLeader() bool {
+	return s.elector == nil || s.elector.isLeader()
+}
+
+func (e *elector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.fence != 0
+}
+
+// release stops campaigning, and gives up the leadership so another host
+// takes over right away, once no open instance uses the elector.
+func (e *elector) release() error {
+	electorsMu.Lock()
+	e.refs--
+	if e.refs > 0 {
+		electorsMu.Unlock()
+		return nil
+	}
+	delete(electors, e.key)
+	electorsMu.Unlock()
+	close(e.stop)
+	<-e.done
+	e.mu.Lock()
+	fence := e.fence
+	e.mu.Unlock()
+	if fence == 0 {
+		return nil
+	}
+	e.s.log().Infof("resigning as leader of s3://%s", e.key)
+	return e.s.locker.unlock(leaderLockName, fence)
+}
+
+func (e *elector) run() {
+	defer close(e.done)
+	t := e.s.newTicker(e.s.locker.lease() / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-t.C():
+		}
+		e.campaign()
+	}
+}
+
+// campaign renews the leader lock while leader, and otherwise tries to
+// obtain it.
+func (e *elector) campaign() {
+	e.mu.Lock()
+	fence := e.fence
+	e.mu.Unlock()
+	if fence != 0 {
+		err := e.s.locker.renew(leaderLockName, fence)
+		if err == errLockLost {
+			e.s.log().Warnf("lost leadership of s3://%s", e.key)
+			e.mu.Lock()
+			e.fence = 0
+			e.mu.Unlock()
+		} else if err != nil {
+			e.s.log().Warnf("renewing leadership of s3://%s: %s", e.key, err)
+		}
+		return
+	}
+	w, fence, err := e.s.locker.tryLock(leaderLockName)
+	if err != nil {
+		e.s.log().Warnf("campaigning for leadership of s3://%s: %s", e.key, err)
+		return
+	}
+	if w != nil {
+		return
+	}
+	e.s.log().Infof("elected leader of s3://%s", e.key)
+	e.mu.Lock()
+	e.fence = fence
+	e.mu.Unlock()
+}
+
+// followerWaiter returns a Waiter for a follower's attempt to lock name,
+// or nil if the lock should be obtained as usual. Renewals of stored sites
+// are left to the leader, so a follower returns right away and reloads the
+// site instead of renewing it.
+func (s *S3Storage) followerWaiter(name string) caddytls.Waiter {
+	if s.IsLeader() {
+		return nil
+	}
+	exists, err := s.SiteExists(name)
+	if err != nil || !exists {
+		return nil
+	}
+	s.log().Debugf("not renewing %s as a follower", name)
+	return new(sync.WaitGroup)
+}
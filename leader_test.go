@@ -0,0 +1,59 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestLeaderElection(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another host is the leader.
+	other, _ := json.Marshal(&lockInfo{Owner: "other", Created: clock.Now(), Expires: clock.Now().Add(time.Minute), Fence: 1})
+	client.SetObject("bucket", "acme/ca/locks/"+leaderLockName, other, nil)
+	storage.startElection()
+	defer storage.Close()
+	if storage.IsLeader() {
+		t.Fatal("Expected to be a follower")
+	}
+	if w, err := storage.TryLock("example.com"); err != nil || w == nil {
+		t.Fatalf("Expected a follower to leave renewals to the leader, got %v, %v", w, err)
+	} else {
+		w.Wait()
+	}
+	if w, err := storage.TryLock("new.example.com"); err != nil || w != nil {
+		t.Fatalf("Expected a follower to issue new names, got %v, %v", w, err)
+	}
+	if err := storage.Unlock("new.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leader goes away.
+	clock.Add(2 * time.Minute)
+	storage.elector.campaign()
+	if !storage.IsLeader() {
+		t.Fatal("Expected to be elected once the lease expired")
+	}
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("Expected the leader to renew, got %v, %v", w, err)
+	}
+	if err := storage.Unlock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !lockReleased(t, client, "bucket", "acme/ca/locks/"+leaderLockName) {
+		t.Error("Expected the leader lock to be released on close")
+	}
+}
@@ -0,0 +1,189 @@
+package caddytlss3
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RequestLimits caps the S3 requests of the process, e.g. so that
+// on-demand TLS for many names stays below the request rates S3 supports
+// per prefix and doesn't exhaust sockets. Reads and writes have separate
+// budgets so that a burst of loads can't hold up renewals. Requests wait
+// for their turn, within the operation timeout. Zero fields are unlimited.
+type RequestLimits struct {
+	// MaxReads and MaxWrites cap the number of requests in flight.
+	MaxReads  int
+	MaxWrites int
+	// ReadRate and WriteRate are the requests started per second. Bursts
+	// of up to a second worth of requests are allowed.
+	ReadRate  float64
+	WriteRate float64
+}
+
+func (l RequestLimits) validate() error {
+	if l.MaxReads < 0 || l.MaxWrites < 0 || l.ReadRate < 0 || l.WriteRate < 0 {
+		return errors.New("request limits must not be negative")
+	}
+	return nil
+}
+
+// requestLimits are the limiters of reads and writes.
+type requestLimits struct {
+	reads, writes *requestLimiter
+	// releases holds the release functions of requests in flight.
+	releases sync.Map
+}
+
+// sharedRequestLimits returns the limiters for l, nil if l is unlimited.
+func sharedRequestLimits(l RequestLimits) *requestLimits {
+	if l == (RequestLimits{}) {
+		return nil
+	}
+	requestLimiters.Lock()
+	defer requestLimiters.Unlock()
+	rl, ok := requestLimiters.m[l]
+	if !ok {
+		rl = &requestLimits{
+			reads:  newRequestLimiter(l.MaxReads, l.ReadRate),
+			writes: newRequestLimiter(l.MaxWrites, l.WriteRate),
+		}
+		requestLimiters.m[l] = rl
+	}
+	return rl
+}
+
+// isWriteOperation returns true if the S3 operation modifies the bucket.
+func isWriteOperation(name string) bool {
+	for _, p := range []string{"Put", "Delete", "Copy", "Create", "Restore", "Upload", "Complete", "Abort"} {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlers returns the request handlers that wait for the limiter of the
+// operation before the request is built, and release it once the request,
+// including its retries, is complete.
+func (rl *requestLimits) handlers() (acquire, release request.NamedHandler) {
+	acquire = request.NamedHandler{
+		Name: "caddytlss3.LimitRequests",
+		Fn: func(r *request.Request) {
+			l := rl.reads
+			if r.Operation != nil && isWriteOperation(r.Operation.Name) {
+				l = rl.writes
+			}
+			done, err := l.acquire(r.Context())
+			if err != nil {
+				r.Error = awserr.New(request.CanceledErrorCode, "S3Storage: gave up waiting for the request limit", err)
+				return
+			}
+			rl.releases.Store(r, done)
+		},
+	}
+	release = request.NamedHandler{
+		Name: "caddytlss3.ReleaseRequestLimit",
+		Fn: func(r *request.Request) {
+			if done, ok := rl.releases.Load(r); ok {
+				rl.releases.Delete(r)
+				done.(func())()
+			}
+		},
+	}
+	return acquire, release
+}
+
+// requestLimiter caps the requests in flight with a semaphore and the rate
+// at which they start with a token bucket.
+type requestLimiter struct {
+	sem  chan struct{} // nil for no cap
+	rate float64       // zero for no limit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRequestLimiter(max int, rate float64) *requestLimiter {
+	l := &requestLimiter{rate: rate, tokens: burst(rate), last: time.Now()}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+func (l *requestLimiter) String() string {
+	max, rate := "unlimited", "unlimited"
+	if l.sem != nil {
+		max = strconv.Itoa(cap(l.sem))
+	}
+	if l.rate > 0 {
+		rate = strconv.FormatFloat(l.rate, 'g', -1, 64) + "/s"
+	}
+	return max + " in flight at " + rate
+}
+
+// burst returns the size of the token bucket for rate.
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// acquire waits until a request may start or ctx is done, and returns the
+// function to call once the request is complete.
+func (l *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	if err := l.waitRate(ctx); err != nil {
+		return nil, err
+	}
+	if l.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return func() { <-l.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waitRate takes a token, waiting for one to become available if needed.
+func (l *requestLimiter) waitRate(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if b := burst(l.rate); l.tokens > b {
+		l.tokens = b
+	}
+	l.last = now
+	// Taking the token before waiting for it reserves it, so waiters are
+	// served in order.
+	l.tokens--
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
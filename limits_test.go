@@ -0,0 +1,112 @@
+package caddytlss3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestRequestLimits(t *testing.T) {
+	rl := &requestLimits{reads: newRequestLimiter(1, 0), writes: newRequestLimiter(1, 0)}
+	acquire, release := rl.handlers()
+	get := &request.Request{Operation: &request.Operation{Name: "GetObject"}}
+	acquire.Fn(get)
+	if get.Error != nil {
+		t.Fatal(get.Error)
+	}
+	// Writes have their own budget.
+	put := &request.Request{Operation: &request.Operation{Name: "PutObject"}}
+	acquire.Fn(put)
+	if put.Error != nil {
+		t.Fatal(put.Error)
+	}
+
+	// Another read waits for the first one to complete.
+	acquired := make(chan struct{})
+	head := &request.Request{Operation: &request.Operation{Name: "HeadObject"}}
+	go func() {
+		acquire.Fn(head)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected the second read to wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release.Fn(get)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second read to start once the first completed")
+	}
+	release.Fn(head)
+	release.Fn(put)
+	// Releasing twice has no effect.
+	release.Fn(put)
+	if n := len(rl.writes.sem); n != 0 {
+		t.Errorf("Expected no writes in flight, got %d", n)
+	}
+}
+
+func TestRequestLimiterCanceled(t *testing.T) {
+	l := newRequestLimiter(1, 0)
+	done, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+
+}
+
+func TestRequestLimiterRate(t *testing.T) {
+	l := newRequestLimiter(0, 50)
+	start := time.Now()
+	// A second worth of requests starts at once, the next one waits.
+	for i := 0; i < 51; i++ {
+		done, err := l.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("Expected the request over the burst to wait, took %s", elapsed)
+	}
+
+	// Canceled waits return their token.
+	l = newRequestLimiter(0, 1)
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.acquire(ctx); err != context.Canceled {
+		t.Fatalf("Expected the wait to be canceled, got %v", err)
+	}
+	if l.tokens < -0.5 {
+		t.Errorf("Expected the token of the canceled wait returned, got %f tokens", l.tokens)
+	}
+}
+
+func TestIsWriteOperation(t *testing.T) {
+	for name, want := range map[string]bool{
+		"GetObject":        false,
+		"HeadBucket":       false,
+		"ListObjectsV2":    false,
+		"PutObject":        true,
+		"DeleteObjects":    true,
+		"CopyObject":       true,
+		"PutObjectTagging": true,
+	} {
+		if got := isWriteOperation(name); got != want {
+			t.Errorf("isWriteOperation(%s) = %t, want %t", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listPageSize is the number of keys requested per ListObjectsV2 call.
+const listPageSize = 1000
+
+// Iterator enumerates stored names (domains or emails) one page of keys at
+// a time so that very large prefixes never have to be held in memory.
+//
+//	it := storage.IterSites("")
+//	for it.Next() {
+//		fmt.Println(it.Name())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Cursor returns an opaque token identifying the current position which can
+// be passed to a new iterator to resume listing after the current name, for
+// instance after a crash in a long running tool.
+type Iterator struct {
+	s      *S3Storage
+	locs   []*location
+	name   func(key string) (string, bool)
+	seen   map[string]bool // deduplicates names that map to several keys
+	loc    int
+	token  *string
+	after  string
+	page   []*s3.Object
+	cur    string
+	curKey string
+	curObj *s3.Object
+	done   bool
+	err    error
+}
+
+func newIterator(s *S3Storage, locs []*location, cursor string, name func(key string) (string, bool)) *Iterator {
+	it := &Iterator{s: s, locs: locs, name: name}
+	if cursor != "" {
+		idx := strings.IndexByte(cursor, ':')
+		n, err := -1, error(nil)
+		if idx >= 0 {
+			n, err = strconv.Atoi(cursor[:idx])
+		}
+		if err != nil || n < 0 || n >= len(locs) {
+			it.err = fmt.Errorf("S3Storage: invalid cursor %q", cursor)
+			return it
+		}
+		it.loc = n
+		it.after = cursor[idx+1:]
+	}
+	return it
+}
+
+// Next advances to the next name, fetching the next page from S3 when
+// needed. It returns false when there are no more names or on error.
+func (it *Iterator) Next() bool {
+	for it.err == nil {
+		for len(it.page) != 0 {
+			obj := it.page[0]
+			it.page = it.page[1:]
+			key := aws.StringValue(obj.Key)
+			name, ok := it.name(key)
+			if !ok || it.seen[name] {
+				continue
+			}
+			if it.seen != nil {
+				it.seen[name] = true
+			}
+			it.cur = name
+			it.curKey = key
+			it.curObj = obj
+			return true
+		}
+		if it.loc >= len(it.locs) {
+			return false
+		}
+		if it.done {
+			it.loc++
+			it.token = nil
+			it.after = ""
+			it.done = false
+			continue
+		}
+		loc := it.locs[it.loc]
+		in := &s3.ListObjectsV2Input{
+			Bucket:            &loc.bucket,
+			Prefix:            &loc.prefix,
+			ContinuationToken: it.token,
+			MaxKeys:           aws.Int64(listPageSize),
+		}
+		if it.token == nil && it.after != "" {
+			in.StartAfter = aws.String(it.after)
+		}
+		ctx, cancel := it.s.opContext()
+		res, err := loc.s3.ListObjectsV2WithContext(ctx, in)
+		cancel()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page = res.Contents
+		it.token = res.NextContinuationToken
+		it.done = !aws.BoolValue(res.IsTruncated)
+	}
+	return false
+}
+
+// Name returns the current name.
+func (it *Iterator) Name() string {
+	return it.cur
+}
+
+// object returns the bucket and the listed object of the current name.
+func (it *Iterator) object() (string, *s3.Object) {
+	return it.locs[it.loc].bucket, it.curObj
+}
+
+// Cursor returns a token to resume listing after the current name.
+func (it *Iterator) Cursor() string {
+	return strconv.Itoa(it.loc) + ":" + it.curKey
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// IterSites returns an iterator over the domains that have site data stored
+// in the CA namespace of the storage, including domains routed to other
+// buckets. Pass an empty cursor to start from the beginning.
+func (s *S3Storage) IterSites(cursor string) *Iterator {
+	roots := s.routes.roots()
+	locs := make([]*location, len(roots))
+	for i, r := range roots {
+		l := *r
+		l.prefix = caPrefix(r.prefix, s.ca) + "domain/"
+		locs[i] = &l
+	}
+	it := newIterator(s, locs, cursor, func(key string) (string, bool) {
+		for _, loc := range locs {
+			if strings.HasPrefix(key, loc.prefix) {
+				name := key[len(loc.prefix):]
+				// Sites in the split layout are listed by their certificate.
+				name = strings.TrimSuffix(name, "/"+splitCert)
+				return unescapeName(name), name != "" && !strings.Contains(name, "/")
+			}
+		}
+		return "", false
+	})
+	// A site stored before domains were escaped may briefly have a
+	// legacy key too, and one stored in both layouts has two keys.
+	it.seen = make(map[string]bool)
+	return it
+}
+
+// IterUsers returns an iterator over the emails of the stored accounts.
+// Pass an empty cursor to start from the beginning.
+func (s *S3Storage) IterUsers(cursor string) *Iterator {
+	prefix := aws.StringValue(s.userKey(""))
+	it := newIterator(s, []*location{{s3: s.s3, bucket: s.bucket, prefix: prefix}}, cursor, func(key string) (string, bool) {
+		return userEmail(prefix, key)
+	})
+	it.seen = make(map[string]bool)
+	return it
+}
+
+// userEmail returns the email of the account stored at key under the user
+// prefix.
+func userEmail(prefix, key string) (string, bool) {
+	name := strings.TrimPrefix(key, prefix)
+	if name == "recent" {
+		// Legacy most recent user pointer that hasn't been migrated.
+		return "", false
+	}
+	// Accounts are stored as user/<email> or user/<email>/<key type>.
+	if idx := strings.IndexByte(name, '/'); idx >= 0 {
+		name = name[:idx]
+	}
+	return unescapeName(name), name != ""
+}
+
+// ListSites returns the sorted domains of all sites stored in the CA
+// namespace of the storage, including those routed to other locations.
+// Use IterSites to avoid holding very large listings in memory.
+func (s *S3Storage) ListSites() ([]string, error) {
+	return s.IterSites("").all()
+}
+
+// ListUsers returns the sorted emails of all stored accounts. Use IterUsers
+// to avoid holding very large listings in memory.
+func (s *S3Storage) ListUsers() ([]string, error) {
+	return s.IterUsers("").all()
+}
+
+// all consumes the iterator and returns the sorted names.
+func (it *Iterator) all() ([]string, error) {
+	var names []string
+	for it.Next() {
+		names = append(names, it.Name())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,117 @@
+package caddytlss3
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// listClient implements ListObjectsV2 over a fixed set of keys with a
+// small page size to exercise pagination.
+type listClient struct {
+	s3iface.S3API
+	keys     []string
+	pageSize int
+	calls    int
+}
+
+func (c *listClient) ListObjectsV2(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	c.calls++
+	sort.Strings(c.keys)
+	after := aws.StringValue(in.StartAfter)
+	if in.ContinuationToken != nil {
+		after = *in.ContinuationToken
+	}
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for _, k := range c.keys {
+		if k <= after || !strings.HasPrefix(k, aws.StringValue(in.Prefix)) {
+			continue
+		}
+		if len(out.Contents) == c.pageSize {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = out.Contents[len(out.Contents)-1].Key
+			break
+		}
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
+
+func (c *listClient) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	return c.ListObjectsV2(in)
+}
+
+func collect(t *testing.T, it *Iterator) []string {
+	var names []string
+	for it.Next() {
+		names = append(names, it.Name())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestIterSites(t *testing.T) {
+	client := &listClient{pageSize: 2, keys: []string{
+		"acme/ca/domain/a.com",
+		"acme/ca/domain/b.com",
+		"acme/ca/domain/c.com",
+		"acme/ca/domain/d.com",
+		"acme/ca/domain/e.com",
+		"acme/ca/user/someone@example.com",
+		"acme/other/domain/x.com",
+	}}
+	storage := newFakeStorage(t, client, "bucket")
+
+	all := []string{"a.com", "b.com", "c.com", "d.com", "e.com"}
+	if names := collect(t, storage.IterSites("")); !reflect.DeepEqual(names, all) {
+		t.Errorf("Expected %v, got %v", all, names)
+	}
+
+	it := storage.IterSites("")
+	for i := 0; i < 3; i++ {
+		it.Next()
+	}
+	resumed := collect(t, storage.IterSites(it.Cursor()))
+	if !reflect.DeepEqual(resumed, all[3:]) {
+		t.Errorf("Expected %v after resuming, got %v", all[3:], resumed)
+	}
+
+	if names, err := storage.ListSites(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, all) {
+		t.Errorf("Expected %v from ListSites, got %v", all, names)
+	}
+
+	if it := storage.IterSites("bogus"); it.Next() || it.Err() == nil {
+		t.Error("Expected an error for an invalid cursor")
+	}
+}
+
+func TestIterUsers(t *testing.T) {
+	client := &listClient{pageSize: 2, keys: []string{
+		"acme/ca/user/a@example.com",
+		"acme/ca/user/a@example.com/ecdsa",
+		"acme/ca/user/a@example.com/rsa",
+		"acme/ca/user/a@example.org",
+		"acme/ca/user/b@example.com/ecdsa",
+		"acme/ca/user/recent",
+	}}
+	storage := newFakeStorage(t, client, "bucket")
+	exp := []string{"a@example.com", "a@example.org", "b@example.com"}
+	if names := collect(t, storage.IterUsers("")); !reflect.DeepEqual(names, exp) {
+		t.Errorf("Expected %v, got %v", exp, names)
+	}
+	if names, err := storage.ListUsers(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, exp) {
+		t.Errorf("Expected %v from ListUsers, got %v", exp, names)
+	}
+}
@@ -0,0 +1,642 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+const (
+	defaultLockTTL   = 10 * time.Minute
+	lockPollInterval = 2 * time.Second
+	maxLockAttempts  = 3
+)
+
+// lockFenceMeta is the object metadata key of site data recording the
+// fencing token of the lock it was stored under.
+const lockFenceMeta = "Lock-Fence"
+
+// nameLocks is shared by all S3Storage instances. Caddy constructs new
+// storage instances whenever its configuration is reloaded, so keeping the
+// locks at the package level means a lock obtained through an instance
+// built from the old configuration is still honored by the new one. Locks
+// are keyed by lockKey, so storages for different buckets or CA namespaces
+// don't block each other.
+var (
+	nameLocksMu sync.Mutex
+	nameLocks   = make(map[string]*nameLock)
+)
+
+type nameLock struct {
+	// name is the name the lock was obtained for.
+	name  string
+	owner *S3Storage
+	since time.Time
+	// released is closed once the lock is released.
+	released localWaiter
+	// fence is the fencing token of the distributed lock, zero if the
+	// lock is only held in-process. stop ends the heartbeat renewing the
+	// lease, and lost is set once another host has taken the lock over.
+	fence uint64
+	stop  chan struct{}
+	lost  bool
+}
+
+// lockKey returns the key of the lock for name in nameLocks. Names are
+// case-insensitive, like the lock objects of the lockers.
+func (s *S3Storage) lockKey(name string) string {
+	return s.bucket + "/" + s.prefix + strings.ToLower(name)
+}
+
+// errLockLost is returned by renew when the lock is no longer held.
+var errLockLost = errors.New("S3Storage: lock was taken over")
+
+// lockOwner identifies this process in distributed lock objects.
+var lockOwner = newLockOwner()
+
+func newLockOwner() string {
+	host, _ := os.Hostname()
+	var b [8]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(b[:]))
+}
+
+// locker is a distributed lock backend which coordinates certificate
+// issuance across hosts. Locks are always taken in-process first so a
+// backend only sees one attempt per name from each process.
+//
+// Locks are leases that expire unless they're renewed, so a lock held by
+// a crashed host is eventually taken over. Every time a lock is obtained
+// it gets a new fencing token that is larger than that of any previous
+// holder, which writes made under the lock record so a holder that lost
+// its lock can't overwrite the work of the next one.
+type locker interface {
+	// tryLock obtains the lock for name and returns its fencing token, or
+	// returns a Waiter if another host holds it.
+	tryLock(name string) (caddytls.Waiter, uint64, error)
+	// renew extends the lease of a lock obtained with the given fencing
+	// token, or returns errLockLost if it's no longer held.
+	renew(name string, fence uint64) error
+	// unlock releases a lock obtained with the given fencing token, unless
+	// it was taken over since.
+	unlock(name string, fence uint64) error
+	// lease is how long a lock is held without being renewed.
+	lease() time.Duration
+	// mode names the backend for diagnostics.
+	mode() string
+}
+
+// newFence returns a fencing token for a lock obtained at now. Tokens are
+// based on the time so that they keep increasing after a lock object is
+// deleted. A lock is only taken over once its lease has expired, long
+// after the previous token was issued, so clocks only need to be roughly
+// in sync.
+func newFence(now time.Time) uint64 {
+	return uint64(now.UnixNano())
+}
+
+// TryLock attempts to get a lock for name, otherwise it returns
+// a Waiter value to wait until the other process is finished. The Waiter
+// is a *LockWaiter, which gives up after Config.LockWait.
+//
+// With leader election, a follower gets a Waiter that returns right away
+// for names with stored site data, so it reloads the site instead of
+// renewing it.
+func (s *S3Storage) TryLock(name string) (caddytls.Waiter, error) {
+	if s.readOnly {
+		// Nothing is issued here, so there is nothing to coordinate.
+		return nil, nil
+	}
+	if w := s.followerWaiter(name); w != nil {
+		return w, nil
+	}
+	if w := s.tryLocalLock(name); w != nil {
+		return s.newLockWaiter(name, w), nil
+	}
+	if s.locker == nil {
+		return nil, nil
+	}
+	w, fence, err := s.locker.tryLock(name)
+	if err != nil || w != nil {
+		// Held elsewhere (or unknown), so this process doesn't hold it either.
+		s.releaseLocalLock(name)
+		if w != nil {
+			return s.newLockWaiter(name, w), err
+		}
+		return nil, err
+	}
+	stop := make(chan struct{})
+	nameLocksMu.Lock()
+	if l, ok := nameLocks[s.lockKey(name)]; ok {
+		l.fence = fence
+		l.stop = stop
+	}
+	nameLocksMu.Unlock()
+	go s.heartbeat(name, fence, stop)
+	return nil, nil
+}
+
+// heartbeat renews the lease of the lock for name until stop is closed, so
+// that the lock isn't taken over while a slow issuance is in progress.
+func (s *S3Storage) heartbeat(name string, fence uint64, stop chan struct{}) {
+	t := s.newTicker(s.locker.lease() / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C():
+		}
+		err := s.locker.renew(name, fence)
+		if err == errLockLost {
+			s.log().Errorf("lock for %s was taken over by another host, not storing its site data", name)
+			countLockLost()
+			nameLocksMu.Lock()
+			if l, ok := nameLocks[s.lockKey(name)]; ok && l.fence == fence {
+				l.lost = true
+			}
+			nameLocksMu.Unlock()
+			return
+		}
+		if err != nil {
+			s.log().Warnf("renewing lock for %s: %s", name, err)
+		}
+	}
+}
+
+// lockFence returns the fencing token of the distributed lock for name if
+// it's held by this process, or zero. It returns an error if the lock was
+// taken over by another host so that writes it guards aren't made.
+func (s *S3Storage) lockFence(name string) (uint64, error) {
+	nameLocksMu.Lock()
+	defer nameLocksMu.Unlock()
+	l, ok := nameLocks[s.lockKey(name)]
+	if !ok {
+		return 0, nil
+	}
+	if l.lost {
+		return 0, fmt.Errorf("S3Storage: lock for %s was taken over by another host", name)
+	}
+	return l.fence, nil
+}
+
+// Unlock unlocks name.
+func (s *S3Storage) Unlock(name string) error {
+	if s.readOnly {
+		return nil
+	}
+	var fence uint64
+	nameLocksMu.Lock()
+	if l, ok := nameLocks[s.lockKey(name)]; ok {
+		fence = l.fence
+		if l.stop != nil {
+			close(l.stop)
+			l.stop = nil
+		}
+	}
+	nameLocksMu.Unlock()
+	var err error
+	if s.locker != nil && fence != 0 {
+		err = s.locker.unlock(name, fence)
+	}
+	if err2 := s.releaseLocalLock(name); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (s *S3Storage) tryLocalLock(name string) caddytls.Waiter {
+	nameLocksMu.Lock()
+	defer nameLocksMu.Unlock()
+	key := s.lockKey(name)
+	l, ok := nameLocks[key]
+	if ok {
+		// lock already obtained, let caller wait on it
+		return l.released
+	}
+	// caller gets lock
+	nameLocks[key] = &nameLock{name: name, released: make(localWaiter), owner: s, since: s.now()}
+	return nil
+}
+
+func (s *S3Storage) releaseLocalLock(name string) error {
+	nameLocksMu.Lock()
+	defer nameLocksMu.Unlock()
+	key := s.lockKey(name)
+	l, ok := nameLocks[key]
+	if !ok {
+		return fmt.Errorf("S3Storage: no lock to release for %s", name)
+	}
+	close(l.released)
+	delete(nameLocks, key)
+	return nil
+}
+
+// releaseLocks releases all locks for which match returns true, including
+// their distributed counterparts.
+func releaseLocks(match func(*nameLock) bool) error {
+	nameLocksMu.Lock()
+	var held []*nameLock
+	for _, l := range nameLocks {
+		if match(l) {
+			held = append(held, l)
+		}
+	}
+	nameLocksMu.Unlock()
+	var firstErr error
+	for _, l := range held {
+		if err := l.owner.Unlock(l.name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// newLocker returns the distributed lock backend selected by cfg.Lock: "s3"
+// (the default), "dynamodb" (the default when a lock table is configured),
+// or "local" to only lock within the process. Dry runs only lock locally
+// since lock objects are writes too.
+func newLocker(s *S3Storage, cfg Config) (locker, error) {
+	switch cfg.Lock {
+	case "", "s3":
+		if s.dryRun {
+			return nil, nil
+		}
+		return &s3Locker{s: s, ttl: cfg.LockTTL}, nil
+	case "dynamodb":
+		if cfg.LockTable == "" {
+			return nil, errors.New("CADDY_S3_LOCK_TABLE is required for DynamoDB locks")
+		}
+		if s.dryRun {
+			return nil, nil
+		}
+		db := dynamodb.New(s.session)
+		s.addDebugHandlers(&db.Handlers)
+		return &dynamoLocker{s: s, db: db, table: cfg.LockTable, ttl: cfg.LockTTL}, nil
+	case "local":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown lock mode %q", cfg.Lock)
+}
+
+// s3Locker implements distributed locks using lock objects that are
+// created with conditional writes, so only one host can create the lock
+// object for a name. Lock objects carry an expiry so that a lock left
+// behind by a crashed host can be taken over once it has expired.
+//
+// S3 can't delete objects conditionally, so a lock is released by writing
+// it with a zero expiry under the condition that it's unchanged, rather
+// than deleted, which could delete the lock of a host that took it over in
+// the meantime. Released lock objects are removed by CleanUp.
+type s3Locker struct {
+	s   *S3Storage
+	ttl time.Duration
+}
+
+// lockInfo is the content of a lock object.
+type lockInfo struct {
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Fence   uint64    `json:"fence,omitempty"`
+}
+
+func (l *s3Locker) mode() string {
+	return "s3"
+}
+
+func (l *s3Locker) lease() time.Duration {
+	return l.ttl
+}
+
+func (l *s3Locker) key(name string) *string {
+	return aws.String(l.s.prefix + "locks/" + strings.ToLower(name))
+}
+
+func (l *s3Locker) tryLock(name string) (caddytls.Waiter, uint64, error) {
+	for attempt := 0; attempt < maxLockAttempts; attempt++ {
+		now := l.s.now()
+		fence := newFence(now)
+		err := l.put(name, &lockInfo{Owner: lockOwner, Created: now, Expires: now.Add(l.ttl), Fence: fence}, nil)
+		if err == nil {
+			return nil, fence, nil
+		}
+		if !isConditionFailed(err) {
+			return nil, 0, err
+		}
+		// The lock object exists. Take it over if it has expired.
+		info, etag, err := l.read(name)
+		if isNotFound(err) {
+			// Released in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if info.Expires.IsZero() {
+			// Released, obtain it like a missing lock.
+			if fence <= info.Fence {
+				fence = info.Fence + 1
+			}
+			err = l.put(name, &lockInfo{Owner: lockOwner, Created: now, Expires: now.Add(l.ttl), Fence: fence}, etag)
+			if err == nil {
+				return nil, fence, nil
+			}
+			if !isConditionFailed(err) {
+				return nil, 0, err
+			}
+			continue
+		}
+		if now.Before(info.Expires) {
+			l.s.log().Debugf("lock for %s is held by %s until %s, waiting", name, info.Owner, info.Expires)
+			return &lockWaiter{s: l.s, expires: info.Expires, owner: info.Owner, poll: func() (*lockInfo, error) {
+				info, _, err := l.read(name)
+				if isNotFound(err) {
+					return nil, nil
+				}
+				return info, err
+			}}, 0, nil
+		}
+		l.s.log().Warnf("taking over lock for %s from %s which expired at %s", name, info.Owner, info.Expires)
+		countLockTakeover()
+		if fence <= info.Fence {
+			fence = info.Fence + 1
+		}
+		err = l.put(name, &lockInfo{Owner: lockOwner, Created: now, Expires: now.Add(l.ttl), Fence: fence}, etag)
+		if err == nil {
+			l.s.audit(&AuditRecord{
+				Event:         Event{Action: AuditLockTakeover, Bucket: l.s.bucket, Key: *l.key(name), Time: now.UTC()},
+				Lock:          name,
+				PreviousOwner: info.Owner,
+			})
+			return nil, fence, nil
+		}
+		if !isConditionFailed(err) {
+			return nil, 0, err
+		}
+	}
+	// Too much contention.
+	countLockTimeout()
+	return nil, 0, ErrLockTimeout{Name: name}
+}
+
+func (l *s3Locker) renew(name string, fence uint64) error {
+	info, etag, err := l.read(name)
+	if isNotFound(err) {
+		return errLockLost
+	}
+	if err != nil {
+		return err
+	}
+	if info.Owner != lockOwner || info.Fence != fence {
+		return errLockLost
+	}
+	info.Expires = l.s.now().Add(l.ttl)
+	// A concurrent change fails the write, and is detected by the next
+	// renewal if the lock was taken over.
+	return l.put(name, info, etag)
+}
+
+// put writes the lock object. If etag is nil the object must not exist,
+// otherwise it must still have the given ETag.
+func (l *s3Locker) put(name string, info *lockInfo, etag *string) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	in := l.s.encrypt(&s3.PutObjectInput{
+		Bucket:        &l.s.bucket,
+		Key:           l.key(name),
+		Body:          bytes.NewReader(b),
+		ContentLength: aws.Int64(int64(len(b))),
+		ContentType:   aws.String(contentTypeJSON),
+		ACL:           l.s.cannedACL(),
+	})
+	if err := setHeaders(in); err != nil {
+		return err
+	}
+	if etag == nil {
+		in.IfNoneMatch = aws.String("*")
+	} else {
+		in.IfMatch = etag
+	}
+	ctx, cancel := l.s.opContext()
+	defer cancel()
+	_, err = l.s.s3.PutObjectWithContext(ctx, in)
+	return err
+}
+
+func (l *s3Locker) read(name string) (*lockInfo, *string, error) {
+	ctx, cancel := l.s.opContext()
+	defer cancel()
+	res, err := l.s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &l.s.bucket,
+		Key:    l.key(name),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	var info lockInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, nil, fmt.Errorf("S3Storage: invalid lock object for %s: %s", name, err)
+	}
+	return &info, res.ETag, nil
+}
+
+func (l *s3Locker) unlock(name string, fence uint64) error {
+	info, etag, err := l.read(name)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Owner != lockOwner || info.Fence != fence {
+		l.s.log().Warnf("lock for %s was taken over by %s, not releasing it", name, info.Owner)
+		return nil
+	}
+	// The fencing token is kept so the next holder's is larger.
+	info.Expires = time.Time{}
+	err = l.put(name, info, etag)
+	if isConditionFailed(err) {
+		l.s.log().Warnf("lock for %s was changed concurrently, not releasing it", name)
+		return nil
+	}
+	return err
+}
+
+// deleteStale deletes the lock object for name, read as info with the
+// given ETag, unless it changed since. It's taken over with a conditional
+// write first, so a host trying to obtain it until it's deleted waits for
+// the new lease instead of having its own lock deleted. It returns whether
+// the lock object was deleted.
+func (l *s3Locker) deleteStale(name string, info *lockInfo, etag *string) (bool, error) {
+	now := l.s.now()
+	fence := newFence(now)
+	if fence <= info.Fence {
+		fence = info.Fence + 1
+	}
+	err := l.put(name, &lockInfo{Owner: lockOwner, Created: now, Expires: now.Add(l.ttl), Fence: fence}, etag)
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = l.s.deleteObject(l.s.s3, &s3.DeleteObjectInput{Bucket: &l.s.bucket, Key: l.key(name)})
+	return err == nil, err
+}
+
+// localWaiter waits for a lock held by another goroutine of this process
+// to be released.
+type localWaiter chan struct{}
+
+func (w localWaiter) Wait() {
+	<-w
+}
+
+// wait is Wait, returning early once stop is closed.
+func (w localWaiter) wait(stop <-chan struct{}) {
+	select {
+	case <-w:
+	case <-stop:
+	}
+}
+
+// lockWaiter waits for a lock held by another host to be released or to
+// expire.
+type lockWaiter struct {
+	s       *S3Storage
+	expires time.Time
+	// owner is the holder of the lock when the wait started.
+	owner string
+	// poll returns the current holder of the lock, or nil if the lock has
+	// been released.
+	poll func() (*lockInfo, error)
+}
+
+func (w *lockWaiter) Wait() {
+	w.wait(nil)
+}
+
+// wait is Wait, returning early once stop is closed.
+func (w *lockWaiter) wait(stop <-chan struct{}) {
+	for w.s.now().Before(w.expires) {
+		t := w.s.newTimer(lockPollInterval)
+		select {
+		case <-t.C():
+		case <-stop:
+			t.Stop()
+			return
+		}
+		info, err := w.poll()
+		if err != nil {
+			// Keep waiting until the last known expiry.
+			continue
+		}
+		if info == nil || info.Owner == lockOwner {
+			// Released, or obtained by this process in the meantime.
+			return
+		}
+		w.expires = info.Expires
+	}
+}
+
+// LockWaiter is the Waiter returned by TryLock when another goroutine or
+// host holds the lock. Wait returns once the lock is released, the storage
+// context is canceled, or Config.LockWait has passed, so a stuck issuance
+// doesn't block the waiters forever.
+type LockWaiter struct {
+	s    *S3Storage
+	name string
+	// holder is the host holding the lock, empty for this process.
+	holder string
+	// wait blocks until the lock is released or stop is closed.
+	wait func(stop <-chan struct{})
+
+	mu  sync.Mutex
+	err error
+}
+
+// newLockWaiter returns a LockWaiter for w, a Waiter for the lock name.
+func (s *S3Storage) newLockWaiter(name string, w caddytls.Waiter) *LockWaiter {
+	lw := &LockWaiter{s: s, name: name}
+	switch w := w.(type) {
+	case *lockWaiter:
+		lw.holder = w.owner
+		lw.wait = w.wait
+	case localWaiter:
+		lw.wait = w.wait
+	default:
+		// Can't be stopped, so it's left waiting in the background.
+		lw.wait = func(<-chan struct{}) { w.Wait() }
+	}
+	return lw
+}
+
+// Wait waits for the lock to be released.
+func (w *LockWaiter) Wait() {
+	w.WaitContext(context.Background())
+}
+
+// WaitContext is Wait, also returning once ctx is done. It returns the
+// error Err returns afterwards.
+func (w *LockWaiter) WaitContext(ctx context.Context) error {
+	storageCtx := w.s.ctx
+	if storageCtx == nil {
+		storageCtx = context.Background()
+	}
+	defer startLockWait()()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		w.wait(stop)
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if w.s.lockWait > 0 {
+		t := w.s.newTimer(w.s.lockWait)
+		defer t.Stop()
+		timeout = t.C()
+	}
+	var err error
+	select {
+	case <-done:
+	case <-timeout:
+		w.s.log().Warnf("gave up waiting for lock for %s after %s", w.name, w.s.lockWait)
+		err = ErrLockTimeout{Name: w.name, Holder: w.holder}
+		countLockTimeout()
+	case <-storageCtx.Done():
+		err = storageCtx.Err()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	close(stop)
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+	return err
+}
+
+// Err returns why the last Wait returned before the lock was released: an
+// ErrLockTimeout, or the error of the canceled storage context (or context
+// of WaitContext). It returns nil if the lock was released.
+func (w *LockWaiter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
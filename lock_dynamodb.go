@@ -0,0 +1,207 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// dynamoLocker implements distributed locks as items in a DynamoDB table
+// with a string partition key named LockID. Items are created with a
+// conditional PutItem that only succeeds if the lock doesn't exist or its
+// lease has expired with a lower fencing token, which works even with S3
+// compatible stores that don't support conditional writes.
+type dynamoLocker struct {
+	s     *S3Storage
+	db    dynamodbiface.DynamoDBAPI
+	table string
+	ttl   time.Duration
+}
+
+func (l *dynamoLocker) mode() string {
+	return "dynamodb"
+}
+
+func (l *dynamoLocker) lease() time.Duration {
+	return l.ttl
+}
+
+// lockID scopes lock names to the bucket and CA namespace so a table can
+// be shared by several deployments.
+func (l *dynamoLocker) lockID(name string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(l.s.bucket + "/" + l.s.prefix + strings.ToLower(name))}
+}
+
+func unixMillis(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))}
+}
+
+func (l *dynamoLocker) tryLock(name string) (caddytls.Waiter, uint64, error) {
+	now := l.s.now()
+	fence := newFence(now)
+	for attempt := 0; attempt < maxLockAttempts; attempt++ {
+		res, err := l.put(name, now, fence)
+		if err == nil {
+			if owner := res.Attributes["Owner"]; owner != nil {
+				l.s.log().Warnf("took over expired lock for %s from %s", name, aws.StringValue(owner.S))
+				countLockTakeover()
+			}
+			return nil, fence, nil
+		}
+		if !isConditionalCheckFailed(err) {
+			return nil, 0, err
+		}
+		info, err := l.read(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if info == nil {
+			// Released in the meantime, let the caller assume the other host
+			// finished.
+			return &lockWaiter{s: l.s}, 0, nil
+		}
+		if info.Expires.Before(now) && info.Fence >= fence {
+			// An expired lock with a fencing token ahead of this clock,
+			// retry with a higher one.
+			fence = info.Fence + 1
+			continue
+		}
+		l.s.log().Debugf("lock for %s is held by %s until %s, waiting", name, info.Owner, info.Expires)
+		return &lockWaiter{s: l.s, expires: info.Expires, owner: info.Owner, poll: func() (*lockInfo, error) {
+			return l.read(name)
+		}}, 0, nil
+	}
+	return nil, 0, ErrLockTimeout{Name: name}
+}
+
+// put creates the lock item for name with the given fencing token, unless
+// it's held by another host or the fencing token of the expired lock it
+// replaces isn't lower, so tokens only increase.
+func (l *dynamoLocker) put(name string, now time.Time, fence uint64) (*dynamodb.PutItemOutput, error) {
+	ctx, cancel := l.s.opContext()
+	defer cancel()
+	return l.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: &l.table,
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID":  l.lockID(name),
+			"Owner":   {S: aws.String(lockOwner)},
+			"Created": unixMillis(now),
+			"Expires": unixMillis(now.Add(l.ttl)),
+			"Fence":   {N: aws.String(strconv.FormatUint(fence, 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#id) OR (#expires < :now AND (attribute_not_exists(#fence) OR #fence < :fence))"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id":      aws.String("LockID"),
+			"#expires": aws.String("Expires"),
+			"#fence":   aws.String("Fence"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":   unixMillis(now),
+			":fence": {N: aws.String(strconv.FormatUint(fence, 10))},
+		},
+		// The previous item is returned if an expired lock was taken over.
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+}
+
+func (l *dynamoLocker) renew(name string, fence uint64) error {
+	info, err := l.read(name)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.Owner != lockOwner || info.Fence != fence {
+		return errLockLost
+	}
+	ctx, cancel := l.s.opContext()
+	defer cancel()
+	_, err = l.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: &l.table,
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID":  l.lockID(name),
+			"Owner":   {S: aws.String(lockOwner)},
+			"Created": unixMillis(info.Created),
+			"Expires": unixMillis(l.s.now().Add(l.ttl)),
+			"Fence":   {N: aws.String(strconv.FormatUint(fence, 10))},
+		},
+		ConditionExpression:      aws.String("#owner = :owner AND #fence = :fence"),
+		ExpressionAttributeNames: map[string]*string{"#owner": aws.String("Owner"), "#fence": aws.String("Fence")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(lockOwner)},
+			":fence": {N: aws.String(strconv.FormatUint(fence, 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return errLockLost
+	}
+	return err
+}
+
+// read returns the current holder of the lock, or nil if there is none.
+func (l *dynamoLocker) read(name string) (*lockInfo, error) {
+	ctx, cancel := l.s.opContext()
+	defer cancel()
+	res, err := l.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      &l.table,
+		Key:            map[string]*dynamodb.AttributeValue{"LockID": l.lockID(name)},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Item == nil {
+		return nil, nil
+	}
+	info := &lockInfo{}
+	if v := res.Item["Owner"]; v != nil {
+		info.Owner = aws.StringValue(v.S)
+	}
+	for attr, t := range map[string]*time.Time{"Created": &info.Created, "Expires": &info.Expires} {
+		if v := res.Item[attr]; v != nil {
+			ms, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("S3Storage: invalid %s in lock item for %s", attr, name)
+			}
+			*t = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+	if v := res.Item["Fence"]; v != nil {
+		fence, err := strconv.ParseUint(aws.StringValue(v.N), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("S3Storage: invalid Fence in lock item for %s", name)
+		}
+		info.Fence = fence
+	}
+	return info, nil
+}
+
+func (l *dynamoLocker) unlock(name string, fence uint64) error {
+	ctx, cancel := l.s.opContext()
+	defer cancel()
+	_, err := l.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                &l.table,
+		Key:                      map[string]*dynamodb.AttributeValue{"LockID": l.lockID(name)},
+		ConditionExpression:      aws.String("#owner = :owner AND #fence = :fence"),
+		ExpressionAttributeNames: map[string]*string{"#owner": aws.String("Owner"), "#fence": aws.String("Fence")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(lockOwner)},
+			":fence": {N: aws.String(strconv.FormatUint(fence, 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		l.s.log().Warnf("lock for %s is no longer held by this process, not releasing it", name)
+		return nil
+	}
+	return err
+}
+
+func isConditionalCheckFailed(err error) bool {
+	e, ok := err.(awserr.Error)
+	return ok && e.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
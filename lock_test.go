@@ -0,0 +1,477 @@
+package caddytlss3
+
+import (
+	"context"
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// lockReleased returns whether the lock object at key was released.
+func lockReleased(t *testing.T, client *fakes.S3, bucket, key string) bool {
+	t.Helper()
+	b, ok := client.Object(bucket, key)
+	if !ok {
+		t.Fatalf("Expected a lock object at %s", key)
+	}
+	var info lockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	return info.Expires.IsZero()
+}
+
+// lockWaitGoroutines returns the number of goroutines started by
+// LockWaiter.Wait which are still running.
+func lockWaitGoroutines() int {
+	buf := make([]byte, 1<<20)
+	return strings.Count(string(buf[:runtime.Stack(buf, true)]), "(*LockWaiter).Wait.func")
+}
+
+func TestS3Locker(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+
+	name := "lock.example.com"
+	if w, err := storage.TryLock(name); err != nil {
+		t.Fatal(err)
+	} else if w != nil {
+		t.Fatal("Expected to obtain the lock")
+	}
+	if _, ok := client.Object("bucket", "acme/ca/locks/"+name); !ok {
+		t.Fatal("Expected a lock object")
+	}
+	if err := storage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+	if !lockReleased(t, client, "bucket", "acme/ca/locks/"+name) {
+		t.Fatal("Expected the lock to be released")
+	}
+	// A released lock is obtained again without waiting.
+	if w, err := storage.TryLock(name); err != nil || w != nil {
+		t.Fatalf("Expected to obtain the released lock, got %v, %v", w, err)
+	}
+	// Unlocking doesn't release a lock taken over since, even by another
+	// instance in this process.
+	taken, _ := json.Marshal(&lockInfo{Owner: lockOwner, Created: clock.Now(), Expires: clock.Now().Add(time.Minute), Fence: 1 << 62})
+	client.SetObject("bucket", "acme/ca/locks/"+name, taken, nil)
+	if err := storage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+	if lockReleased(t, client, "bucket", "acme/ca/locks/"+name) {
+		t.Fatal("Expected the lock taken over to be kept")
+	}
+
+	// Lock held by another host.
+	other, err := json.Marshal(&lockInfo{Owner: "other", Created: clock.Now(), Expires: clock.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetObject("bucket", "acme/ca/locks/"+name, other, nil)
+	w, err := storage.TryLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w == nil {
+		t.Fatal("Expected a waiter for a lock held by another host")
+	}
+	// The local lock must not be held while another host holds the lock.
+	if err := storage.releaseLocalLock(name); err == nil {
+		t.Error("Expected the local lock to be released")
+	}
+
+	// Once expired the waiter returns and the lock can be taken over.
+	clock.Add(2 * time.Minute)
+	w.Wait()
+	if w, err := storage.TryLock(name); err != nil {
+		t.Fatal(err)
+	} else if w != nil {
+		t.Fatal("Expected to take over the expired lock")
+	}
+	var info lockInfo
+	b, _ := client.Object("bucket", "acme/ca/locks/"+name)
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Owner != lockOwner {
+		t.Errorf("Expected lock to be owned by %s, got %s", lockOwner, info.Owner)
+	}
+	// Names are case-insensitive in this process as they are in S3.
+	if w, err := storage.TryLock("Lock.Example.com"); err != nil || w == nil {
+		t.Fatalf("Expected a waiter for the same name in another case, got %v, %v", w, err)
+	}
+	if err := storage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// memDynamo is a minimal in-memory DynamoDB table implementing the
+// conditions used by dynamoLocker.
+type memDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+}
+
+func (m *memDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := *in.Item["LockID"].S
+	cur, ok := m.items[id]
+	if owner := in.ExpressionAttributeValues[":owner"]; owner != nil {
+		// Renewal by the holder.
+		if !ok || *cur["Owner"].S != *owner.S || *cur["Fence"].N != *in.ExpressionAttributeValues[":fence"].N {
+			return nil, conditionFailed()
+		}
+	} else if ok {
+		expires, _ := strconv.ParseInt(*cur["Expires"].N, 10, 64)
+		now, _ := strconv.ParseInt(*in.ExpressionAttributeValues[":now"].N, 10, 64)
+		if expires >= now {
+			return nil, conditionFailed()
+		}
+		if f := cur["Fence"]; f != nil {
+			fence, _ := strconv.ParseUint(*f.N, 10, 64)
+			next, _ := strconv.ParseUint(*in.ExpressionAttributeValues[":fence"].N, 10, 64)
+			if fence >= next {
+				return nil, conditionFailed()
+			}
+		}
+	}
+	m.items[id] = in.Item
+	if ok && aws.StringValue(in.ReturnValues) == dynamodb.ReturnValueAllOld {
+		return &dynamodb.PutItemOutput{Attributes: cur}, nil
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *memDynamo) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(in)
+}
+
+func (m *memDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: m.items[*in.Key["LockID"].S]}, nil
+}
+
+func (m *memDynamo) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(in)
+}
+
+func (m *memDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := *in.Key["LockID"].S
+	cur, ok := m.items[id]
+	if !ok || *cur["Owner"].S != *in.ExpressionAttributeValues[":owner"].S || *cur["Fence"].N != *in.ExpressionAttributeValues[":fence"].N {
+		return nil, conditionFailed()
+	}
+	delete(m.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (m *memDynamo) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	return m.DeleteItem(in)
+}
+
+func TestDynamoLocker(t *testing.T) {
+	db := &memDynamo{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket", WithClock(clock))
+	// DynamoDB locks aren't supported with an injected S3 client.
+	storage.locker = &dynamoLocker{s: storage, db: db, table: "locks", ttl: time.Minute}
+
+	name := "lock.example.com"
+	id := "bucket/acme/ca/" + name
+	if w, err := storage.TryLock(name); err != nil {
+		t.Fatal(err)
+	} else if w != nil {
+		t.Fatal("Expected to obtain the lock")
+	}
+	if _, ok := db.items[id]; !ok {
+		t.Fatal("Expected a lock item")
+	}
+	if err := storage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.items[id]; ok {
+		t.Fatal("Expected the lock item to be deleted")
+	}
+
+	// Lock held by another host.
+	db.items[id] = map[string]*dynamodb.AttributeValue{
+		"LockID":  {S: aws.String(id)},
+		"Owner":   {S: aws.String("other")},
+		"Expires": unixMillis(clock.Now().Add(time.Minute)),
+	}
+	w, err := storage.TryLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w == nil {
+		t.Fatal("Expected a waiter for a lock held by another host")
+	}
+
+	// Once the lease expires the waiter returns and the lock can be taken over.
+	clock.Add(2 * time.Minute)
+	w.Wait()
+	if w, err := storage.TryLock(name); err != nil {
+		t.Fatal(err)
+	} else if w != nil {
+		t.Fatal("Expected to take over the expired lock")
+	}
+	if owner := *db.items[id]["Owner"].S; owner != lockOwner {
+		t.Errorf("Expected lock to be owned by %s, got %s", lockOwner, owner)
+	}
+	if err := storage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fencing token of an expired lock is exceeded even if it's ahead
+	// of this clock.
+	ahead := uint64(1) << 62
+	db.items[id] = map[string]*dynamodb.AttributeValue{
+		"LockID":  {S: aws.String(id)},
+		"Owner":   {S: aws.String("other")},
+		"Expires": unixMillis(clock.Now().Add(-time.Minute)),
+		"Fence":   {N: aws.String(strconv.FormatUint(ahead, 10))},
+	}
+	if w, err := storage.TryLock(name); err != nil || w != nil {
+		t.Fatalf("Expected to take over the expired lock, got %v, %v", w, err)
+	}
+	if info, _ := storage.locker.(*dynamoLocker).read(name); info.Fence <= ahead {
+		t.Errorf("Expected a fencing token above %d, got %d", ahead, info.Fence)
+	}
+	if err := storage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockHeartbeat(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+
+	name := "heartbeat.example.com"
+	if w, err := storage.TryLock(name); err != nil || w != nil {
+		t.Fatalf("Expected to obtain the lock, got %v, %v", w, err)
+	}
+	readLock := func() lockInfo {
+		t.Helper()
+		var info lockInfo
+		b, _ := client.Object("bucket", "acme/ca/locks/"+name)
+		if err := json.Unmarshal(b, &info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	info := readLock()
+	if info.Fence == 0 {
+		t.Fatal("Expected a fencing token")
+	}
+	// The lease is renewed every third of the TTL while the lock is held.
+	clock.blockUntil(t, 1)
+	clock.Add(20 * time.Second)
+	for deadline := time.Now().Add(time.Second); !readLock().Expires.After(info.Expires); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the lease to be renewed, got %+v after %+v", readLock(), info)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if renewed := readLock(); !renewed.Expires.Equal(clock.Now().Add(time.Minute)) || renewed.Fence != info.Fence {
+		t.Fatalf("Expected the lease to be renewed, got %+v after %+v", renewed, info)
+	}
+
+	// Another host takes the lock over, e.g. after a long pause, which
+	// the next renewal finds.
+	other, _ := json.Marshal(&lockInfo{Owner: "other", Expires: clock.Now().Add(time.Minute), Fence: info.Fence + 1})
+	client.SetObject("bucket", "acme/ca/locks/"+name, other, nil)
+	clock.Add(20 * time.Second)
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, err := storage.lockFence(name); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the lock to be lost")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := storage.StoreSite(name, &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err == nil {
+		t.Error("Expected storing under a lost lock to fail")
+	}
+	if err := storage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/locks/"+name); !ok {
+		t.Error("Expected the lock of the other host to be kept")
+	}
+}
+
+func TestLockFencing(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+
+	name := "fenced.example.com"
+	if w, err := storage.TryLock(name); err != nil || w != nil {
+		t.Fatalf("Expected to obtain the lock, got %v, %v", w, err)
+	}
+	defer storage.Unlock(name)
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}
+	if err := storage.StoreSite(name, site); err != nil {
+		t.Fatal(err)
+	}
+	key := "acme/ca/domain/" + name
+	fence, err := strconv.ParseUint(metadataValue(client.Metadata("bucket", key), lockFenceMeta), 10, 64)
+	if err != nil {
+		t.Fatalf("Expected the fencing token in the metadata: %s", err)
+	}
+	// A later holder stored the site in the meantime.
+	b, _ := client.Object("bucket", key)
+	client.SetObject("bucket", key, b, map[string]*string{lockFenceMeta: aws.String(strconv.FormatUint(fence+1, 10))})
+	if err := storage.StoreSite(name, site); err == nil {
+		t.Error("Expected storing with an older fencing token to fail")
+	}
+}
+
+func TestDynamoLockerRenew(t *testing.T) {
+	db := &memDynamo{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket")
+	l := &dynamoLocker{s: storage, db: db, table: "locks", ttl: time.Minute}
+
+	name := "renew.example.com"
+	_, fence, err := l.tryLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := l.read(name)
+	time.Sleep(5 * time.Millisecond)
+	if err := l.renew(name, fence); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := l.read(name)
+	if !after.Expires.After(before.Expires) || after.Fence != fence {
+		t.Errorf("Expected the lease to be renewed, got %+v after %+v", after, before)
+	}
+	if err := l.renew(name, fence+1); err != errLockLost {
+		t.Errorf("Expected errLockLost for another fencing token, got %v", err)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	client := fakes.NewS3()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	storage := newFakeStorage(t, client, "bucket", WithLockWait(50*time.Millisecond), WithContext(ctx))
+
+	// Lock held by another host that never releases it.
+	other, _ := json.Marshal(&lockInfo{Owner: "other", Created: time.Now(), Expires: time.Now().Add(time.Minute)})
+	client.SetObject("bucket", "acme/ca/locks/stuck.example.com", other, nil)
+	w, err := storage.TryLock("stuck.example.com")
+	if err != nil || w == nil {
+		t.Fatalf("Expected a waiter, got %v, %v", w, err)
+	}
+	w.Wait()
+	if e, ok := w.(*LockWaiter).Err().(ErrLockTimeout); !ok || e.Holder != "other" {
+		t.Fatalf("Expected a lock timeout, got %v", w.(*LockWaiter).Err())
+	}
+
+	// Lock held by another goroutine which releases it in time.
+	storage.lockWait = time.Minute
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("Expected to obtain the lock, got %v, %v", w, err)
+	}
+	w, err = storage.TryLock("example.com")
+	if err != nil || w == nil {
+		t.Fatalf("Expected a waiter, got %v, %v", w, err)
+	}
+	go storage.Unlock("example.com")
+	w.Wait()
+	if err := w.(*LockWaiter).Err(); err != nil {
+		t.Fatalf("Expected the lock to be released, got %v", err)
+	}
+
+	// Giving up on a lock held by another goroutine doesn't leave a
+	// goroutine waiting for its release.
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("Expected to obtain the lock, got %v, %v", w, err)
+	}
+	storage.lockWait = 10 * time.Millisecond
+	w, _ = storage.TryLock("example.com")
+	w.Wait()
+	if _, ok := w.(*LockWaiter).Err().(ErrLockTimeout); !ok {
+		t.Fatalf("Expected a lock timeout, got %v", w.(*LockWaiter).Err())
+	}
+	for deadline := time.Now().Add(time.Second); lockWaitGoroutines() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected no goroutine left waiting for the lock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := storage.Unlock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	storage.lockWait = time.Minute
+
+	// Canceling the storage context stops waiting.
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("Expected to obtain the lock, got %v, %v", w, err)
+	}
+	defer storage.Unlock("example.com")
+	w, _ = storage.TryLock("example.com")
+	cancel()
+	w.Wait()
+	if err := w.(*LockWaiter).Err(); err != context.Canceled {
+		t.Fatalf("Expected the wait to be canceled, got %v", err)
+	}
+}
+
+func TestLockMetrics(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+	before := storage.LockMetrics()
+
+	// An expired lock of another host is taken over.
+	other, _ := json.Marshal(&lockInfo{Owner: "other", Created: clock.Now().Add(-2 * time.Minute), Expires: clock.Now().Add(-time.Minute)})
+	client.SetObject("bucket", "acme/ca/locks/example.com", other, nil)
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("Expected to take over the expired lock, got %v, %v", w, err)
+	}
+	locks := storage.Locks()
+	if len(locks) != 1 || locks[0].Name != "example.com" || locks[0].Fence == 0 || !locks[0].Since.Equal(clock.Now()) {
+		t.Fatalf("Unexpected locks %+v", locks)
+	}
+
+	// Another goroutine waits for it.
+	w, err := storage.TryLock("example.com")
+	if err != nil || w == nil {
+		t.Fatalf("Expected a waiter, got %v, %v", w, err)
+	}
+	go storage.Unlock("example.com")
+	w.Wait()
+
+	m := storage.LockMetrics()
+	if m.Held != before.Held || m.Waiting != before.Waiting {
+		t.Errorf("Expected no held locks or waiters, got %+v", m)
+	}
+	if m.Takeovers-before.Takeovers != 1 || m.Waits-before.Waits != 1 || m.WaitTime <= before.WaitTime {
+		t.Errorf("Expected a takeover and a wait, got %+v (before %+v)", m, before)
+	}
+}
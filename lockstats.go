@@ -0,0 +1,116 @@
+package caddytlss3
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// lockStats are the lock counters of the process. Like the locks
+// themselves they're shared by all storage instances.
+var lockStats struct {
+	sync.Mutex
+	waiting   int
+	waits     int64
+	waitTime  time.Duration
+	timeouts  int64
+	takeovers int64
+	lost      int64
+}
+
+// LockMetrics are counters and gauges of the locks of this process, which
+// show when hosts are contending for the same names.
+type LockMetrics struct {
+	// Held is the number of locks currently held.
+	Held int
+	// Waiting is the number of callers currently waiting for a lock held
+	// by another goroutine or host.
+	Waiting int
+	// Waits is the number of finished waits, and WaitTime their total
+	// duration.
+	Waits    int64
+	WaitTime time.Duration
+	// Timeouts counts attempts to obtain a lock that were given up, after
+	// Config.LockWait or because of too much contention.
+	Timeouts int64
+	// Takeovers counts expired locks of other hosts that were taken over,
+	// and Lost the locks of this process taken over by other hosts.
+	Takeovers int64
+	Lost      int64
+}
+
+// LockMetrics returns the lock metrics of the process.
+func (s *S3Storage) LockMetrics() LockMetrics {
+	nameLocksMu.Lock()
+	held := len(nameLocks)
+	nameLocksMu.Unlock()
+	lockStats.Lock()
+	defer lockStats.Unlock()
+	return LockMetrics{
+		Held:      held,
+		Waiting:   lockStats.waiting,
+		Waits:     lockStats.waits,
+		WaitTime:  lockStats.waitTime,
+		Timeouts:  lockStats.timeouts,
+		Takeovers: lockStats.takeovers,
+		Lost:      lockStats.lost,
+	}
+}
+
+// HeldLock describes a lock held by this process.
+type HeldLock struct {
+	Name string
+	// Since is when the lock was obtained.
+	Since time.Time
+	// Fence is the fencing token of the distributed lock, zero if the lock
+	// is only held in-process.
+	Fence uint64
+	// Lost is set once another host has taken the lock over.
+	Lost bool
+}
+
+// Locks returns the locks held by this process, sorted by name.
+func (s *S3Storage) Locks() []HeldLock {
+	nameLocksMu.Lock()
+	locks := make([]HeldLock, 0, len(nameLocks))
+	for _, l := range nameLocks {
+		locks = append(locks, HeldLock{Name: l.name, Since: l.since, Fence: l.fence, Lost: l.lost})
+	}
+	nameLocksMu.Unlock()
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
+
+func countLockTimeout() {
+	lockStats.Lock()
+	lockStats.timeouts++
+	lockStats.Unlock()
+}
+
+func countLockTakeover() {
+	lockStats.Lock()
+	lockStats.takeovers++
+	lockStats.Unlock()
+}
+
+func countLockLost() {
+	lockStats.Lock()
+	lockStats.lost++
+	lockStats.Unlock()
+}
+
+// startLockWait counts a wait for a lock and returns a function to call
+// when it's over.
+func startLockWait() func() {
+	start := time.Now()
+	lockStats.Lock()
+	lockStats.waiting++
+	lockStats.Unlock()
+	return func() {
+		lockStats.Lock()
+		lockStats.waiting--
+		lockStats.waits++
+		lockStats.waitTime += time.Since(start)
+		lockStats.Unlock()
+	}
+}
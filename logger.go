@@ -0,0 +1,108 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Logger receives the log messages of the storage. *zap.SugaredLogger and
+// *logrus.Logger implement it as is.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NopLogger discards all messages.
+type NopLogger struct{}
+
+func (NopLogger) Debugf(format string, args ...interface{}) {}
+func (NopLogger) Infof(format string, args ...interface{})  {}
+func (NopLogger) Warnf(format string, args ...interface{})  {}
+func (NopLogger) Errorf(format string, args ...interface{}) {}
+
+// StdLogger returns a Logger writing to l with the level prefixes used by
+// Caddy 1, e.g. "[WARNING] S3Storage: ...". If l is nil the standard
+// logger is used, which Caddy redirects to its log. Debug messages are
+// dropped unless debug is set.
+func StdLogger(l *log.Logger, debug bool) Logger {
+	return stdLogger{l: l, debug: debug}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+func (l stdLogger) printf(level, format string, args []interface{}) {
+	msg := "[" + level + "] S3Storage: " + fmt.Sprintf(format, args...)
+	if l.l == nil {
+		log.Print(msg)
+	} else {
+		l.l.Print(msg)
+	}
+}
+
+func (l stdLogger) Debugf(format string, args ...interface{}) {
+	if l.debug {
+		l.printf("DEBUG", format, args)
+	}
+}
+
+func (l stdLogger) Infof(format string, args ...interface{}) {
+	l.printf("INFO", format, args)
+}
+
+func (l stdLogger) Warnf(format string, args ...interface{}) {
+	l.printf("WARNING", format, args)
+}
+
+func (l stdLogger) Errorf(format string, args ...interface{}) {
+	l.printf("ERROR", format, args)
+}
+
+// log returns the logger of the storage, which discards messages if none
+// is configured.
+func (s *S3Storage) log() Logger {
+	if s.logger == nil {
+		return NopLogger{}
+	}
+	return s.logger
+}
+
+// addDebugHandlers adds request handlers logging failed attempts and the
+// outcome of every AWS request at debug level, including the request ID
+// needed when asking AWS support about a request.
+func (s *S3Storage) addDebugHandlers(h *request.Handlers) {
+	h.CompleteAttempt.PushBackNamed(request.NamedHandler{
+		Name: "caddytlss3.DebugAttempt",
+		Fn: func(r *request.Request) {
+			if r.Error != nil {
+				s.log().Debugf("%s %s attempt %d failed (request ID %s): %s",
+					r.Operation.Name, requestPath(r), r.RetryCount+1, r.RequestID, r.Error)
+			}
+		},
+	})
+	h.Complete.PushBackNamed(request.NamedHandler{
+		Name: "caddytlss3.DebugComplete",
+		Fn: func(r *request.Request) {
+			status := 0
+			if r.HTTPResponse != nil {
+				status = r.HTTPResponse.StatusCode
+			}
+			s.log().Debugf("%s %s: status %d, request ID %s, %d retries, %s",
+				r.Operation.Name, requestPath(r), status, r.RequestID, r.RetryCount, time.Since(r.Time))
+		},
+	})
+}
+
+func requestPath(r *request.Request) string {
+	if r.HTTPRequest == nil || r.HTTPRequest.URL == nil {
+		return ""
+	}
+	return r.HTTPRequest.URL.Path
+}
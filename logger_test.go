@@ -0,0 +1,113 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// recordLogger records messages with their level.
+type recordLogger struct {
+	msgs []string
+}
+
+func (l *recordLogger) Debugf(format string, args ...interface{}) { l.add("debug", format, args) }
+func (l *recordLogger) Infof(format string, args ...interface{})  { l.add("info", format, args) }
+func (l *recordLogger) Warnf(format string, args ...interface{})  { l.add("warn", format, args) }
+func (l *recordLogger) Errorf(format string, args ...interface{}) { l.add("error", format, args) }
+
+func (l *recordLogger) add(level, format string, args []interface{}) {
+	l.msgs = append(l.msgs, level+" "+fmt.Sprintf(format, args...))
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := StdLogger(log.New(&buf, "", 0), false)
+	l.Debugf("hidden")
+	l.Warnf("lock for %s", "example.com")
+	if got, want := buf.String(), "[WARNING] S3Storage: lock for example.com\n"; got != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+
+	buf.Reset()
+	StdLogger(log.New(&buf, "", 0), true).Debugf("shown")
+	if got, want := buf.String(), "[DEBUG] S3Storage: shown\n"; got != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestDefaultLogger(t *testing.T) {
+	// Messages are discarded unless a logger is configured.
+	cfg := Config{Bucket: "bucket"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Logger.(NopLogger); !ok {
+		t.Errorf("Expected the no-op logger by default, got %T", cfg.Logger)
+	}
+	// Caddy logs to the standard logger.
+	u, _ := url.Parse("s3://bucket/prefix")
+	cfg, err := ConfigFromEnv(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Logger.(stdLogger); !ok {
+		t.Errorf("Expected the standard logger for Caddy, got %T", cfg.Logger)
+	}
+}
+
+func TestStorageLogger(t *testing.T) {
+	rec := &recordLogger{}
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket", WithDryRun(true), WithLogger(rec))
+	if err := storage.DeleteSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Construction logs the dry run warning and the configuration first.
+	if len(rec.msgs) == 0 || !strings.HasPrefix(rec.msgs[len(rec.msgs)-1], "info dry run: DeleteObject s3://bucket/acme/ca/domain/example.com") {
+		t.Fatalf("Unexpected messages %q", rec.msgs)
+	}
+}
+
+func TestDryRunDeletes(t *testing.T) {
+	rec := &recordLogger{}
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "dry-run-deletes", WithDryRunDeletes(), WithLogger(rec))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.StoreUser("admin@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	keys := client.Keys("dry-run-deletes")
+	if len(keys) == 0 {
+		t.Fatal("Expected writes to be performed")
+	}
+
+	if err := storage.DeleteSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteUser("admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.Keys("dry-run-deletes"); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Errorf("Expected no deletes, got keys %v (before %v)", got, keys)
+	}
+	var logged int
+	for _, msg := range rec.msgs {
+		if strings.HasPrefix(msg, "info dry run: DeleteObject s3://dry-run-deletes/") {
+			logged++
+		}
+	}
+	if logged < 2 {
+		t.Errorf("Expected the deletes to be logged, got %q", rec.msgs)
+	}
+	if email := storage.MostRecentUserEmail(); email != "admin@example.com" {
+		t.Errorf("Expected the account to remain the most recent user, got %q", email)
+	}
+}
@@ -0,0 +1,247 @@
+package caddytlss3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// Caddy's default file storage keeps the data of each CA under
+// $CADDYPATH/acme/<ca host>:
+//
+//	sites/<domain>/<domain>.crt, <domain>.key, <domain>.json
+//	users/<email>/<username>.json, <username>.key
+//
+// where username is the part of the email before the @. With migration
+// enabled, sites and accounts missing from S3 are read from there and
+// imported, so a single host deployment can switch to S3 without
+// reissuing its certificates.
+
+// defaultFileStorageDir returns the root of Caddy's file storage, which is
+// $CADDYPATH/acme or ~/.caddy/acme.
+func defaultFileStorageDir() string {
+	if p := os.Getenv("CADDYPATH"); p != "" {
+		return filepath.Join(p, "acme")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".caddy", "acme")
+}
+
+// fileStorage reads the data of a CA from Caddy's file storage.
+type fileStorage struct {
+	dir string
+}
+
+func (f *fileStorage) site(domain string) string {
+	domain = strings.ToLower(domain)
+	return filepath.Join(f.dir, "sites", domain, domain)
+}
+
+func (f *fileStorage) user(email string) string {
+	email = strings.ToLower(email)
+	if email == "" {
+		email = "default"
+	}
+	username := email
+	if at := strings.IndexByte(email, '@'); at == 0 {
+		username = email[1:]
+	} else if at > 0 {
+		username = email[:at]
+	}
+	return filepath.Join(f.dir, "users", email, username)
+}
+
+// siteExists returns true if the certificate of domain is stored.
+func (f *fileStorage) siteExists(domain string) bool {
+	_, err := os.Stat(f.site(domain) + ".crt")
+	return err == nil
+}
+
+// loadSite returns the site data for domain, or an error for which
+// os.IsNotExist is true if it isn't stored.
+func (f *fileStorage) loadSite(domain string) (*caddytls.SiteData, error) {
+	base := f.site(domain)
+	data := new(caddytls.SiteData)
+	var err error
+	if data.Cert, err = ioutil.ReadFile(base + ".crt"); err != nil {
+		return nil, err
+	}
+	if data.Key, err = ioutil.ReadFile(base + ".key"); err != nil {
+		return nil, err
+	}
+	if data.Meta, err = ioutil.ReadFile(base + ".json"); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// loadUser returns the account for email, or an error for which
+// os.IsNotExist is true if it isn't stored.
+func (f *fileStorage) loadUser(email string) (*caddytls.UserData, error) {
+	base := f.user(email)
+	data := new(caddytls.UserData)
+	var err error
+	if data.Reg, err = ioutil.ReadFile(base + ".json"); err != nil {
+		return nil, err
+	}
+	if data.Key, err = ioutil.ReadFile(base + ".key"); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// names returns the names of the directories in sub ("sites" or "users").
+func (f *fileStorage) names(sub string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(f.dir, sub))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range infos {
+		if fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// mostRecentUser returns the email of the most recently modified account
+// like Caddy's file storage does, or an empty string if there are none.
+func (f *fileStorage) mostRecentUser() string {
+	infos, err := ioutil.ReadDir(filepath.Join(f.dir, "users"))
+	if err != nil {
+		return ""
+	}
+	var email string
+	var latest time.Time
+	for _, fi := range infos {
+		if fi.IsDir() && fi.ModTime().After(latest) {
+			email, latest = fi.Name(), fi.ModTime()
+		}
+	}
+	if email == "default" {
+		return ""
+	}
+	return email
+}
+
+// migrateSite imports the site data for domain from the file storage after
+// it wasn't found in S3. It returns false if migration is disabled or the
+// site isn't in the file storage either.
+func (s *S3Storage) migrateSite(domain string) (*caddytls.SiteData, bool) {
+	if s.files == nil {
+		return nil, false
+	}
+	data, err := s.files.loadSite(domain)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log().Errorf("reading %s from file storage: %s", domain, err)
+		}
+		return nil, false
+	}
+	// The certificate can be used even if importing it fails, it's
+	// imported on the next load. Read-only hosts leave importing it to the
+	// control node.
+	if s.readOnly {
+		return data, true
+	}
+	if err := s.StoreSite(domain, data); err != nil {
+		s.log().Errorf("importing %s from file storage: %s", domain, err)
+	} else {
+		s.log().Infof("imported %s from file storage %s", domain, s.files.dir)
+	}
+	return data, true
+}
+
+// migrateUser imports the account for email from the file storage after it
+// wasn't found in S3, like migrateSite.
+func (s *S3Storage) migrateUser(email string) (*caddytls.UserData, bool) {
+	if s.files == nil {
+		return nil, false
+	}
+	data, err := s.files.loadUser(email)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log().Errorf("reading account %s from file storage: %s", email, err)
+		}
+		return nil, false
+	}
+	if s.readOnly {
+		return data, true
+	}
+	if err := s.StoreUser(email, data); err != nil {
+		s.log().Errorf("importing account %s from file storage: %s", email, err)
+	} else {
+		s.log().Infof("imported account %s from file storage %s", email, s.files.dir)
+	}
+	return data, true
+}
+
+// Migrate imports all sites and accounts of the CA namespace from Caddy's
+// file storage in dir, $CADDYPATH/acme if dir is empty. Certificates in S3
+// that expire later than the imported ones and accounts that already exist
+// in S3 are kept. Migrate can be run again, e.g. after hosts that still
+// used the file storage renewed certificates.
+func (s *S3Storage) Migrate(dir string) error {
+	if dir == "" {
+		dir = defaultFileStorageDir()
+	}
+	files := &fileStorage{dir: filepath.Join(dir, s.fileCA())}
+	domains, err := files.names("sites")
+	if err != nil {
+		return err
+	}
+	var sites int
+	for _, domain := range domains {
+		data, err := files.loadSite(domain)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.StoreSite(domain, data); err != nil {
+			return err
+		}
+		sites++
+	}
+	emails, err := files.names("users")
+	if err != nil {
+		return err
+	}
+	var users int
+	for _, email := range emails {
+		if email == "default" {
+			// The account without an email isn't reused by Caddy.
+			continue
+		}
+		data, err := files.loadUser(email)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := s.LoadUser(email); err == nil {
+			continue
+		} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+			return err
+		}
+		if err := s.StoreUser(email, data); err != nil {
+			return err
+		}
+		users++
+	}
+	s.log().Infof("migrated %d sites and %d accounts from %s", sites, users, files.dir)
+	return nil
+}
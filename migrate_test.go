@@ -0,0 +1,110 @@
+package caddytlss3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// writeFileStorage lays out a site and an account like Caddy's file
+// storage and returns its root.
+func writeFileStorage(t *testing.T) string {
+	root, err := ioutil.TempDir("", "caddytlss3-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	for path, data := range map[string]string{
+		"ca/sites/example.com/example.com.crt":        "cert",
+		"ca/sites/example.com/example.com.key":        "key",
+		"ca/sites/example.com/example.com.json":       "{}",
+		"ca/users/user@example.com/user.json":         "reg",
+		"ca/users/user@example.com/user.key":          "userkey",
+		"ca/sites/incomplete.com/incomplete.com.crt":  "cert",
+		"other-ca/sites/example.org/example.org.crt":  "cert",
+		"other-ca/sites/example.org/example.org.key":  "key",
+		"other-ca/users/other@example.org/other.json": "reg",
+		"other-ca/users/other@example.org/other.key":  "key",
+	} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestMigrateOnLoad(t *testing.T) {
+	root := writeFileStorage(t)
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+
+	if ok, _ := storage.SiteExists("example.com"); ok {
+		t.Fatal("Expected no site without migration")
+	}
+	storage.files = &fileStorage{dir: filepath.Join(root, "ca")}
+	if ok, err := storage.SiteExists("example.com"); err != nil || !ok {
+		t.Fatalf("Expected the site in the file storage to exist, got %t, %v", ok, err)
+	}
+	data, err := storage.LoadSite("Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data.Cert) != "cert" || string(data.Key) != "key" || string(data.Meta) != "{}" {
+		t.Errorf("Unexpected site data %+v", data)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/domain/example.com"); !ok {
+		t.Error("Expected the site to be imported")
+	}
+	if _, err := storage.LoadSite("incomplete.com"); err == nil {
+		t.Error("Expected an error for a site without a key")
+	}
+
+	if email := storage.MostRecentUserEmail(); email != "user@example.com" {
+		t.Errorf("Expected the most recent user from the file storage, got %q", email)
+	}
+	user, err := storage.LoadUser("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(user.Reg) != "reg" || string(user.Key) != "userkey" {
+		t.Errorf("Unexpected user data %+v", user)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/user/user@example.com"); !ok {
+		t.Error("Expected the account to be imported")
+	}
+	if _, err := storage.LoadUser("other@example.org"); err == nil {
+		t.Error("Expected accounts of other CAs not to be imported")
+	} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+		t.Errorf("Expected ErrNotExist, got %T", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	root := writeFileStorage(t)
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket", WithCA("other-ca"))
+
+	if err := storage.Migrate(root); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := storage.ListSites(); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 || names[0] != "example.org" {
+		t.Errorf("Expected example.org to be migrated, got %v", names)
+	}
+	if _, err := storage.LoadUser("other@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// Running it again keeps the migrated data.
+	if err := storage.Migrate(root); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+package caddytlss3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The disk mirror keeps a local copy of site data so that certificates
+// that were already issued can still be loaded while S3 is unavailable.
+// Unlike the cache it's never read while S3 is working.
+
+// storeMirror writes the site data for a key to the mirror after it was
+// successfully stored in or loaded from S3.
+func (s *S3Storage) storeMirror(bucket, key string, data []byte) {
+	if s.mirrorDir == "" {
+		return
+	}
+	// The mirror holds private keys so it must only be readable by this
+	// user.
+	if err := os.MkdirAll(s.mirrorDir, 0700); err != nil {
+		s.log().Errorf("creating mirror directory: %s", err)
+		return
+	}
+	// Write to a temporary file first so a crash can't leave a truncated
+	// copy behind.
+	path := hashedPath(s.mirrorDir, cacheKey(bucket, key))
+	f, err := ioutil.TempFile(s.mirrorDir, filepath.Base(path)+".tmp")
+	if err == nil {
+		_, err = f.Write(data)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		s.log().Errorf("writing mirror of %s: %s", key, err)
+	}
+}
+
+// loadMirror returns the mirrored data for a key after loading it from S3
+// failed with s3Err, unless it's older than the staleness limit.
+func (s *S3Storage) loadMirror(bucket, key string, s3Err error) ([]byte, bool) {
+	if s.mirrorDir == "" {
+		return nil, false
+	}
+	path := hashedPath(s.mirrorDir, cacheKey(bucket, key))
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	age := s.now().Sub(fi.ModTime())
+	if s.mirrorMaxAge > 0 && age > s.mirrorMaxAge {
+		s.log().Warnf("not using mirror of %s after S3 error (%s): mirror is %s old", key, s3Err, age)
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	s.log().Warnf("loaded %s from the disk mirror (%s old) after S3 error: %s", key, age, s3Err)
+	return data, true
+}
+
+// deleteMirror removes the mirrored data for a deleted key.
+func (s *S3Storage) deleteMirror(bucket, key string) {
+	if s.mirrorDir == "" {
+		return
+	}
+	if err := os.Remove(hashedPath(s.mirrorDir, cacheKey(bucket, key))); err != nil && !os.IsNotExist(err) {
+		s.log().Errorf("removing mirror of %s: %s", key, err)
+	}
+}
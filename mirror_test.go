@@ -0,0 +1,59 @@
+package caddytlss3
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// unavailableS3 fails every read as during an S3 outage.
+type unavailableS3 struct {
+	s3iface.S3API
+}
+
+func (unavailableS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), http.StatusServiceUnavailable, "")
+}
+
+func (u unavailableS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return u.GetObject(in)
+}
+
+func TestDiskMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytlss3-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket", WithMirror(dir, time.Hour), WithClock(clock))
+
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Meta: []byte("meta")}); err != nil {
+		t.Fatal(err)
+	}
+	storage.s3 = unavailableS3{}
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Meta) != "meta" {
+		t.Errorf("Expected mirrored data, got %q", data.Meta)
+	}
+	if _, err := storage.LoadSite("other.example.com"); err == nil {
+		t.Error("Expected error for a site that isn't mirrored")
+	}
+
+	clock.Add(2 * time.Hour)
+	if _, err := storage.LoadSite("example.com"); err == nil {
+		t.Error("Expected error for a stale mirror")
+	}
+}
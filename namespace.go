@@ -0,0 +1,253 @@
+package caddytlss3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// caPrefix returns the prefix under which all data for the CA with the
+// given host is stored. Every CA gets its own namespace so that, for
+// instance, certificates from a staging CA never shadow production ones.
+func caPrefix(basePrefix, ca string) string {
+	return basePrefix + "acme/" + ca + "/"
+}
+
+// CANamespace returns the CA namespace for an ACME directory URL. It's the
+// lowercase host, followed by "_" and the port if that isn't the default
+// port of the scheme, followed by "-" and the first 8 hex digits of the
+// SHA-256 of the path unless it's empty, "/" or "/directory":
+//
+//	https://acme-v02.api.letsencrypt.org/directory  acme-v02.api.letsencrypt.org
+//	https://ca.example.com:8443/directory           ca.example.com_8443
+//	https://ca.example.com/acme/prod/directory      ca.example.com-1a2b3c4d
+//
+// so directories on the same host that differ by port or path get their
+// own namespaces. Previous versions used the host as is, which is kept as
+// Config.LegacyCA. URLs that aren't HTTP URLs are also used as is.
+func CANamespace(caURL *url.URL) string {
+	if caURL.Scheme != "http" && caURL.Scheme != "https" {
+		return caURL.Host
+	}
+	ns := strings.ToLower(caURL.Hostname())
+	if ip := net.ParseIP(ns); ip != nil && ip.To4() == nil {
+		// IPv6 addresses contain colons, which aren't valid in paths on
+		// every platform, e.g. for the file storage.
+		ns = strings.Replace(ns, ":", "-", -1)
+	}
+	if port := caURL.Port(); port != "" && !(caURL.Scheme == "https" && port == "443" || caURL.Scheme == "http" && port == "80") {
+		ns += "_" + port
+	}
+	switch p := strings.TrimSuffix(caURL.EscapedPath(), "/"); p {
+	case "", "/directory":
+	default:
+		sum := sha256.Sum256([]byte(p))
+		ns += "-" + hex.EncodeToString(sum[:4])
+	}
+	return ns
+}
+
+func validateCANamespace(ca string) error {
+	if ca == "" || ca == "." || ca == ".." || strings.Contains(ca, "/") {
+		return fmt.Errorf("S3Storage: invalid CA namespace %q", ca)
+	}
+	return nil
+}
+
+// CANamespaces returns the names (see CANamespace) of all CA namespaces that
+// have data stored in the bucket.
+func (s *S3Storage) CANamespaces() ([]string, error) {
+	root := s.basePrefix + "acme/"
+	var namespaces []string
+	ctx, cancel := s.opContext()
+	defer cancel()
+	err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:    &s.bucket,
+		Prefix:    &root,
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			ns := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), root), "/")
+			if ns != "" {
+				namespaces = append(namespaces, ns)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namespaces, nil
+}
+
+// CopySite copies the stored data for domain from the CA namespace fromCA
+// to the namespace toCA (e.g. when switching from Let's Encrypt staging to
+// production). Existing data for the domain in toCA is overwritten.
+func (s *S3Storage) CopySite(domain, fromCA, toCA string) error {
+	if err := validateCANamespace(fromCA); err != nil {
+		return err
+	}
+	if err := validateCANamespace(toCA); err != nil {
+		return err
+	}
+	src := s.routes.siteIn(domain, fromCA)
+	dst := s.routes.siteIn(domain, toCA)
+	if err := s.copyBlob(src, dst); err != nil {
+		return err
+	}
+	if !s.split {
+		return s.copyObject(src, dst)
+	}
+	for _, name := range []string{splitCert, splitKey, splitMeta} {
+		err := s.copyObject(src.splitPart(name), dst.splitPart(name))
+		if err != nil && !(name == splitMeta && isNotFound(err)) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject copies the object at src to dst.
+func (s *S3Storage) copyObject(src, dst *location) error {
+	if s.dryRun {
+		s.log().Infof("dry run: CopyObject s3://%s/%s to s3://%s/%s", src.bucket, src.key, dst.bucket, dst.key)
+		return nil
+	}
+	in := &s3.CopyObjectInput{
+		Bucket:     &dst.bucket,
+		Key:        &dst.key,
+		CopySource: aws.String(url.PathEscape(src.bucket + "/" + src.key)),
+	}
+	in.ServerSideEncryption, in.SSEKMSKeyId = dst.sseParams()
+	if s.class != "" {
+		in.StorageClass = aws.String(s.class)
+	}
+	in.ACL = s.cannedACL()
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, err := dst.s3.CopyObjectWithContext(ctx, in)
+	return s.storageError("CopyObject", dst.bucket, dst.key, err)
+}
+
+// fileCA returns the namespace of the CA in Caddy's file storage, which is
+// the host of its directory URL.
+func (s *S3Storage) fileCA() string {
+	if s.legacyCA != "" {
+		return s.legacyCA
+	}
+	return s.ca
+}
+
+// legacySiteLocations returns the locations of the site data for domain in
+// the CA namespace used by previous versions, in lookup order, or nil if
+// it's the same namespace.
+func (s *S3Storage) legacySiteLocations(domain string) []*location {
+	if s.legacyCA == "" || s.legacyCA == s.ca {
+		return nil
+	}
+	loc := s.routes.siteIn(domain, s.legacyCA)
+	locs := []*location{loc}
+	if legacy := loc.legacySite(domain); legacy != nil {
+		locs = append(locs, legacy)
+	}
+	return locs
+}
+
+// legacySiteExists returns true if the site data for domain is stored in
+// the CA namespace used by previous versions.
+func (s *S3Storage) legacySiteExists(domain string) bool {
+	for _, loc := range s.legacySiteLocations(domain) {
+		ctx, cancel := s.opContext()
+		_, err := loc.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &loc.bucket,
+			Key:    &loc.key,
+		})
+		cancel()
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateLegacySite imports the site data for domain from the CA namespace
+// used by previous versions after it wasn't found, like migrateSite. The
+// data is left in place for hosts still running previous versions.
+func (s *S3Storage) migrateLegacySite(domain string) (*caddytls.SiteData, bool) {
+	for _, loc := range s.legacySiteLocations(domain) {
+		b, err := s.getObject(loc.s3, loc.bucket, loc.key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			s.log().Errorf("reading %s from CA namespace %s: %s", domain, s.legacyCA, err)
+			return nil, false
+		}
+		data, err := unmarshalSite(loc.bucket, loc.key, b)
+		if err != nil {
+			s.log().Errorf("reading %s from CA namespace %s: %s", domain, s.legacyCA, err)
+			return nil, false
+		}
+		if s.readOnly {
+			return data, true
+		}
+		if err := s.StoreSite(domain, data); err != nil {
+			s.log().Errorf("importing %s from CA namespace %s: %s", domain, s.legacyCA, err)
+		} else {
+			s.log().Infof("imported %s from CA namespace %s", domain, s.legacyCA)
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// migrateLegacyUser imports the account for email from the CA namespace
+// used by previous versions after it wasn't found, like migrateSite.
+func (s *S3Storage) migrateLegacyUser(email string) (*caddytls.UserData, bool) {
+	if s.legacyCA == "" || s.legacyCA == s.ca {
+		return nil, false
+	}
+	prefix := caPrefix(s.basePrefix, s.legacyCA) + "user/"
+	for _, key := range s.userKeysUnder(prefix, email) {
+		data, err := s.loadUser(key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			s.log().Errorf("reading account %s from CA namespace %s: %s", email, s.legacyCA, err)
+			return nil, false
+		}
+		if s.readOnly {
+			return data, true
+		}
+		if err := s.StoreUser(email, data); err != nil {
+			s.log().Errorf("importing account %s from CA namespace %s: %s", email, s.legacyCA, err)
+		} else {
+			s.log().Infof("imported account %s from CA namespace %s", email, s.legacyCA)
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// legacyRecentUser returns the most recent user of the CA namespace used
+// by previous versions, or an empty string if there is none. The account
+// is imported when it's loaded.
+func (s *S3Storage) legacyRecentUser() string {
+	if s.legacyCA == "" || s.legacyCA == s.ca {
+		return ""
+	}
+	key := caPrefix(s.basePrefix, s.legacyCA) + "meta/most-recent-user"
+	b, err := s.getObject(s.s3, s.bucket, key)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
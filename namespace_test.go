@@ -0,0 +1,88 @@
+package caddytlss3
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestCANamespace(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://acme-v02.api.letsencrypt.org/directory":         "acme-v02.api.letsencrypt.org",
+		"https://acme-staging-v02.api.letsencrypt.org/directory": "acme-staging-v02.api.letsencrypt.org",
+		"https://CA.example.com:443/directory/":                  "ca.example.com",
+		"https://ca.example.com:8443/directory":                  "ca.example.com_8443",
+		"http://localhost:80":                                    "localhost",
+		"http://localhost:14000/dir":                             "localhost_14000-" + pathHash("/dir"),
+		"https://ca.example.com/acme/prod/directory":             "ca.example.com-" + pathHash("/acme/prod/directory"),
+		"https://[::1]:14000/directory":                          "--1_14000",
+		"s3://bucket/prefix":                                     "bucket",
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := CANamespace(u)
+		if got != want {
+			t.Errorf("CANamespace(%s) = %q, want %q", raw, got, want)
+		}
+		if err := validateCANamespace(got); err != nil {
+			t.Errorf("CANamespace(%s): %s", raw, err)
+		}
+	}
+	staging, _ := url.Parse("https://ca.example.com/acme/staging/directory")
+	prod, _ := url.Parse("https://ca.example.com/acme/prod/directory")
+	if CANamespace(staging) == CANamespace(prod) {
+		t.Error("Expected directories with different paths to get different namespaces")
+	}
+}
+
+func pathHash(p string) string {
+	u := &url.URL{Scheme: "https", Host: "h", Path: p}
+	return CANamespace(u)[len("h-"):]
+}
+
+func TestLegacyCANamespace(t *testing.T) {
+	client := fakes.NewS3()
+	old := newFakeStorage(t, client, "bucket", WithCA("localhost:14000"))
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}
+	if err := old.StoreSite("example.com", site); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.StoreUser("me@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := newFakeStorage(t, client, "bucket", WithCA("localhost_14000"), WithLegacyCA("localhost:14000"))
+	if ok, err := storage.SiteExists("example.com"); err != nil || !ok {
+		t.Fatalf("SiteExists: %v %v", ok, err)
+	}
+	if _, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "acme/localhost_14000/domain/example.com"); !ok {
+		t.Error("Expected the site imported into the new namespace")
+	}
+	if _, ok := client.Object("bucket", "acme/localhost:14000/domain/example.com"); !ok {
+		t.Error("Expected the site kept in the old namespace")
+	}
+	if email := storage.MostRecentUserEmail(); email != "me@example.com" {
+		t.Fatalf("Expected the most recent user of the old namespace, got %q", email)
+	}
+	if _, err := storage.LoadUser("me@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	var imported bool
+	for _, key := range client.Keys("bucket") {
+		imported = imported || strings.HasPrefix(key, "acme/localhost_14000/user/")
+	}
+	if !imported {
+		t.Errorf("Expected the account imported into the new namespace, got %v", client.Keys("bucket"))
+	}
+	if _, err := storage.LoadSite("missing.example.com"); err == nil {
+		t.Error("Expected an error loading a missing site")
+	}
+}
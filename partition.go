@@ -0,0 +1,34 @@
+package caddytlss3
+
+import (
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// partitionRegions are the regions used to detect the region of a bucket
+// in each AWS partition when none is configured. Like us-east-1 in the
+// standard partition, they answer GetBucketLocation for any bucket of
+// their partition.
+var partitionRegions = map[string]string{
+	endpoints.AwsPartitionID:      defaultRegion,
+	endpoints.AwsCnPartitionID:    "cn-north-1",
+	endpoints.AwsUsGovPartitionID: "us-gov-west-1",
+}
+
+// regionPartition returns the ID of the AWS partition of region, e.g.
+// aws-us-gov, or of the standard partition if the region is unknown.
+func regionPartition(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID()
+	}
+	return endpoints.AwsPartitionID
+}
+
+// arn returns the ARN of an S3 bucket or object in the partition of the
+// storage, for policies and permission errors.
+func (s *S3Storage) arn(resource string) string {
+	partition := s.partition
+	if partition == "" {
+		partition = endpoints.AwsPartitionID
+	}
+	return "arn:" + partition + ":s3:::" + resource
+}
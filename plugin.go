@@ -2,36 +2,36 @@ package caddytlss3
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddytls"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// TODO:
-// - support credentials in the config URL
-// - distributed locks to avoid generating certs on multiple hosts
-// - region support
-// - setting bucket without env
-
 func init() {
 	// caddy.RegisterPlugin("s3", caddy.Plugin{Action: setup})
 	caddytls.RegisterStorageProvider("s3", NewS3Storage)
+	caddy.OnProcessExit = append(caddy.OnProcessExit, closeAll)
 }
 
 // func setup(c *caddy.Controller) error {
@@ -46,93 +46,552 @@ func init() {
 // 	return nil
 // }
 
+// openStorages tracks the instances that have background work to stop so
+// they can be closed when the process exits.
+var (
+	openStoragesMu sync.Mutex
+	openStorages   = make(map[*S3Storage]struct{})
+)
+
+// closeAll closes every open storage instance and releases all locks.
+func closeAll() {
+	openStoragesMu.Lock()
+	storages := make([]*S3Storage, 0, len(openStorages))
+	for s := range openStorages {
+		storages = append(storages, s)
+	}
+	openStoragesMu.Unlock()
+	for _, s := range storages {
+		if err := s.Close(); err != nil {
+			s.log().Errorf("close: %s", err)
+		}
+	}
+	releaseLocks(func(l *nameLock) bool { return true })
+}
+
+// S3Storage implements caddytls.Storage on top of S3. Configuration is read
+// every time an instance is constructed, so changes to the environment take
+// effect on the next Caddy reload without restarting the process. Instances
+// are never mutated, so operations already in flight complete against the
+// configuration they started with.
 type S3Storage struct {
-	bucket      string
-	prefix      string
-	s3          s3iface.S3API
-	nameLocksMu sync.Mutex
-	nameLocks   map[string]*sync.WaitGroup
+	bucket     string
+	basePrefix string // user supplied prefix shared by all CA namespaces
+	prefix     string // prefix of the CA namespace for this instance
+	ca         string
+	legacyCA   string // namespace of the CA used by previous versions
+	session    *session.Session
+	s3Config   *aws.Config // applied to every S3 client, e.g. a custom endpoint
+	partition  string      // AWS partition of the bucket, for ARNs
+	s3         s3iface.S3API
+	sse        string
+	kmsKeyID   string
+	class      string // storage class, empty for the default
+	noTagging  bool
+	verify     bool        // read site data back after writing it
+	split      bool        // store sites in the split layout
+	shared     bool        // store sites in the shared layout
+	keys       *keySecrets // private keys in Secrets Manager, nil to keep them in S3
+	notifier   *notifier   // publishes events of changes, nil for none
+	dryRun     bool
+	readOnly   bool // refuses writes and skips locks, see Config.ReadOnly
+	readable   bool
+	cacheTTL   time.Duration
+	// negativeTTL is how long LoadSite remembers that a site is missing.
+	negativeTTL time.Duration
+	cacheDir    string
+	routes      *router
+	domainRate  *rateLimit
+	clock       Clock
+	locker      locker
+	// accountKeyTypes is the order in which accounts are looked up by key type.
+	accountKeyTypes []string
+	mirrorDir       string
+	// mirrorMaxAge is the staleness limit of the mirror, zero for none.
+	mirrorMaxAge time.Duration
+	// requesterPays accepts the charges of requests to requester pays
+	// buckets.
+	requesterPays bool
+	// acl is the canned ACL of written objects, empty for none.
+	acl string
+	// assumeExists reports sites whose existence check was denied as
+	// existing.
+	assumeExists bool
+	// sharedAccounts stores accounts outside of the CA namespaces.
+	sharedAccounts bool
+	// dryRunDeletes only logs deletes, see Config.DryRunDeletes.
+	dryRunDeletes bool
+	// auditLog records changes in the bucket, see audit.
+	auditLog bool
+	// xray instruments the S3 client with the X-Ray SDK.
+	xray bool
+	// wildcard serves missing sites from wildcard certificates, see
+	// Config.WildcardFallback.
+	wildcard bool
+	// lockWait bounds waiting for locks held elsewhere, zero for none.
+	lockWait time.Duration
+	// sseCustomerKey is the SSE-C key, nil unless the SSE mode is
+	// SSECustomer.
+	sseCustomerKey []byte
+	// compression is the compression of written objects.
+	compression string
+	// limits caps S3 requests, nil for no limits.
+	limits *requestLimits
+	// ctx is the parent of the context of every operation, and timeout
+	// bounds each one.
+	ctx     context.Context
+	timeout time.Duration
+	logger  Logger
+	tracer  trace.Tracer
+
+	replica *replica
+	// elector is the leader election, nil if it's disabled.
+	elector *elector
+	// invalidationQueue is the SQS queue consumed to evict cached data
+	// changed by other hosts.
+	invalidationQueue string
+	// siteLoads collapses concurrent loads of a domain.
+	siteLoads flightGroup
+	// recentUser caches MostRecentUserEmail.
+	recentUser recentUserCache
+	// health caches Healthy.
+	health healthCache
+
+	// files is Caddy's file storage that missing data is imported from.
+	files *fileStorage
+
+	closeMu sync.Mutex
+	closers []func() error
 }
 
+// maxStoreSiteAttempts is the number of conditional writes StoreSite makes
+// before giving up when the site keeps being changed concurrently.
+const maxStoreSiteAttempts = 5
+
 // NewS3Storage instantiates a new caddy TLS storage instance that uses S3.
+//
+// When given a storage URL of the form s3://bucket/prefix the bucket and
+// key prefix are taken from the URL. Otherwise (e.g. for an ACME CA URL)
+// they're read from the CADDY_S3_BUCKET and CADDY_S3_PREFIX environment
+// variables.
 func NewS3Storage(caURL *url.URL) (caddytls.Storage, error) {
-	cred := credentials.NewEnvCredentials()
-	if v, err := cred.Get(); err != nil || v.AccessKeyID == "" || v.SecretAccessKey == "" {
-		cred = ec2rolecreds.NewCredentials(session.New(), func(p *ec2rolecreds.EC2RoleProvider) {
-			p.ExpiryWindow = time.Minute * 5
-		})
+	cfg, err := ConfigFromEnv(caURL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Bucket == "" {
+		return nil, errNoBucket
+	}
+	s, err := NewS3StorageWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewS3StorageWithClient instantiates a storage instance that sends all S3
+// requests to client instead of a client built from the AWS environment,
+// e.g. one with custom request signing, or a fake in tests. The region,
+// endpoint, credentials, HTTP, and retry settings of the client are used
+// as is, so the corresponding options have no effect. Options that need
+// other AWS clients (DynamoDB locks, and routes or replicas in other
+// regions) are rejected.
+func NewS3StorageWithClient(client s3iface.S3API, bucket, prefix string, opts ...Option) (*S3Storage, error) {
+	return NewS3StorageWithConfig(Config{Bucket: bucket, Prefix: prefix, client: client}, opts...)
+}
+
+// NewS3StorageWithConfig instantiates a storage instance from cfg modified
+// by opts, for programs that embed the storage outside of Caddy's plugin
+// registration.
+func NewS3StorageWithConfig(cfg Config, opts ...Option) (*S3Storage, error) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("S3Storage: %s", err)
+	}
+	if cfg.DryRun {
+		cfg.Logger.Warnf("dry run enabled, writes and deletes to bucket %s will not be performed", cfg.Bucket)
+	} else if cfg.DryRunDeletes {
+		cfg.Logger.Warnf("dry run of deletes enabled, deletes from bucket %s will not be performed", cfg.Bucket)
+	}
+	var (
+		sess     *session.Session
+		s3Config *aws.Config
+		err      error
+	)
+	region := cfg.Region
+	if cfg.client == nil {
+		if s3Config, err = endpointConfig(cfg.Endpoint, cfg.ForcePathStyle); err != nil {
+			return nil, err
+		}
+		s3Config = withAWSEndpoints(s3Config, cfg.Accelerate, cfg.DualStack)
+		if sess, err = newSession(cfg, s3Config); err != nil {
+			return nil, err
+		}
+		region = aws.StringValue(sess.Config.Region)
+	}
+	prefix := caPrefix(cfg.Prefix, cfg.CA)
+	if cfg.flat {
+		prefix = cfg.Prefix
+	}
+	s := &S3Storage{
+		bucket:      cfg.Bucket,
+		basePrefix:  cfg.Prefix,
+		prefix:      prefix,
+		ca:          cfg.CA,
+		legacyCA:    cfg.LegacyCA,
+		session:     sess,
+		s3Config:    s3Config,
+		partition:   regionPartition(region),
+		sse:         cfg.SSE,
+		kmsKeyID:    cfg.KMSKeyID,
+		class:       cfg.StorageClass,
+		noTagging:   cfg.DisableTagging,
+		verify:      cfg.VerifyWrites,
+		split:       cfg.SiteLayout == SiteLayoutSplit,
+		shared:      cfg.SiteLayout == SiteLayoutShared,
+		dryRun:      cfg.DryRun,
+		readOnly:    cfg.ReadOnly,
+		readable:    cfg.Readable,
+		cacheTTL:    cfg.CacheTTL,
+		negativeTTL: cfg.NegativeCacheTTL,
+		cacheDir:    cfg.CacheDir,
+		clock:       cfg.Clock,
+
+		accountKeyTypes: cfg.AccountKeyTypes,
+		requesterPays:   cfg.RequesterPays,
+		assumeExists:    cfg.AssumeExistsOnDenied,
+		sharedAccounts:  cfg.SharedAccounts,
+		dryRunDeletes:   cfg.DryRunDeletes,
+		xray:            cfg.XRay,
+		auditLog:        cfg.AuditLog,
+		wildcard:        cfg.WildcardFallback,
+		lockWait:        cfg.LockWait,
+		sseCustomerKey:  cfg.SSECustomerKey,
+		compression:     cfg.Compression,
+		limits:          sharedRequestLimits(cfg.Limits),
+		acl:             cfg.ACL,
+		mirrorDir:       cfg.MirrorDir,
+		mirrorMaxAge:    cfg.MirrorMaxAge,
+		ctx:             cfg.Context,
+		timeout:         cfg.Timeout,
+		logger:          cfg.Logger,
+		tracer:          cfg.TracerProvider.Tracer(tracerName),
+	}
+	if cfg.MigrateDir != "" {
+		s.files = &fileStorage{dir: filepath.Join(cfg.MigrateDir, s.fileCA())}
+	}
+	if cfg.DomainRateLimit > 0 {
+		s.domainRate = &rateLimit{n: cfg.DomainRateLimit, interval: cfg.DomainRateInterval}
 	}
+	if s.s3 = cfg.client; s.s3 == nil {
+		s.s3 = s.newClient()
+	}
+	s.routes = newRouter(s, cfg.Routes)
+	if cfg.ReplicaBucket != "" {
+		s.replica = &replica{s3: s.s3, bucket: cfg.ReplicaBucket, timeout: cfg.ReplicaTimeout}
+		if cfg.ReplicaRegion != "" {
+			s.replica.s3 = s.routes.client(cfg.ReplicaRegion)
+		}
+	}
+	if cfg.KeySecretPrefix != "" {
+		sm := secretsmanager.New(s.session)
+		s.addDebugHandlers(&sm.Handlers)
+		s.keys = &keySecrets{client: sm, prefix: cfg.KeySecretPrefix, kmsKeyID: cfg.KeySecretKMSKeyID}
+	}
+	if cfg.EventTopicARN != "" || cfg.EventBus != "" {
+		s.notifier = s.newNotifier(cfg.EventTopicARN, cfg.EventBus)
+	}
+	if s.locker, err = newLocker(s, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.CreateBucket {
+		if err := s.bootstrapBucket(region); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.VerifyPrivate {
+		if err := s.verifyPrivate(); err != nil {
+			return nil, err
+		}
+	}
+	if !cfg.SkipValidate {
+		if err := s.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	// Started last so a failed construction doesn't leave them running.
+	if cfg.LeaderElection && s.locker != nil {
+		s.startElection()
+	}
+	if cfg.InvalidationQueueURL != "" {
+		q := sqs.New(s.session)
+		s.addDebugHandlers(&q.Handlers)
+		s.startInvalidation(q, cfg.InvalidationQueueURL, cfg.OnInvalidate)
+	}
+	if cfg.WatchInterval > 0 {
+		s.startWatch(cfg.WatchInterval, cfg.OnWatchChange)
+	}
+	if cfg.Prefetch > 0 {
+		s.startPrefetch(cfg.Prefetch)
+	}
+	s.reportDiagnostics(region)
+	return s, nil
+}
+
+// errNoBucket is returned by bucketAndPrefix if no bucket is configured.
+var errNoBucket = errors.New("CADDY_S3_BUCKET not set")
+
+// bucketAndPrefix returns the bucket and normalized key prefix from an
+// s3://bucket/prefix URL, falling back to the environment for other URLs.
+// It returns errNoBucket along with the prefix if there is no bucket.
+func bucketAndPrefix(u *url.URL) (string, string, error) {
 	bucket := os.Getenv("CADDY_S3_BUCKET")
+	prefix := os.Getenv("CADDY_S3_PREFIX")
+	if u.Scheme == "s3" && u.Host != "" {
+		bucket = u.Host
+		prefix = u.Path
+	}
+	prefix, err := normalizePrefix(prefix)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid prefix: %s", err)
+	}
 	if bucket == "" {
-		return nil, errors.New("CADDY_S3_BUCKET not set")
+		return "", prefix, errNoBucket
 	}
-	session := session.New(&aws.Config{
-		Region:      aws.String("us-east-1"),
-		Credentials: cred,
-	})
-	return &S3Storage{
-		bucket:    bucket,
-		prefix:    "acme/" + caURL.Host + "/",
-		s3:        s3.New(session),
-		nameLocks: make(map[string]*sync.WaitGroup),
-	}, nil
+	return bucket, prefix, nil
+}
+
+// storageQuery returns the query parameters of an s3:// storage URL. Other
+// URLs are CA URLs, so their parameters are ignored.
+func storageQuery(u *url.URL) url.Values {
+	if u.Scheme != "s3" {
+		return url.Values{}
+	}
+	return u.Query()
 }
 
-func (s *S3Storage) domainKey(domain string) *string {
-	domain = strings.ToLower(domain)
-	return aws.String(s.prefix + "domain/" + domain)
+// newClient returns an S3 client for the storage session with the storage
+// configuration applied and request handlers installed.
+//
+// Requests are sent with aws-sdk-go. Its types are part of the API of the
+// package (Config.Credentials, Config.Retryer, and the client passed to
+// NewS3StorageWithClient), so moving to aws-sdk-go-v2 is left for a major
+// version that can change them.
+func (s *S3Storage) newClient(cfgs ...*aws.Config) *s3.S3 {
+	if s.s3Config != nil {
+		cfgs = append([]*aws.Config{s.s3Config}, cfgs...)
+	}
+	c := s3.New(s.session, cfgs...)
+	if s.requesterPays {
+		c.Handlers.Build.PushBackNamed(requesterPaysHandler)
+	}
+	if s.sseCustomerKey != nil {
+		c.Handlers.Validate.PushFrontNamed(sseCustomerHandler(s.sseCustomerKey))
+	}
+	if s.limits != nil {
+		acquire, release := s.limits.handlers()
+		c.Handlers.Validate.PushFrontNamed(acquire)
+		c.Handlers.Complete.PushBackNamed(release)
+	}
+	if s.tracer != nil {
+		start, end := tracingHandlers(s.tracer)
+		c.Handlers.Validate.PushFrontNamed(start)
+		c.Handlers.Complete.PushBackNamed(end)
+	}
+	c.Handlers.Complete.PushBackNamed(s.accessHandler())
+	s.addDebugHandlers(&c.Handlers)
+	if s.xray {
+		xray.AWS(c.Client)
+	}
+	return c
+}
+
+// requesterPaysHandler accepts the charges of every request to requester
+// pays buckets. Setting the header when building the request covers the
+// operations whose input has no RequestPayer field, and it's signed with
+// the rest of the request.
+var requesterPaysHandler = request.NamedHandler{
+	Name: "caddytlss3.RequesterPays",
+	Fn: func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Request-Payer", s3.RequestPayerRequester)
+	},
+}
+
+// parseBoolEnv parses a boolean environment variable, which is false
+// when unset.
+func parseBoolEnv(name string) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value %q: %s", name, v, err)
+	}
+	return b, nil
+}
+
+// normalizePrefix validates a user supplied key prefix and returns it with
+// leading slashes removed and exactly one trailing slash. An empty prefix
+// is returned as is.
+func normalizePrefix(prefix string) (string, error) {
+	p := strings.Trim(prefix, "/")
+	if p == "" {
+		return "", nil
+	}
+	for _, seg := range strings.Split(p, "/") {
+		switch seg {
+		case "":
+			return "", fmt.Errorf("prefix %q contains an empty path segment", prefix)
+		case ".", "..":
+			return "", fmt.Errorf("prefix %q contains a relative path segment %q", prefix, seg)
+		}
+	}
+	return p + "/", nil
+}
+
+// putObject stores an object with the configured storage class and
+// compression and a checksum of its contents unless dry run is enabled, in
+// which case the write is only logged.
+func (s *S3Storage) putObject(client s3iface.S3API, in *s3.PutObjectInput) error {
+	if err := s.compress(in); err != nil {
+		return err
+	}
+	return s.putPlainObject(client, in)
+}
+
+// putPlainObject is putObject without compression, for objects that are
+// meant to be opened directly.
+func (s *S3Storage) putPlainObject(client s3iface.S3API, in *s3.PutObjectInput) error {
+	if s.class != "" && in.StorageClass == nil {
+		in.StorageClass = aws.String(s.class)
+	}
+	if in.ACL == nil {
+		in.ACL = s.cannedACL()
+	}
+	if err := setChecksum(in); err != nil {
+		return err
+	}
+	if err := setHeaders(in); err != nil {
+		return err
+	}
+	if s.dryRun {
+		s.log().Infof("dry run: PutObject s3://%s/%s (%d bytes, encryption %s)",
+			aws.StringValue(in.Bucket), aws.StringValue(in.Key),
+			aws.Int64Value(in.ContentLength), aws.StringValue(in.ServerSideEncryption))
+		return nil
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, err := client.PutObjectWithContext(ctx, in)
+	return s.storageError("PutObject", aws.StringValue(in.Bucket), aws.StringValue(in.Key), err)
+}
+
+// cannedACL returns the ACL parameter of written objects, or nil to leave
+// access to the object ownership settings of the bucket.
+func (s *S3Storage) cannedACL() *string {
+	if s.acl == "" {
+		return nil
+	}
+	return aws.String(s.acl)
+}
+
+// skipDeletes reports whether deletes are only logged.
+func (s *S3Storage) skipDeletes() bool {
+	return s.dryRun || s.dryRunDeletes
+}
+
+// deleteObject deletes an object unless dry run or a dry run of deletes is
+// enabled, in which case the delete is only logged.
+func (s *S3Storage) deleteObject(client s3iface.S3API, in *s3.DeleteObjectInput) error {
+	if s.skipDeletes() {
+		s.log().Infof("dry run: DeleteObject s3://%s/%s",
+			aws.StringValue(in.Bucket), aws.StringValue(in.Key))
+		return nil
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, err := client.DeleteObjectWithContext(ctx, in)
+	return s.storageError("DeleteObject", aws.StringValue(in.Bucket), aws.StringValue(in.Key), err)
+}
+
+func siteKey(prefix, domain string) string {
+	return prefix + "domain/" + escapeName(domain)
 }
 
 func (s *S3Storage) userKey(email string) *string {
-	email = strings.ToLower(email)
-	return aws.String(s.prefix + "user/" + email)
-}
-
-// TryLock attempts to get a lock for name, otherwise it returns
-// a Waiter value to wait until the other process is finished.
-func (s *S3Storage) TryLock(name string) (caddytls.Waiter, error) {
-	s.nameLocksMu.Lock()
-	defer s.nameLocksMu.Unlock()
-	wg, ok := s.nameLocks[name]
-	if ok {
-		// lock already obtained, let caller wait on it
-		return wg, nil
-	}
-	// caller gets lock
-	wg = new(sync.WaitGroup)
-	wg.Add(1)
-	s.nameLocks[name] = wg
-	return nil, nil
-}
-
-// Unlock unlocks name.
-func (s *S3Storage) Unlock(name string) error {
-	s.nameLocksMu.Lock()
-	defer s.nameLocksMu.Unlock()
-	wg, ok := s.nameLocks[name]
-	if !ok {
-		return fmt.Errorf("S3Storage: no lock to release for %s", name)
+	return aws.String(s.userPrefix() + escapeName(email))
+}
+
+// onClose registers fn to be called when the storage is closed. It's used
+// by features that run in the background or buffer writes so that Close
+// can drain and stop them.
+func (s *S3Storage) onClose(fn func() error) {
+	s.closeMu.Lock()
+	s.closers = append(s.closers, fn)
+	s.closeMu.Unlock()
+	openStoragesMu.Lock()
+	openStorages[s] = struct{}{}
+	openStoragesMu.Unlock()
+}
+
+// Close flushes pending work, stops background goroutines, and releases
+// any locks obtained through this instance. It's called for all open
+// instances when Caddy exits. The storage must not be used afterwards.
+func (s *S3Storage) Close() error {
+	openStoragesMu.Lock()
+	delete(openStorages, s)
+	openStoragesMu.Unlock()
+
+	s.closeMu.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.closeMu.Unlock()
+	var firstErr error
+	for _, fn := range closers {
+		if err := fn(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	wg.Done()
-	delete(s.nameLocks, name)
-	return nil
+
+	if err := releaseLocks(func(l *nameLock) bool { return l.owner == s }); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
 }
 
 // SiteExists returns true if this site exists in storage.
 // Site data is considered present when StoreSite has been called
 // successfully (without DeleteSite having been called, of course).
 func (s *S3Storage) SiteExists(domain string) (bool, error) {
-	_, err := s.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: &s.bucket,
-		Key:    s.domainKey(domain),
-	})
-	if err != nil {
-		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
-			return false, nil
+	for _, loc := range s.siteLocations(domain) {
+		ctx, cancel := s.opContext()
+		_, err := loc.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &loc.bucket,
+			Key:    &loc.key,
+		})
+		cancel()
+		if err == nil {
+			return true, nil
+		}
+		if isAccessDenied(err) {
+			if s.assumeExists {
+				s.log().Warnf("existence check of s3://%s/%s denied, assuming %s exists", loc.bucket, loc.key, domain)
+				return true, nil
+			}
+			return false, s.storageError("HeadObject", loc.bucket, loc.key, err)
+		}
+		if !isNotFound(err) {
+			return false, s.storageError("HeadObject", loc.bucket, loc.key, err)
 		}
-		return false, err
 	}
-	return true, nil
+	// The site is imported when it's loaded.
+	if s.legacySiteExists(domain) {
+		return true, nil
+	}
+	return s.files != nil && s.files.siteExists(domain), nil
 }
 
 // LoadSite obtains the site data from storage for the given domain and
@@ -140,25 +599,117 @@ func (s *S3Storage) SiteExists(domain string) (bool, error) {
 // of type ErrNotExist is returned. For multi-server storage, care
 // should be taken to make this load atomic to prevent race conditions
 // that happen with multiple data loads.
+//
+// Concurrent loads of the same domain, e.g. by a burst of handshakes for a
+// name that isn't cached yet, share a single request.
 func (s *S3Storage) LoadSite(domain string) (*caddytls.SiteData, error) {
-	res, err := s.s3.GetObject(&s3.GetObjectInput{
-		Bucket: &s.bucket,
-		Key:    s.domainKey(domain),
+	v, err := s.siteLoads.do(strings.ToLower(domain), func() (interface{}, error) {
+		data, err := s.loadSite(domain)
+		if err != nil {
+			return nil, err
+		}
+		if data.Key, err = s.resolveKey(data.Key); err != nil {
+			return nil, err
+		}
+		return data, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	// Every caller gets its own copy so they can't modify each other's.
+	data := *v.(*caddytls.SiteData)
+	return &data, nil
+}
+
+// loadSite loads the site data for domain, following a site alias to the
+// site it refers to and, with wildcard fallback enabled, falling back to
+// the wildcard certificate covering domain.
+func (s *S3Storage) loadSite(domain string) (*caddytls.SiteData, error) {
+	data, err := s.loadSiteData(domain)
+	if alias, ok := err.(errSiteAlias); ok {
+		data, err = s.loadAlias(domain, alias.domain)
+	}
+	if _, ok := err.(caddytls.ErrNotExist); ok && s.wildcard {
+		if data, ok := s.wildcardSite(domain); ok {
+			return data, nil
+		}
+	}
+	return data, err
+}
+
+// loadSiteData loads the site data stored for domain, following pointers
+// of the shared layout. It returns an errSiteAlias if it's an alias of
+// another domain.
+func (s *S3Storage) loadSiteData(domain string) (*caddytls.SiteData, error) {
+	loc := s.routes.site(domain)
+	bucket, key := loc.bucket, loc.key
+	if s.knownMissing(bucket, key) {
+		return nil, caddytls.ErrNotExist(fmt.Errorf("S3Storage: no site data for %s (cached)", domain))
+	}
+	if s.split {
+		// Sites stored before the layout was changed remain readable.
+		data, err := s.loadSplitSite(loc)
+		if err == nil {
+			if b, err := marshalSite(data); err == nil {
+				s.storeMirror(loc.bucket, loc.key, b)
+			}
+			return data, nil
+		}
+		if !isNotFound(err) {
+			return s.mirroredSite(loc, err)
+		}
+	}
+	b, err := s.getObject(loc.s3, loc.bucket, loc.key)
+	if legacy := loc.legacySite(domain); legacy != nil && isNotFound(err) {
+		loc = legacy
+		b, err = s.getObject(loc.s3, loc.bucket, loc.key)
+	}
 	if err != nil {
 		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			if data, ok := s.migrateLegacySite(domain); ok {
+				return data, nil
+			}
+			if data, ok := s.migrateSite(domain); ok {
+				return data, nil
+			}
+			s.cacheMissing(bucket, key)
 			return nil, caddytls.ErrNotExist(err)
 		}
+		if _, ok := err.(ErrCorruptData); ok {
+			return s.recoverSite(domain, err)
+		}
+		return s.mirroredSite(loc, err)
+	}
+	data, err := unmarshalSite(loc.bucket, loc.key, b)
+	if alias, ok := err.(errSiteAlias); ok {
+		if alias.blob != "" {
+			return s.loadBlob(loc, alias.blob)
+		}
+		s.storeMirror(loc.bucket, loc.key, b)
 		return nil, err
 	}
-	defer res.Body.Close()
-	var data *caddytls.SiteData
-	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+	if _, ok := err.(ErrSchemaVersion); ok {
+		// Previous versions would roll back the site of a newer host.
 		return nil, err
 	}
+	if err != nil {
+		s.invalidate(loc.bucket, loc.key)
+		return s.recoverSite(domain, ErrCorruptData{Bucket: loc.bucket, Key: loc.key, Err: err})
+	}
+	s.storeMirror(loc.bucket, loc.key, b)
 	return data, nil
 }
 
+// mirroredSite returns the site data for loc from the disk mirror after
+// reading it from S3 failed with err, or err if it isn't mirrored.
+func (s *S3Storage) mirroredSite(loc *location, err error) (*caddytls.SiteData, error) {
+	mb, ok := s.loadMirror(loc.bucket, loc.key, err)
+	if !ok {
+		return nil, err
+	}
+	return unmarshalSite(loc.bucket, loc.key, mb)
+}
+
 // StoreSite persists the given site data for the given domain in
 // storage. For multi-server storage, care should be taken to make this
 // call atomic to prevent half-written data on failure of an internal
@@ -166,29 +717,186 @@ func (s *S3Storage) LoadSite(domain string) (*caddytls.SiteData, error) {
 // this function will only be invoked after LockRegister and before
 // UnlockRegister of the same domain.
 func (s *S3Storage) StoreSite(domain string, data *caddytls.SiteData) error {
-	jsonData, err := json.Marshal(data)
+	if s.readOnly {
+		return ErrReadOnly{Op: "StoreSite", Name: domain}
+	}
+	if err := s.checkDomainRate(domain); err != nil {
+		return err
+	}
+	fence, err := s.lockFence(domain)
 	if err != nil {
 		return err
 	}
-	_, err = s.s3.PutObject(&s3.PutObjectInput{
-		Bucket:               &s.bucket,
-		Key:                  s.domainKey(domain),
-		Body:                 bytes.NewReader(jsonData),
-		ContentLength:        aws.Int64(int64(len(jsonData))),
-		ServerSideEncryption: aws.String("AES256"),
-	})
-	return err
+	loc := s.routes.site(domain)
+	if s.keys != nil {
+		if data, err = s.storeSiteKey(loc, data); err != nil {
+			return err
+		}
+	}
+	jsonData, err := marshalSite(data)
+	if err != nil {
+		return err
+	}
+	var tagging string
+	if !s.noTagging {
+		tagging = certTagging(domain, data.Cert)
+	}
+	meta := certMetadata(data.Cert)
+	if fence != 0 {
+		if meta == nil {
+			meta = make(map[string]*string)
+		}
+		meta[lockFenceMeta] = aws.String(strconv.FormatUint(fence, 10))
+	}
+	var written bool
+	switch {
+	case s.split:
+		written, err = s.putSplitSite(loc, data, meta, tagging)
+	case s.shared:
+		written, err = s.putSharedSite(loc, jsonData, meta, tagging)
+	default:
+		written, err = s.putSite(loc, jsonData, "", meta, tagging)
+	}
+	s.invalidate(loc.bucket, loc.key)
+	if err != nil {
+		return err
+	}
+	if written && s.verify && !s.dryRun {
+		switch {
+		case s.split:
+			err = s.verifyWrite(loc.splitPart(splitCert), data.Cert)
+			if err == nil {
+				err = s.verifyWrite(loc.splitPart(splitKey), data.Key)
+			}
+		case s.shared:
+			err = s.verifyWrite(loc.withKey(blobKey(loc, blobSum(jsonData))), jsonData)
+		default:
+			err = s.verifyWrite(loc, jsonData)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !s.dryRun {
+		s.storeMirror(loc.bucket, loc.key, jsonData)
+	}
+	if legacy := loc.legacySite(domain); legacy != nil {
+		// Remove the copy stored before domains were escaped so it can't
+		// be read once the new object is gone.
+		if err := s.deleteLegacySite(legacy); err != nil {
+			s.log().Errorf("deleting s3://%s/%s: %s", legacy.bucket, legacy.key, err)
+		}
+	}
+	if s.readable {
+		// The mirror is a convenience for operators so failing to write it
+		// must not fail the store.
+		if err := s.storeReadable(loc, domain, data); err != nil {
+			s.log().Errorf("writing readable copy of %s: %s", domain, err)
+		}
+	}
+	if written {
+		s.publish(s.siteEvent(EventSiteStored, domain, loc, data.Cert))
+		if s.shared {
+			s.shareSite(domain, data, jsonData)
+		}
+	}
+	return nil
+}
+
+// putSite writes site data with a conditional write against the object
+// that is currently stored, so that concurrent renewals by different hosts
+// are detected and retried rather than silently overwriting each other.
+// Site data stored under a lock that was since taken over by a host that
+// stored site data with a larger fencing token isn't written. It returns
+// whether the site data was written.
+func (s *S3Storage) putSite(loc *location, body []byte, contentType string, meta map[string]*string, tagging string) (bool, error) {
+	fence, _ := strconv.ParseUint(aws.StringValue(meta[lockFenceMeta]), 10, 64)
+	for attempt := 0; attempt < maxStoreSiteAttempts; attempt++ {
+		in := loc.encrypt(&s3.PutObjectInput{
+			Bucket:        &loc.bucket,
+			Key:           &loc.key,
+			Body:          bytes.NewReader(body),
+			ContentLength: aws.Int64(int64(len(body))),
+			Metadata:      meta,
+		})
+		if contentType != "" {
+			in.ContentType = aws.String(contentType)
+		}
+		if tagging != "" {
+			in.Tagging = aws.String(tagging)
+		}
+		ctx, cancel := s.opContext()
+		head, err := loc.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &loc.bucket,
+			Key:    &loc.key,
+		})
+		cancel()
+		switch {
+		case isNotFound(err):
+			in.IfNoneMatch = aws.String("*")
+		case err != nil:
+			return false, err
+		default:
+			if cur, err := strconv.ParseUint(metadataValue(head.Metadata, lockFenceMeta), 10, 64); err == nil && fence != 0 && cur > fence {
+				return false, fmt.Errorf("S3Storage: s3://%s/%s was stored under a newer lock (fencing token %d > %d)",
+					loc.bucket, loc.key, cur, fence)
+			}
+			in.IfMatch = head.ETag
+		}
+		err = s.putObject(loc.s3, in)
+		if isConditionFailed(err) {
+			s.log().Infof("s3://%s/%s was changed concurrently, retrying", loc.bucket, loc.key)
+			continue
+		}
+		return err == nil, err
+	}
+	return false, fmt.Errorf("S3Storage: too many concurrent updates of s3://%s/%s", loc.bucket, loc.key)
 }
 
 // DeleteSite deletes the site for the given domain from storage.
 // Multi-server implementations should attempt to make this atomic. If
 // the site does not exist, an error value of type ErrNotExist is returned.
 func (s *S3Storage) DeleteSite(domain string) error {
-	_, err := s.s3.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: &s.bucket,
-		Key:    s.domainKey(domain),
+	if s.readOnly {
+		return ErrReadOnly{Op: "DeleteSite", Name: domain}
+	}
+	if err := s.checkDomainRate(domain); err != nil {
+		return err
+	}
+	loc := s.routes.site(domain)
+	err := s.deleteObject(loc.s3, &s3.DeleteObjectInput{
+		Bucket: &loc.bucket,
+		Key:    &loc.key,
 	})
-	return err
+	s.invalidate(loc.bucket, loc.key)
+	if err != nil {
+		return err
+	}
+	if !s.skipDeletes() {
+		s.deleteMirror(loc.bucket, loc.key)
+	}
+	if legacy := loc.legacySite(domain); legacy != nil {
+		if err := s.deleteLegacySite(legacy); err != nil {
+			return err
+		}
+	}
+	if s.split {
+		if err := s.deleteSplitSite(loc); err != nil {
+			return err
+		}
+	}
+	if s.keys != nil {
+		if err := s.deleteKey(loc.bucket, loc.key); err != nil {
+			return err
+		}
+	}
+	if s.readable {
+		if err := s.deleteReadable(loc, domain); err != nil {
+			return err
+		}
+	}
+	s.publish(s.siteEvent(EventSiteDeleted, domain, loc, nil))
+	return nil
 }
 
 // LoadUser obtains user data from storage for the given email and
@@ -197,19 +905,52 @@ func (s *S3Storage) DeleteSite(domain string) error {
 // should take care to make this operation atomic for all loaded
 // data items.
 func (s *S3Storage) LoadUser(email string) (*caddytls.UserData, error) {
-	res, err := s.s3.GetObject(&s3.GetObjectInput{
-		Bucket: &s.bucket,
-		Key:    s.userKey(email),
-	})
+	var err error
+	for _, key := range s.userKeys(email) {
+		var data *caddytls.UserData
+		data, err = s.loadUser(key)
+		if err == nil {
+			return data, nil
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+	}
+	if data, ok := s.migrateScopedUser(email); ok {
+		return data, nil
+	}
+	if data, ok := s.migrateLegacyUser(email); ok {
+		return data, nil
+	}
+	if data, ok := s.migrateUser(email); ok {
+		return data, nil
+	}
+	return nil, caddytls.ErrNotExist(err)
+}
+
+func (s *S3Storage) loadUser(key *string) (*caddytls.UserData, error) {
+	b, err := s.getObject(s.s3, s.bucket, *key)
 	if err != nil {
-		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
-			return nil, caddytls.ErrNotExist(err)
+		return nil, err
+	}
+	account, err := s.sharedAccountRef(*key, b)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil {
+		key = account
+		if b, err = s.getObject(s.s3, s.bucket, *key); err != nil {
+			return nil, err
 		}
+	}
+	data, err := unmarshalUser(s.bucket, *key, b)
+	if _, ok := err.(ErrSchemaVersion); ok {
 		return nil, err
 	}
-	defer res.Body.Close()
-	var data *caddytls.UserData
-	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+	if err != nil {
+		return nil, ErrCorruptData{Bucket: s.bucket, Key: *key, Err: err}
+	}
+	if data.Key, err = s.resolveKey(data.Key); err != nil {
 		return nil, err
 	}
 	return data, nil
@@ -219,46 +960,202 @@ func (s *S3Storage) LoadUser(email string) (*caddytls.UserData, error) {
 // storage. Multi-server implementations should take care to make this
 // operation atomic for all stored data items.
 func (s *S3Storage) StoreUser(email string, data *caddytls.UserData) error {
-	jsonData, err := json.Marshal(data)
+	if s.readOnly {
+		return ErrReadOnly{Op: "StoreUser", Name: email}
+	}
+	storedAt := s.now()
+	key := s.userKey(email)
+	if kt := accountKeyType(data.Key); kt != "" {
+		key = s.typedUserKey(email, kt)
+	}
+	// With shared accounts, the account is stored by the thumbprint of
+	// its key, and key refers to it.
+	account := key
+	var thumbprint string
+	if s.sharedAccounts {
+		var err error
+		if thumbprint, err = accountThumbprint(data.Key); err != nil {
+			return fmt.Errorf("S3Storage: storing shared account %s: %s", email, err)
+		}
+		account = s.accountKey(thumbprint)
+	}
+	if s.keys != nil {
+		ref, err := s.storeKey(s.bucket, *account, data.Key)
+		if err != nil {
+			return err
+		}
+		stored := *data
+		stored.Key = ref
+		data = &stored
+	}
+	jsonData, err := marshalUser(data)
 	if err != nil {
 		return err
 	}
-	_, err = s.s3.PutObject(&s3.PutObjectInput{
-		Bucket:               &s.bucket,
-		Key:                  s.userKey(email),
-		Body:                 bytes.NewReader(jsonData),
-		ContentLength:        aws.Int64(int64(len(jsonData))),
-		ServerSideEncryption: aws.String("AES256"),
-	})
-	if err != nil {
+	if err := s.putUserObject(account, jsonData, storedAt); err != nil {
 		return err
 	}
-	// Store most recent user
-	_, err = s.s3.PutObject(&s3.PutObjectInput{
-		Bucket:               &s.bucket,
-		Key:                  s.userKey("recent"),
-		Body:                 strings.NewReader(email),
-		ContentLength:        aws.Int64(int64(len(email))),
-		ServerSideEncryption: aws.String("AES256"),
+	if account != key {
+		ref, err := marshalAccountRef(thumbprint)
+		if err != nil {
+			return err
+		}
+		if err := s.putUserObject(key, ref, storedAt); err != nil {
+			return err
+		}
+	}
+	s.recentUser.set(email, storedAt)
+	// The account is stored at this point. The pointer is only kept for
+	// hosts running previous versions, and MostRecentUserEmail repairs it
+	// if this fails.
+	if err := s.storeRecentUser(email, storedAt); err != nil {
+		s.log().Warnf("updating the most recent user pointer for %s: %s", email, err)
+	}
+	s.publish(&Event{
+		Action: EventUserStored,
+		Email:  strings.ToLower(email),
+		CA:     s.ca,
+		Bucket: s.bucket,
+		Key:    *key,
+		Time:   storedAt.UTC(),
 	})
+	return nil
+}
+
+// putUserObject writes an account, or a reference to a shared account,
+// recording when it was stored.
+func (s *S3Storage) putUserObject(key *string, body []byte, storedAt time.Time) error {
+	err := s.putObject(s.s3, s.encrypt(&s3.PutObjectInput{
+		Bucket:        &s.bucket,
+		Key:           key,
+		Body:          bytes.NewReader(body),
+		ContentLength: aws.Int64(int64(len(body))),
+		Metadata: map[string]*string{
+			recentStoredAtMeta: aws.String(storedAt.UTC().Format(time.RFC3339Nano)),
+		},
+	}))
+	s.invalidate(s.bucket, *key)
 	return err
 }
 
+// DeleteUser deletes the user for the given email, including the accounts
+// for all key types, from storage. If it was the most recent user, the
+// most recently modified remaining account becomes the most recent user.
+func (s *S3Storage) DeleteUser(email string) error {
+	if s.readOnly {
+		return ErrReadOnly{Op: "DeleteUser", Name: email}
+	}
+	for _, key := range s.userKeys(email) {
+		if err := s.deleteSharedAccount(key); err != nil {
+			return err
+		}
+		err := s.deleteObject(s.s3, &s3.DeleteObjectInput{
+			Bucket: &s.bucket,
+			Key:    key,
+		})
+		s.invalidate(s.bucket, *key)
+		if err != nil {
+			return err
+		}
+		if s.keys != nil {
+			if err := s.deleteKey(s.bucket, *key); err != nil {
+				return err
+			}
+		}
+	}
+	s.recentUser.reset()
+	if s.dryRunDeletes {
+		// The account is still there, so the pointer stays too.
+		return nil
+	}
+	return s.replaceRecentUser(email)
+}
+
 // MostRecentUserEmail provides the most recently used email parameter
 // in StoreUser. The result is an empty string if there are no
 // persisted users in storage.
+//
+// It's the account that was stored last according to a listing of the
+// accounts, which, unlike the most recent user pointer, can't be left
+// stale by a failed or concurrent StoreUser. The result is cached briefly.
+// The pointer is only read if the accounts can't be listed or there are
+// none, e.g. before accounts are imported from Caddy's file storage.
 func (s *S3Storage) MostRecentUserEmail() string {
-	res, err := s.s3.GetObject(&s3.GetObjectInput{
+	if email, ok := s.recentUser.get(s.now()); ok {
+		return email
+	}
+	email, _, err := s.latestUser("")
+	if err != nil {
+		s.log().Warnf("listing accounts to find the most recent user, reading the pointer instead: %s", err)
+		return s.recentUserPointer()
+	}
+	if email == "" {
+		email = s.recentUserPointer()
+	} else {
+		s.repairRecentUser(email)
+	}
+	s.recentUser.set(email, s.now())
+	return email
+}
+
+// recentUserPointer returns the email the most recent user pointer points
+// to, which is kept up to date for hosts running previous versions.
+func (s *S3Storage) recentUserPointer() string {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: &s.bucket,
-		Key:    s.userKey("recent"),
+		Key:    s.recentUserKey(),
 	})
+	if isNotFound(err) {
+		email := s.migrateRecentUser()
+		if email == "" {
+			email = s.legacyRecentUser()
+		}
+		if email == "" && s.files != nil {
+			email = s.files.mostRecentUser()
+		}
+		return email
+	}
 	if err != nil {
 		return ""
 	}
-	defer res.Body.Close()
-	b, err := ioutil.ReadAll(res.Body)
+	b, err := readObject(res, s.bucket, *s.recentUserKey())
 	if err != nil {
+		s.log().Errorf("reading most recent user: %s", err)
 		return ""
 	}
 	return string(b)
 }
+
+// deletePrefix removes every object stored under prefix in bucket with
+// DeleteObjects. Objects that fail to delete are reported together in an
+// ErrDeleteObjects after the others were deleted.
+func (s *S3Storage) deletePrefix(client s3iface.S3API, bucket, prefix string) error {
+	errs := make(deleteErrors)
+	b := s.newDeleteBatch(client, bucket, errs.add)
+	var delErr error
+	ctx, cancel := s.opContext()
+	defer cancel()
+	err := client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			if delErr = b.add(aws.StringValue(o.Key)); delErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if delErr == nil {
+		delErr = b.flush()
+	}
+	if delErr != nil {
+		return delErr
+	}
+	return errs.err(bucket)
+}
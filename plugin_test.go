@@ -1,17 +1,39 @@
 package caddytlss3
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
+	"encoding/pem"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
 )
 
 var rnd *rand.Rand
@@ -20,13 +42,16 @@ func init() {
 	rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
 }
 
-func newTestStorage(t *testing.T) caddytls.Storage {
+// newTestStorage returns a storage in the bucket named by TEST_S3_BUCKET,
+// or in an in-memory fake when it's not set.
+func newTestStorage(t *testing.T) *S3Storage {
+	// Keep each test run in its own namespace so it can be purged afterwards.
+	prefix := randomPrefix(t)
 	bucket := os.Getenv("TEST_S3_BUCKET")
 	if bucket == "" {
-		t.Skip("TEST_S3_BUCKET environment variable not set.")
+		return newFakeStorage(t, fakes.NewS3(), "test", WithPrefix("test/"+prefix), WithCA("acme-v02.api.letsencrypt.org"))
 	}
-	prefix := randomPrefix(t)
-	ur, err := url.Parse("s3://" + bucket + "/" + prefix)
+	ur, err := url.Parse("s3://" + bucket + "/test/" + prefix)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -34,11 +59,35 @@ func newTestStorage(t *testing.T) caddytls.Storage {
 	if err != nil {
 		t.Fatal(err)
 	}
+	return storage.(*S3Storage)
+}
+
+// newFakeStorage returns a storage on client built by the constructor with
+// opts, for the CA "ca" and without the access check of Validate, and
+// closes it when the test ends. Locks expire after a minute.
+func newFakeStorage(t *testing.T, client s3iface.S3API, bucket string, opts ...Option) *S3Storage {
+	t.Helper()
+	opts = append([]Option{WithCA("ca"), func(c *Config) {
+		c.SkipValidate = true
+		c.LockTTL = time.Minute
+	}}, opts...)
+	storage, err := NewS3StorageWithClient(client, bucket, "", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
 	return storage
 }
 
+func cleanupTestStorage(t *testing.T, storage *S3Storage) {
+	if err := storage.Purge(); err != nil {
+		t.Errorf("Failed to clean up prefix %s: %s", storage.basePrefix, err)
+	}
+}
+
 func TestS3StorageIntegrationDomain(t *testing.T) {
 	storage := newTestStorage(t)
+	defer cleanupTestStorage(t, storage)
 
 	domain := "example.com"
 
@@ -97,6 +146,7 @@ func TestS3StorageIntegrationDomain(t *testing.T) {
 
 func TestS3StorageIntegrationUser(t *testing.T) {
 	storage := newTestStorage(t)
+	defer cleanupTestStorage(t, storage)
 
 	email := "someone@example.com"
 
@@ -118,7 +168,7 @@ func TestS3StorageIntegrationUser(t *testing.T) {
 	if err := storage.StoreUser(email, userData); err != nil {
 		t.Fatal(err)
 	}
-	// TODO: delete the create user data for cleanup
+	defer storage.DeleteUser(email)
 
 	ud, err := storage.LoadUser(email)
 	if err != nil {
@@ -131,6 +181,1181 @@ func TestS3StorageIntegrationUser(t *testing.T) {
 	if user := storage.MostRecentUserEmail(); user != email {
 		t.Errorf("Expected %q for most recent user, got %q", email, user)
 	}
+
+	if err := storage.DeleteUser(email); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.LoadUser(email)
+	if err == nil {
+		t.Error("Expected user not to exist")
+	} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+		t.Errorf("Expected caddytls.ErrNotExist, got %T", err)
+	}
+}
+
+func TestS3StorageIntegrationCANamespaces(t *testing.T) {
+	storage := newTestStorage(t)
+	defer cleanupTestStorage(t, storage)
+
+	domain := "example.com"
+	siteData := &caddytls.SiteData{
+		Cert: []byte("cert"),
+		Key:  []byte("key"),
+		Meta: []byte("meta"),
+	}
+	if err := storage.StoreSite(domain, siteData); err != nil {
+		t.Fatal(err)
+	}
+
+	from := strings.TrimSuffix(strings.TrimPrefix(storage.prefix, storage.basePrefix+"acme/"), "/")
+	if err := storage.CopySite(domain, from, "acme.example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces, err := storage.CANamespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(namespaces)
+	exp := []string{"acme.example.org", from}
+	sort.Strings(exp)
+	if !reflect.DeepEqual(namespaces, exp) {
+		t.Errorf("Expected CA namespaces %v, got %v", exp, namespaces)
+	}
+
+	if err := storage.CopySite(domain, from, "bad/ca"); err == nil {
+		t.Error("Expected an error for an invalid CA namespace")
+	}
+}
+
+func TestS3StorageLocksSharedAcrossInstances(t *testing.T) {
+	// Simulate a Caddy reload which replaces the storage instance while
+	// a lock is held.
+	client := fakes.NewS3()
+	oldStorage := newFakeStorage(t, client, "bucket", WithLock("local", ""))
+	newStorage := newFakeStorage(t, client, "bucket", WithLock("local", ""))
+	// Storages for other buckets or CA namespaces don't share locks.
+	otherBucket := newFakeStorage(t, client, "other", WithLock("local", ""))
+	otherCA := newFakeStorage(t, client, "bucket", WithCA("other"), WithLock("local", ""))
+
+	name := "reload.example.com"
+	w, err := oldStorage.TryLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != nil {
+		t.Fatal("Expected to obtain the lock")
+	}
+	w, err = newStorage.TryLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w == nil {
+		t.Fatal("Expected a waiter for a lock held by another instance")
+	}
+	for _, other := range []*S3Storage{otherBucket, otherCA} {
+		if w, err := other.TryLock(name); err != nil || w != nil {
+			t.Fatalf("Expected to obtain the lock of another storage, got %v, %v", w, err)
+		}
+		if err := other.Unlock(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newStorage.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+	w.Wait()
+	if err := oldStorage.Unlock(name); err == nil {
+		t.Error("Expected an error when unlocking a released lock")
+	}
+}
+
+func TestS3StorageCloseReleasesLocks(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket", WithLock("local", ""))
+	other := newFakeStorage(t, client, "bucket", WithLock("local", ""))
+
+	var closed bool
+	storage.onClose(func() error {
+		closed = true
+		return nil
+	})
+
+	if _, err := storage.TryLock("mine.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.TryLock("theirs.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Unlock("theirs.example.com")
+
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed {
+		t.Error("Expected close callback to be called")
+	}
+	if w, err := other.TryLock("mine.example.com"); err != nil {
+		t.Fatal(err)
+	} else if w != nil {
+		t.Error("Expected lock to be released by Close")
+	}
+	other.Unlock("mine.example.com")
+	if w, err := storage.TryLock("theirs.example.com"); err != nil {
+		t.Fatal(err)
+	} else if w == nil {
+		t.Error("Expected lock held by another instance to survive Close")
+	}
+}
+
+func TestBucketAndPrefix(t *testing.T) {
+	defer os.Setenv("CADDY_S3_BUCKET", os.Getenv("CADDY_S3_BUCKET"))
+	defer os.Setenv("CADDY_S3_PREFIX", os.Getenv("CADDY_S3_PREFIX"))
+	os.Setenv("CADDY_S3_BUCKET", "env-bucket")
+	os.Setenv("CADDY_S3_PREFIX", "env/prefix")
+
+	cases := []struct {
+		url    string
+		bucket string
+		prefix string
+	}{
+		{"s3://url-bucket/url/prefix/", "url-bucket", "url/prefix/"},
+		{"s3://url-bucket", "url-bucket", ""},
+		{"https://acme-v01.api.letsencrypt.org/directory", "env-bucket", "env/prefix/"},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket, prefix, err := bucketAndPrefix(u)
+		if err != nil {
+			t.Errorf("%s: %s", c.url, err)
+		} else if bucket != c.bucket || prefix != c.prefix {
+			t.Errorf("%s: expected bucket %q and prefix %q, got %q and %q", c.url, c.bucket, c.prefix, bucket, prefix)
+		}
+	}
+
+	os.Setenv("CADDY_S3_BUCKET", "")
+	u, _ := url.Parse("https://acme-v01.api.letsencrypt.org/directory")
+	if _, _, err := bucketAndPrefix(u); err == nil {
+		t.Error("Expected error without a bucket")
+	}
+}
+
+func TestConfiguredRegion(t *testing.T) {
+	defer os.Setenv("CADDY_S3_REGION", os.Getenv("CADDY_S3_REGION"))
+	os.Setenv("CADDY_S3_REGION", "eu-west-1")
+
+	u, _ := url.Parse("s3://bucket/prefix?region=us-west-2")
+	if r := configuredRegion(storageQuery(u)); r != "us-west-2" {
+		t.Errorf("Expected region from URL, got %q", r)
+	}
+	u, _ = url.Parse("https://acme.example.com/directory?region=us-west-2")
+	if r := configuredRegion(storageQuery(u)); r != "eu-west-1" {
+		t.Errorf("Expected region from environment, got %q", r)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	cfg := Config{Bucket: "bucket"}
+	for _, opt := range []Option{WithPrefix("/caddy"), WithSSE(SSEKMS, "alias/caddy"), WithLock("", "locks"), WithClock(clock)} {
+		opt(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Prefix != "caddy/" {
+		t.Errorf("Expected normalized prefix, got %q", cfg.Prefix)
+	}
+	if cfg.Lock != "dynamodb" {
+		t.Errorf("Expected DynamoDB locks when a lock table is set, got %q", cfg.Lock)
+	}
+	if cfg.LockTTL != defaultLockTTL {
+		t.Errorf("Expected default lock TTL, got %s", cfg.LockTTL)
+	}
+	if cfg.Clock != clock {
+		t.Error("Expected clock to be kept")
+	}
+
+	for _, c := range []Config{
+		{},
+		{Bucket: "bucket", SSE: "des"},
+		{Bucket: "bucket", SSE: SSEAES256, KMSKeyID: "alias/caddy"},
+		{Bucket: "bucket", SSE: SSECustomer, SSECustomerKey: []byte("short")},
+		{Bucket: "bucket", SSECustomerKey: make([]byte, sseCustomerKeySize)},
+		{Bucket: "bucket", SSE: SSECustomer, SSECustomerKey: make([]byte, sseCustomerKeySize), Routes: []*RouteRule{{Suffix: ".example.com", KMSKeyID: "alias/other"}}},
+		{Bucket: "bucket", DomainRateLimit: 10},
+		{Bucket: "bucket", AccountKeyTypes: []string{"dsa"}},
+		{Bucket: "bucket", StorageClass: "GLACIER"},
+		{Bucket: "bucket", Endpoint: "http://minio:9000", DualStack: true},
+		{Bucket: "my.bucket", Accelerate: true},
+		{Bucket: "bucket", ForcePathStyle: true, Accelerate: true},
+		{Bucket: "bucket", FIPS: true, Accelerate: true},
+		{Bucket: "bucket", Partition: "aws-mars"},
+		{Bucket: "bucket", Partition: "aws-us-gov", Region: "eu-west-1"},
+		{Bucket: "bucket", WatchInterval: time.Minute, OnInvalidate: func(string) {}},
+		{Bucket: "bucket", InvalidationQueueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/caddy", OnWatchChange: func(string) {}},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected error for %+v", c)
+		}
+	}
+
+	// The invalidation queue and the watch each keep their own callback.
+	var invalidated, watched string
+	cfg = Config{Bucket: "bucket"}
+	WithInvalidationQueue("https://sqs.us-east-1.amazonaws.com/123456789012/caddy", func(domain string) { invalidated = domain })(&cfg)
+	WithWatch(time.Minute, func(domain string) { watched = domain })(&cfg)
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.OnInvalidate("queue.example.com")
+	cfg.OnWatchChange("watch.example.com")
+	if invalidated != "queue.example.com" || watched != "watch.example.com" {
+		t.Errorf("Expected separate callbacks, got %q and %q", invalidated, watched)
+	}
+}
+
+// classS3 records the storage class of every write.
+type classS3 struct {
+	*fakes.S3
+	classes map[string]string
+}
+
+func (c classS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	c.classes[*in.Key] = aws.StringValue(in.StorageClass)
+	return c.S3.PutObjectWithContext(ctx, in, opts...)
+}
+
+func TestStorageClass(t *testing.T) {
+	client := classS3{fakes.NewS3(), make(map[string]string)}
+	storage := newFakeStorage(t, client, "bucket", WithStorageClass("STANDARD_IA"))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert")}); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("TryLock: %v %v", w, err)
+	}
+	defer storage.Unlock("example.com")
+	if got := client.classes["acme/ca/domain/example.com"]; got != "STANDARD_IA" {
+		t.Errorf("Expected site stored as STANDARD_IA, got %q", got)
+	}
+	if got := client.classes["acme/ca/locks/example.com"]; got != "" {
+		t.Errorf("Expected lock object in the default class, got %q", got)
+	}
+}
+
+// aclS3 records the ACL of every write and copy.
+type aclS3 struct {
+	*fakes.S3
+	acls map[string]string
+}
+
+func (c aclS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	c.acls[*in.Key] = aws.StringValue(in.ACL)
+	return c.S3.PutObjectWithContext(ctx, in, opts...)
+}
+
+func (c aclS3) CopyObjectWithContext(ctx aws.Context, in *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	c.acls[*in.Key] = aws.StringValue(in.ACL)
+	return c.S3.CopyObjectWithContext(ctx, in, opts...)
+}
+
+func TestObjectACL(t *testing.T) {
+	client := aclS3{fakes.NewS3(), make(map[string]string)}
+	storage := newFakeStorage(t, client, "bucket", WithACL(s3.ObjectCannedACLBucketOwnerFullControl))
+	if w, err := storage.TryLock("example.com"); err != nil || w != nil {
+		t.Fatalf("TryLock: %v %v", w, err)
+	}
+	defer storage.Unlock("example.com")
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CopySite("example.com", "ca", "other"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"acme/ca/domain/example.com", "acme/ca/locks/example.com", "acme/other/domain/example.com"} {
+		if got := client.acls[key]; got != s3.ObjectCannedACLBucketOwnerFullControl {
+			t.Errorf("Expected %s to be written with bucket-owner-full-control, got %q", key, got)
+		}
+	}
+}
+
+func TestNewS3StorageWithClient(t *testing.T) {
+	client := fakes.NewS3()
+	storage, err := NewS3StorageWithClient(client, "bucket", "caddy", WithCA("ca"), WithLogger(StdLogger(log.New(ioutil.Discard, "", 0), false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("bucket", "caddy/acme/ca/domain/example.com"); !ok {
+		t.Error("Expected the site to be stored with the injected client")
+	}
+	if d := storage.diagnostics("").String(); !strings.Contains(d, `credentials="injected client"`) {
+		t.Errorf("Expected the injected client in the diagnostics, got %s", d)
+	}
+
+	if _, err := NewS3StorageWithClient(client, "bucket", "", WithLock("", "locks")); err == nil {
+		t.Error("Expected an error for DynamoDB locks with an injected client")
+	}
+	routed, err := NewS3StorageWithClient(client, "bucket", "caddy", WithCA("ca"),
+		WithRoutes(&RouteRule{Domains: []string{"bank.example.com"}, Bucket: "restricted"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := routed.StoreSite("bank.example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Object("restricted", "caddy/acme/ca/domain/bank.example.com"); !ok {
+		t.Error("Expected the site to be stored in the routed bucket")
+	}
+	if _, err := NewS3StorageWithClient(client, "bucket", "", WithXRay()); err == nil {
+		t.Error("Expected an error for X-Ray with an injected client")
+	}
+}
+
+func TestConfiguredEndpoint(t *testing.T) {
+	defer os.Setenv("CADDY_S3_ENDPOINT", os.Getenv("CADDY_S3_ENDPOINT"))
+	defer os.Setenv("CADDY_S3_FORCE_PATH_STYLE", os.Getenv("CADDY_S3_FORCE_PATH_STYLE"))
+	os.Setenv("CADDY_S3_ENDPOINT", "https://nyc3.digitaloceanspaces.com")
+	os.Setenv("CADDY_S3_FORCE_PATH_STYLE", "")
+
+	u, _ := url.Parse("https://acme.example.com/directory")
+	endpoint, pathStyle, err := configuredEndpoint(storageQuery(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != "https://nyc3.digitaloceanspaces.com" {
+		t.Errorf("Expected endpoint from environment, got %q", endpoint)
+	}
+	if pathStyle {
+		t.Error("Expected virtual hosted-style addressing by default")
+	}
+
+	u, _ = url.Parse("s3://bucket/prefix?endpoint=http://minio:9000&path_style=true")
+	endpoint, pathStyle, err = configuredEndpoint(storageQuery(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := endpointConfig(endpoint, pathStyle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := aws.StringValue(cfg.Endpoint); e != "http://minio:9000" {
+		t.Errorf("Expected endpoint from URL, got %q", e)
+	}
+	if !aws.BoolValue(cfg.S3ForcePathStyle) {
+		t.Error("Expected path-style addressing")
+	}
+
+	if _, err := endpointConfig("ftp://minio:9000", false); err == nil {
+		t.Error("Expected error for a non-HTTP endpoint")
+	}
+}
+
+func TestAWSEndpoints(t *testing.T) {
+	cfg := withAWSEndpoints(aws.NewConfig(), true, true)
+	if !aws.BoolValue(cfg.S3UseAccelerate) {
+		t.Error("Expected transfer acceleration")
+	}
+	if cfg.UseDualStackEndpoint != endpoints.DualStackEndpointStateEnabled {
+		t.Error("Expected dual-stack endpoints")
+	}
+	cfg = withAWSEndpoints(aws.NewConfig(), false, false)
+	if cfg.S3UseAccelerate != nil || cfg.UseDualStackEndpoint != endpoints.DualStackEndpointStateUnset {
+		t.Error("Expected the default endpoints")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	for region, want := range map[string]string{
+		"us-east-1":     "aws",
+		"cn-north-1":    "aws-cn",
+		"us-gov-west-1": "aws-us-gov",
+	} {
+		if got := regionPartition(region); got != want {
+			t.Errorf("regionPartition(%q) = %q, want %q", region, got, want)
+		}
+	}
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket", WithRegion("us-gov-east-1"))
+	if got := storage.arn("bucket/acme/"); got != "arn:aws-us-gov:s3:::bucket/acme/" {
+		t.Errorf("Unexpected ARN %q", got)
+	}
+	if got := newFakeStorage(t, fakes.NewS3(), "bucket").arn("bucket"); got != "arn:aws:s3:::bucket" {
+		t.Errorf("Unexpected default ARN %q", got)
+	}
+	cfg := Config{Bucket: "bucket", Region: "us-gov-east-1", Partition: "aws-us-gov", FIPS: true}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	cases := []struct {
+		prefix string
+		want   string
+		err    bool
+	}{
+		{prefix: "", want: ""},
+		{prefix: "/", want: ""},
+		{prefix: "caddy", want: "caddy/"},
+		{prefix: "/caddy", want: "caddy/"},
+		{prefix: "caddy/", want: "caddy/"},
+		{prefix: "//caddy//", want: "caddy/"},
+		{prefix: "caddy/prod", want: "caddy/prod/"},
+		{prefix: "caddy//prod", err: true},
+		{prefix: "caddy/../prod", err: true},
+		{prefix: "./caddy", err: true},
+	}
+	for _, c := range cases {
+		p, err := normalizePrefix(c.prefix)
+		if c.err {
+			if err == nil {
+				t.Errorf("Expected error for prefix %q, got %q", c.prefix, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for prefix %q: %s", c.prefix, err)
+		} else if p != c.want {
+			t.Errorf("Expected %q for prefix %q, got %q", c.want, c.prefix, p)
+		}
+	}
+}
+
+func TestRouteRules(t *testing.T) {
+	rules, err := parseRouteRules(`[
+		{"suffix": "eu.example.com", "bucket": "certs-eu", "region": "eu-west-1"},
+		{"pattern": "^customer-[0-9]+\\.example\\.com$", "prefix": "/customers/", "kms_key_id": "key"},
+		{"domains": ["Bank.example.com"], "bucket": "certs-restricted"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := &RouteRule{Match: func(domain string) bool { return domain == "tenant.example.net" }, Bucket: "certs-tenant"}
+	if err := tenant.compile(); err != nil {
+		t.Fatal(err)
+	}
+	storage := newFakeStorage(t, fakes.NewS3(), "certs", WithPrefix("base"), WithCA("ca.example.com"))
+	r := newRouter(storage, append(rules, tenant))
+	r.clients["eu-west-1"] = nil
+
+	cases := []struct {
+		domain string
+		bucket string
+		key    string
+		kmsKey string
+	}{
+		{"example.com", "certs", "base/acme/ca.example.com/domain/example.com", ""},
+		{"EU.example.com", "certs-eu", "base/acme/ca.example.com/domain/eu.example.com", ""},
+		{"www.eu.example.com", "certs-eu", "base/acme/ca.example.com/domain/www.eu.example.com", ""},
+		{"neu.example.com", "certs", "base/acme/ca.example.com/domain/neu.example.com", ""},
+		{"customer-12.example.com", "certs", "base/customers/acme/ca.example.com/domain/customer-12.example.com", "key"},
+		{"bank.example.com", "certs-restricted", "base/acme/ca.example.com/domain/bank.example.com", ""},
+		{"www.bank.example.com", "certs", "base/acme/ca.example.com/domain/www.bank.example.com", ""},
+		{"Tenant.example.net", "certs-tenant", "base/acme/ca.example.com/domain/tenant.example.net", ""},
+	}
+	for _, c := range cases {
+		loc := r.site(c.domain)
+		if loc.bucket != c.bucket || loc.key != c.key || loc.kmsKeyID != c.kmsKey {
+			t.Errorf("%s: expected %s/%s (kms %q), got %s/%s (kms %q)", c.domain, c.bucket, c.key, c.kmsKey, loc.bucket, loc.key, loc.kmsKeyID)
+		}
+	}
+
+	for _, v := range []string{
+		`[{"bucket": "b"}]`,
+		`[{"suffix": "a", "pattern": "b", "bucket": "b"}]`,
+		`[{"suffix": "a", "domains": ["b"], "bucket": "b"}]`,
+		`[{"suffix": "a"}]`,
+		`[{"pattern": "(", "bucket": "b"}]`,
+	} {
+		if _, err := parseRouteRules(v); err == nil {
+			t.Errorf("Expected error for route rules %s", v)
+		}
+	}
+}
+
+func TestDomainLimiter(t *testing.T) {
+	limit, err := parseRateLimit("2/1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &domainLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	if !l.allow("example.com", limit, now) || !l.allow("example.com", limit, now) {
+		t.Fatal("Expected burst of 2 to be allowed")
+	}
+	if l.allow("example.com", limit, now) {
+		t.Error("Expected third operation to be limited")
+	}
+	if !l.allow("other.example.com", limit, now) {
+		t.Error("Expected other domains not to be limited")
+	}
+	if !l.allow("example.com", limit, now.Add(30*time.Second)) {
+		t.Error("Expected a token to be refilled after half the interval")
+	}
+	if l.allow("example.com", limit, now.Add(30*time.Second)) {
+		t.Error("Expected operation to be limited after using the refilled token")
+	}
+
+	for _, v := range []string{"10", "0/1m", "x/1m", "1/x", "1/-1m"} {
+		if _, err := parseRateLimit(v); err == nil {
+			t.Errorf("Expected error for rate limit %q", v)
+		}
+	}
+}
+
+func TestAccountKeyType(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rnd, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key  []byte
+		want string
+	}{
+		{pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), keyTypeRSA},
+		{pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), keyTypeECDSA},
+		{pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER}), keyTypeRSA},
+		{[]byte("key"), ""},
+	}
+	for i, c := range cases {
+		if kt := accountKeyType(c.key); kt != c.want {
+			t.Errorf("%d: expected key type %q, got %q", i, c.want, kt)
+		}
+	}
+}
+
+// testClock is a Clock whose time only changes with Add, which fires the
+// timers and tickers that are due.
+type testClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	timers []*testTimer
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	c.fire()
+}
+
+// blockUntil waits until n timers and tickers are waiting to fire, so
+// that Add fires the ones started by other goroutines.
+func (c *testClock) blockUntil(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		waiting := len(c.timers)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d timers waiting, got %d", n, waiting)
+		}
+	}
+}
+
+func (c *testClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *testClock) NewTicker(d time.Duration) Ticker {
+	return testTicker{c.newTimer(d, d)}
+}
+
+func (c *testClock) newTimer(d, period time.Duration) *testTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &testTimer{c: c, ch: make(chan time.Time, 1), at: c.t.Add(d), period: period}
+	c.timers = append(c.timers, t)
+	c.fire()
+	return t
+}
+
+// fire sends the time on the channels of the timers that are due, and
+// drops the timers that won't fire again. Like time.Ticker, a ticker
+// that fell behind only fires once.
+func (c *testClock) fire() {
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.at.After(c.t) {
+			select {
+			case t.ch <- c.t:
+			default:
+			}
+			if t.period == 0 {
+				continue
+			}
+			for !t.at.After(c.t) {
+				t.at = t.at.Add(t.period)
+			}
+		}
+		timers = append(timers, t)
+	}
+	c.timers = timers
+}
+
+// testTimer is a Timer of a testClock, and the ticker of a testTicker.
+type testTimer struct {
+	c      *testClock
+	ch     chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (t *testTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *testTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, u := range t.c.timers {
+		if u == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// testTicker is a Ticker of a testClock.
+type testTicker struct {
+	*testTimer
+}
+
+func (t testTicker) Stop() {
+	t.testTimer.Stop()
+}
+
+func TestS3StorageDomainRateLimit(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket", WithClock(clock), func(c *Config) {
+		c.DomainRateLimit = 1
+		c.DomainRateInterval = time.Hour
+	})
+	domain := "rate-limit.example.com"
+	if err := storage.checkDomainRate(domain); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.checkDomainRate(domain); err == nil {
+		t.Fatal("Expected rate limit to be exceeded")
+	}
+	clock.Add(time.Hour)
+	if err := storage.checkDomainRate(domain); err != nil {
+		t.Fatalf("Expected rate limit to be reset after an hour: %s", err)
+	}
+}
+
+// testCertificate returns a PEM encoded self-signed certificate and key for
+// the given domains.
+func testCertificate(t *testing.T, domains []string, notAfter time.Time) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(rnd.Int63()),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		Issuer:       pkix.Name{CommonName: "Test CA"},
+		DNSNames:     domains,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rnd, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestLeafCertificate(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	certPEM, keyPEM := testCertificate(t, []string{"example.com", "www.example.com"}, notAfter)
+	cert, err := LeafCertificate(append(keyPEM, certPEM...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cert.DNSNames, []string{"example.com", "www.example.com"}) {
+		t.Errorf("Unexpected SANs %v", cert.DNSNames)
+	}
+	if !cert.NotAfter.Equal(notAfter) {
+		t.Errorf("Expected NotAfter %s, got %s", notAfter, cert.NotAfter)
+	}
+	if _, err := LeafCertificate(keyPEM); err == nil {
+		t.Error("Expected error when there's no certificate")
+	}
+
+	meta := certMetadata(certPEM)
+	fp := sha256.Sum256(cert.Raw)
+	if v := aws.StringValue(meta[certFingerprintMeta]); v != hex.EncodeToString(fp[:]) {
+		t.Errorf("Unexpected fingerprint metadata %q", v)
+	}
+	if v := aws.StringValue(meta[certNotAfterMeta]); v != notAfter.UTC().Format(time.RFC3339) {
+		t.Errorf("Unexpected expiry metadata %q", v)
+	}
+	if meta := certMetadata([]byte("cert")); meta != nil {
+		t.Errorf("Expected no metadata for an invalid certificate, got %v", meta)
+	}
+}
+
+func TestCertTagging(t *testing.T) {
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	certPEM, _ := testCertificate(t, []string{"example.com"}, notAfter)
+	tags, err := url.ParseQuery(certTagging("Example.com", certPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{
+		domainTag:       {"example.com"},
+		certIssuerTag:   {"example.com"}, // self-signed
+		certNotAfterTag: {"2030-01-02"},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("Expected tags %v, got %v", want, tags)
+	}
+	if got := certTagging("example.com", []byte("cert")); got != "caddy-domain=example.com" {
+		t.Errorf("Expected only the domain tag for an invalid certificate, got %q", got)
+	}
+	if got := tagValue(`Let's "Encrypt" R3`); got != "Let_s _Encrypt_ R3" {
+		t.Errorf("Unexpected tag value %q", got)
+	}
+}
+
+func TestStatSite(t *testing.T) {
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket")
+	if _, err := storage.StatSite("example.com"); err == nil {
+		t.Fatal("Expected error for a missing site")
+	} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+		t.Fatalf("Expected ErrNotExist, got %T", err)
+	}
+
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	certPEM, keyPEM := testCertificate(t, []string{"example.com"}, notAfter)
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := storage.StatSite("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size == 0 || info.ETag == "" {
+		t.Errorf("Expected size and ETag, got %+v", info)
+	}
+	if !info.CertNotAfter.Equal(notAfter) {
+		t.Errorf("Expected NotAfter %s, got %s", notAfter, info.CertNotAfter)
+	}
+	if len(info.CertSHA256) != 64 {
+		t.Errorf("Expected a certificate fingerprint, got %q", info.CertSHA256)
+	}
+}
+
+func TestExpiringSites(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "expiring-bucket", WithClock(clock))
+	for domain, notAfter := range map[string]time.Time{
+		"expired.example.com": clock.Now().Add(-time.Hour),
+		"soon.example.com":    clock.Now().Add(5 * 24 * time.Hour),
+		"later.example.com":   clock.Now().Add(60 * 24 * time.Hour),
+	} {
+		certPEM, keyPEM := testCertificate(t, []string{domain}, notAfter)
+		if err := storage.StoreSite(domain, &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stored before certificate metadata was recorded.
+	certPEM, keyPEM := testCertificate(t, []string{"legacy.example.com"}, clock.Now().Add(24*time.Hour))
+	b, err := marshalSite(&caddytls.SiteData{Cert: certPEM, Key: keyPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetObject("expiring-bucket", "acme/ca/domain/legacy.example.com", b, nil)
+	if err := storage.StoreSite("invalid.example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+
+	sites, err := storage.ExpiringSites(30 * 24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var domains []string
+	for _, site := range sites {
+		domains = append(domains, site.Domain)
+	}
+	if want := []string{"expired.example.com", "legacy.example.com", "soon.example.com"}; !reflect.DeepEqual(domains, want) {
+		t.Fatalf("Expected %v, got %v", want, domains)
+	}
+	if sites[0].NotAfter.IsZero() || !sites[0].NotAfter.Before(clock.Now()) {
+		t.Errorf("Expected the expiry of the expired site, got %s", sites[0].NotAfter)
+	}
+}
+
+func TestStoreSiteConditional(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+
+	now := time.Now().Truncate(time.Second)
+	newer, key := testCertificate(t, []string{"example.com"}, now.Add(90*24*time.Hour))
+	older, _ := testCertificate(t, []string{"example.com"}, now.Add(30*24*time.Hour))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: older, Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: newer, Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	// Replacing a certificate with one expiring earlier, e.g. after a key
+	// rotation, is stored too.
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: older, Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := storage.LoadSite("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data.Cert, older) {
+		t.Error("Expected the certificate to be replaced")
+	}
+}
+
+func TestMostRecentUserMigration(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+	client.SetObject("bucket", "acme/ca/user/recent", []byte("someone@example.com"), nil)
+
+	if email := storage.MostRecentUserEmail(); email != "someone@example.com" {
+		t.Errorf("Expected email from the legacy pointer, got %q", email)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/user/recent"); ok {
+		t.Error("Expected the legacy pointer to be deleted")
+	}
+	if b, _ := client.Object("bucket", "acme/ca/meta/most-recent-user"); string(b) != "someone@example.com" {
+		t.Errorf("Expected the pointer to be migrated, got %q", b)
+	}
+	if email := storage.MostRecentUserEmail(); email != "someone@example.com" {
+		t.Errorf("Expected email after migration, got %q", email)
+	}
+
+	// An account for the email "recent" is not a pointer.
+	client = fakes.NewS3()
+	storage.s3 = client
+	storage.recentUser.reset()
+	client.SetObject("bucket", "acme/ca/user/recent", []byte(`{"Reg":"","Key":""}`), nil)
+	if email := storage.MostRecentUserEmail(); email != "" {
+		t.Errorf("Expected no most recent user, got %q", email)
+	}
+	if _, ok := client.Object("bucket", "acme/ca/user/recent"); !ok {
+		t.Error("Expected the account to be kept")
+	}
+}
+
+func TestMostRecentUserListing(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		if err := storage.StoreUser(email, &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A stale pointer doesn't matter.
+	client.SetObject("bucket", "acme/ca/meta/most-recent-user", []byte("first@example.com"), nil)
+	storage.recentUser.reset()
+	if email := storage.MostRecentUserEmail(); email != "second@example.com" {
+		t.Fatalf("Expected the most recently stored account, got %q", email)
+	}
+
+	// Accounts stored by other hosts are seen once the cache expires.
+	client.SetObject("bucket", "acme/ca/user/third@example.com", []byte(`{"Reg":"cmVn","Key":"a2V5"}`), nil)
+	if email := storage.MostRecentUserEmail(); email != "second@example.com" {
+		t.Fatalf("Expected the cached account, got %q", email)
+	}
+	clock.Add(recentUserTTL)
+	if email := storage.MostRecentUserEmail(); email != "third@example.com" {
+		t.Fatalf("Expected the account stored by another host, got %q", email)
+	}
+}
+
+// failingPointerS3 fails writes of the most recent user pointer while
+// failing is set.
+type failingPointerS3 struct {
+	*fakes.S3
+	failing *bool
+}
+
+func (c failingPointerS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if *c.failing && strings.HasSuffix(*in.Key, "meta/most-recent-user") {
+		return nil, awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), http.StatusInternalServerError, "")
+	}
+	return c.S3.PutObjectWithContext(ctx, in, opts...)
+}
+
+func TestStoreUserPointerFailure(t *testing.T) {
+	failing := false
+	client := failingPointerS3{fakes.NewS3(), &failing}
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+	if err := storage.StoreUser("first@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	failing = true
+	if err := storage.StoreUser("second@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+		t.Fatalf("Expected the account stored despite the pointer failure, got %v", err)
+	}
+	if _, ok := recentStoredAt(client.Metadata("bucket", "acme/ca/user/second@example.com")); !ok {
+		t.Error("Expected the account to record when it was stored")
+	}
+	if got, _ := client.Object("bucket", "acme/ca/meta/most-recent-user"); string(got) != "first@example.com" {
+		t.Fatalf("Expected the stale pointer, got %q", got)
+	}
+
+	// The listing is authoritative and the pointer is repaired.
+	failing = false
+	storage.recentUser.reset()
+	if email := storage.MostRecentUserEmail(); email != "second@example.com" {
+		t.Fatalf("Expected second@example.com, got %q", email)
+	}
+	if got, _ := client.Object("bucket", "acme/ca/meta/most-recent-user"); string(got) != "second@example.com" {
+		t.Errorf("Expected the pointer repaired, got %q", got)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+	for _, email := range []string{"first@example.com", "second@example.com", "third@example.com"} {
+		if err := storage.StoreUser(email, &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleting an account that isn't the most recent keeps the pointer.
+	if err := storage.DeleteUser("second@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if email := storage.MostRecentUserEmail(); email != "third@example.com" {
+		t.Fatalf("Expected third@example.com, got %q", email)
+	}
+	if _, err := storage.LoadUser("second@example.com"); err == nil {
+		t.Fatal("Expected the account to be deleted")
+	}
+
+	if err := storage.DeleteUser("third@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if email := storage.MostRecentUserEmail(); email != "first@example.com" {
+		t.Fatalf("Expected the remaining account to become the most recent, got %q", email)
+	}
+	if err := storage.DeleteUser("First@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if email := storage.MostRecentUserEmail(); email != "" {
+		t.Fatalf("Expected no most recent user, got %q", email)
+	}
+}
+
+func TestPolicyAllowsPublicRead(t *testing.T) {
+	cases := []struct {
+		policy string
+		public bool
+	}{
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::certs/*"}}`, true},
+		{`{"Statement": [{"Effect": "Allow", "Principal": {"AWS": ["*"]}, "Action": ["s3:Get*"], "Resource": ["arn:aws:s3:::certs/caddy/acme/*"]}]}`, true},
+		{`{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "s3:*", "Resource": "arn:aws:s3:::certs/cad*"}]}`, true},
+		{`{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::certs/public/*"}]}`, false},
+		{`{"Statement": [{"Effect": "Deny", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::certs/*"}]}`, false},
+		{`{"Statement": [{"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::123456789012:root"}, "Action": "s3:GetObject", "Resource": "arn:aws:s3:::certs/*"}]}`, false},
+		{`{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "s3:PutObject", "Resource": "arn:aws:s3:::certs/*"}]}`, false},
+		{`{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::certs/*", "Condition": {"IpAddress": {"aws:SourceIp": "10.0.0.0/8"}}}]}`, false},
+	}
+	for i, c := range cases {
+		public, err := policyAllowsPublicRead(c.policy, "arn:aws:s3:::certs/caddy/")
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+		} else if public != c.public {
+			t.Errorf("%d: expected public=%t, got %t", i, c.public, public)
+		}
+	}
+}
+
+func TestAccessMonitor(t *testing.T) {
+	m := &accessMonitor{}
+	now := time.Now()
+	for i := 0; i < accessDeniedThreshold-1; i++ {
+		if m.denied(now) {
+			t.Fatal("Expected no probe before reaching the threshold")
+		}
+	}
+	if !m.denied(now) {
+		t.Fatal("Expected a probe when reaching the threshold")
+	}
+	if m.denied(now.Add(time.Second)) {
+		t.Error("Expected only one probe per window")
+	}
+	now = now.Add(accessDeniedWindow)
+	if m.denied(now) {
+		t.Error("Expected old denials to expire")
+	}
+}
+
+func TestConfigFromEnvRole(t *testing.T) {
+	for _, name := range []string{"CADDY_S3_ROLE_CHAIN", "CADDY_S3_ROLE_ARN", "CADDY_S3_EXTERNAL_ID", "CADDY_S3_ROLE_SESSION_NAME"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("CADDY_S3_ROLE_CHAIN", "arn:aws:iam::111111111111:role/a")
+	os.Setenv("CADDY_S3_ROLE_ARN", "arn:aws:iam::222222222222:role/tls")
+	os.Setenv("CADDY_S3_EXTERNAL_ID", "secret")
+	os.Setenv("CADDY_S3_ROLE_SESSION_NAME", "caddy-prod")
+
+	u, _ := url.Parse("s3://bucket/prefix")
+	cfg, err := ConfigFromEnv(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"arn:aws:iam::111111111111:role/a", "arn:aws:iam::222222222222:role/tls"}
+	if !reflect.DeepEqual(cfg.RoleChain, want) {
+		t.Errorf("Expected role chain %v, got %v", want, cfg.RoleChain)
+	}
+	if cfg.ExternalID != "secret" || cfg.RoleSessionName != "caddy-prod" {
+		t.Errorf("Unexpected external ID %q or session name %q", cfg.ExternalID, cfg.RoleSessionName)
+	}
+
+	os.Setenv("CADDY_S3_ROLE_SESSION_NAME", "caddy prod")
+	if cfg, err := ConfigFromEnv(u); err != nil {
+		t.Fatal(err)
+	} else if err := cfg.validate(); err == nil {
+		t.Error("Expected error for an invalid role session name")
+	}
+}
+
+func TestURLCredentials(t *testing.T) {
+	u, _ := url.Parse("s3://AKIAEXAMPLE:wJalr%2FK7MDENG@bucket/prefix?session_token=token")
+	creds, err := urlCredentials(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds == nil {
+		t.Fatal("Expected credentials from the URL")
+	}
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "AKIAEXAMPLE" || v.SecretAccessKey != "wJalr/K7MDENG" || v.SessionToken != "token" {
+		t.Errorf("Unexpected credentials %+v", v)
+	}
+
+	u, _ = url.Parse("s3://bucket/prefix")
+	if creds, err := urlCredentials(u); err != nil || creds != nil {
+		t.Errorf("Expected no credentials, got %v, %v", creds, err)
+	}
+	u, _ = url.Parse("s3://AKIAEXAMPLE@bucket/prefix")
+	if _, err := urlCredentials(u); err == nil {
+		t.Error("Expected error without a secret")
+	}
+	u, _ = url.Parse("s3://AKIAEXAMPLE:secret@bucket/prefix")
+	if bucket, _, err := bucketAndPrefix(u); err != nil || bucket != "bucket" {
+		t.Errorf("Expected bucket without credentials, got %q, %v", bucket, err)
+	}
+}
+
+func TestCheckWebIdentity(t *testing.T) {
+	defer os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	defer os.Setenv("AWS_ROLE_ARN", os.Getenv("AWS_ROLE_ARN"))
+	token, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(token.Name())
+	token.Close()
+
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	os.Setenv("AWS_ROLE_ARN", "")
+	if err := checkWebIdentity(); err != nil {
+		t.Errorf("Expected no error without web identity, got %s", err)
+	}
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", token.Name())
+	if err := checkWebIdentity(); err == nil {
+		t.Error("Expected error without AWS_ROLE_ARN")
+	}
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::111111111111:role/caddy")
+	if err := checkWebIdentity(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", token.Name()+".missing")
+	if err := checkWebIdentity(); err == nil {
+		t.Error("Expected error for a missing token file")
+	}
+}
+
+func TestContainerCredentialsEndpoint(t *testing.T) {
+	defer os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"))
+	defer os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"))
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+
+	if e := containerCredentialsEndpoint(); e != "" {
+		t.Errorf("Expected no endpoint outside of a container, got %q", e)
+	}
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "http://localhost:8080/creds")
+	if e := containerCredentialsEndpoint(); e != "http://localhost:8080/creds" {
+		t.Errorf("Expected full URI, got %q", e)
+	}
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/5b1c3d2e")
+	if e := containerCredentialsEndpoint(); e != "http://169.254.170.2/v2/credentials/5b1c3d2e" {
+		t.Errorf("Expected ECS task role endpoint, got %q", e)
+	}
+}
+
+func TestParseRoleChain(t *testing.T) {
+	arns, err := parseRoleChain(" arn:aws:iam::111111111111:role/a, arn:aws:iam::222222222222:role/path/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"arn:aws:iam::111111111111:role/a", "arn:aws:iam::222222222222:role/path/b"}; !reflect.DeepEqual(arns, exp) {
+		t.Errorf("Expected %v, got %v", exp, arns)
+	}
+	if arns, err := parseRoleChain(""); err != nil || arns != nil {
+		t.Errorf("Expected no roles, got %v, %v", arns, err)
+	}
+	for _, v := range []string{"a", "arn:aws:iam::111111111111:user/a", "arn:aws:iam::111111111111:role/a,"} {
+		if _, err := parseRoleChain(v); err == nil {
+			t.Errorf("Expected error for role chain %q", v)
+		}
+	}
 }
 
 func randomPrefix(t *testing.T) string {
@@ -140,3 +1365,57 @@ func randomPrefix(t *testing.T) string {
 	}
 	return hex.EncodeToString(b[:])
 }
+
+func TestRequesterPaysHandler(t *testing.T) {
+	r := &request.Request{HTTPRequest: httptest.NewRequest("GET", "https://bucket.s3.amazonaws.com/key", nil)}
+	requesterPaysHandler.Fn(r)
+	if v := r.HTTPRequest.Header.Get("X-Amz-Request-Payer"); v != "requester" {
+		t.Errorf("Expected the request payer header, got %q", v)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	client := fakes.NewS3()
+	writer := newFakeStorage(t, client, "read-only-storage")
+	if err := writer.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	keys := client.Keys("read-only-storage")
+
+	storage := newFakeStorage(t, client, "read-only-storage", WithReadOnly())
+	if data, err := storage.LoadSite("example.com"); err != nil || string(data.Cert) != "cert" {
+		t.Fatalf("Expected the stored site, got %v, %v", data, err)
+	}
+	if w, err := storage.TryLock("example.com"); w != nil || err != nil {
+		t.Fatalf("Expected locking to be skipped, got %v, %v", w, err)
+	}
+	if err := storage.Unlock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("new")}),
+		storage.DeleteSite("example.com"),
+		storage.StoreUser("admin@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("key")}),
+		storage.DeleteUser("admin@example.com"),
+	} {
+		if _, ok := err.(ErrReadOnly); !ok {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+	}
+	if got := client.Keys("read-only-storage"); !reflect.DeepEqual(got, keys) {
+		t.Errorf("Expected no writes, got keys %v (before %v)", got, keys)
+	}
+
+	u, _ := url.Parse("s3://bucket/prefix?read_only=true")
+	cfg, err := ConfigFromEnv(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.ReadOnly {
+		t.Error("Expected the read_only URL parameter to enable read-only mode")
+	}
+	cfg.LeaderElection = true
+	if err := cfg.validate(); err == nil {
+		t.Error("Expected an error for leader election with read-only storage")
+	}
+}
@@ -0,0 +1,83 @@
+package caddytlss3
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// startPrefetch runs Prefetch in the background until it's done or the
+// storage is closed.
+func (s *S3Storage) startPrefetch(concurrency int) {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := s.Prefetch(ctx, concurrency)
+		if err != nil {
+			s.log().Errorf("prefetching sites: %s", err)
+			return
+		}
+		s.log().Infof("prefetched %d sites", n)
+	}()
+	s.onClose(func() error {
+		cancel()
+		<-done
+		return nil
+	})
+}
+
+// Prefetch loads every site stored in the CA namespace, concurrency at a
+// time, so that they're in the cache and the disk mirror before the first
+// handshake that needs them. Sites that fail to load are logged and
+// skipped. It returns the number of sites loaded, and stops early when ctx
+// is done.
+func (s *S3Storage) Prefetch(ctx context.Context, concurrency int) (int, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	domains := make(chan string)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		loaded int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range domains {
+				_, err := s.LoadSite(domain)
+				if _, ok := err.(caddytls.ErrNotExist); ok {
+					// Deleted since it was listed.
+					continue
+				}
+				if err != nil {
+					s.log().Warnf("prefetching %s: %s", domain, err)
+					continue
+				}
+				mu.Lock()
+				loaded++
+				mu.Unlock()
+			}
+		}()
+	}
+	it := s.IterSites("")
+	for ctx.Err() == nil && it.Next() {
+		select {
+		case domains <- it.Name():
+		case <-ctx.Done():
+		}
+	}
+	close(domains)
+	wg.Wait()
+	if err := it.Err(); err != nil {
+		return loaded, err
+	}
+	return loaded, ctx.Err()
+}
@@ -0,0 +1,83 @@
+package caddytlss3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// countingS3 counts GetObject requests.
+type countingS3 struct {
+	*fakes.S3
+	mu   *sync.Mutex
+	gets *int
+}
+
+func (c countingS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	c.mu.Lock()
+	*c.gets++
+	c.mu.Unlock()
+	return c.S3.GetObjectWithContext(ctx, in, opts...)
+}
+
+func (c countingS3) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.gets
+}
+
+func TestPrefetch(t *testing.T) {
+	client := countingS3{fakes.NewS3(), new(sync.Mutex), new(int)}
+	writer := newFakeStorage(t, client, "prefetch-bucket")
+	var domains []string
+	for i := 0; i < 5; i++ {
+		domain := fmt.Sprintf("site%d.example.com", i)
+		if err := writer.StoreSite(domain, &caddytls.SiteData{Cert: []byte("cert")}); err != nil {
+			t.Fatal(err)
+		}
+		domains = append(domains, domain)
+	}
+
+	storage, err := NewS3StorageWithClient(client, "prefetch-bucket", "", WithCA("ca"), WithCache(time.Hour, ""), WithPrefetch(2),
+		WithLogger(StdLogger(log.New(ioutil.Discard, "", 0), false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); client.count() < len(domains); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d sites prefetched, got %d", len(domains), client.count())
+		}
+	}
+	// A done context stops the prefetch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := storage.Prefetch(ctx, 1); err != context.Canceled {
+		t.Errorf("Expected the prefetch to be canceled, got %v", err)
+	}
+
+	// Close waits for the prefetch to finish.
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	objectCache.Lock()
+	for _, domain := range domains {
+		if _, ok := objectCache.entries[cacheKey("prefetch-bucket", siteKey("acme/ca/", domain))]; !ok {
+			t.Errorf("Expected %s to be cached", domain)
+		}
+	}
+	objectCache.Unlock()
+
+	if _, err := NewS3StorageWithClient(client, "prefetch-bucket", "", WithPrefetch(2)); err == nil {
+		t.Error("Expected an error prefetching without a cache")
+	}
+}
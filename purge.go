@@ -0,0 +1,29 @@
+package caddytlss3
+
+import "fmt"
+
+// Purge deletes every object under the prefix of the storage in all CA
+// namespaces, in its bucket and the buckets of its routes, e.g. to clean
+// up after tests or when decommissioning an environment. Objects are
+// deleted with DeleteObjects a page of the listing at a time. Previous
+// versions in versioned buckets and private keys in Secrets Manager are
+// left in place. A storage without a prefix is refused since it would
+// empty the whole bucket.
+func (s *S3Storage) Purge() error {
+	if s.readOnly {
+		return ErrReadOnly{Op: "Purge", Name: s.bucket}
+	}
+	roots := s.routes.roots()
+	for _, root := range roots {
+		if root.prefix == "" {
+			return fmt.Errorf("S3Storage: refusing to purge bucket %s without a prefix", root.bucket)
+		}
+	}
+	for _, root := range roots {
+		if err := s.deletePrefix(root.s3, root.bucket, root.prefix); err != nil {
+			return err
+		}
+		s.log().Infof("purged %s", objectURL(root.bucket, root.prefix))
+	}
+	return nil
+}
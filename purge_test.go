@@ -0,0 +1,56 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestPurge(t *testing.T) {
+	client := fakes.NewS3()
+	tenant := &RouteRule{Domains: []string{"tenant.example.com"}, Bucket: "purge-tenant"}
+	if err := tenant.compile(); err != nil {
+		t.Fatal(err)
+	}
+	storage := newFakeStorage(t, client, "purge-bucket", WithPrefix("env"), WithRoutes(tenant))
+
+	// More than a page of the listing.
+	for i := 0; i < 1100; i++ {
+		client.SetObject("purge-bucket", fmt.Sprintf("env/acme/ca/domain/%04d.example.com", i), []byte("site"), nil)
+	}
+	for _, domain := range []string{"example.com", "tenant.example.com"} {
+		if err := storage.StoreSite(domain, &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.SetObject("purge-bucket", "env/acme/other/domain/example.com", []byte("site"), nil)
+	client.SetObject("purge-bucket", "other/acme/ca/domain/example.com", []byte("site"), nil)
+
+	if err := storage.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := client.Keys("purge-bucket"); !reflect.DeepEqual(keys, []string{"other/acme/ca/domain/example.com"}) {
+		t.Errorf("Expected only objects outside the prefix to remain, got %d objects", len(keys))
+	}
+	if keys := client.Keys("purge-tenant"); len(keys) != 0 {
+		t.Errorf("Expected the routed bucket to be purged, got %v", keys)
+	}
+	if _, err := storage.LoadSite("example.com"); err == nil {
+		t.Error("Expected the purged site to be gone")
+	}
+
+	unscoped := newFakeStorage(t, client, "purge-bucket")
+	if err := unscoped.Purge(); err == nil {
+		t.Error("Expected purging a storage without a prefix to be refused")
+	}
+	if keys := client.Keys("purge-bucket"); len(keys) != 1 {
+		t.Errorf("Expected nothing to be deleted, got %v", keys)
+	}
+	storage.readOnly = true
+	if err := storage.Purge(); err == nil {
+		t.Error("Expected read-only storage to refuse purging")
+	}
+}
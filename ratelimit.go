@@ -0,0 +1,102 @@
+package caddytlss3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxLimiterBuckets = 10000
+
+// domainLimits is shared by all S3Storage instances for the same reason
+// the name locks are: Caddy constructs storage instances on demand.
+var domainLimits = &domainLimiter{buckets: make(map[string]*tokenBucket)}
+
+// rateLimit is the number of operations allowed per interval.
+type rateLimit struct {
+	n        int
+	interval time.Duration
+}
+
+// parseRateLimit parses a limit of the form "N/duration" (e.g. "10/1h").
+func parseRateLimit(v string) (*rateLimit, error) {
+	if v == "" {
+		return nil, nil
+	}
+	idx := strings.IndexByte(v, '/')
+	if idx < 0 {
+		return nil, fmt.Errorf("rate limit %q must be of the form N/duration", v)
+	}
+	n, err := strconv.Atoi(v[:idx])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("rate limit %q must have a positive count", v)
+	}
+	interval, err := time.ParseDuration(v[idx+1:])
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("rate limit %q must have a positive duration", v)
+	}
+	return &rateLimit{n: n, interval: interval}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// domainLimiter is a token bucket per domain. The bucket size equals the
+// number of operations allowed per interval so short bursts are allowed.
+type domainLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow consumes a token for domain, returning false if none is left.
+func (l *domainLimiter) allow(domain string, limit *rateLimit, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[domain]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.n), last: now}
+		l.buckets[domain] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(limit.n) * float64(elapsed) / float64(limit.interval)
+		if b.tokens > float64(limit.n) {
+			b.tokens = float64(limit.n)
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	if len(l.buckets) > maxLimiterBuckets {
+		l.prune(limit, now)
+	}
+	return true
+}
+
+// prune drops buckets that have refilled completely since they carry no
+// state, bounding memory when many distinct domains are seen.
+func (l *domainLimiter) prune(limit *rateLimit, now time.Time) {
+	for domain, b := range l.buckets {
+		if now.Sub(b.last) >= limit.interval {
+			delete(l.buckets, domain)
+		}
+	}
+}
+
+// checkDomainRate returns an error if the per-domain rate limit for
+// operations that modify a site has been exceeded.
+func (s *S3Storage) checkDomainRate(domain string) error {
+	if s.domainRate == nil {
+		return nil
+	}
+	domain = strings.ToLower(domain)
+	if !domainLimits.allow(domain, s.domainRate, s.now()) {
+		return fmt.Errorf("S3Storage: too many changes to %s, limit is %d per %s", domain, s.domainRate.n, s.domainRate.interval)
+	}
+	return nil
+}
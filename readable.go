@@ -0,0 +1,86 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// certSummary is the human readable summary of a stored certificate
+// written next to the public certificate when the readable mirror is
+// enabled. It never contains private key material.
+type certSummary struct {
+	Domain    string    `json:"domain"`
+	SANs      []string  `json:"sans"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+func readablePrefix(loc *location, domain string) string {
+	return loc.prefix + "readable/" + escapeName(domain) + "/"
+}
+
+// storeReadable writes the public certificate and a JSON summary of it
+// under the readable/ prefix so operators can inspect certificates when
+// browsing the bucket.
+func (s *S3Storage) storeReadable(loc *location, domain string, data *caddytls.SiteData) error {
+	cert, err := LeafCertificate(data.Cert)
+	if err != nil {
+		return err
+	}
+	summary, err := json.MarshalIndent(&certSummary{
+		Domain:    strings.ToLower(domain),
+		SANs:      cert.DNSNames,
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	prefix := readablePrefix(loc, domain)
+	for _, obj := range []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"cert.pem", contentTypePEM, data.Cert},
+		{"summary.json", contentTypeJSON, summary},
+	} {
+		l := loc.withKey(prefix + obj.name)
+		err := s.putPlainObject(l.s3, l.encrypt(&s3.PutObjectInput{
+			Bucket:        &l.bucket,
+			Key:           &l.key,
+			Body:          bytes.NewReader(obj.body),
+			ContentLength: aws.Int64(int64(len(obj.body))),
+			ContentType:   aws.String(obj.contentType),
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteReadable removes the readable mirror of a site.
+func (s *S3Storage) deleteReadable(loc *location, domain string) error {
+	prefix := readablePrefix(loc, domain)
+	for _, name := range []string{"cert.pem", "summary.json"} {
+		l := loc.withKey(prefix + name)
+		if err := s.deleteObject(l.s3, &s3.DeleteObjectInput{
+			Bucket: &l.bucket,
+			Key:    &l.key,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package caddytlss3
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// recentStoredAtMeta is the object metadata on the most recent user
+	// pointer that records when the user it points to was stored.
+	recentStoredAtMeta = "Stored-At"
+
+	maxRecentUserAttempts = 5
+
+	// recentUserTTL is how long the most recent user is cached. StoreUser
+	// calls on other hosts are seen once it expires.
+	recentUserTTL = time.Minute
+)
+
+// recentUserCache caches the most recent user of a storage instance.
+type recentUserCache struct {
+	mu      sync.Mutex
+	email   string
+	expires time.Time
+}
+
+func (c *recentUserCache) get(now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.email, now.Before(c.expires)
+}
+
+// set caches email as the most recent user as of now.
+func (c *recentUserCache) set(email string, now time.Time) {
+	c.mu.Lock()
+	c.email = email
+	c.expires = now.Add(recentUserTTL)
+	c.mu.Unlock()
+}
+
+func (c *recentUserCache) reset() {
+	c.mu.Lock()
+	c.email = ""
+	c.expires = time.Time{}
+	c.mu.Unlock()
+}
+
+// recentUserKey is the key of the most recent user pointer. It's outside
+// of the user/ namespace so it can't collide with an account.
+func (s *S3Storage) recentUserKey() *string {
+	return aws.String(s.prefix + "meta/most-recent-user")
+}
+
+// legacyRecentUserKey is where the most recent user pointer used to be
+// stored, which collides with the account for the email "recent".
+func (s *S3Storage) legacyRecentUserKey() *string {
+	return s.userKey("recent")
+}
+
+// migrateRecentUser moves a most recent user pointer from the legacy key
+// to the current one and returns the email it points to, or an empty
+// string if there is none. An account that is actually stored under the
+// legacy key (its data is JSON) is left alone.
+func (s *S3Storage) migrateRecentUser() string {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    s.legacyRecentUserKey(),
+	})
+	if err != nil {
+		return ""
+	}
+	b, err := readObject(res, s.bucket, *s.legacyRecentUserKey())
+	if err != nil || len(b) == 0 || b[0] == '{' {
+		return ""
+	}
+	email := string(b)
+	if s.readOnly {
+		return email
+	}
+	storedAt, _ := recentStoredAt(res.Metadata)
+	if err := s.storeRecentUser(email, storedAt); err != nil {
+		s.log().Errorf("migrating most recent user pointer: %s", err)
+		return email
+	}
+	err = s.deleteObject(s.s3, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    s.legacyRecentUserKey(),
+	})
+	if err != nil {
+		s.log().Errorf("deleting legacy most recent user pointer: %s", err)
+	}
+	return email
+}
+
+// storeRecentUser points the most recent user pointer at email unless a
+// user stored later than storedAt has already been recorded. The pointer is
+// updated with conditional writes so that concurrent StoreUser calls on
+// different hosts can't move it back to an older account.
+func (s *S3Storage) storeRecentUser(email string, storedAt time.Time) error {
+	for attempt := 0; attempt < maxRecentUserAttempts; attempt++ {
+		in := s.encrypt(&s3.PutObjectInput{
+			Bucket:        &s.bucket,
+			Key:           s.recentUserKey(),
+			Body:          strings.NewReader(email),
+			ContentLength: aws.Int64(int64(len(email))),
+			Metadata: map[string]*string{
+				recentStoredAtMeta: aws.String(storedAt.UTC().Format(time.RFC3339Nano)),
+			},
+		})
+		ctx, cancel := s.opContext()
+		head, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &s.bucket,
+			Key:    s.recentUserKey(),
+		})
+		cancel()
+		switch {
+		case isNotFound(err):
+			in.IfNoneMatch = aws.String("*")
+		case err != nil:
+			return err
+		default:
+			if prev, ok := recentStoredAt(head.Metadata); ok && prev.After(storedAt) {
+				// A more recent user has already been recorded.
+				return nil
+			}
+			in.IfMatch = head.ETag
+		}
+		err = s.putObject(s.s3, in)
+		if isConditionFailed(err) {
+			continue
+		}
+		return err
+	}
+	return errors.New("S3Storage: too many concurrent updates of the most recent user")
+}
+
+// repairRecentUser points the most recent user pointer at email, the
+// most recent user according to a listing, if it points elsewhere, e.g.
+// because StoreUser failed to update it.
+func (s *S3Storage) repairRecentUser(email string) {
+	if s.readOnly {
+		return
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    s.recentUserKey(),
+	})
+	if err == nil {
+		b, err := readObject(res, s.bucket, *s.recentUserKey())
+		if err == nil && strings.EqualFold(string(b), email) {
+			return
+		}
+	} else if !isNotFound(err) {
+		return
+	}
+	// Accounts record when they were stored, except those stored by
+	// previous versions.
+	for _, k := range s.userKeys(email) {
+		head, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &s.bucket,
+			Key:    k,
+		})
+		if err != nil {
+			continue
+		}
+		storedAt, ok := recentStoredAt(head.Metadata)
+		if !ok {
+			storedAt = aws.TimeValue(head.LastModified)
+		}
+		s.log().Infof("repairing the most recent user pointer to %s", email)
+		if err := s.storeRecentUser(email, storedAt); err != nil {
+			s.log().Warnf("repairing the most recent user pointer to %s: %s", email, err)
+		}
+		return
+	}
+}
+
+// replaceRecentUser moves the most recent user pointer away from the
+// deleted account to the most recently modified remaining account, or
+// deletes it if there are none. The pointer is only replaced while it still
+// points at the deleted account.
+func (s *S3Storage) replaceRecentUser(deleted string) error {
+	for attempt := 0; attempt < maxRecentUserAttempts; attempt++ {
+		ctx, cancel := s.opContext()
+		res, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: &s.bucket,
+			Key:    s.recentUserKey(),
+		})
+		if err != nil {
+			cancel()
+			if isNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		b, err := readObject(res, s.bucket, *s.recentUserKey())
+		cancel()
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(string(b), deleted) {
+			return nil
+		}
+		email, modified, err := s.latestUser(deleted)
+		if err != nil {
+			return err
+		}
+		if email == "" {
+			return s.deleteObject(s.s3, &s3.DeleteObjectInput{
+				Bucket: &s.bucket,
+				Key:    s.recentUserKey(),
+			})
+		}
+		err = s.putObject(s.s3, s.encrypt(&s3.PutObjectInput{
+			Bucket:        &s.bucket,
+			Key:           s.recentUserKey(),
+			Body:          strings.NewReader(email),
+			ContentLength: aws.Int64(int64(len(email))),
+			IfMatch:       res.ETag,
+			Metadata: map[string]*string{
+				recentStoredAtMeta: aws.String(modified.UTC().Format(time.RFC3339Nano)),
+			},
+		}))
+		if isConditionFailed(err) {
+			continue
+		}
+		return err
+	}
+	return errors.New("S3Storage: too many concurrent updates of the most recent user")
+}
+
+// latestUser returns the email and modification time of the most recently
+// modified account other than except, or an empty email if there are none.
+func (s *S3Storage) latestUser(except string) (string, time.Time, error) {
+	prefix := aws.StringValue(s.userKey(""))
+	var email string
+	var latest time.Time
+	ctx, cancel := s.opContext()
+	defer cancel()
+	err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			name, ok := userEmail(prefix, aws.StringValue(o.Key))
+			if ok && !strings.EqualFold(name, except) && aws.TimeValue(o.LastModified).After(latest) {
+				email, latest = name, aws.TimeValue(o.LastModified)
+			}
+		}
+		return true
+	})
+	return email, latest, err
+}
+
+func recentStoredAt(meta map[string]*string) (time.Time, bool) {
+	for k, v := range meta {
+		if http.CanonicalHeaderKey(k) == recentStoredAtMeta {
+			t, err := time.Parse(time.RFC3339Nano, aws.StringValue(v))
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(awserr.RequestFailure)
+	return ok && e.StatusCode() == http.StatusNotFound
+}
+
+// isAccessDenied returns true if a request was denied by the IAM or
+// bucket policy.
+func isAccessDenied(err error) bool {
+	if _, ok := err.(ErrAccessDenied); ok {
+		return true
+	}
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusForbidden {
+		return true
+	}
+	return isCode(err, "AccessDenied")
+}
+
+// isConditionFailed returns true if a conditional request failed because
+// the object was changed concurrently.
+func isConditionFailed(err error) bool {
+	e, ok := err.(awserr.RequestFailure)
+	return ok && (e.StatusCode() == http.StatusPreconditionFailed || e.StatusCode() == http.StatusConflict)
+}
@@ -0,0 +1,62 @@
+package caddytlss3
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// replica is a copy of the default bucket in another region, e.g. kept up
+// to date by S3 cross-region replication, that site and user data is read
+// from when the default bucket fails. It's never written to.
+type replica struct {
+	s3     s3iface.S3API
+	bucket string
+	// timeout bounds reads from the default bucket before falling back,
+	// zero to only fall back on errors.
+	timeout time.Duration
+}
+
+// fetchObject reads an object, falling back to the replica when reading it
+// from the default bucket fails or takes longer than the replica timeout.
+// Objects that don't exist in the default bucket are not looked up in the
+// replica since it can only be behind.
+func (s *S3Storage) fetchObject(client s3iface.S3API, bucket, key string) ([]byte, error) {
+	if s.replica == nil || bucket != s.bucket {
+		return s.fetchFrom(client, bucket, key, 0)
+	}
+	data, err := s.fetchFrom(client, bucket, key, s.replica.timeout)
+	if err == nil || isNotFound(err) {
+		return data, err
+	}
+	if _, ok := err.(ErrCorruptData); ok {
+		return nil, err
+	}
+	rdata, rerr := s.fetchFrom(s.replica.s3, s.replica.bucket, key, 0)
+	if rerr != nil {
+		s.log().Errorf("reading %s from replica bucket %s after error (%s): %s", key, s.replica.bucket, err, rerr)
+		return nil, err
+	}
+	s.log().Warnf("read %s from replica bucket %s after error: %s", key, s.replica.bucket, err)
+	return rdata, nil
+}
+
+// fetchFrom reads an object, giving up after timeout if it's not zero.
+func (s *S3Storage) fetchFrom(client s3iface.S3API, bucket, key string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	res, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, s.storageError("GetObject", bucket, key, err)
+	}
+	return readObject(res, bucket, key)
+}
@@ -0,0 +1,48 @@
+package caddytlss3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestReplicaFallback(t *testing.T) {
+	replicated := fakes.NewS3()
+	src := newFakeStorage(t, replicated, "replica")
+	if err := src.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.StoreUser("user@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: testAccountKey(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, primary := range map[string]s3iface.S3API{
+		"error": unavailableS3{},
+		"slow":  hungS3{},
+	} {
+		storage := newFakeStorage(t, primary, "bucket", WithTimeout(time.Minute))
+		storage.replica = &replica{s3: replicated, bucket: "replica", timeout: 10 * time.Millisecond}
+		data, err := storage.LoadSite("example.com")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if string(data.Cert) != "cert" {
+			t.Errorf("%s: expected the replicated site, got %q", name, data.Cert)
+		}
+		if _, err := storage.LoadUser("user@example.com"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+
+	// A missing object isn't read from the replica.
+	storage := newFakeStorage(t, fakes.NewS3(), "bucket")
+	storage.replica = &replica{s3: replicated, bucket: "replica"}
+	if _, err := storage.LoadSite("example.com"); err == nil {
+		t.Fatal("Expected the site to be missing")
+	} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+}
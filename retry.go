@@ -0,0 +1,140 @@
+package caddytlss3
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RetryPolicy configures how failed AWS requests are retried. Zero fields
+// take the defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first, 5 by
+	// default. Use 1 to disable retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, which is doubled for
+	// each following one up to MaxDelay. 100ms and 10s by default.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the fraction of each delay that is randomized, from 0 to 1.
+	// The default of 1 spreads retries of many hosts the most.
+	Jitter float64
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	Jitter:      1,
+}
+
+// withDefaults returns the policy with zero fields set to their defaults.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultRetryPolicy.MaxAttempts
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = defaultRetryPolicy.BaseDelay
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaultRetryPolicy.MaxDelay
+	}
+	if p.Jitter == 0 {
+		p.Jitter = defaultRetryPolicy.Jitter
+	}
+	return p
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("retry policy must allow at least one attempt")
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay {
+		return errors.New("retry policy delays must be positive with the maximum at least the base delay")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("retry policy jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// retryableCodes are the error codes of transient failures: throttling,
+// timeouts, and server side errors.
+var retryableCodes = map[string]bool{
+	"SlowDown":                               true,
+	"RequestTimeout":                         true,
+	"InternalError":                          true,
+	"ServiceUnavailable":                     true,
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"RequestLimitExceeded":                   true,
+	"ProvisionedThroughputExceededException": true,
+	"RequestError":                           true, // connection failures
+}
+
+// retryableError classifies errors of AWS requests as transient. Client
+// errors such as AccessDenied, NoSuchKey, or failed conditional writes are
+// never retried since retrying can't change the outcome.
+func retryableError(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		switch e.StatusCode() {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	if e, ok := err.(awserr.Error); ok {
+		return retryableCodes[e.Code()]
+	}
+	return false
+}
+
+// retryer implements request.Retryer with exponential backoff and jitter.
+// It's installed on the session so it applies to every AWS client.
+type retryer struct {
+	policy RetryPolicy
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newRetryer(p RetryPolicy) *retryer {
+	return &retryer{policy: p.withDefaults(), rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *retryer) MaxRetries() int {
+	return r.policy.MaxAttempts - 1
+}
+
+func (r *retryer) ShouldRetry(req *request.Request) bool {
+	if req.Retryable != nil {
+		return *req.Retryable
+	}
+	return retryableError(req.Error)
+}
+
+func (r *retryer) RetryRules(req *request.Request) time.Duration {
+	return r.delay(req.RetryCount)
+}
+
+// delay returns the backoff before retry number n (starting at 0).
+func (r *retryer) delay(n int) time.Duration {
+	d := r.policy.MaxDelay
+	if n < 32 {
+		if e := r.policy.BaseDelay << uint(n); e > 0 && e < d {
+			d = e
+		}
+	}
+	jitter := time.Duration(float64(d) * r.policy.Jitter)
+	if jitter <= 0 {
+		return d
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return d - jitter + time.Duration(r.rnd.Int63n(int64(jitter)+1))
+}
@@ -0,0 +1,60 @@
+package caddytlss3
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryableError(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, ""), true},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, ""), true},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 502, ""), true},
+		{awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), 429, ""), true},
+		{awserr.New("RequestError", "connection reset", nil), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, ""), false},
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, ""), false},
+		{awserr.NewRequestFailure(awserr.New("PreconditionFailed", "", nil), 412, ""), false},
+		{awserr.New("RequestCanceled", "", nil), false},
+		{errors.New("other"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := retryableError(c.err); got != c.retryable {
+			t.Errorf("retryableError(%v) = %t, want %t", c.err, got, c.retryable)
+		}
+	}
+}
+
+func TestRetryerDelay(t *testing.T) {
+	r := newRetryer(RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.5})
+	if r.MaxRetries() != 3 {
+		t.Fatalf("MaxRetries() = %d, want 3", r.MaxRetries())
+	}
+	for n, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := r.delay(n); d < want/2 || d > want {
+				t.Fatalf("delay(%d) = %s, want between %s and %s", n, d, want/2, want)
+			}
+		}
+	}
+	if d := r.delay(100); d > time.Second {
+		t.Fatalf("delay(100) = %s, want at most 1s", d)
+	}
+
+	var cfg Config
+	WithMaxRetries(0)(&cfg)
+	if p := cfg.Retry.withDefaults(); p.MaxAttempts != 1 || p.BaseDelay != defaultRetryPolicy.BaseDelay {
+		t.Fatalf("policy = %+v, want 1 attempt with default delays", p)
+	}
+	if err := (RetryPolicy{MaxAttempts: 2, BaseDelay: time.Second, MaxDelay: time.Millisecond}).validate(); err == nil {
+		t.Fatal("expected an error for a maximum delay below the base delay")
+	}
+}
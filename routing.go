@@ -0,0 +1,258 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// RouteRule routes the site data of matching domains to a different
+// bucket, prefix, region, or encryption key than the defaults. Exactly one
+// of Suffix, Pattern, Domains, or Match must be set, and the first rule
+// that matches a domain applies. This makes it possible to satisfy data
+// residency requirements, e.g. keeping certificates of EU customers in an
+// EU bucket, or to keep high-value domains in a more tightly controlled
+// bucket. Account (user) data always stays in the default bucket.
+type RouteRule struct {
+	// Suffix matches domains equal to or ending in the suffix
+	// (e.g. "eu.example.com" matches "a.eu.example.com").
+	Suffix string `json:"suffix,omitempty"`
+	// Pattern is a regular expression matched against the domain.
+	Pattern string `json:"pattern,omitempty"`
+	// Domains matches exactly the listed domains.
+	Domains []string `json:"domains,omitempty"`
+	// Match is called with the lower case domain, for routing decided by
+	// the embedding program, e.g. from a tenant database. It must be fast
+	// and always return the same result for a domain.
+	Match func(domain string) bool `json:"-"`
+
+	Bucket   string `json:"bucket,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Region   string `json:"region,omitempty"`
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	re      *regexp.Regexp
+	domains map[string]bool
+}
+
+func (r *RouteRule) compile() error {
+	var matchers int
+	for _, set := range []bool{r.Suffix != "", r.Pattern != "", len(r.Domains) != 0, r.Match != nil} {
+		if set {
+			matchers++
+		}
+	}
+	if matchers != 1 {
+		return errors.New("exactly one of suffix, pattern, domains, or match is required")
+	}
+	if r.Bucket == "" && r.Prefix == "" && r.Region == "" && r.KMSKeyID == "" {
+		return errors.New("at least one of bucket, prefix, region, or kms_key_id is required")
+	}
+	r.Suffix = strings.ToLower(strings.TrimPrefix(r.Suffix, "."))
+	if r.Pattern != "" {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	}
+	if len(r.Domains) != 0 {
+		r.domains = make(map[string]bool, len(r.Domains))
+		for _, d := range r.Domains {
+			r.domains[strings.ToLower(d)] = true
+		}
+	}
+	p, err := normalizePrefix(r.Prefix)
+	if err != nil {
+		return err
+	}
+	r.Prefix = p
+	return nil
+}
+
+func (r *RouteRule) match(domain string) bool {
+	switch {
+	case r.re != nil:
+		return r.re.MatchString(domain)
+	case r.domains != nil:
+		return r.domains[domain]
+	case r.Match != nil:
+		return r.Match(domain)
+	}
+	return domain == r.Suffix || strings.HasSuffix(domain, "."+r.Suffix)
+}
+
+// parseRouteRules parses the route rules from a JSON array, or from the
+// file it names if the value doesn't look like JSON.
+func parseRouteRules(v string) ([]*RouteRule, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	b := []byte(v)
+	if !strings.HasPrefix(v, "[") {
+		var err error
+		b, err = ioutil.ReadFile(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var rules []*RouteRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("route %d: %s", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// location identifies where an object is stored and how it's encrypted.
+type location struct {
+	s3       s3iface.S3API
+	bucket   string
+	prefix   string // prefix of the CA namespace containing the key
+	key      string
+	sse      string
+	kmsKeyID string
+}
+
+// withKey returns a copy of the location for another key in the same
+// bucket and CA namespace.
+func (l *location) withKey(key string) *location {
+	l2 := *l
+	l2.key = key
+	return &l2
+}
+
+// encrypt sets the server side encryption for the location on in.
+func (l *location) encrypt(in *s3.PutObjectInput) *s3.PutObjectInput {
+	in.ServerSideEncryption, in.SSEKMSKeyId = l.sseParams()
+	return in
+}
+
+// sseParams returns the ServerSideEncryption and SSEKMSKeyId request
+// parameters for the location. A route KMS key always selects KMS.
+func (l *location) sseParams() (*string, *string) {
+	switch {
+	case l.kmsKeyID != "":
+		return aws.String(SSEKMS), aws.String(l.kmsKeyID)
+	case l.sse == SSENone, l.sse == SSECustomer:
+		// The customer key is added by sseCustomerHandler.
+		return nil, nil
+	case l.sse == SSEKMS:
+		return aws.String(SSEKMS), nil
+	}
+	return aws.String(SSEAES256), nil
+}
+
+// location returns a location in the default bucket with the default
+// encryption settings of the storage.
+func (s *S3Storage) location(prefix, key string) *location {
+	return &location{
+		s3:       s.s3,
+		bucket:   s.bucket,
+		prefix:   prefix,
+		key:      key,
+		sse:      s.sse,
+		kmsKeyID: s.kmsKeyID,
+	}
+}
+
+// encrypt sets the default server side encryption of the storage on in.
+func (s *S3Storage) encrypt(in *s3.PutObjectInput) *s3.PutObjectInput {
+	return s.location(s.prefix, aws.StringValue(in.Key)).encrypt(in)
+}
+
+// router resolves the location of site data according to the route rules.
+type router struct {
+	s     *S3Storage
+	rules []*RouteRule
+
+	mu      sync.Mutex
+	clients map[string]s3iface.S3API // by region
+}
+
+func newRouter(s *S3Storage, rules []*RouteRule) *router {
+	return &router{
+		s:       s,
+		rules:   rules,
+		clients: make(map[string]s3iface.S3API),
+	}
+}
+
+// site returns the location of the site data for domain in the CA
+// namespace of the storage.
+func (r *router) site(domain string) *location {
+	return r.siteIn(domain, r.s.ca)
+}
+
+// siteIn returns the location of the site data for domain in the given
+// CA namespace.
+func (r *router) siteIn(domain, ca string) *location {
+	domain = strings.ToLower(domain)
+	for _, rule := range r.rules {
+		if !rule.match(domain) {
+			continue
+		}
+		prefix := caPrefix(r.s.basePrefix+rule.Prefix, ca)
+		loc := r.s.location(prefix, siteKey(prefix, domain))
+		if rule.KMSKeyID != "" {
+			loc.kmsKeyID = rule.KMSKeyID
+		}
+		if rule.Bucket != "" {
+			loc.bucket = rule.Bucket
+		}
+		if rule.Region != "" {
+			loc.s3 = r.client(rule.Region)
+		}
+		return loc
+	}
+	prefix := caPrefix(r.s.basePrefix, ca)
+	return r.s.location(prefix, siteKey(prefix, domain))
+}
+
+func (r *router) client(region string) s3iface.S3API {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.clients[region]
+	if !ok {
+		c = r.s.newClient(aws.NewConfig().WithRegion(region))
+		r.clients[region] = c
+	}
+	return c
+}
+
+// roots returns the distinct locations (bucket and root prefix) that the
+// storage writes to, starting with the default one.
+func (r *router) roots() []*location {
+	locs := []*location{r.s.location(r.s.basePrefix, "")}
+	seen := map[string]bool{r.s.bucket + "/" + r.s.basePrefix: true}
+	for _, rule := range r.rules {
+		loc := r.s.location(r.s.basePrefix+rule.Prefix, "")
+		if rule.KMSKeyID != "" {
+			loc.kmsKeyID = rule.KMSKeyID
+		}
+		if rule.Bucket != "" {
+			loc.bucket = rule.Bucket
+		}
+		if rule.Region != "" {
+			loc.s3 = r.client(rule.Region)
+		}
+		if id := loc.bucket + "/" + loc.prefix; !seen[id] {
+			seen[id] = true
+			locs = append(locs, loc)
+		}
+	}
+	return locs
+}
@@ -0,0 +1,222 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// verifiedPrivate records the bucket and prefix combinations that have
+// passed the public access check so it only runs once per process.
+var (
+	verifiedPrivateMu sync.Mutex
+	verifiedPrivate   = make(map[string]bool)
+)
+
+// verifyPrivate makes sure none of the locations the storage writes to can
+// be read publicly. Every bucket must have all Block Public Access settings
+// enabled, and no bucket policy statement may grant anonymous read access
+// to the storage prefix. Private keys are never written to a bucket that
+// fails the check.
+func (s *S3Storage) verifyPrivate() error {
+	for _, loc := range s.routes.roots() {
+		id := loc.bucket + "/" + loc.prefix
+		verifiedPrivateMu.Lock()
+		ok := verifiedPrivate[id]
+		verifiedPrivateMu.Unlock()
+		if ok {
+			continue
+		}
+		if err := s.verifyPublicAccessBlock(loc); err != nil {
+			return err
+		}
+		if err := s.verifyBucketPolicy(loc, s.arn(loc.bucket+"/"+loc.prefix)); err != nil {
+			return err
+		}
+		verifiedPrivateMu.Lock()
+		verifiedPrivate[id] = true
+		verifiedPrivateMu.Unlock()
+	}
+	return nil
+}
+
+func (s *S3Storage) verifyPublicAccessBlock(loc *location) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := loc.s3.GetPublicAccessBlockWithContext(ctx, &s3.GetPublicAccessBlockInput{Bucket: &loc.bucket})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == "NoSuchPublicAccessBlockConfiguration" {
+			return fmt.Errorf("S3Storage: refusing to use bucket %s: Block Public Access is not configured", loc.bucket)
+		}
+		return fmt.Errorf("S3Storage: checking Block Public Access of bucket %s: %s", loc.bucket, err)
+	}
+	c := res.PublicAccessBlockConfiguration
+	if c == nil || !aws.BoolValue(c.BlockPublicAcls) || !aws.BoolValue(c.IgnorePublicAcls) ||
+		!aws.BoolValue(c.BlockPublicPolicy) || !aws.BoolValue(c.RestrictPublicBuckets) {
+		return fmt.Errorf("S3Storage: refusing to use bucket %s: not all Block Public Access settings are enabled", loc.bucket)
+	}
+	return nil
+}
+
+func (s *S3Storage) verifyBucketPolicy(loc *location, prefixARN string) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := loc.s3.GetBucketPolicyWithContext(ctx, &s3.GetBucketPolicyInput{Bucket: &loc.bucket})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == "NoSuchBucketPolicy" {
+			return nil
+		}
+		return fmt.Errorf("S3Storage: checking policy of bucket %s: %s", loc.bucket, err)
+	}
+	public, err := policyAllowsPublicRead(aws.StringValue(res.Policy), prefixARN)
+	if err != nil {
+		return fmt.Errorf("S3Storage: parsing policy of bucket %s: %s", loc.bucket, err)
+	}
+	if public {
+		return fmt.Errorf("S3Storage: refusing to use bucket %s: its policy allows public read access to %q", loc.bucket, loc.prefix)
+	}
+	return nil
+}
+
+// stringOrSlice is an IAM policy element that may be a string or a list.
+type stringOrSlice []string
+
+func (s *stringOrSlice) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err == nil {
+		*s = []string{v}
+		return nil
+	}
+	var vs []string
+	if err := json.Unmarshal(b, &vs); err != nil {
+		return err
+	}
+	*s = vs
+	return nil
+}
+
+type policyStatement struct {
+	Effect    string
+	Principal json.RawMessage
+	Action    stringOrSlice
+	Resource  stringOrSlice
+	Condition json.RawMessage
+}
+
+type statementList []policyStatement
+
+func (l *statementList) UnmarshalJSON(b []byte) error {
+	var st policyStatement
+	if err := json.Unmarshal(b, &st); err == nil && len(b) > 0 && b[0] == '{' {
+		*l = []policyStatement{st}
+		return nil
+	}
+	var sts []policyStatement
+	if err := json.Unmarshal(b, &sts); err != nil {
+		return err
+	}
+	*l = sts
+	return nil
+}
+
+// policyAllowsPublicRead returns true if any statement of the bucket
+// policy unconditionally allows anyone to get objects under the prefix
+// with ARN arnPrefix.
+func policyAllowsPublicRead(policy, arnPrefix string) (bool, error) {
+	var doc struct {
+		Statement statementList
+	}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return false, err
+	}
+	for _, st := range doc.Statement {
+		if st.Effect != "Allow" || len(st.Condition) != 0 || !isPublicPrincipal(st.Principal) {
+			continue
+		}
+		var getObject bool
+		for _, a := range st.Action {
+			if wildcardMatch(strings.ToLower(a), "s3:getobject") {
+				getObject = true
+				break
+			}
+		}
+		if !getObject {
+			continue
+		}
+		for _, r := range st.Resource {
+			if wildcardCoversPrefix(r, arnPrefix) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func isPublicPrincipal(p json.RawMessage) bool {
+	var v string
+	if err := json.Unmarshal(p, &v); err == nil {
+		return v == "*"
+	}
+	var m map[string]stringOrSlice
+	if err := json.Unmarshal(p, &m); err != nil {
+		return false
+	}
+	for _, v := range m["AWS"] {
+		if v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch reports whether s matches the IAM style pattern where '*'
+// matches any sequence of characters and '?' any single character.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// wildcardCoversPrefix reports whether pattern matches any string that
+// starts with prefix.
+func wildcardCoversPrefix(pattern, prefix string) bool {
+	for len(pattern) > 0 && len(prefix) > 0 {
+		switch pattern[0] {
+		case '*':
+			return true
+		case '?':
+		default:
+			if pattern[0] != prefix[0] {
+				return false
+			}
+		}
+		pattern, prefix = pattern[1:], prefix[1:]
+	}
+	// Either the pattern is exhausted while the prefix isn't, in which case
+	// only an exact match is possible, or the rest of the pattern can be
+	// satisfied by whatever follows the prefix.
+	return len(prefix) == 0
+}
@@ -0,0 +1,82 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// schemaVersion is the version of the format of stored site and user data,
+// recorded in its schemaVersion field. Data without the field, written
+// before it was introduced, is version 1 too.
+//
+// Version 1 is the JSON encoding of caddytls.SiteData and
+// caddytls.UserData. Changes that readers of older versions would
+// misinterpret must increase the version, so that those readers fail with
+// an ErrSchemaVersion instead; additions that are safe to ignore, like the
+// version field itself, don't.
+const schemaVersion = 1
+
+// aliasSchemaVersion is the version of site aliases (see siteAlias), so
+// previous versions reject them instead of taking them for empty site
+// data. Site and user data are still written as version 1.
+const aliasSchemaVersion = 2
+
+// schemaHeader is the part of stored data identifying its format.
+type schemaHeader struct {
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+}
+
+// checkSchema returns an ErrSchemaVersion if the data stored at bucket/key
+// was written in a format newer than this version supports.
+func checkSchema(bucket, key string, b []byte) error {
+	var h schemaHeader
+	if err := json.Unmarshal(b, &h); err != nil {
+		return err
+	}
+	if h.SchemaVersion > schemaVersion {
+		return ErrSchemaVersion{Bucket: bucket, Key: key, Version: h.SchemaVersion}
+	}
+	return nil
+}
+
+func marshalSite(data *caddytls.SiteData) ([]byte, error) {
+	return json.Marshal(struct {
+		schemaHeader
+		*caddytls.SiteData
+	}{schemaHeader{schemaVersion}, data})
+}
+
+// unmarshalSite decodes site data, or returns an errSiteAlias if b is a
+// site alias.
+func unmarshalSite(bucket, key string, b []byte) (*caddytls.SiteData, error) {
+	if alias, ok := parseSiteAlias(b); ok {
+		return nil, alias
+	}
+	if err := checkSchema(bucket, key, b); err != nil {
+		return nil, err
+	}
+	var data *caddytls.SiteData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func marshalUser(data *caddytls.UserData) ([]byte, error) {
+	return json.Marshal(struct {
+		schemaHeader
+		*caddytls.UserData
+	}{schemaHeader{schemaVersion}, data})
+}
+
+func unmarshalUser(bucket, key string, b []byte) (*caddytls.UserData, error) {
+	if err := checkSchema(bucket, key, b); err != nil {
+		return nil, err
+	}
+	var data *caddytls.UserData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,48 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket")
+
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := client.Object("bucket", "acme/ca/domain/example.com")
+	var h schemaHeader
+	if err := json.Unmarshal(b, &h); err != nil || h.SchemaVersion != schemaVersion {
+		t.Fatalf("Expected schema version %d, got %d (%v)", schemaVersion, h.SchemaVersion, err)
+	}
+	// Hosts that predate the schema version still decode the data.
+	var legacy caddytls.SiteData
+	if err := json.Unmarshal(b, &legacy); err != nil || !bytes.Equal(legacy.Cert, []byte("cert")) {
+		t.Fatalf("Expected the data to decode as SiteData, got %+v, %v", legacy, err)
+	}
+
+	// Data without a schema version is version 1.
+	b, _ = json.Marshal(&caddytls.SiteData{Cert: []byte("old"), Key: []byte("key")})
+	client.SetObject("bucket", "acme/ca/domain/old.example.com", b, nil)
+	if data, err := storage.LoadSite("old.example.com"); err != nil || !bytes.Equal(data.Cert, []byte("old")) {
+		t.Fatalf("Expected data without a schema version to load, got %+v, %v", data, err)
+	}
+
+	client.SetObject("bucket", "acme/ca/domain/new.example.com", []byte(`{"schemaVersion":2,"Cert":"Y2VydA=="}`), nil)
+	_, err := storage.LoadSite("new.example.com")
+	if e, ok := err.(ErrSchemaVersion); !ok || e.Version != 2 {
+		t.Fatalf("Expected ErrSchemaVersion, got %v", err)
+	}
+	client.SetObject("bucket", *storage.userKey("user@example.com"), []byte(`{"schemaVersion":2}`), nil)
+	if _, err := storage.LoadUser("user@example.com"); err == nil {
+		t.Fatal("Expected an error for an unsupported user data version")
+	} else if _, ok := err.(ErrSchemaVersion); !ok {
+		t.Fatalf("Expected ErrSchemaVersion, got %v", err)
+	}
+}
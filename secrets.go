@@ -0,0 +1,151 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// keySecretRef starts the Key of site and user data whose private key is
+// stored in Secrets Manager. It's followed by the secret name and the
+// version that was stored with the data, separated by "#".
+const keySecretRef = "secretsmanager:"
+
+// keySecrets stores the private keys of sites and accounts as Secrets
+// Manager secrets, one per object, while the rest of the data stays in S3
+// with a reference to the secret version in place of the key. Referencing
+// the version keeps the key consistent with the certificate when a store
+// is skipped or raced by another host, since the secret is written first.
+type keySecrets struct {
+	client secretsmanageriface.SecretsManagerAPI
+	// prefix is prepended to the secret names.
+	prefix   string
+	kmsKeyID string
+}
+
+// secretName returns the name of the secret for the key of the object at
+// bucket/key. Escaped names map to allowed characters since "%" isn't one
+// and "+" never occurs in them otherwise.
+func (k *keySecrets) secretName(bucket, key string) string {
+	return k.prefix + bucket + "/" + strings.Replace(key, "%", "+", -1)
+}
+
+// storeKey stores key as the current version of the secret for the object
+// at bucket/objectKey and returns the reference to store in its place,
+// creating the secret or restoring it from a pending deletion as needed.
+func (s *S3Storage) storeKey(bucket, objectKey string, key []byte) ([]byte, error) {
+	name := s.keys.secretName(bucket, objectKey)
+	if s.skipDeletes() {
+		s.log().Infof("dry run: PutSecretValue %s (%d bytes)", name, len(key))
+		return []byte(keySecretRef + name), nil
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := s.keys.client.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     &name,
+		SecretBinary: key,
+	})
+	if isCode(err, secretsmanager.ErrCodeInvalidRequestException) {
+		// Secrets of deleted sites and accounts are scheduled for deletion
+		// rather than deleted, so they're restored when stored again.
+		if _, rerr := s.keys.client.RestoreSecretWithContext(ctx, &secretsmanager.RestoreSecretInput{
+			SecretId: &name,
+		}); rerr != nil {
+			return nil, fmt.Errorf("S3Storage: restoring secret %s: %s", name, rerr)
+		}
+		res, err = s.keys.client.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+			SecretId:     &name,
+			SecretBinary: key,
+		})
+	}
+	if isCode(err, secretsmanager.ErrCodeResourceNotFoundException) {
+		in := &secretsmanager.CreateSecretInput{
+			Name:         &name,
+			Description:  aws.String("Private key of s3://" + bucket + "/" + objectKey),
+			SecretBinary: key,
+		}
+		if s.keys.kmsKeyID != "" {
+			in.KmsKeyId = &s.keys.kmsKeyID
+		}
+		created, cerr := s.keys.client.CreateSecretWithContext(ctx, in)
+		if cerr == nil {
+			return []byte(keySecretRef + name + "#" + aws.StringValue(created.VersionId)), nil
+		}
+		if !isCode(cerr, secretsmanager.ErrCodeResourceExistsException) {
+			return nil, fmt.Errorf("S3Storage: creating secret %s: %s", name, cerr)
+		}
+		// Created concurrently by another host.
+		res, err = s.keys.client.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+			SecretId:     &name,
+			SecretBinary: key,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("S3Storage: storing secret %s: %s", name, err)
+	}
+	return []byte(keySecretRef + name + "#" + aws.StringValue(res.VersionId)), nil
+}
+
+// resolveKey returns the private key that key refers to if it's a
+// reference to a secret, or key itself otherwise.
+func (s *S3Storage) resolveKey(key []byte) ([]byte, error) {
+	if !bytes.HasPrefix(key, []byte(keySecretRef)) {
+		return key, nil
+	}
+	ref := string(key[len(keySecretRef):])
+	if s.keys == nil {
+		return nil, fmt.Errorf("S3Storage: the private key is stored in secret %s but Secrets Manager isn't configured", ref)
+	}
+	in := &secretsmanager.GetSecretValueInput{SecretId: &ref}
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		in.SecretId = aws.String(ref[:i])
+		in.VersionId = aws.String(ref[i+1:])
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := s.keys.client.GetSecretValueWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("S3Storage: reading secret %s: %s", ref, err)
+	}
+	if res.SecretBinary == nil {
+		return []byte(aws.StringValue(res.SecretString)), nil
+	}
+	return res.SecretBinary, nil
+}
+
+// deleteKey schedules the deletion of the secret for the key of the object
+// at bucket/objectKey, which can be restored during the default recovery
+// window of Secrets Manager. Missing secrets are ignored.
+func (s *S3Storage) deleteKey(bucket, objectKey string) error {
+	name := s.keys.secretName(bucket, objectKey)
+	if s.dryRun {
+		s.log().Infof("dry run: DeleteSecret %s", name)
+		return nil
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, err := s.keys.client.DeleteSecretWithContext(ctx, &secretsmanager.DeleteSecretInput{
+		SecretId: &name,
+	})
+	if err != nil && !isCode(err, secretsmanager.ErrCodeResourceNotFoundException) {
+		return fmt.Errorf("S3Storage: deleting secret %s: %s", name, err)
+	}
+	return nil
+}
+
+// storeSiteKey returns a copy of data with the key replaced by a reference
+// to the secret it was stored in.
+func (s *S3Storage) storeSiteKey(loc *location, data *caddytls.SiteData) (*caddytls.SiteData, error) {
+	ref, err := s.storeKey(loc.bucket, loc.key, data.Key)
+	if err != nil {
+		return nil, err
+	}
+	stored := *data
+	stored.Key = ref
+	return &stored, nil
+}
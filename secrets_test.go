@@ -0,0 +1,146 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// memSecrets is a minimal in-memory Secrets Manager keeping every version
+// of a secret.
+type memSecrets struct {
+	secretsmanageriface.SecretsManagerAPI
+	mu       sync.Mutex
+	versions map[string][][]byte
+	deleted  map[string]bool
+}
+
+func (m *memSecrets) CreateSecretWithContext(ctx aws.Context, in *secretsmanager.CreateSecretInput, opts ...request.Option) (*secretsmanager.CreateSecretOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := *in.Name
+	if _, ok := m.versions[name]; ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceExistsException, "exists", nil)
+	}
+	m.versions[name] = [][]byte{in.SecretBinary}
+	return &secretsmanager.CreateSecretOutput{Name: in.Name, VersionId: aws.String("0")}, nil
+}
+
+func (m *memSecrets) PutSecretValueWithContext(ctx aws.Context, in *secretsmanager.PutSecretValueInput, opts ...request.Option) (*secretsmanager.PutSecretValueOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := *in.SecretId
+	if _, ok := m.versions[name]; !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	if m.deleted[name] {
+		return nil, awserr.New(secretsmanager.ErrCodeInvalidRequestException, "scheduled for deletion", nil)
+	}
+	m.versions[name] = append(m.versions[name], in.SecretBinary)
+	return &secretsmanager.PutSecretValueOutput{VersionId: aws.String(strconv.Itoa(len(m.versions[name]) - 1))}, nil
+}
+
+func (m *memSecrets) GetSecretValueWithContext(ctx aws.Context, in *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions := m.versions[*in.SecretId]
+	i, err := strconv.Atoi(aws.StringValue(in.VersionId))
+	if err != nil || i >= len(versions) || m.deleted[*in.SecretId] {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretBinary: versions[i]}, nil
+}
+
+func (m *memSecrets) DeleteSecretWithContext(ctx aws.Context, in *secretsmanager.DeleteSecretInput, opts ...request.Option) (*secretsmanager.DeleteSecretOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.versions[*in.SecretId]; !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	m.deleted[*in.SecretId] = true
+	return &secretsmanager.DeleteSecretOutput{}, nil
+}
+
+func (m *memSecrets) RestoreSecretWithContext(ctx aws.Context, in *secretsmanager.RestoreSecretInput, opts ...request.Option) (*secretsmanager.RestoreSecretOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deleted, *in.SecretId)
+	return &secretsmanager.RestoreSecretOutput{}, nil
+}
+
+func TestKeySecrets(t *testing.T) {
+	client := fakes.NewS3()
+	secrets := &memSecrets{versions: make(map[string][][]byte), deleted: make(map[string]bool)}
+	storage := newFakeStorage(t, client, "bucket")
+	storage.keys = &keySecrets{client: secrets, prefix: "caddy/"}
+
+	domain := "*.example.com"
+	if err := storage.StoreSite(domain, &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := client.Object("bucket", siteKey("acme/ca/", domain))
+	var stored caddytls.SiteData
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored.Key, []byte(keySecretRef)) || string(stored.Cert) != "cert" {
+		t.Fatalf("Expected the key to be replaced by a reference, got %s", b)
+	}
+	if _, ok := secrets.versions["caddy/bucket/acme/ca/domain/+2A.example.com"]; !ok {
+		t.Fatalf("Expected a secret for the key, got %v", secrets.versions)
+	}
+	data, err := storage.LoadSite(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data.Key) != "key" {
+		t.Errorf("Expected the key from the secret, got %q", data.Key)
+	}
+
+	// A deleted key is restored when the site is stored again.
+	if err := storage.DeleteSite(domain); err != nil {
+		t.Fatal(err)
+	}
+	if !secrets.deleted["caddy/bucket/acme/ca/domain/+2A.example.com"] {
+		t.Fatal("Expected the secret to be deleted")
+	}
+	if err := storage.StoreSite(domain, &caddytls.SiteData{Cert: []byte("cert2"), Key: []byte("key2")}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.LoadSite(domain); err != nil {
+		t.Fatal(err)
+	} else if string(data.Key) != "key2" {
+		t.Errorf("Expected the restored secret, got %q", data.Key)
+	}
+
+	if err := storage.StoreUser("user@example.com", &caddytls.UserData{Reg: []byte("reg"), Key: []byte("userkey")}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := storage.LoadUser("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(user.Key) != "userkey" {
+		t.Errorf("Expected the account key from the secret, got %q", user.Key)
+	}
+
+	// Keys stored in S3 before remain readable.
+	storage.keys = nil
+	if err := storage.StoreSite("plain.example.com", &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	storage.keys = &keySecrets{client: secrets, prefix: "caddy/"}
+	if data, err := storage.LoadSite("plain.example.com"); err != nil || string(data.Key) != "key" {
+		t.Errorf("Expected the key stored in S3, got %v, %v", data, err)
+	}
+}
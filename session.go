@@ -0,0 +1,251 @@
+package caddytlss3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// defaultRegion is used when no region is configured and the region of
+	// the bucket can't be detected.
+	defaultRegion = "us-east-1"
+
+	defaultRoleSessionName = "caddy-s3-storage"
+
+	// ec2RoleExpiryWindow refreshes EC2 role credentials this long before
+	// they expire so requests in flight don't fail with expired credentials.
+	ec2RoleExpiryWindow = 5 * time.Minute
+)
+
+// bucketRegions caches detected bucket regions by endpoint and bucket since
+// storage instances are constructed often.
+var (
+	bucketRegionsMu sync.Mutex
+	bucketRegions   = make(map[string]string)
+)
+
+// newSession creates an AWS session for cfg using the same configuration
+// chain as other AWS tools: AWS_REGION/AWS_DEFAULT_REGION, AWS_PROFILE, the
+// shared config and credentials files, and the default credential
+// providers (environment, shared credentials, web identity, ECS, and EC2
+// roles).
+//
+// The EC2 instance role is read from the instance metadata service with
+// IMDSv2 session tokens, falling back to IMDSv1 unless cfg.RequireIMDSv2
+// is set.
+//
+// Explicit credentials, an HTTP client or HTTP settings, a retry policy,
+// and a region in cfg take precedence over the environment. When no region
+// is set the region of the bucket is detected using GetBucketLocation in
+// the configured partition. FIPS endpoints, if enabled, are used for every
+// service, including STS and DynamoDB.
+//
+// If the role chain is not empty each role is assumed in order using the
+// credentials of the previous one, e.g. instance role -> intermediate role
+// -> role in the account that owns the bucket. The external ID is only
+// passed for the last role. Assumed role credentials are refreshed
+// automatically shortly before they expire.
+//
+// s3Config is the S3 client configuration (e.g. a custom endpoint) used to
+// detect the region of the bucket.
+func newSession(cfg Config, s3Config *aws.Config) (*session.Session, error) {
+	awsConfig := aws.NewConfig()
+	if cfg.Credentials != nil {
+		awsConfig.WithCredentials(cfg.Credentials)
+	}
+	if cfg.HTTPClient != nil {
+		awsConfig.WithHTTPClient(cfg.HTTPClient)
+	} else if hc, err := cfg.HTTP.client(); err != nil {
+		return nil, fmt.Errorf("S3Storage: %s", err)
+	} else if hc != nil {
+		awsConfig.WithHTTPClient(hc)
+	}
+	if cfg.Retryer != nil {
+		awsConfig = request.WithRetryer(awsConfig, cfg.Retryer)
+	} else {
+		awsConfig = request.WithRetryer(awsConfig, newRetryer(cfg.Retry))
+	}
+	if cfg.Region != "" {
+		awsConfig.WithRegion(cfg.Region)
+	}
+	if cfg.FIPS {
+		awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if cfg.RequireIMDSv2 {
+		awsConfig.WithEC2MetadataEnableFallback(false)
+	}
+	if cfg.Credentials == nil {
+		if err := checkWebIdentity(); err != nil {
+			return nil, err
+		}
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Credentials == nil {
+		sess = withEC2RoleExpiryWindow(sess)
+		if cfg.RequireIMDSv2 {
+			if _, err := sess.Config.Credentials.Get(); err != nil {
+				return nil, fmt.Errorf("S3Storage: resolving AWS credentials with IMDSv2: %s "+
+					"(in a container on EC2 the instance metadata hop limit must be at least 2)", err)
+			}
+		}
+	}
+	for i, arn := range cfg.RoleChain {
+		last := i == len(cfg.RoleChain)-1
+		creds := stscreds.NewCredentials(sess, arn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = cfg.RoleSessionName
+			p.ExpiryWindow = time.Minute
+			if last && cfg.ExternalID != "" {
+				p.ExternalID = aws.String(cfg.ExternalID)
+			}
+		})
+		sess = sess.Copy(aws.NewConfig().WithCredentials(creds))
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess = sess.Copy(aws.NewConfig().WithRegion(detectBucketRegion(sess, cfg.Bucket, cfg.Partition, s3Config, cfg.Timeout)))
+	}
+	return sess, nil
+}
+
+// urlCredentials returns static credentials from a storage URL of the form
+// s3://ACCESS_KEY_ID:SECRET@bucket/prefix, with an optional session_token
+// query parameter for temporary credentials, or nil if the URL has none.
+// Secrets must be URL encoded. Errors never include the secret.
+func urlCredentials(u *url.URL) (*credentials.Credentials, error) {
+	if u.Scheme != "s3" || u.User == nil {
+		return nil, nil
+	}
+	secret, ok := u.User.Password()
+	if u.User.Username() == "" || !ok || secret == "" {
+		return nil, errors.New("S3Storage: credentials in the storage URL must include an access key ID and a secret")
+	}
+	return credentials.NewStaticCredentials(u.User.Username(), secret, u.Query().Get("session_token")), nil
+}
+
+// checkWebIdentity verifies the web identity configuration used by IAM
+// Roles for Service Accounts (IRSA) on EKS. The default credential chain
+// reads AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, and re-reads the
+// token file whenever the credentials are refreshed since it's rotated by
+// the kubelet. A missing token file only fails on the first request, so
+// it's reported here with a clearer error instead.
+func checkWebIdentity() error {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if tokenFile == "" {
+		return nil
+	}
+	if os.Getenv("AWS_ROLE_ARN") == "" {
+		return errors.New("S3Storage: AWS_WEB_IDENTITY_TOKEN_FILE is set but AWS_ROLE_ARN is not")
+	}
+	if _, err := os.Stat(tokenFile); err != nil {
+		return fmt.Errorf("S3Storage: web identity token file: %s", err)
+	}
+	return nil
+}
+
+// ecsCredentialsHost is the address of the ECS container credentials
+// endpoint that AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is relative to.
+const ecsCredentialsHost = "http://169.254.170.2"
+
+// containerCredentialsEndpoint returns the ECS (or Fargate, or EKS Pod
+// Identity) container credentials endpoint the default credential chain
+// uses for the task role, or an empty string when not running in a
+// container with a task role. The relative URI takes precedence, as in the
+// SDK.
+func containerCredentialsEndpoint() string {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return ecsCredentialsHost + uri
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+}
+
+// withEC2RoleExpiryWindow replaces the credentials of sess with ones that
+// are refreshed early if the default credential chain resolved to the EC2
+// instance role. The default chain doesn't allow configuring the window.
+// The metadata client inherits the IMDS settings of sess.
+func withEC2RoleExpiryWindow(sess *session.Session) *session.Session {
+	v, err := sess.Config.Credentials.Get()
+	if err != nil || v.ProviderName != ec2rolecreds.ProviderName {
+		return sess
+	}
+	return sess.Copy(aws.NewConfig().WithCredentials(ec2rolecreds.NewCredentials(sess, func(p *ec2rolecreds.EC2RoleProvider) {
+		p.ExpiryWindow = ec2RoleExpiryWindow
+	})))
+}
+
+// detectBucketRegion returns the region of the bucket, or the default
+// region of the partition if it can't be determined within timeout.
+func detectBucketRegion(sess *session.Session, bucket, partition string, s3Config *aws.Config, timeout time.Duration) string {
+	fallback := defaultRegion
+	if r, ok := partitionRegions[partition]; ok {
+		fallback = r
+	}
+	cacheKey := aws.StringValue(s3Config.Endpoint) + "/" + fallback + "/" + bucket
+	bucketRegionsMu.Lock()
+	r, ok := bucketRegions[cacheKey]
+	bucketRegionsMu.Unlock()
+	if ok {
+		return r
+	}
+	// The cache isn't locked during the request so that a slow region
+	// doesn't hold up the storages of other buckets. Concurrent
+	// detections of the same bucket find the same region.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := s3.New(sess, s3Config, aws.NewConfig().WithRegion(fallback)).GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{
+		Bucket: &bucket,
+	})
+	if err != nil {
+		// Don't cache failures so detection is retried.
+		return fallback
+	}
+	r = s3.NormalizeBucketLocation(aws.StringValue(res.LocationConstraint))
+	bucketRegionsMu.Lock()
+	bucketRegions[cacheKey] = r
+	bucketRegionsMu.Unlock()
+	return r
+}
+
+// configuredRegion returns the region from the region query parameter of
+// a storage URL, or from CADDY_S3_REGION.
+func configuredRegion(query url.Values) string {
+	if r := query.Get("region"); r != "" {
+		return r
+	}
+	return os.Getenv("CADDY_S3_REGION")
+}
+
+// parseRoleChain parses a comma separated list of IAM role ARNs.
+func parseRoleChain(v string) ([]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var arns []string
+	for _, arn := range strings.Split(v, ",") {
+		arn = strings.TrimSpace(arn)
+		if !strings.HasPrefix(arn, "arn:") || !strings.Contains(arn, ":role/") {
+			return nil, fmt.Errorf("%q is not an IAM role ARN", arn)
+		}
+		arns = append(arns, arn)
+	}
+	return arns, nil
+}
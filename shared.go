@@ -0,0 +1,147 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// blobKey returns the key of the blob with the given SHA-256 in the CA
+// namespace of loc, blob/<sha256>. Blobs are never modified, a renewal
+// stores a new one.
+func blobKey(loc *location, sum string) string {
+	return loc.prefix + "blob/" + sum
+}
+
+// blobSum returns the name of the blob of site data in the shared layout.
+func blobSum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadBlob reads the site data of the blob with the given SHA-256 that the
+// pointer stored at loc refers to. It's mirrored in place of the pointer
+// so the disk mirror doesn't depend on the blob.
+func (s *S3Storage) loadBlob(loc *location, sum string) (*caddytls.SiteData, error) {
+	blob := loc.withKey(blobKey(loc, sum))
+	b, err := s.getObject(blob.s3, blob.bucket, blob.key)
+	if isNotFound(err) {
+		return nil, ErrCorruptData{Bucket: loc.bucket, Key: loc.key, Err: errors.New("missing blob " + sum)}
+	}
+	if err != nil {
+		return s.mirroredSite(loc, err)
+	}
+	if blobSum(b) != sum {
+		return nil, ErrCorruptData{Bucket: blob.bucket, Key: blob.key}
+	}
+	data, err := unmarshalSite(blob.bucket, blob.key, b)
+	if _, ok := err.(ErrSchemaVersion); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ErrCorruptData{Bucket: blob.bucket, Key: blob.key, Err: err}
+	}
+	s.storeMirror(loc.bucket, loc.key, b)
+	return data, nil
+}
+
+// putBlob stores body as a blob in the CA namespace of loc unless it's
+// already there.
+func (s *S3Storage) putBlob(loc *location, sum string, body []byte) error {
+	blob := loc.withKey(blobKey(loc, sum))
+	err := s.putObject(blob.s3, blob.encrypt(&s3.PutObjectInput{
+		Bucket:        &blob.bucket,
+		Key:           &blob.key,
+		Body:          bytes.NewReader(body),
+		ContentLength: aws.Int64(int64(len(body))),
+		IfNoneMatch:   aws.String("*"),
+	}))
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// putSharedSite writes a site in the shared layout, and returns whether it
+// was written. The site data is stored as a blob first, then the pointer
+// to it under the same conditions as putSite, with the metadata of the
+// certificate so StatSite doesn't need the blob.
+func (s *S3Storage) putSharedSite(loc *location, body []byte, meta map[string]*string, tagging string) (bool, error) {
+	sum := blobSum(body)
+	if err := s.putBlob(loc, sum, body); err != nil {
+		return false, err
+	}
+	ptr, err := json.Marshal(siteAlias{schemaHeader: schemaHeader{aliasSchemaVersion}, Blob: sum})
+	if err != nil {
+		return false, err
+	}
+	return s.putSite(loc, ptr, "", meta, tagging)
+}
+
+// shareSite points the other domains of the certificate of a site stored
+// for domain in the shared layout at its blob, so a renewal under any of
+// them is seen under all of them. Domains with their own certificate
+// expiring later are kept. Failures are logged since the site was stored
+// for domain.
+func (s *S3Storage) shareSite(domain string, data *caddytls.SiteData, body []byte) {
+	cert, err := LeafCertificate(data.Cert)
+	if err != nil {
+		return
+	}
+	seen := map[string]bool{strings.ToLower(domain): true}
+	for _, name := range cert.DNSNames {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if head, err := s.headSite(name); err == nil {
+			cur, err := time.Parse(time.RFC3339, metadataValue(head.Metadata, certNotAfterMeta))
+			if err == nil && cur.After(cert.NotAfter) {
+				s.log().Infof("not sharing the certificate of %s with %s, which has one expiring later", domain, name)
+				continue
+			}
+		}
+		loc := s.routes.site(name)
+		var tagging string
+		if !s.noTagging {
+			tagging = certTagging(name, data.Cert)
+		}
+		written, err := s.putSharedSite(loc, body, certMetadata(data.Cert), tagging)
+		s.invalidate(loc.bucket, loc.key)
+		if err != nil {
+			s.log().Errorf("storing the certificate of %s for %s: %s", domain, name, err)
+			continue
+		}
+		if written {
+			s.publish(s.siteEvent(EventSiteStored, name, loc, data.Cert))
+		}
+	}
+}
+
+// copyBlob copies the blob the site stored at src refers to, if it's a
+// pointer of the shared layout, to the CA namespace of dst so the pointer
+// can be copied there.
+func (s *S3Storage) copyBlob(src, dst *location) error {
+	b, err := s.getObject(src.s3, src.bucket, src.key)
+	if isNotFound(err) {
+		// Left to copying the site, which reports it.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	alias, ok := parseSiteAlias(b)
+	if !ok || alias.blob == "" {
+		return nil
+	}
+	return s.copyObject(src.withKey(blobKey(src, alias.blob)), dst.withKey(blobKey(dst, alias.blob)))
+}
@@ -0,0 +1,122 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func blobKeys(client *fakes.S3, bucket, prefix string) []string {
+	var keys []string
+	for _, key := range client.Keys(bucket) {
+		if strings.HasPrefix(key, prefix+"blob/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestSharedLayout(t *testing.T) {
+	client := fakes.NewS3()
+	clock := &testClock{t: time.Now()}
+	storage := newFakeStorage(t, client, "shared-bucket", WithSiteLayout(SiteLayoutShared), WithClock(clock))
+
+	domains := []string{"example.com", "www.example.com", "api.example.com"}
+	certPEM, keyPEM := testCertificate(t, domains, clock.Now().Add(30*24*time.Hour))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+	blobs := blobKeys(client, "shared-bucket", "acme/ca/")
+	if len(blobs) != 1 {
+		t.Fatalf("Expected one blob, got %v", blobs)
+	}
+	for _, domain := range domains {
+		b, _ := client.Object("shared-bucket", "acme/ca/domain/"+domain)
+		if alias, ok := parseSiteAlias(b); !ok || "acme/ca/blob/"+alias.blob != blobs[0] {
+			t.Errorf("Expected %s to point at %s, got %s", domain, blobs[0], b)
+		}
+		data, err := storage.LoadSite(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data.Cert, certPEM) || !bytes.Equal(data.Key, keyPEM) {
+			t.Errorf("Expected the shared certificate for %s", domain)
+		}
+		if info, err := storage.StatSite(domain); err != nil || info.CertNotAfter.IsZero() {
+			t.Errorf("Expected the certificate metadata on the pointer of %s, got %+v, %v", domain, info, err)
+		}
+	}
+
+	// A renewal under any of the names is seen under all of them.
+	clock.Add(time.Hour)
+	renewedPEM, renewedKey := testCertificate(t, domains, clock.Now().Add(90*24*time.Hour))
+	if err := storage.StoreSite("www.example.com", &caddytls.SiteData{Cert: renewedPEM, Key: renewedKey}); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range domains {
+		if data, err := storage.LoadSite(domain); err != nil || !bytes.Equal(data.Cert, renewedPEM) {
+			t.Errorf("Expected the renewed certificate for %s, got %v", domain, err)
+		}
+	}
+	// A domain's own certificate expiring later isn't replaced by the next
+	// renewal of a certificate it's a name of.
+	ownPEM, ownKey := testCertificate(t, []string{"api.example.com"}, clock.Now().Add(120*24*time.Hour))
+	if err := storage.StoreSite("api.example.com", &caddytls.SiteData{Cert: ownPEM, Key: ownKey}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Hour)
+	renewedPEM, renewedKey = testCertificate(t, domains, clock.Now().Add(90*24*time.Hour))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: renewedPEM, Key: renewedKey}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.LoadSite("api.example.com"); err != nil || !bytes.Equal(data.Cert, ownPEM) {
+		t.Errorf("Expected the own certificate of api.example.com to be kept, got %v", err)
+	}
+	if data, err := storage.LoadSite("www.example.com"); err != nil || !bytes.Equal(data.Cert, renewedPEM) {
+		t.Errorf("Expected the renewed certificate for www.example.com, got %v", err)
+	}
+
+	// Copies to another CA namespace take the blob along.
+	if err := storage.CopySite("example.com", "ca", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := blobKeys(client, "shared-bucket", "acme/other/"); len(blobs) != 1 {
+		t.Fatalf("Expected the blob to be copied, got %v", blobs)
+	}
+	// Blobs no site refers to, of the first two certificates, are removed
+	// by CleanUp once they're old.
+	clock.Add(2 * time.Hour)
+	report, err := storage.CleanUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Blobs) != 2 {
+		t.Errorf("Expected the unused blobs to be deleted, got %v", report.Blobs)
+	}
+	remaining := blobKeys(client, "shared-bucket", "acme/ca/")
+	if len(remaining) != 2 {
+		t.Fatalf("Expected the blobs in use to remain, got %v", remaining)
+	}
+	if data, err := storage.LoadSite("example.com"); err != nil || !bytes.Equal(data.Cert, renewedPEM) {
+		t.Errorf("Expected the site to remain readable, got %v", err)
+	}
+	if !reflect.DeepEqual(report.Sites, []string(nil)) {
+		t.Errorf("Expected no sites to be deleted, got %v", report.Sites)
+	}
+}
+
+func TestSharedLayoutMissingBlob(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "shared-missing-bucket", WithSiteLayout(SiteLayoutShared))
+	client.SetObject("shared-missing-bucket", "acme/ca/domain/example.com", []byte(`{"schemaVersion":2,"blob":"00"}`), nil)
+	if _, err := storage.LoadSite("example.com"); err == nil {
+		t.Fatal("Expected an error for a missing blob")
+	} else if _, ok := err.(ErrCorruptData); !ok {
+		t.Fatalf("Expected ErrCorruptData, got %T %v", err, err)
+	}
+}
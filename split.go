@@ -0,0 +1,118 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// Site layouts, see Config.SiteLayout.
+const (
+	// SiteLayoutJSON stores the certificate, key, and metadata of a site
+	// as one JSON object, domain/<domain>, which is written atomically.
+	SiteLayoutJSON = "json"
+	// SiteLayoutSplit stores them as three objects, domain/<domain>/cert.pem,
+	// key.pem, and meta.json, which other tools can read directly and IAM
+	// policies can grant access to separately.
+	SiteLayoutSplit = "split"
+	// SiteLayoutShared stores the JSON object once per certificate as a
+	// blob, blob/<sha256>, and domain/<domain> of each of its domains as a
+	// small pointer to it, so certificates with many names are stored once
+	// and a renewal under one name is seen under all of them.
+	SiteLayoutShared = "shared"
+)
+
+// Objects of a site in the split layout. The certificate carries the
+// metadata of the site and is written first, with the same conditions as
+// the JSON object.
+const (
+	splitCert = "cert.pem"
+	splitKey  = "key.pem"
+	splitMeta = "meta.json"
+)
+
+// splitPart returns the location of an object of the split layout of the
+// site stored at l.
+func (l *location) splitPart(name string) *location {
+	return l.withKey(l.key + "/" + name)
+}
+
+// loadSplitSite reads the site stored at loc in the split layout. A missing
+// certificate is reported as not found; a missing key as an error since the
+// site was only partly written. The metadata is optional.
+func (s *S3Storage) loadSplitSite(loc *location) (*caddytls.SiteData, error) {
+	data := new(caddytls.SiteData)
+	for _, part := range []struct {
+		name string
+		dst  *[]byte
+	}{
+		{splitCert, &data.Cert},
+		{splitKey, &data.Key},
+		{splitMeta, &data.Meta},
+	} {
+		l := loc.splitPart(part.name)
+		b, err := s.getObject(l.s3, l.bucket, l.key)
+		switch {
+		case err == nil:
+			*part.dst = b
+		case part.name == splitMeta && isNotFound(err):
+		case part.name == splitKey && isNotFound(err):
+			return nil, fmt.Errorf("S3Storage: s3://%s/%s has a certificate but no key", loc.bucket, loc.key)
+		default:
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// putSplitSite writes a site in the split layout, and returns whether it
+// was written. The certificate is written first under the same conditions
+// as putSite, followed by the key and the metadata, so other hosts may
+// briefly read a new certificate with the previous key.
+func (s *S3Storage) putSplitSite(loc *location, data *caddytls.SiteData, meta map[string]*string, tagging string) (bool, error) {
+	cert := loc.splitPart(splitCert)
+	written, err := s.putSite(cert, data.Cert, contentTypePEM, meta, tagging)
+	s.invalidate(cert.bucket, cert.key)
+	if err != nil || !written {
+		return written, err
+	}
+	for _, part := range []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{splitKey, contentTypePEM, data.Key},
+		{splitMeta, contentTypeJSON, data.Meta},
+	} {
+		l := loc.splitPart(part.name)
+		if len(part.body) == 0 && part.name == splitMeta {
+			err = s.deleteObject(l.s3, &s3.DeleteObjectInput{Bucket: &l.bucket, Key: &l.key})
+		} else {
+			err = s.putObject(l.s3, l.encrypt(&s3.PutObjectInput{
+				Bucket:        &l.bucket,
+				Key:           &l.key,
+				Body:          bytes.NewReader(part.body),
+				ContentLength: aws.Int64(int64(len(part.body))),
+				ContentType:   aws.String(part.contentType),
+			}))
+		}
+		s.invalidate(l.bucket, l.key)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// deleteSplitSite deletes the objects of the site stored at loc in the
+// split layout with a single DeleteObjects request.
+func (s *S3Storage) deleteSplitSite(loc *location) error {
+	var keys []string
+	for _, name := range []string{splitCert, splitKey, splitMeta} {
+		keys = append(keys, loc.splitPart(name).key)
+	}
+	return s.deleteKeys(loc.s3, loc.bucket, keys)
+}
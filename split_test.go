@@ -0,0 +1,69 @@
+package caddytlss3
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestSplitLayout(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "bucket", WithSiteLayout(SiteLayoutSplit))
+
+	// Sites stored in the JSON layout remain readable.
+	old, _ := json.Marshal(&caddytls.SiteData{Cert: []byte("old"), Key: []byte("key")})
+	client.SetObject("bucket", "acme/ca/domain/old.example.com", old, nil)
+	if data, err := storage.LoadSite("old.example.com"); err != nil || string(data.Cert) != "old" {
+		t.Fatalf("Expected the JSON site, got %v, %v", data, err)
+	}
+
+	certPEM, keyPEM := testCertificate(t, []string{"example.com"}, time.Now().Add(90*24*time.Hour))
+	site := &caddytls.SiteData{Cert: certPEM, Key: keyPEM, Meta: []byte(`{"renewed":true}`)}
+	if err := storage.StoreSite("example.com", site); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{"cert.pem": certPEM, "key.pem": keyPEM, "meta.json": site.Meta} {
+		if b, ok := client.Object("bucket", "acme/ca/domain/example.com/"+name); !ok || string(b) != string(want) {
+			t.Errorf("Expected %s to be stored, got %q", name, b)
+		}
+	}
+	if _, ok := client.Object("bucket", "acme/ca/domain/example.com"); ok {
+		t.Error("Expected no JSON object")
+	}
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(data, site) {
+		t.Errorf("Expected %+v, got %+v", site, data)
+	}
+	if ok, err := storage.SiteExists("example.com"); err != nil || !ok {
+		t.Errorf("Expected the site to exist, got %t, %v", ok, err)
+	}
+	if info, err := storage.StatSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if info.CertNotAfter.IsZero() {
+		t.Error("Expected the certificate metadata on cert.pem")
+	}
+	if names, err := storage.ListSites(); err != nil {
+		t.Fatal(err)
+	} else if exp := []string{"example.com", "old.example.com"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("Expected sites %v, got %v", exp, names)
+	}
+
+	// A certificate without a key is an error rather than a missing site.
+	client.SetObject("bucket", "acme/ca/domain/partial.example.com/cert.pem", certPEM, nil)
+	if _, err := storage.LoadSite("partial.example.com"); err == nil || !strings.Contains(err.Error(), "no key") {
+		t.Errorf("Expected an error for a partly written site, got %v", err)
+	}
+
+	if err := storage.DeleteSite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := client.Keys("bucket"); len(keys) != 2 {
+		t.Errorf("Expected only the other sites to be left, got %v", keys)
+	}
+}
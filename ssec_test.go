@@ -0,0 +1,80 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestSSECustomerHandler(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, sseCustomerKeySize)
+	h := sseCustomerHandler(key)
+
+	get := &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}
+	h.Fn(&request.Request{Params: get})
+	if aws.StringValue(get.SSECustomerAlgorithm) != "AES256" || aws.StringValue(get.SSECustomerKey) != string(key) {
+		t.Errorf("Expected the customer key on reads, got %+v", get)
+	}
+	head := &s3.HeadObjectInput{}
+	h.Fn(&request.Request{Params: head})
+	if aws.StringValue(head.SSECustomerKey) != string(key) {
+		t.Error("Expected the customer key on HEAD requests")
+	}
+	put := &s3.PutObjectInput{}
+	h.Fn(&request.Request{Params: put})
+	if aws.StringValue(put.SSECustomerKey) != string(key) {
+		t.Error("Expected the customer key on writes")
+	}
+	put = &s3.PutObjectInput{ServerSideEncryption: aws.String(SSEKMS)}
+	h.Fn(&request.Request{Params: put})
+	if put.SSECustomerKey != nil {
+		t.Error("Expected writes with another encryption mode to be left alone")
+	}
+	cp := &s3.CopyObjectInput{}
+	h.Fn(&request.Request{Params: cp})
+	if aws.StringValue(cp.SSECustomerKey) != string(key) || aws.StringValue(cp.CopySourceSSECustomerKey) != string(key) {
+		t.Error("Expected the customer key for both sides of copies")
+	}
+	h.Fn(&request.Request{Params: &s3.DeleteObjectInput{}})
+}
+
+func TestConfiguredCustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, sseCustomerKeySize)
+	defer os.Unsetenv("CADDY_S3_SSE_CUSTOMER_KEY")
+	defer os.Unsetenv("CADDY_S3_SSE_CUSTOMER_KEY_FILE")
+
+	if k, err := configuredCustomerKey(); err != nil || k != nil {
+		t.Fatalf("Expected no key, got %v, %v", k, err)
+	}
+	os.Setenv("CADDY_S3_SSE_CUSTOMER_KEY", base64.StdEncoding.EncodeToString(key))
+	if k, err := configuredCustomerKey(); err != nil || !bytes.Equal(k, key) {
+		t.Fatalf("Expected the key from the environment, got %v, %v", k, err)
+	}
+	os.Unsetenv("CADDY_S3_SSE_CUSTOMER_KEY")
+
+	dir, err := ioutil.TempDir("", "ssec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string][]byte{
+		"raw":    key,
+		"base64": []byte(base64.StdEncoding.EncodeToString(key) + "\n"),
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CADDY_S3_SSE_CUSTOMER_KEY_FILE", path)
+		if k, err := configuredCustomerKey(); err != nil || !bytes.Equal(k, key) {
+			t.Errorf("%s: expected the key from the file, got %v, %v", name, k, err)
+		}
+	}
+}
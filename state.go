@@ -0,0 +1,14 @@
+package caddytlss3
+
+import "sync"
+
+// requestLimiters are the request limiters by limits. They're shared by
+// all S3Storage instances of the process since Caddy constructs storage
+// instances on demand, including whenever its configuration is reloaded,
+// so limiters kept on an instance would be duplicated. Instances with the
+// same limits share a budget, while instances with different limits don't
+// interfere.
+var requestLimiters = struct {
+	sync.Mutex
+	m map[RequestLimits]*requestLimits
+}{m: make(map[RequestLimits]*requestLimits)}
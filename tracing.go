@@ -0,0 +1,89 @@
+package caddytlss3
+
+import (
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of S3 requests.
+const tracerName = "github.com/sprucehealth/caddytlss3"
+
+// tracingHandlers returns the request handlers that start a span for each
+// S3 request before it's validated, and end it once the request, including
+// its retries, is complete, so the span covers waiting for request limits
+// and retries.
+func tracingHandlers(tracer trace.Tracer) (start, end request.NamedHandler) {
+	start = request.NamedHandler{
+		Name: "caddytlss3.StartSpan",
+		Fn: func(r *request.Request) {
+			op := operationName(r)
+			attrs := []attribute.KeyValue{
+				attribute.String("rpc.system", "aws-api"),
+				attribute.String("rpc.service", "S3"),
+				attribute.String("rpc.method", op),
+			}
+			if bucket := paramString(r.Params, "Bucket"); bucket != "" {
+				attrs = append(attrs, attribute.String("aws.s3.bucket", bucket))
+			}
+			if key := paramString(r.Params, "Key"); key != "" {
+				attrs = append(attrs, attribute.String("aws.s3.key", key))
+			}
+			ctx, _ := tracer.Start(r.Context(), "S3."+op,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attrs...))
+			r.SetContext(ctx)
+		},
+	}
+	end = request.NamedHandler{
+		Name: "caddytlss3.EndSpan",
+		Fn: func(r *request.Request) {
+			span := trace.SpanFromContext(r.Context())
+			if r.RequestID != "" {
+				span.SetAttributes(attribute.String("aws.request_id", r.RequestID))
+			}
+			span.SetAttributes(attribute.Int("aws.retry_count", r.RetryCount))
+			if r.HTTPResponse != nil {
+				span.SetAttributes(attribute.Int("http.response.status_code", r.HTTPResponse.StatusCode))
+			}
+			if r.Error != nil {
+				if e, ok := r.Error.(awserr.Error); ok {
+					span.SetAttributes(attribute.String("aws.error_code", e.Code()))
+				}
+				span.RecordError(r.Error)
+				span.SetStatus(codes.Error, r.Error.Error())
+			}
+			span.End()
+		},
+	}
+	return start, end
+}
+
+func operationName(r *request.Request) string {
+	if r.Operation == nil {
+		return ""
+	}
+	return r.Operation.Name
+}
+
+// paramString returns the string field of the input of a request, e.g. the
+// Bucket or Key of an S3 input, or "" if the input has no such field.
+func paramString(params interface{}, field string) string {
+	v := reflect.ValueOf(params)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ""
+	}
+	v = v.Elem()
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	f := v.FieldByName(field)
+	if !f.IsValid() || f.Type() != reflect.TypeOf((*string)(nil)) || f.IsNil() {
+		return ""
+	}
+	return f.Elem().String()
+}
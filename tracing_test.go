@@ -0,0 +1,126 @@
+package caddytlss3
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type recordingTracer struct {
+	trace.Tracer
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	span := &recordingSpan{name: name, kind: cfg.Kind, attrs: map[attribute.Key]interface{}{}}
+	span.SetAttributes(cfg.Attributes...)
+	t.spans = append(t.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	trace.Span
+	name   string
+	kind   trace.SpanKind
+	attrs  map[attribute.Key]interface{}
+	err    error
+	status codes.Code
+	ended  bool
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value.AsInterface()
+	}
+}
+
+func (s *recordingSpan) RecordError(err error, _ ...trace.EventOption) { s.err = err }
+func (s *recordingSpan) SetStatus(code codes.Code, _ string)           { s.status = code }
+func (s *recordingSpan) End(...trace.SpanEndOption)                    { s.ended = true }
+
+func TestTracingHandlers(t *testing.T) {
+	tracer := &recordingTracer{}
+	start, end := tracingHandlers(tracer)
+
+	r := &request.Request{
+		Operation: &request.Operation{Name: "GetObject"},
+		Params:    &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("acme/ca/sites/example.com")},
+	}
+	start.Fn(r)
+	if len(tracer.spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if trace.SpanFromContext(r.Context()) != trace.Span(span) {
+		t.Fatal("Expected the span in the request context")
+	}
+	r.RequestID = "req-1"
+	r.RetryCount = 2
+	r.HTTPResponse = &http.Response{StatusCode: http.StatusNotFound}
+	r.Error = awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	end.Fn(r)
+
+	if span.name != "S3.GetObject" || span.kind != trace.SpanKindClient {
+		t.Errorf("Expected a client span S3.GetObject, got %s (%d)", span.name, span.kind)
+	}
+	want := map[attribute.Key]interface{}{
+		"rpc.system":                "aws-api",
+		"rpc.service":               "S3",
+		"rpc.method":                "GetObject",
+		"aws.s3.bucket":             "bucket",
+		"aws.s3.key":                "acme/ca/sites/example.com",
+		"aws.request_id":            "req-1",
+		"aws.retry_count":           int64(2),
+		"http.response.status_code": int64(http.StatusNotFound),
+		"aws.error_code":            s3.ErrCodeNoSuchKey,
+	}
+	for k, v := range want {
+		if span.attrs[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, span.attrs[k])
+		}
+	}
+	if !span.ended || span.status != codes.Error || span.err == nil {
+		t.Errorf("Expected an ended span with an error, got ended=%t status=%d err=%v", span.ended, span.status, span.err)
+	}
+}
+
+func TestTracingHandlersNoKey(t *testing.T) {
+	tracer := &recordingTracer{}
+	start, end := tracingHandlers(tracer)
+	r := &request.Request{
+		Operation: &request.Operation{Name: "ListObjectsV2"},
+		Params:    &s3.ListObjectsV2Input{Bucket: aws.String("bucket")},
+	}
+	start.Fn(r)
+	end.Fn(r)
+	span := tracer.spans[0]
+	if _, ok := span.attrs["aws.s3.key"]; ok {
+		t.Error("Expected no key attribute for a listing")
+	}
+	if span.status != codes.Unset || span.err != nil {
+		t.Errorf("Expected no error, got status=%d err=%v", span.status, span.err)
+	}
+	if !span.ended {
+		t.Error("Expected the span to have ended")
+	}
+}
+
+func TestParamString(t *testing.T) {
+	for _, params := range []interface{}{nil, "bucket", &s3.HeadBucketInput{}, struct{ Bucket *string }{aws.String("bucket")}} {
+		if got := paramString(params, "Bucket"); got != "" {
+			t.Errorf("paramString(%#v) = %q, want empty", params, got)
+		}
+	}
+	if got := paramString(&s3.HeadBucketInput{Bucket: aws.String("bucket")}, "Bucket"); got != "bucket" {
+		t.Errorf("Expected bucket, got %q", got)
+	}
+}
@@ -0,0 +1,87 @@
+package caddytlss3
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Account key types. Accounts are stored per key type so that changing
+// the account key algorithm doesn't overwrite the existing account.
+const (
+	keyTypeECDSA = "ecdsa"
+	keyTypeRSA   = "rsa"
+)
+
+var defaultAccountKeyTypes = []string{keyTypeECDSA, keyTypeRSA}
+
+// parseAccountKeyTypes returns the lookup order of account key types with
+// the preferred type (if any) first.
+func parseAccountKeyTypes(preferred string) ([]string, error) {
+	preferred = strings.ToLower(preferred)
+	switch preferred {
+	case "":
+		return defaultAccountKeyTypes, nil
+	case keyTypeECDSA:
+		return []string{keyTypeECDSA, keyTypeRSA}, nil
+	case keyTypeRSA:
+		return []string{keyTypeRSA, keyTypeECDSA}, nil
+	}
+	return nil, fmt.Errorf("unknown key type %q", preferred)
+}
+
+// accountKeyType returns the type of the PEM encoded private key, or an
+// empty string if it can't be determined.
+func accountKeyType(key []byte) string {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return ""
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return keyTypeRSA
+	case "EC PRIVATE KEY":
+		return keyTypeECDSA
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return ""
+		}
+		switch k.(type) {
+		case *rsa.PrivateKey:
+			return keyTypeRSA
+		case *ecdsa.PrivateKey:
+			return keyTypeECDSA
+		}
+	}
+	return ""
+}
+
+func (s *S3Storage) typedUserKey(email, keyType string) *string {
+	return aws.String(aws.StringValue(s.userKey(email)) + "/" + keyType)
+}
+
+// userKeys returns the keys under which the account for email may be
+// stored, in lookup order. The untyped key is used for accounts stored
+// before accounts were split by key type, and the unescaped keys for
+// accounts stored before emails were escaped.
+func (s *S3Storage) userKeys(email string) []*string {
+	keys := make([]*string, 0, 2*(len(s.accountKeyTypes)+1))
+	for _, kt := range s.accountKeyTypes {
+		keys = append(keys, s.typedUserKey(email, kt))
+	}
+	keys = append(keys, s.userKey(email))
+	if name, ok := legacyName(email); ok {
+		legacy := s.userPrefix() + name
+		for _, kt := range s.accountKeyTypes {
+			keys = append(keys, aws.String(legacy+"/"+kt))
+		}
+		keys = append(keys, aws.String(legacy))
+	}
+	return keys
+}
@@ -0,0 +1,141 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// validated records the bucket and prefix combinations that have passed
+// Validate so the round trip only runs once per process.
+var (
+	validatedMu sync.Mutex
+	validated   = make(map[string]bool)
+)
+
+// Validate checks that the storage can be used before Caddy relies on it:
+// every bucket must exist, and a probe object must be writable, readable,
+// and deletable under every prefix. Errors name the IAM permissions that
+// are missing. Dry runs and read-only storage only check that the buckets
+// exist.
+func (s *S3Storage) Validate() error {
+	for _, loc := range s.routes.roots() {
+		id := loc.bucket + "/" + loc.prefix
+		validatedMu.Lock()
+		ok := validated[id]
+		validatedMu.Unlock()
+		if ok {
+			continue
+		}
+		if err := s.validateLocation(loc); err != nil {
+			return err
+		}
+		validatedMu.Lock()
+		validated[id] = true
+		validatedMu.Unlock()
+	}
+	return nil
+}
+
+func (s *S3Storage) validateLocation(loc *location) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	bucketARN := s.arn(loc.bucket)
+	if _, err := loc.s3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: &loc.bucket}); err != nil {
+		if isNotFound(err) || isCode(err, s3.ErrCodeNoSuchBucket) {
+			return ErrBucketNotFound{Bucket: loc.bucket, RequestID: requestID(err), Err: err}
+		}
+		return permissionError("HeadBucket", loc.bucket, "", bucketARN, []string{"s3:ListBucket"}, err)
+	}
+	if s.dryRun || s.readOnly {
+		return nil
+	}
+
+	var b [8]byte
+	rand.Read(b[:])
+	probe := "probe-" + hex.EncodeToString(b[:])
+	key := loc.prefix + "probe/" + probe
+	objectARN := bucketARN + "/" + loc.prefix + "*"
+	kms := loc.sse == SSEKMS || loc.kmsKeyID != ""
+
+	perms := []string{"s3:PutObject"}
+	in := loc.encrypt(&s3.PutObjectInput{
+		Bucket:        &loc.bucket,
+		Key:           &key,
+		Body:          strings.NewReader(probe),
+		ContentLength: aws.Int64(int64(len(probe))),
+	})
+	if !s.noTagging {
+		// Site objects are tagged, so check that tagging is allowed too.
+		in.Tagging = aws.String(url.Values{domainTag: {probe}}.Encode())
+		perms = append(perms, "s3:PutObjectTagging")
+	}
+	if kms {
+		perms = append(perms, "kms:GenerateDataKey")
+	}
+	if in.ACL = s.cannedACL(); in.ACL != nil {
+		perms = append(perms, "s3:PutObjectAcl")
+	}
+	if _, err := loc.s3.PutObjectWithContext(ctx, in); err != nil {
+		return permissionError("PutObject", loc.bucket, key, objectARN, perms, err)
+	}
+
+	perms = []string{"s3:GetObject"}
+	if kms {
+		perms = append(perms, "kms:Decrypt")
+	}
+	res, err := loc.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &loc.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return permissionError("GetObject", loc.bucket, key, objectARN, perms, err)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("S3Storage: reading probe object s3://%s/%s: %s", loc.bucket, key, err)
+	}
+	if !bytes.Equal(data, []byte(probe)) {
+		return fmt.Errorf("S3Storage: probe object s3://%s/%s read back different content", loc.bucket, key)
+	}
+
+	if _, err := loc.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &loc.bucket,
+		Key:    &key,
+	}); err != nil {
+		return permissionError("DeleteObject", loc.bucket, key, objectARN, []string{"s3:DeleteObject"}, err)
+	}
+	return nil
+}
+
+// permissionError describes a failed validation request on the object at
+// bucket/key, naming the permissions required on resource if access was
+// denied.
+func permissionError(op, bucket, key, resource string, perms []string, err error) error {
+	if isAccessDenied(err) {
+		return ErrAccessDenied{
+			Op:        op,
+			Bucket:    bucket,
+			Key:       key,
+			RequestID: requestID(err),
+			Err:       err,
+			hint:      "grant " + strings.Join(perms, " and ") + " on " + resource,
+		}
+	}
+	return fmt.Errorf("S3Storage: %s on %s: %s", op, resource, err)
+}
+
+func isCode(err error, code string) bool {
+	e, ok := err.(awserr.Error)
+	return ok && e.Code() == code
+}
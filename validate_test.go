@@ -0,0 +1,92 @@
+package caddytlss3
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+// readOnlyS3 denies writes like a bucket policy without s3:PutObject.
+type readOnlyS3 struct {
+	*fakes.S3
+}
+
+func (readOnlyS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "")
+}
+
+// noListS3 denies reads of missing objects like a bucket policy without
+// s3:ListBucket.
+type noListS3 struct {
+	*fakes.S3
+}
+
+func (f noListS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	res, err := f.S3.HeadObjectWithContext(ctx, in, opts...)
+	if isNotFound(err) {
+		return nil, awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "req-1")
+	}
+	return res, err
+}
+
+func (f noListS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	res, err := f.S3.GetObjectWithContext(ctx, in, opts...)
+	if isNotFound(err) {
+		return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "req-1")
+	}
+	return res, err
+}
+
+func TestValidate(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "validate-bucket", WithPrefix("caddy"), WithSSE(SSEKMS, ""))
+	if err := storage.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := client.Keys("validate-bucket"); len(keys) != 0 {
+		t.Fatalf("Expected the probe object to be deleted, found %v", keys)
+	}
+
+	storage = newFakeStorage(t, readOnlyS3{fakes.NewS3()}, "read-only-bucket", WithPrefix("caddy"), WithSSE(SSEKMS, ""))
+	err := storage.Validate()
+	if err == nil {
+		t.Fatal("Expected an error for a read-only bucket")
+	}
+	for _, s := range []string{"s3:PutObject", "kms:GenerateDataKey", "arn:aws:s3:::read-only-bucket/caddy/*"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Expected %q in error %q", s, err)
+		}
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+	storage := newFakeStorage(t, noListS3{fakes.NewS3()}, "bucket")
+	for name, fn := range map[string]func() error{
+		"SiteExists": func() error { _, err := storage.SiteExists("example.com"); return err },
+		"StatSite":   func() error { _, err := storage.StatSite("example.com"); return err },
+		"LoadSite":   func() error { _, err := storage.LoadSite("example.com"); return err },
+		"LoadUser":   func() error { _, err := storage.LoadUser("user@example.com"); return err },
+	} {
+		err := fn()
+		if e, ok := err.(ErrAccessDenied); !ok || e.Bucket != "bucket" || e.RequestID != "req-1" {
+			t.Errorf("%s: expected ErrAccessDenied, got %#v", name, err)
+			continue
+		}
+		for _, s := range []string{"s3:GetObject on arn:aws:s3:::bucket/acme/", "s3:ListBucket on arn:aws:s3:::bucket ", "req-1"} {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%s: expected %q in error %q", name, s, err)
+			}
+		}
+	}
+
+	storage.assumeExists = true
+	if exists, err := storage.SiteExists("example.com"); err != nil || !exists {
+		t.Errorf("Expected a denied site to be assumed to exist, got %t, %v", exists, err)
+	}
+}
@@ -0,0 +1,37 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// verifyAttempts bounds the reads made to confirm a write, which are
+// spaced by verifyDelay, doubled after each attempt.
+const (
+	verifyAttempts = 3
+	verifyDelay    = 100 * time.Millisecond
+)
+
+// verifyWrite reads an object back from the bucket it was written to and
+// compares it with data, so a write that was lost or is not yet visible
+// isn't reported as stored. Reads bypass the cache, mirror, and replica.
+func (s *S3Storage) verifyWrite(loc *location, data []byte) error {
+	var err error
+	for attempt := 0; attempt < verifyAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(verifyDelay << uint(attempt-1))
+		}
+		var stored []byte
+		stored, err = s.fetchFrom(loc.s3, loc.bucket, loc.key, 0)
+		if err == nil && bytes.Equal(stored, data) {
+			return nil
+		}
+		if err == nil {
+			err = errors.New("the stored object differs from the one written")
+		}
+		s.log().Debugf("verifying write of s3://%s/%s (attempt %d): %s", loc.bucket, loc.key, attempt+1, err)
+	}
+	return fmt.Errorf("S3Storage: could not confirm the write of s3://%s/%s: %s", loc.bucket, loc.key, err)
+}
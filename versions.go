@@ -0,0 +1,176 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// SiteVersion describes a version of the site data of a domain in a bucket
+// with versioning enabled. Buckets without versioning have a single
+// version with the ID "null".
+type SiteVersion struct {
+	VersionID    string
+	LastModified time.Time
+	Size         int64
+	IsLatest     bool
+	// DeleteMarker is set for versions recording a delete, which have no
+	// data.
+	DeleteMarker bool
+}
+
+// ListSiteVersions returns the versions of the site data for domain, the
+// most recent first.
+func (s *S3Storage) ListSiteVersions(domain string) ([]SiteVersion, error) {
+	loc := s.routes.site(domain)
+	ctx, cancel := s.opContext()
+	defer cancel()
+	var versions []SiteVersion
+	err := loc.s3.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: &loc.bucket,
+		Prefix: &loc.key,
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		// The prefix also matches longer keys, e.g. example.com.au for
+		// example.com.
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) == loc.key {
+				versions = append(versions, SiteVersion{
+					VersionID:    aws.StringValue(v.VersionId),
+					LastModified: aws.TimeValue(v.LastModified),
+					Size:         aws.Int64Value(v.Size),
+					IsLatest:     aws.BoolValue(v.IsLatest),
+				})
+			}
+		}
+		for _, m := range page.DeleteMarkers {
+			if aws.StringValue(m.Key) == loc.key {
+				versions = append(versions, SiteVersion{
+					VersionID:    aws.StringValue(m.VersionId),
+					LastModified: aws.TimeValue(m.LastModified),
+					IsLatest:     aws.BoolValue(m.IsLatest),
+					DeleteMarker: true,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].IsLatest != versions[j].IsLatest {
+			return versions[i].IsLatest
+		}
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, nil
+}
+
+// LoadSiteVersion loads a version of the site data for domain. If the
+// version does not exist an error of type ErrNotExist is returned.
+func (s *S3Storage) LoadSiteVersion(domain, versionID string) (*caddytls.SiteData, error) {
+	loc := s.routes.site(domain)
+	ctx, cancel := s.opContext()
+	defer cancel()
+	res, err := loc.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    &loc.bucket,
+		Key:       &loc.key,
+		VersionId: &versionID,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, caddytls.ErrNotExist(err)
+		}
+		return nil, err
+	}
+	b, err := readObject(res, loc.bucket, loc.key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := unmarshalSite(loc.bucket, loc.key, b)
+	if alias, ok := err.(errSiteAlias); ok && alias.blob != "" {
+		return s.loadBlob(loc, alias.blob)
+	}
+	return data, err
+}
+
+// recoverSite returns the most recent previous version of the site data
+// for domain that is valid after the latest version failed to decode with
+// decodeErr, e.g. because it was truncated. The corrupted version is left
+// in place for inspection. decodeErr is returned if the bucket isn't
+// versioned or no valid version is found.
+func (s *S3Storage) recoverSite(domain string, decodeErr error) (*caddytls.SiteData, error) {
+	versions, err := s.ListSiteVersions(domain)
+	if err != nil {
+		s.log().Errorf("listing versions of %s to recover from corrupted site data: %s", domain, err)
+		return nil, decodeErr
+	}
+	for _, v := range versions {
+		if v.IsLatest || v.DeleteMarker {
+			continue
+		}
+		data, err := s.LoadSiteVersion(domain, v.VersionID)
+		if err != nil || !validSiteData(data) {
+			continue
+		}
+		s.log().Warnf("site data of %s is corrupted (%s), using version %s from %s; restore it with RestoreSiteVersion",
+			domain, decodeErr, v.VersionID, v.LastModified)
+		return data, nil
+	}
+	s.log().Errorf("site data of %s is corrupted and no valid previous version was found: %s", domain, decodeErr)
+	return nil, decodeErr
+}
+
+// validSiteData returns true if data has a certificate that parses, or no
+// certificate at all.
+func validSiteData(data *caddytls.SiteData) bool {
+	if data == nil {
+		return false
+	}
+	if len(data.Cert) == 0 {
+		return true
+	}
+	_, err := LeafCertificate(data.Cert)
+	return err == nil
+}
+
+// RestoreSiteVersion rolls the site data for domain back to a previous
+// version, e.g. after a bad renewal, by storing it as the latest version.
+func (s *S3Storage) RestoreSiteVersion(domain, versionID string) error {
+	if s.readOnly {
+		return ErrReadOnly{Op: "RestoreSiteVersion", Name: domain}
+	}
+	data, err := s.LoadSiteVersion(domain, versionID)
+	if err != nil {
+		return err
+	}
+	jsonData, err := marshalSite(data)
+	if err != nil {
+		return err
+	}
+	loc := s.routes.site(domain)
+	in := loc.encrypt(&s3.PutObjectInput{
+		Bucket:        &loc.bucket,
+		Key:           &loc.key,
+		Body:          bytes.NewReader(jsonData),
+		ContentLength: aws.Int64(int64(len(jsonData))),
+		Metadata:      certMetadata(data.Cert),
+	})
+	if !s.noTagging {
+		in.Tagging = aws.String(certTagging(domain, data.Cert))
+	}
+	err = s.putObject(loc.s3, in)
+	s.invalidate(loc.bucket, loc.key)
+	if err != nil {
+		return err
+	}
+	s.log().Infof("restored s3://%s/%s to version %s", loc.bucket, loc.key, versionID)
+	if !s.dryRun {
+		s.storeMirror(loc.bucket, loc.key, jsonData)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package caddytlss3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// versionedS3 is an in-memory bucket with versioning enabled.
+type versionedS3 struct {
+	s3iface.S3API
+	mu       sync.Mutex
+	versions map[string][]objectVersion // oldest first
+	clock    *testClock
+}
+
+type objectVersion struct {
+	id       string
+	data     []byte
+	modified time.Time
+}
+
+func (v *versionedS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.clock.Add(time.Second)
+	id := strconv.Itoa(len(v.versions[*in.Key]) + 1)
+	v.versions[*in.Key] = append(v.versions[*in.Key], objectVersion{id: id, data: b, modified: v.clock.Now()})
+	return &s3.PutObjectOutput{VersionId: &id}, nil
+}
+
+func (v *versionedS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), http.StatusNotFound, "")
+}
+
+func (v *versionedS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vs := v.versions[*in.Key]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if in.VersionId == nil || *in.VersionId == vs[i].id {
+			return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(vs[i].data)), VersionId: aws.String(vs[i].id)}, nil
+		}
+	}
+	return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "not found", nil), http.StatusNotFound, "")
+}
+
+func (v *versionedS3) ListObjectVersionsPagesWithContext(ctx aws.Context, in *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, opts ...request.Option) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := &s3.ListObjectVersionsOutput{}
+	for key, vs := range v.versions {
+		if len(key) < len(*in.Prefix) || key[:len(*in.Prefix)] != *in.Prefix {
+			continue
+		}
+		for i := len(vs) - 1; i >= 0; i-- {
+			out.Versions = append(out.Versions, &s3.ObjectVersion{
+				Key:          aws.String(key),
+				VersionId:    aws.String(vs[i].id),
+				LastModified: aws.Time(vs[i].modified),
+				Size:         aws.Int64(int64(len(vs[i].data))),
+				IsLatest:     aws.Bool(i == len(vs)-1),
+			})
+		}
+	}
+	fn(out, true)
+	return nil
+}
+
+func TestSiteVersions(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	client := &versionedS3{versions: make(map[string][]objectVersion), clock: clock}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+
+	for _, meta := range []string{"good", "bad"} {
+		if err := storage.StoreSite("example.com", &caddytls.SiteData{Meta: []byte(meta)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.StoreSite("example.com.au", &caddytls.SiteData{Meta: []byte("other")}); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := storage.ListSiteVersions("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].VersionID != "2" || !versions[0].IsLatest || versions[1].VersionID != "1" {
+		t.Fatalf("Unexpected versions %+v", versions)
+	}
+
+	data, err := storage.LoadSiteVersion("example.com", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data.Meta) != "good" {
+		t.Fatalf("Expected the first version, got %q", data.Meta)
+	}
+	if _, err := storage.LoadSiteVersion("example.com", "9"); err == nil {
+		t.Fatal("Expected error for a missing version")
+	} else if _, ok := err.(caddytls.ErrNotExist); !ok {
+		t.Fatalf("Expected ErrNotExist, got %T", err)
+	}
+
+	if err := storage.RestoreSiteVersion("example.com", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.LoadSite("example.com"); err != nil {
+		t.Fatal(err)
+	} else if string(data.Meta) != "good" {
+		t.Fatalf("Expected the restored version, got %q", data.Meta)
+	}
+	if versions, err := storage.ListSiteVersions("example.com"); err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 3 {
+		t.Fatalf("Expected the restore to add a version, got %+v", versions)
+	}
+}
+
+func TestCorruptedSiteRecovery(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	client := &versionedS3{versions: make(map[string][]objectVersion), clock: clock}
+	storage := newFakeStorage(t, client, "bucket", WithClock(clock))
+
+	certPEM, keyPEM := testCertificate(t, []string{"example.com"}, time.Now().Add(time.Hour))
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+	// A version with an invalid certificate is skipped too.
+	if err := storage.StoreSite("example.com", &caddytls.SiteData{Cert: []byte("invalid"), Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+	key := siteKey("acme/ca/", "example.com")
+	if _, err := client.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{Key: &key, Body: bytes.NewReader([]byte(`{"Cert":`))}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := storage.LoadSite("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data.Cert, certPEM) {
+		t.Fatal("Expected the last valid version")
+	}
+
+	client.versions[key] = client.versions[key][2:]
+	if _, err := storage.LoadSite("example.com"); err == nil {
+		t.Fatal("Expected a decode error without a valid previous version")
+	}
+}
@@ -0,0 +1,149 @@
+package caddytlss3
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// watchers are the running watchers by bucket and CA namespace, so each
+// namespace is polled once per process no matter how many instances Caddy
+// constructs.
+var (
+	watchersMu sync.Mutex
+	watchers   = make(map[string]*watcher)
+)
+
+// watcher polls the listing of the sites of a CA namespace to detect sites
+// changed by other hosts or by operators, for deployments without an
+// invalidation queue.
+type watcher struct {
+	s        *S3Storage
+	id       string
+	interval time.Duration
+	onChange func(domain string)
+	// etags are the ETags of the listed site objects by domain.
+	etags map[string]watchedSite
+
+	// refs counts the open instances using the watcher.
+	refs int
+	stop chan struct{}
+	done chan struct{}
+}
+
+type watchedSite struct {
+	bucket, key, etag string
+}
+
+// startWatch polls the sites every interval until the storage is closed,
+// starting a watcher unless another instance already did.
+func (s *S3Storage) startWatch(interval time.Duration, onChange func(domain string)) {
+	id := s.bucket + "/" + s.prefix
+	watchersMu.Lock()
+	w, ok := watchers[id]
+	if !ok {
+		w = &watcher{
+			s:        s,
+			id:       id,
+			interval: interval,
+			onChange: onChange,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		watchers[id] = w
+		go w.run()
+	}
+	w.refs++
+	watchersMu.Unlock()
+	s.onClose(w.release)
+}
+
+// release stops the watcher once no open instance uses it.
+func (w *watcher) release() error {
+	watchersMu.Lock()
+	w.refs--
+	if w.refs > 0 {
+		watchersMu.Unlock()
+		return nil
+	}
+	delete(watchers, w.id)
+	watchersMu.Unlock()
+	close(w.stop)
+	<-w.done
+	return nil
+}
+
+func (w *watcher) run() {
+	defer close(w.done)
+	ctx := w.s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		if err := w.poll(); err != nil {
+			w.s.log().Errorf("watching sites for changes: %s", err)
+		}
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll lists the sites and reports those that were stored, replaced, or
+// deleted since the previous poll. The first poll only records the sites.
+func (w *watcher) poll() error {
+	etags := make(map[string]watchedSite, len(w.etags))
+	it := w.s.IterSites("")
+	for it.Next() {
+		bucket, obj := it.object()
+		etags[it.Name()] = watchedSite{bucket, aws.StringValue(obj.Key), aws.StringValue(obj.ETag)}
+	}
+	if err := it.Err(); err != nil {
+		// Keep the previous listing so changes are reported on the next
+		// successful poll.
+		return err
+	}
+	prev := w.etags
+	w.etags = etags
+	if prev == nil {
+		return nil
+	}
+	for domain, site := range etags {
+		if p, ok := prev[domain]; !ok || p.etag != site.etag {
+			w.changed(domain, site)
+		}
+	}
+	for domain, site := range prev {
+		if _, ok := etags[domain]; !ok {
+			w.changed(domain, site)
+		}
+	}
+	return nil
+}
+
+// changed evicts the cached data of a changed site, including its parts in
+// the split layout, and reports it to the callback. Sites stored by this
+// host are reported too.
+func (w *watcher) changed(domain string, site watchedSite) {
+	w.s.invalidate(site.bucket, site.key)
+	key := site.key
+	if loc := w.s.routes.site(domain); loc.bucket == site.bucket {
+		key = loc.key
+	}
+	w.s.invalidate(site.bucket, key)
+	for _, part := range []string{splitCert, splitKey, splitMeta} {
+		w.s.invalidate(site.bucket, key+"/"+part)
+	}
+	w.s.log().Debugf("%s changed in s3://%s/%s", domain, site.bucket, site.key)
+	if w.onChange != nil {
+		w.onChange(domain)
+	}
+}
@@ -0,0 +1,63 @@
+package caddytlss3
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/sprucehealth/caddytlss3/fakes"
+)
+
+func TestWatch(t *testing.T) {
+	client := fakes.NewS3()
+	storage := newFakeStorage(t, client, "watch-bucket", WithCache(time.Hour, ""))
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		if err := storage.StoreSite(domain, &caddytls.SiteData{Cert: []byte("cert")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.LoadSite(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var changed []string
+	w := &watcher{s: storage, onChange: func(domain string) { changed = append(changed, domain) }}
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Fatalf("Expected the first poll to only record the sites, got %v", changed)
+	}
+
+	// Another host renews a site, one is deleted, and one is stored.
+	client.SetObject("watch-bucket", "acme/ca/domain/a.example.com", []byte(`{"Cert":"cmVuZXdlZA=="}`), nil)
+	if _, err := client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("watch-bucket"), Key: aws.String("acme/ca/domain/b.example.com")}); err != nil {
+		t.Fatal(err)
+	}
+	client.SetObject("watch-bucket", "acme/ca/domain/c.example.com", []byte(`{"Cert":"bmV3"}`), nil)
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(changed)
+	if want := []string{"a.example.com", "b.example.com", "c.example.com"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("Expected %v changed, got %v", want, changed)
+	}
+	data, err := storage.LoadSite("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data.Cert) != "renewed" {
+		t.Errorf("Expected the renewed certificate after the cache was evicted, got %q", data.Cert)
+	}
+
+	changed = nil
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("Expected no changes, got %v", changed)
+	}
+}